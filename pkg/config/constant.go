@@ -1,30 +1,55 @@
 package config
 
 const (
-	ENTRY_ID           = "$entry_id"
-	REMOTE_ADDR        = "$remote_addr"
-	TIME               = "$time"
-	RECEIVED_SIZE      = "$received_size"
-	SEND_SIZE          = "$send_size"
-	STATUS             = "$status"
-	REQUEST            = "$request"
-	REQUEST_PROTOCOL   = "$request_protocol"
-	REQUEST_METHOD     = "$request_method"
-	REQUEST_URI        = "$request_uri"
-	REQUEST_PATH       = "$request_path"
-	REQUEST_BODY       = "$request_body"
-	DURATION           = "$duration"
-	LOG_TIME           = "$log_time"
-	UPSTREAM           = "$upstream"
-	UPSTREAM_URI       = "$upstream_uri"
-	UPSTREAM_METHOD    = "$upstream_method"
-	UPSTREAM_PROTOCOL  = "$upstream_protocol"
-	UPSTREAM_PATH      = "$upstream_path"
-	UPSTREAM_ADDR      = "$upstream_addr"
-	UPSTREAM_DURATION  = "$upstream_duration"
-	UPSTREAM_STATUS    = "$upstream_status"
-	CLIENT_CANCELED_AT = "$client_canceled_at"
-	TRACE_ID           = "$trace_id"
+	ENTRY_ID                 = "$entry_id"
+	REMOTE_ADDR              = "$remote_addr"
+	CLIENT_IP                = "$client_ip"
+	TIME                     = "$time"
+	RECEIVED_SIZE            = "$received_size"
+	SEND_SIZE                = "$send_size"
+	STATUS                   = "$status"
+	REQUEST                  = "$request"
+	REQUEST_PROTOCOL         = "$request_protocol"
+	REQUEST_METHOD           = "$request_method"
+	REQUEST_URI              = "$request_uri"
+	REQUEST_PATH             = "$request_path"
+	REQUEST_BODY             = "$request_body"
+	DURATION                 = "$duration"
+	LOG_TIME                 = "$log_time"
+	UPSTREAM                 = "$upstream"
+	UPSTREAM_URI             = "$upstream_uri"
+	UPSTREAM_METHOD          = "$upstream_method"
+	UPSTREAM_PROTOCOL        = "$upstream_protocol"
+	UPSTREAM_PATH            = "$upstream_path"
+	UPSTREAM_ADDR            = "$upstream_addr"
+	UPSTREAM_DURATION        = "$upstream_duration"
+	UPSTREAM_STATUS          = "$upstream_status"
+	UPSTREAM_SELECTED_REASON = "$upstream_selected_reason"
+	UPSTREAM_SPLIT           = "$upstream_split"
+	UPSTREAM_ERROR           = "$upstream_error"
+	UPSTREAM_DNS_TIME        = "$upstream_dns_time"
+	UPSTREAM_CONNECT_TIME    = "$upstream_connect_time"
+	UPSTREAM_TLS_TIME        = "$upstream_tls_time"
+	UPSTREAM_TTFB            = "$upstream_ttfb"
+	CLIENT_CANCELED_AT       = "$client_canceled_at"
+	TRACE_ID                 = "$trace_id"
+	REQUEST_ID               = "$request_id"
+	API_KEY_OWNER            = "$api_key_owner"
+	GEOIP_COUNTRY            = "$geoip_country"
+	GEOIP_ASN                = "$geoip_asn"
+	SSL_PROTOCOL             = "$ssl_protocol"
+	SSL_CIPHER               = "$ssl_cipher"
+	SSL_SERVER_NAME          = "$ssl_server_name"
+	SSL_CLIENT_S_DN          = "$ssl_client_s_dn"
+	SSL_CLIENT_SAN           = "$ssl_client_san"
+	CONNECTION_REQUESTS      = "$connection_requests"
+	BYTES_SENT               = "$bytes_sent"
+	BYTES_RECEIVED           = "$bytes_received"
+	SLOW_REQUEST             = "$slow_request"
+	RETRY_BUDGET_EXHAUSTED   = "$retry_budget_exhausted"
+	NO_LIVE_UPSTREAM         = "$no_live_upstream"
+	HEALTH_PROBE             = "$health_probe"
+	RATE_LIMITED             = "$rate_limited"
 
 	B  = 1
 	KB = 1024 * B
@@ -3,6 +3,9 @@ package config
 import "time"
 
 type Options struct {
+	// Strict fails the whole config when an option is invalid, it is true when it is nil.
+	// Otherwise the invalid entries, routes, services and upstreams are skipped with a warning.
+	Strict      *bool                       `yaml:"strict" json:"strict"`
 	Providers   ProvidersOtions             `yaml:"providers" json:"providers"`
 	Logging     LoggingOtions               `yaml:"logging" json:"logging"`
 	Metrics     MetricsOptions              `yaml:"metrics" json:"metrics"`
@@ -13,10 +16,24 @@ type Options struct {
 	Middlewares map[string]MiddlwareOptions `yaml:"middlewares" json:"middlewares"`
 	Services    map[string]ServiceOptions   `yaml:"services" json:"services"`
 	Upstreams   map[string]UpstreamOptions  `yaml:"upstreams" json:"upstreams"`
+	Admin       AdminOptions                `yaml:"admin" json:"admin"`
+}
+
+// AdminOptions is the read-only admin api, it listens on its own address and isn't reloaded
+type AdminOptions struct {
+	Enabled   bool             `yaml:"enabled" json:"enabled"`
+	Bind      string           `yaml:"bind" json:"bind"`
+	BasicAuth BasicAuthOptions `yaml:"basic_auth" json:"basic_auth"`
+}
+
+type BasicAuthOptions struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
 }
 
 type ProvidersOtions struct {
 	File FileProviderOptions `yaml:"file" json:"file"`
+	HTTP HTTPProviderOptions `yaml:"http" json:"http"`
 }
 
 type FileProviderOptions struct {
@@ -25,6 +42,17 @@ type FileProviderOptions struct {
 	Watch   bool     `yaml:"watch" json:"watch"`
 }
 
+// HTTPProviderOptions fetches the config from an http endpoint, it is merged like the files of the file provider.
+// With Watch the endpoint is polled every Interval and a change of the content reloads the config.
+type HTTPProviderOptions struct {
+	Enabled  bool              `yaml:"enabled" json:"enabled"`
+	URL      string            `yaml:"url" json:"url"`
+	Headers  map[string]string `yaml:"headers" json:"headers"`
+	Timeout  time.Duration     `yaml:"timeout" json:"timeout"`
+	Watch    bool              `yaml:"watch" json:"watch"`
+	Interval time.Duration     `yaml:"interval" json:"interval"`
+}
+
 type MetricsOptions struct {
 	Prometheus PrometheusOptions `yaml:"prometheus" json:"prometheus"`
 }
@@ -36,14 +64,29 @@ type LoggingOtions struct {
 }
 
 type PrometheusOptions struct {
-	Enabled bool      `yaml:"enabled" json:"enabled"`
-	Bind    string    `yaml:"bind" json:"bind"`
-	Path    string    `yaml:"path" json:"path"`
-	Buckets []float64 `yaml:"buckets" json:"buckets"`
+	Enabled   bool                 `yaml:"enabled" json:"enabled"`
+	Bind      string               `yaml:"bind" json:"bind"`
+	Path      string               `yaml:"path" json:"path"`
+	Buckets   []float64            `yaml:"buckets" json:"buckets"`
+	Exemplars bool                 `yaml:"exemplars" json:"exemplars"`
+	Labels    []MetricLabelOptions `yaml:"labels" json:"labels"`
+}
+
+type MetricLabelOptions struct {
+	Name     string   `yaml:"name" json:"name"`
+	Variable string   `yaml:"variable" json:"variable"`
+	Values   []string `yaml:"values" json:"values"`
 }
 
 type TracingOptions struct {
-	Enabled bool        `yaml:"enabled" json:"enabled"`
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// ServiceName is the service.name of the spans, bifrost when it is empty
+	ServiceName string `yaml:"service_name" json:"service_name"`
+	// SampleRate is the ratio of the new traces which are sampled, 1 when it is zero.
+	// The sampled flag of the traceparent of the request is kept.
+	SampleRate float64 `yaml:"sample_rate" json:"sample_rate"`
+	// Metrics also exports the runtime metrics of opentelemetry to the otlp endpoint
+	Metrics bool        `yaml:"metrics" json:"metrics"`
 	OTLP    OTLPOptions `yaml:"otlp" json:"otlp"`
 }
 
@@ -57,7 +100,9 @@ type OTLPHTTPOptions struct {
 }
 
 type OTLPGRPCOptions struct {
-	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	Endpoint string            `yaml:"endpoint" json:"endpoint"`
+	Insecure bool              `yaml:"insecure" json:"insecure"`
+	Headers  map[string]string `yaml:"headers" json:"headers"`
 }
 
 type EntryOptions struct {
@@ -71,8 +116,39 @@ type EntryOptions struct {
 	Timeout            EntryTimeoutOptions `yaml:"timeout" json:"timeout"`
 	MaxRequestBodySize int                 `yaml:"max_request_body_size" json:"max_request_body_size"`
 	ReadBufferSize     int                 `yaml:"read_buffer_size" json:"read_buffer_size"`
+	MaxHeaderLineSize  int                 `yaml:"max_header_line_size" json:"max_header_line_size"`
+	MaxHeaderTotalSize int                 `yaml:"max_header_total_size" json:"max_header_total_size"`
+	MaxHeaderCount     int                 `yaml:"max_header_count" json:"max_header_count"`
 	PPROF              bool                `yaml:"pprof" json:"pprof"`
 	AccessLogID        string              `yaml:"access_log_id" json:"access_log_id"`
+	Protocol           Protocol            `yaml:"protocol" json:"protocol"`
+	UpstreamID         string              `yaml:"upstream_id" json:"upstream_id"`
+	RobotsTxt          StaticFileOptions   `yaml:"robots_txt" json:"robots_txt"`
+	Favicon            StaticFileOptions   `yaml:"favicon" json:"favicon"`
+
+	// ProxyProtocol reads the PROXY header sent by a L4 load balancer, the header is only accepted from
+	// ProxyProtocolTrustedCIDRs, which can't be empty when it is enabled
+	ProxyProtocol             bool     `yaml:"proxy_protocol" json:"proxy_protocol"`
+	ProxyProtocolTrustedCIDRs []string `yaml:"proxy_protocol_trusted_cidrs" json:"proxy_protocol_trusted_cidrs"`
+
+	// TrustedProxies are the proxies in front of the entry. The client ip is the first untrusted hop of
+	// X-Forwarded-For from the right, X-Forwarded-For of the other clients is ignored
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+
+	Probes ProbeOptions `yaml:"probes" json:"probes"`
+}
+
+// ProbeOptions answers /healthz and /readyz of the entry before the middlewares and the routes
+type ProbeOptions struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// AccessLog writes the probes to the access log, they are excluded by default
+	AccessLog bool `yaml:"access_log" json:"access_log"`
+}
+
+type StaticFileOptions struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Content string `yaml:"content" json:"content"`
+	Path    string `yaml:"path" json:"path"`
 }
 
 type EntryTimeoutOptions struct {
@@ -81,6 +157,7 @@ type EntryTimeoutOptions struct {
 	KeepAliveTimeout time.Duration `yaml:"keepalive_timeout" json:"keepalive_timeout"`
 	ReadTimeout      time.Duration `yaml:"read_timeout" json:"read_timeout"`
 	WriteTimeout     time.Duration `yaml:"write_timeout" json:"write_timeout"`
+	DialTimeout      time.Duration `yaml:"dial_timeout" json:"dial_timeout"`
 }
 
 type EscapeType string
@@ -91,14 +168,23 @@ const (
 	JSONEscape    EscapeType = "json"
 )
 
+type AccessLogFormat string
+
+const (
+	TextAccessLogFormat AccessLogFormat = "text"
+	JSONAccessLogFormat AccessLogFormat = "json"
+)
+
 type AccessLogOptions struct {
-	Enabled    bool          `yaml:"enabled" json:"enabled"`
-	BufferSize int           `yaml:"buffer_size" json:"buffer_size"`
-	Output     string        `yaml:"output" json:"output"`
-	Template   string        `yaml:"template" json:"template"`
-	TimeFormat string        `yaml:"time_format" json:"time_format"`
-	Escape     EscapeType    `yaml:"escape" json:"escape"`
-	Flush      time.Duration `yaml:"flush" json:"flush"`
+	Enabled    bool            `yaml:"enabled" json:"enabled"`
+	BufferSize int             `yaml:"buffer_size" json:"buffer_size"`
+	Output     string          `yaml:"output" json:"output"`
+	Format     AccessLogFormat `yaml:"format" json:"format"`
+	Template   string          `yaml:"template" json:"template"`
+	TimeFormat string          `yaml:"time_format" json:"time_format"`
+	Escape     EscapeType      `yaml:"escape" json:"escape"`
+	Flush      time.Duration   `yaml:"flush" json:"flush"`
+	Filter     string          `yaml:"filter" json:"filter"`
 }
 
 type MiddlwareOptions struct {
@@ -117,41 +203,229 @@ const (
 	HashingStrategy    UpstreamStrategy = "hashing"
 )
 
+type ForwardedHeadersMode string
+
+const (
+	ForwardedHeadersAppend    ForwardedHeadersMode = "append"
+	ForwardedHeadersOverwrite ForwardedHeadersMode = "overwrite"
+	ForwardedHeadersOff       ForwardedHeadersMode = "off"
+)
+
+// ClientIPForwarding is how the client ip is sent upstream in X-Forwarded-For
+type ClientIPForwarding string
+
+const (
+	ClientIPForwardingAppend    ClientIPForwarding = "append"
+	ClientIPForwardingReplace   ClientIPForwarding = "replace"
+	ClientIPForwardingOmit      ClientIPForwarding = "omit"
+	ClientIPForwardingAnonymize ClientIPForwarding = "anonymize"
+)
+
+// ProxyProtocol is the version of the PROXY protocol header sent on each new connection to the targets
+type ProxyProtocol string
+
+const (
+	ProxyProtocolOff ProxyProtocol = "off"
+	ProxyProtocolV1  ProxyProtocol = "v1"
+	ProxyProtocolV2  ProxyProtocol = "v2"
+)
+
+type ResponseBuffering string
+
+const (
+	ResponseBufferingOn  ResponseBuffering = "on"
+	ResponseBufferingOff ResponseBuffering = "off"
+)
+
 type TargetOptions struct {
-	Target string `yaml:"target" json:"target"`
-	Weight int    `yaml:"weight" json:"weight"`
+	Target       string `yaml:"target" json:"target"`
+	Weight       int    `yaml:"weight" json:"weight"`
+	PreserveHost *bool  `yaml:"preserve_host" json:"preserve_host"`
+	UpstreamHost string `yaml:"upstream_host" json:"upstream_host"`
+
+	// the connection reuse settings of the target override the ones of the upstream
+	MaxIdleConnsPerHost *int          `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxIdleConnDuration time.Duration `yaml:"max_idle_conn_duration" json:"max_idle_conn_duration"`
+	DisableKeepalive    *bool         `yaml:"disable_keepalive" json:"disable_keepalive"`
+
+	// ProxyProtocol of the target overrides the one of the upstream
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol" json:"proxy_protocol"`
 }
 
 type UpstreamOptions struct {
-	ID       string           `yaml:"-" json:"-"`
-	Strategy UpstreamStrategy `yaml:"strategy" json:"strategy"`
-	HashOn   string           `yaml:"hash_on" json:"hash_on"`
-	Targets  []TargetOptions  `yaml:"targets" json:"targets"`
+	ID                 string                  `yaml:"-" json:"-"`
+	Strategy           UpstreamStrategy        `yaml:"strategy" json:"strategy"`
+	HashOn             string                  `yaml:"hash_on" json:"hash_on"`
+	Targets            []TargetOptions         `yaml:"targets" json:"targets"`
+	Debug              UpstreamDebugOptions    `yaml:"debug" json:"debug"`
+	DNSDiscovery       bool                    `yaml:"dns_discovery" json:"dns_discovery"`
+	DNSRefreshInterval time.Duration           `yaml:"dns_refresh_interval" json:"dns_refresh_interval"`
+	SourceAddr         string                  `yaml:"source_addr" json:"source_addr"`
+	OutlierDetection   OutlierDetectionOptions `yaml:"outlier_detection" json:"outlier_detection"`
+	RetryBudget        RetryBudgetOptions      `yaml:"retry_budget" json:"retry_budget"`
+	TLSSessionCache    TLSSessionCacheOptions  `yaml:"tls_session_cache" json:"tls_session_cache"`
+
+	// the connection reuse settings of the upstream override the ones of the service
+	MaxIdleConnsPerHost *int          `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxIdleConnDuration time.Duration `yaml:"max_idle_conn_duration" json:"max_idle_conn_duration"`
+	DisableKeepalive    *bool         `yaml:"disable_keepalive" json:"disable_keepalive"`
+
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol" json:"proxy_protocol"`
+}
+
+// TLSSessionCacheOptions resumes the tls sessions of https targets, it is enabled when Enabled is nil
+type TLSSessionCacheOptions struct {
+	Enabled *bool `yaml:"enabled" json:"enabled"`
+	// Size is the number of sessions kept by the upstream, 128 when it is zero
+	Size int `yaml:"size" json:"size"`
+}
+
+type RetryBudgetOptions struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Ratio is the retries allowed per successful primary request, 0.2 when it is zero
+	Ratio            float64 `yaml:"ratio" json:"ratio"`
+	MinRetriesPerSec int     `yaml:"min_retries_per_sec" json:"min_retries_per_sec"`
+}
+
+type OutlierDetectionOptions struct {
+	Enabled            bool          `yaml:"enabled" json:"enabled"`
+	Interval           time.Duration `yaml:"interval" json:"interval"`
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time" json:"base_ejection_time"`
+	MaxEjectionTime    time.Duration `yaml:"max_ejection_time" json:"max_ejection_time"`
+	MaxEjectionPercent int           `yaml:"max_ejection_percent" json:"max_ejection_percent"`
+	MinHosts           int           `yaml:"min_hosts" json:"min_hosts"`
+	MinRequests        int           `yaml:"min_requests" json:"min_requests"`
+	StdevFactor        float64       `yaml:"stdev_factor" json:"stdev_factor"`
+}
+
+type UpstreamDebugOptions struct {
+	Enabled    bool    `yaml:"enabled" json:"enabled"`
+	SampleRate float64 `yaml:"sample_rate" json:"sample_rate"`
 }
 
 type RouteOptions struct {
-	ID          string             `yaml:"-" json:"-"`
-	Methods     []string           `yaml:"methods" json:"methods"`
-	Paths       []string           `yaml:"paths" json:"paths"`
-	Entries     []string           `yaml:"entries" json:"entries"`
-	Middlewares []MiddlwareOptions `yaml:"middlewares" json:"middlewares"`
-	ServiceID   string             `yaml:"service_id" json:"service_id"`
+	ID          string              `yaml:"-" json:"-"`
+	Methods     []string            `yaml:"methods" json:"methods"`
+	Hosts       []string            `yaml:"hosts" json:"hosts"`
+	Paths       []string            `yaml:"paths" json:"paths"`
+	Entries     []string            `yaml:"entries" json:"entries"`
+	Middlewares []MiddlwareOptions  `yaml:"middlewares" json:"middlewares"`
+	ServiceID   string              `yaml:"service_id" json:"service_id"`
+	Timeout     RouteTimeoutOptions `yaml:"timeout" json:"timeout"`
+
+	// RateLimitCost overrides the cost of the requests in the rate_limit middlewares of the route
+	RateLimitCost int `yaml:"rate_limit_cost" json:"rate_limit_cost"`
+}
+
+type RouteTimeoutOptions struct {
+	RequestTimeout time.Duration `yaml:"request" json:"request"`
 }
 
 type Protocol string
 
 const (
-	ProtocolHTTP Protocol = "http"
+	ProtocolHTTP  Protocol = "http"
+	ProtocolHTTP3 Protocol = "http3"
+	ProtocolGRPC  Protocol = "grpc"
+	ProtocolTCP   Protocol = "tcp"
+)
+
+type HTTP3Fallback string
+
+const (
+	HTTP3FallbackHTTP1 HTTP3Fallback = "http1"
+	HTTP3FallbackHTTP2 HTTP3Fallback = "http2"
+	HTTP3FallbackOff   HTTP3Fallback = "off"
 )
 
 type ServiceOptions struct {
-	ID                  string                `yaml:"-" json:"-"`
-	TLSVerify           bool                  `yaml:"tls_verify" json:"tls_verify"`
-	MaxIdleConnsPerHost *int                  `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
-	Protocol            Protocol              `yaml:"protocol" json:"protocol"`
-	Url                 string                `yaml:"url" json:"url"`
-	Timeout             ServiceTimeoutOptions `yaml:"timeout" json:"timeout"`
-	Middlewares         []MiddlwareOptions    `yaml:"middlewares" json:"middlewares"`
+	ID                   string                `yaml:"-" json:"-"`
+	TLSVerify            bool                  `yaml:"tls_verify" json:"tls_verify"`
+	MaxIdleConnsPerHost  *int                  `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxIdleConnDuration  time.Duration         `yaml:"max_idle_conn_duration" json:"max_idle_conn_duration"`
+	DisableKeepalive     *bool                 `yaml:"disable_keepalive" json:"disable_keepalive"`
+	Protocol             Protocol              `yaml:"protocol" json:"protocol"`
+	HTTP3Fallback        HTTP3Fallback         `yaml:"http3_fallback" json:"http3_fallback"`
+	Url                  string                `yaml:"url" json:"url"`
+	Timeout              ServiceTimeoutOptions `yaml:"timeout" json:"timeout"`
+	Middlewares          []MiddlwareOptions    `yaml:"middlewares" json:"middlewares"`
+	OriginalURIHeader    string                `yaml:"original_uri_header" json:"original_uri_header"`
+	Retries              int                   `yaml:"retries" json:"retries"`
+	RetryOn              []string              `yaml:"retry_on" json:"retry_on"`
+	RetryTimeout         time.Duration         `yaml:"retry_timeout" json:"retry_timeout"`
+	RetryNonIdempotent   bool                  `yaml:"retry_non_idempotent" json:"retry_non_idempotent"`
+	MaxRetryAfter        time.Duration         `yaml:"max_retry_after" json:"max_retry_after"`
+	MaxBufferedBodySize  int                   `yaml:"max_buffered_body_size" json:"max_buffered_body_size"`
+	Mirror               MirrorOptions         `yaml:"mirror" json:"mirror"`
+	Coalesce             CoalesceOptions       `yaml:"coalesce" json:"coalesce"`
+	ForwardedHeaders     ForwardedHeadersMode  `yaml:"forwarded_headers" json:"forwarded_headers"`
+	Forwarded            bool                  `yaml:"forwarded" json:"forwarded"`
+	ClientIPForwarding   ClientIPForwarding    `yaml:"client_ip_forwarding" json:"client_ip_forwarding"`
+	TrustedProxies       []string              `yaml:"trusted_proxies" json:"trusted_proxies"`
+	StatusMap            map[int]int           `yaml:"status_map" json:"status_map"`
+	PreserveHost         *bool                 `yaml:"preserve_host" json:"preserve_host"`
+	UpstreamHost         string                `yaml:"upstream_host" json:"upstream_host"`
+	SlowRequestThreshold time.Duration         `yaml:"slow_request_threshold" json:"slow_request_threshold"`
+	Streaming            bool                  `yaml:"streaming" json:"streaming"`
+	MethodOverride       string                `yaml:"method_override" json:"method_override"`
+	MaxResponseBodySize  int                   `yaml:"max_response_body_size" json:"max_response_body_size"`
+	ResponseBuffering    ResponseBuffering     `yaml:"response_buffering" json:"response_buffering"`
+	Split                SplitOptions          `yaml:"split" json:"split"`
+	SourceAddr           string                `yaml:"source_addr" json:"source_addr"`
+	ProxyProtocol        ProxyProtocol         `yaml:"proxy_protocol" json:"proxy_protocol"`
+	ErrorResponse        ErrorResponseOptions  `yaml:"error_response" json:"error_response"`
+	NoLiveUpstream       NoLiveUpstreamOptions `yaml:"no_live_upstream" json:"no_live_upstream"`
+	FallbackUpstream     string                `yaml:"fallback_upstream" json:"fallback_upstream"`
+}
+
+// ErrorResponseOptions renders the errors generated by the gateway when the upstream can't be reached or times out,
+// no target is available or the client went away. The body and the headers can use $status, $trace_id, $service_id
+// and $error.
+type ErrorResponseOptions struct {
+	ContentType string                      `yaml:"content_type" json:"content_type"`
+	Body        string                      `yaml:"body" json:"body"`
+	Headers     map[string]string           `yaml:"headers" json:"headers"`
+	Statuses    map[int]ErrorResponseStatus `yaml:"statuses" json:"statuses"`
+}
+
+// ErrorResponseStatus overrides the error response of a status, empty fields are inherited and the headers are
+// added to the headers of ErrorResponseOptions
+type ErrorResponseStatus struct {
+	ContentType string            `yaml:"content_type" json:"content_type"`
+	Body        string            `yaml:"body" json:"body"`
+	Headers     map[string]string `yaml:"headers" json:"headers"`
+}
+
+// NoLiveUpstreamOptions is the response when every target of the upstream is drained, ejected or removed.
+// Empty fields are rendered by error_response.
+type NoLiveUpstreamOptions struct {
+	Status      int           `yaml:"status" json:"status"`
+	RetryAfter  time.Duration `yaml:"retry_after" json:"retry_after"`
+	ContentType string        `yaml:"content_type" json:"content_type"`
+	Body        string        `yaml:"body" json:"body"`
+}
+
+type SplitOptions struct {
+	Upstreams    []SplitUpstreamOptions `yaml:"upstreams" json:"upstreams"`
+	StickyHeader string                 `yaml:"sticky_header" json:"sticky_header"`
+	StickyCookie string                 `yaml:"sticky_cookie" json:"sticky_cookie"`
+}
+
+type SplitUpstreamOptions struct {
+	Upstream   string  `yaml:"upstream" json:"upstream"`
+	Percentage float64 `yaml:"percentage" json:"percentage"`
+}
+
+type CoalesceOptions struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Headers []string `yaml:"headers" json:"headers"`
+}
+
+type MirrorOptions struct {
+	Upstream    string        `yaml:"upstream" json:"upstream"`
+	Percentage  float64       `yaml:"percentage" json:"percentage"`
+	MaxBodySize int           `yaml:"max_body_size" json:"max_body_size"`
+	Timeout     time.Duration `yaml:"timeout" json:"timeout"`
 }
 
 type ServiceTimeoutOptions struct {
@@ -159,11 +433,40 @@ type ServiceTimeoutOptions struct {
 	WriteTimeout       time.Duration `yaml:"write_timeout" json:"write_timeout"`
 	DailTimeout        time.Duration `yaml:"dail_timeout" json:"dail_timeout"`
 	MaxConnWaitTimeout time.Duration `yaml:"max_conn_wait_timeout" json:"max_conn_wait_timeout"`
+	RequestTimeout     time.Duration `yaml:"request" json:"request"`
+	WebSocketIdle      time.Duration `yaml:"websocket_idle" json:"websocket_idle"`
+	WebSocketPing      time.Duration `yaml:"websocket_ping" json:"websocket_ping"`
 }
 
 type TLSOptions struct {
-	Enabled    bool   `yaml:"enabled" json:"enabled"`
-	MinVersion string `yaml:"min_version" json:"min_version"`
-	CertPEM    string `yaml:"cert_pem" json:"cert_pem"`
-	KeyPEM     string `yaml:"key_pem" json:"key_pem"`
+	Enabled    bool              `yaml:"enabled" json:"enabled"`
+	MinVersion string            `yaml:"min_version" json:"min_version"`
+	CertPEM    string            `yaml:"cert_pem" json:"cert_pem"`
+	KeyPEM     string            `yaml:"key_pem" json:"key_pem"`
+	ACME       ACMEOptions       `yaml:"acme" json:"acme"`
+	ClientAuth ClientAuthOptions `yaml:"client_auth" json:"client_auth"`
+	SNI        SNIOptions        `yaml:"sni" json:"sni"`
+}
+
+type SNIOptions struct {
+	Routes        map[string]string `yaml:"routes" json:"routes"`
+	RejectUnknown bool              `yaml:"reject_unknown" json:"reject_unknown"`
+}
+
+type ClientAuthOptions struct {
+	Enabled         bool     `yaml:"enabled" json:"enabled"`
+	CAPEM           string   `yaml:"ca_pem" json:"ca_pem"`
+	Optional        bool     `yaml:"optional" json:"optional"`
+	AllowedSubjects []string `yaml:"allowed_subjects" json:"allowed_subjects"`
+	AllowedSANs     []string `yaml:"allowed_sans" json:"allowed_sans"`
+}
+
+type ACMEOptions struct {
+	Enabled      bool          `yaml:"enabled" json:"enabled"`
+	Email        string        `yaml:"email" json:"email"`
+	Hosts        []string      `yaml:"hosts" json:"hosts"`
+	CacheDir     string        `yaml:"cache_dir" json:"cache_dir"`
+	Staging      bool          `yaml:"staging" json:"staging"`
+	DirectoryURL string        `yaml:"directory_url" json:"directory_url"`
+	RenewBefore  time.Duration `yaml:"renew_before" json:"renew_before"`
 }
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/adaptor"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	defaultACMECacheDir   = "./acme"
+	acmeChallengePrefix   = "/.well-known/acme-challenge/"
+)
+
+// newACMEManager creates the certificate manager of the entry. Certificates and http-01 tokens are
+// cached in cache_dir, so managers created by reload and restart share them.
+// Certificates are renewed in the background before renew_before, 30 days by default.
+func newACMEManager(entryOpts config.EntryOptions) (*autocert.Manager, error) {
+	opts := entryOpts.TLS.ACME
+
+	if len(opts.Hosts) == 0 {
+		return nil, fmt.Errorf("acme hosts can't be empty in entry '%s'", entryOpts.ID)
+	}
+
+	cacheDir := opts.CacheDir
+	if len(cacheDir) == 0 {
+		cacheDir = defaultACMECacheDir
+	}
+
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		HostPolicy:  autocert.HostWhitelist(opts.Hosts...),
+		Email:       opts.Email,
+		RenewBefore: opts.RenewBefore,
+	}
+
+	directoryURL := opts.DirectoryURL
+	if len(directoryURL) == 0 && opts.Staging {
+		directoryURL = letsEncryptStagingURL
+	}
+
+	if len(directoryURL) > 0 {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+
+	return manager, nil
+}
+
+// setACMECertificate serves certificates of the acme manager by sni and answers tls-alpn-01 challenges.
+// When cert_pem and key_pem are also set, they are used for hosts which are not managed by acme.
+func setACMECertificate(tlsConfig *tls.Config, manager *autocert.Manager) {
+	hasDefault := len(tlsConfig.Certificates) > 0
+
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := manager.GetCertificate(hello)
+		if err != nil && hasDefault {
+			slog.Debug("acme certificate is not available, use default certificate", "server_name", hello.ServerName, "error", err)
+			return nil, nil
+		}
+		return cert, err
+	}
+
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+}
+
+// prefetchACMECertificates obtains certificates of the hosts when the entry starts instead of on the first handshake,
+// the renewal of a certificate is scheduled once it is loaded.
+func prefetchACMECertificates(entryID string, manager *autocert.Manager, hosts []string) {
+	for _, host := range hosts {
+		hello := &tls.ClientHelloInfo{
+			ServerName:       host,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		}
+
+		if _, err := manager.GetCertificate(hello); err != nil {
+			slog.Error("fail to obtain acme certificate", "id", entryID, "host", host, "error", err)
+		}
+	}
+}
+
+// acmeChallenge answers http-01 challenges of the acme managers on plaintext entries
+type acmeChallenge struct {
+	handlers map[string]http.Handler
+}
+
+func newACMEChallenge(managers map[string]*autocert.Manager, entries map[string]config.EntryOptions) *acmeChallenge {
+	challenge := &acmeChallenge{
+		handlers: make(map[string]http.Handler),
+	}
+
+	for id, manager := range managers {
+		handler := manager.HTTPHandler(nil)
+
+		for _, host := range entries[id].TLS.ACME.Hosts {
+			challenge.handlers[strings.ToLower(host)] = handler
+		}
+	}
+
+	return challenge
+}
+
+func (a *acmeChallenge) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	if !strings.HasPrefix(string(ctx.Request.Path()), acmeChallengePrefix) {
+		ctx.Next(c)
+		return
+	}
+
+	host := normalizeHost(ctx.Request.Host())
+	handler, found := a.handlers[host]
+	if !found {
+		ctx.Next(c)
+		return
+	}
+
+	req, err := adaptor.GetCompatRequest(&ctx.Request)
+	if err != nil {
+		ctx.Response.SetStatusCode(400)
+		ctx.Abort()
+		return
+	}
+	// the host policy of the manager doesn't accept a port
+	req.Host = host
+
+	handler.ServeHTTP(adaptor.GetCompatResponseWriter(&ctx.Response), req)
+	ctx.Abort()
+}
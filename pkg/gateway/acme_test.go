@@ -0,0 +1,187 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"http-benchmark/pkg/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// writeACMECache writes a certificate of host in the format of autocert.DirCache, so no acme server is needed
+func writeACMECache(t *testing.T, dir string, host string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	err = os.WriteFile(filepath.Join(dir, host), buf.Bytes(), 0600)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestACMECertificate(t *testing.T) {
+	dir := t.TempDir()
+	cached := writeACMECache(t, dir, "acme.example.com")
+
+	entryOpts := config.EntryOptions{
+		ID: "acme",
+		TLS: config.TLSOptions{
+			Enabled: true,
+			ACME: config.ACMEOptions{
+				Enabled:  true,
+				Hosts:    []string{"acme.example.com"},
+				CacheDir: dir,
+				Staging:  true,
+			},
+		},
+	}
+
+	manager, err := newACMEManager(entryOpts)
+	assert.NoError(t, err)
+	assert.Equal(t, letsEncryptStagingURL, manager.Client.DirectoryURL)
+
+	defaultCert := newTestCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{defaultCert}}
+	setACMECertificate(tlsConfig, manager)
+	assert.Contains(t, tlsConfig.NextProtos, "acme-tls/1")
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9974"), server.WithTLS(tlsConfig))
+	h.GET("/", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, "ok")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	handshake := func(serverName string) *x509.Certificate {
+		conn, err := tls.Dial("tcp", "127.0.0.1:9974", &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	// the certificate is served by sni from the cache
+	cert := handshake("acme.example.com")
+	assert.Equal(t, cached.SerialNumber, cert.SerialNumber)
+
+	// hosts which are not managed by acme get the default certificate
+	cert = handshake("other.example.com")
+	assert.Equal(t, "localhost", cert.Subject.CommonName)
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	dir := t.TempDir()
+
+	entries := map[string]config.EntryOptions{
+		"acme": {
+			ID: "acme",
+			TLS: config.TLSOptions{
+				Enabled: true,
+				ACME: config.ACMEOptions{
+					Enabled:  true,
+					Hosts:    []string{"acme.example.com"},
+					CacheDir: dir,
+				},
+			},
+		},
+	}
+
+	manager, err := newACMEManager(entries["acme"])
+	assert.NoError(t, err)
+
+	// http-01 tokens are shared with other managers through the cache
+	err = manager.Cache.Put(context.Background(), "token1+http-01", []byte("token1.thumbprint"))
+	assert.NoError(t, err)
+
+	challenge := newACMEChallenge(map[string]*autocert.Manager{"acme": manager}, entries)
+
+	serve := func(host string, path string) (*app.RequestContext, bool) {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://" + host + path)
+		nextCalled := false
+		hzCtx.SetHandlers(app.HandlersChain{challenge.ServeHTTP, func(c context.Context, ctx *app.RequestContext) {
+			nextCalled = true
+		}})
+		hzCtx.Next(context.Background())
+		return hzCtx, nextCalled
+	}
+
+	hzCtx, next := serve("acme.example.com", "/.well-known/acme-challenge/token1")
+	assert.False(t, next)
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	assert.Equal(t, "token1.thumbprint", string(hzCtx.Response.Body()))
+
+	hzCtx, next = serve("ACME.example.com:80", "/.well-known/acme-challenge/unknown")
+	assert.False(t, next)
+	assert.Equal(t, 404, hzCtx.Response.StatusCode())
+
+	// other hosts and paths go to the router
+	_, next = serve("other.example.com", "/.well-known/acme-challenge/token1")
+	assert.True(t, next)
+
+	_, next = serve("acme.example.com", "/orders")
+	assert.True(t, next)
+}
+
+func TestACMEValidation(t *testing.T) {
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"https": {
+				Bind: ":9973",
+				TLS: config.TLSOptions{
+					ACME: config.ACMEOptions{Enabled: true, Hosts: []string{"acme.example.com"}},
+				},
+			},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+	}
+
+	err := validateOptions(opts)
+	assert.ErrorContains(t, err, "acme requires tls to be enabled")
+
+	entry := opts.Entries["https"]
+	entry.TLS.Enabled = true
+	entry.TLS.ACME.Hosts = nil
+	opts.Entries["https"] = entry
+
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "acme hosts can't be empty")
+}
@@ -0,0 +1,260 @@
+package gateway
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// AdminServer is the read-only json api of the running gateway. It has its own listener and handlers, so it never
+// shares the middlewares, the timeouts or the connections of the entries.
+type AdminServer struct {
+	bifrost *Bifrost
+	opts    config.AdminOptions
+	server  *http.Server
+}
+
+type AdminService struct {
+	ID       string          `json:"id"`
+	Url      string          `json:"url"`
+	Protocol config.Protocol `json:"protocol"`
+	Upstream string          `json:"upstream,omitempty"`
+}
+
+type AdminUpstream struct {
+	ID       string                  `json:"id"`
+	Strategy config.UpstreamStrategy `json:"strategy"`
+	InFlight int64                   `json:"in_flight"`
+	Pool     PoolStats               `json:"pool"`
+	Targets  []AdminTarget           `json:"targets"`
+}
+
+// AdminTarget is the state of a target, an upstream has an instance in each service and entry using it,
+// the numbers are the sum of the instances
+type AdminTarget struct {
+	Target    string    `json:"target"`
+	Weight    int       `json:"weight"`
+	Drained   bool      `json:"drained"`
+	Ejected   bool      `json:"ejected"`
+	Available bool      `json:"available"`
+	InFlight  int64     `json:"in_flight"`
+	Pool      PoolStats `json:"pool"`
+}
+
+type AdminConfig struct {
+	// Hash is the sha256 of the loaded options, it changes after a reload which changes the config
+	Hash       string      `json:"hash"`
+	Path       string      `json:"path,omitempty"`
+	Skipped    []string    `json:"skipped"`
+	LastReload *ConfigDiff `json:"last_reload"`
+	// ReloadStatus is the outcome of the last reload, a failed reload keeps the running config
+	ReloadStatus *ReloadStatus `json:"reload_status"`
+}
+
+type AdminRuntime struct {
+	Goroutines int `json:"goroutines"`
+	// UpstreamConnections is the number of the open connections to the targets of the services
+	UpstreamConnections int `json:"upstream_connections"`
+	// TCPConnections is the number of the open connections of each tcp entry, the client and the upstream ones
+	TCPConnections map[string]int `json:"tcp_connections"`
+}
+
+func newAdminServer(bifrost *Bifrost, opts config.AdminOptions) *AdminServer {
+	s := &AdminServer{
+		bifrost: bifrost,
+		opts:    opts,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", s.handle(s.services))
+	mux.HandleFunc("/upstreams", s.handle(s.upstreams))
+	mux.HandleFunc("/config", s.handle(s.config))
+	mux.HandleFunc("/runtime", s.handle(s.runtime))
+
+	s.server = &http.Server{
+		Addr:              opts.Bind,
+		Handler:           s.authorize(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+func (s *AdminServer) Run() {
+	slog.Info("starting admin api", "bind", s.opts.Bind)
+
+	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("fail to start admin api", "bind", s.opts.Bind, "error", err)
+	}
+}
+
+func (s *AdminServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// authorize checks the basic auth of the request when the username is set
+func (s *AdminServer) authorize(next http.Handler) http.Handler {
+	auth := s.opts.BasicAuth
+	if auth.Username == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// both are compared, so the time doesn't tell which one is wrong
+		validUser := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
+		if !ok || !validUser || !validPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bifrost"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handle writes the result of fn as json, the api is read-only
+func (s *AdminServer) handle(fn func() any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(fn())
+	}
+}
+
+func (s *AdminServer) services() any {
+	opts, _ := s.bifrost.options()
+	result := make([]AdminService, 0, len(opts.Services))
+
+	for id, serviceOpts := range opts.Services {
+		service := AdminService{
+			ID:       id,
+			Url:      serviceOpts.Url,
+			Protocol: serviceOpts.Protocol,
+		}
+		if len(service.Protocol) == 0 {
+			service.Protocol = config.ProtocolHTTP
+		}
+		if addr, err := url.Parse(serviceOpts.Url); err == nil {
+			if _, found := opts.Upstreams[addr.Hostname()]; found {
+				service.Upstream = addr.Hostname()
+			}
+		}
+		result = append(result, service)
+	}
+
+	slices.SortFunc(result, func(a, b AdminService) int { return cmp.Compare(a.ID, b.ID) })
+	return result
+}
+
+func (s *AdminServer) upstreams() any {
+	opts, _ := s.bifrost.options()
+	result := make([]AdminUpstream, 0, len(opts.Upstreams))
+
+	for id, upstreamOpts := range opts.Upstreams {
+		upstream := AdminUpstream{
+			ID:       id,
+			Strategy: upstreamOpts.Strategy,
+			Targets:  make([]AdminTarget, 0),
+		}
+
+		now := time.Now()
+		index := map[string]int{}
+
+		for _, instance := range s.bifrost.findUpstreams(id) {
+			for _, proxy := range instance.targets() {
+				i, found := index[proxy.targetHost]
+				if !found {
+					i = len(upstream.Targets)
+					index[proxy.targetHost] = i
+					upstream.Targets = append(upstream.Targets, AdminTarget{Target: proxy.targetHost, Weight: int(proxy.weight.Load())})
+				}
+
+				target := &upstream.Targets[i]
+				target.Drained = target.Drained || proxy.drained.Load()
+				target.Ejected = target.Ejected || proxy.isEjected(now)
+				target.InFlight += proxy.inFlight.Load()
+				target.Pool.add(proxy.PoolStats())
+			}
+		}
+
+		for i := range upstream.Targets {
+			target := &upstream.Targets[i]
+			target.Available = !target.Drained && !target.Ejected
+			upstream.InFlight += target.InFlight
+			upstream.Pool.add(target.Pool)
+		}
+
+		result = append(result, upstream)
+	}
+
+	slices.SortFunc(result, func(a, b AdminUpstream) int { return cmp.Compare(a.ID, b.ID) })
+	return result
+}
+
+func (s *AdminServer) config() any {
+	opts, skipped := s.bifrost.options()
+	result := AdminConfig{
+		Hash:         configHash(*opts),
+		Path:         s.bifrost.configPath,
+		Skipped:      make([]string, 0, len(skipped)),
+		LastReload:   s.bifrost.LastReloadDiff(),
+		ReloadStatus: s.bifrost.LastReloadStatus(),
+	}
+
+	for _, option := range skipped {
+		result.Skipped = append(result.Skipped, option.String())
+	}
+
+	return result
+}
+
+func (s *AdminServer) runtime() any {
+	result := AdminRuntime{
+		Goroutines:     runtime.NumGoroutine(),
+		TCPConnections: make(map[string]int, len(s.bifrost.tcpServers)),
+	}
+
+	for _, server := range s.bifrost.httpServers {
+		for _, service := range server.switcher.Engine().services {
+			if service.proxy != nil {
+				result.UpstreamConnections += service.proxy.PoolStats().Established
+			}
+			for _, upstream := range service.upstreams {
+				result.UpstreamConnections += upstream.Stats().Pool.Established
+			}
+		}
+	}
+
+	for id, server := range s.bifrost.tcpServers {
+		result.TCPConnections[id] = server.activeConns()
+	}
+
+	return result
+}
+
+// configHash returns the sha256 of the options, the maps are marshaled with sorted keys, so the hash is stable
+func configHash(opts config.Options) string {
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
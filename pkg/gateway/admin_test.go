@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"http-benchmark/pkg/config"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminServer(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9927"))
+	backend.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(time.Second)
+		ctx.String(200, "slow")
+	})
+	go backend.Spin()
+
+	opts := config.Options{
+		Admin: config.AdminOptions{
+			Enabled:   true,
+			Bind:      "127.0.0.1:9925",
+			BasicAuth: config.BasicAuthOptions{Username: "admin", Password: "secret"},
+		},
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: "127.0.0.1:9926"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"slow": {Paths: []string{"/slow"}, ServiceID: "orders"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"orders": {Url: "http://backend"},
+		},
+		Upstreams: map[string]config.UpstreamOptions{
+			"backend": {
+				Strategy: config.RoundRobinStrategy,
+				Targets:  []config.TargetOptions{{Target: "127.0.0.1:9927", Weight: 1}},
+			},
+		},
+	}
+
+	bifrost, err := Load(opts)
+	assert.NoError(t, err)
+	go bifrost.Run()
+	defer bifrost.Shutdown()
+	time.Sleep(time.Second)
+
+	get := func(path string, out any) int {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:9925"+path, nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth("admin", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer resp.Body.Close()
+
+		if out != nil {
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	t.Run("basic auth", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9925/services")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("services", func(t *testing.T) {
+		services := []AdminService{}
+		assert.Equal(t, 200, get("/services", &services))
+		assert.Equal(t, []AdminService{{ID: "orders", Url: "http://backend", Protocol: config.ProtocolHTTP, Upstream: "backend"}}, services)
+	})
+
+	t.Run("upstreams", func(t *testing.T) {
+		go func() {
+			_, _ = http.Get("http://127.0.0.1:9926/slow")
+		}()
+		time.Sleep(300 * time.Millisecond)
+
+		upstreams := []AdminUpstream{}
+		assert.Equal(t, 200, get("/upstreams", &upstreams))
+		if assert.Len(t, upstreams, 1) {
+			upstream := upstreams[0]
+			assert.Equal(t, "backend", upstream.ID)
+			assert.Equal(t, int64(1), upstream.InFlight)
+			if assert.Len(t, upstream.Targets, 1) {
+				assert.Equal(t, "127.0.0.1:9927", upstream.Targets[0].Target)
+				assert.True(t, upstream.Targets[0].Available)
+				assert.Equal(t, int64(1), upstream.Targets[0].InFlight)
+			}
+		}
+
+		assert.NoError(t, bifrost.DrainTarget("backend", "127.0.0.1:9927"))
+		defer bifrost.EnableTarget("backend", "127.0.0.1:9927")
+
+		assert.Equal(t, 200, get("/upstreams", &upstreams))
+		assert.True(t, upstreams[0].Targets[0].Drained)
+		assert.False(t, upstreams[0].Targets[0].Available)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		result := AdminConfig{}
+		assert.Equal(t, 200, get("/config", &result))
+		assert.Equal(t, configHash(opts), result.Hash)
+		assert.Len(t, result.Hash, 64)
+		assert.Nil(t, result.ReloadStatus)
+
+		// the options were loaded without a config file, so the reload fails
+		assert.Error(t, bifrost.Reload())
+		assert.Equal(t, 200, get("/config", &result))
+		if assert.NotNil(t, result.ReloadStatus) {
+			assert.False(t, result.ReloadStatus.Success)
+			assert.Equal(t, "bifrost: reload needs a config file", result.ReloadStatus.Error)
+		}
+	})
+
+	t.Run("runtime", func(t *testing.T) {
+		result := AdminRuntime{}
+		assert.Equal(t, 200, get("/runtime", &result))
+		assert.Greater(t, result.Goroutines, 0)
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:9925/upstreams", nil)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 405, resp.StatusCode)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		invalid := opts
+		invalid.Admin = config.AdminOptions{Enabled: true, Bind: "127.0.0.1:9926"}
+		assert.ErrorContains(t, validateOptions(invalid), "is used by entry")
+
+		invalid.Admin = config.AdminOptions{Enabled: true, Bind: ":9925", BasicAuth: config.BasicAuthOptions{Username: "admin"}}
+		assert.Error(t, validateOptions(invalid))
+	})
+}
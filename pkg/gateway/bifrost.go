@@ -1,60 +1,224 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"http-benchmark/pkg/config"
 	"http-benchmark/pkg/log"
+	"http-benchmark/pkg/provider"
 	"http-benchmark/pkg/provider/file"
+	"http-benchmark/pkg/provider/remote"
 	"http-benchmark/pkg/tracer/accesslog"
 	"http-benchmark/pkg/tracer/prometheus"
+	"io"
 	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cloudwego/hertz/pkg/common/tracer"
+	otelprovider "github.com/hertz-contrib/obs-opentelemetry/provider"
 	"github.com/rs/dnscache"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type reloadFunc func(bifrost *Bifrost) error
 
 type Bifrost struct {
 	configPath   string
+	profile      string
 	opts         *config.Options
-	fileProvider *file.FileProvider
+	providers    []provider.Provider
 	httpServers  map[string]*HTTPServer
+	tcpServers   map[string]*TCPServer
+	acme         map[string]*autocert.Manager
 	resolver     *dnscache.Resolver
 	reloadCh     chan bool
 	stopCh       chan bool
+	stopOnce     sync.Once
 	onReload     reloadFunc
+	reloadMu     sync.Mutex
+	drained      sync.Map
+	reloadDiff   atomic.Pointer[ConfigDiff]
+	reloadStatus atomic.Pointer[ReloadStatus]
+	reloadHooks  []ReloadHook
+	hooksMu      sync.Mutex
+	skipped      []SkippedOption
+	// optsMu guards opts and skipped, a reload replaces them while the admin api reads them
+	optsMu sync.RWMutex
+	admin  *AdminServer
+	otel   otelprovider.OtelProvider
+}
+
+// ReloadStatus is the outcome of a reload
+type ReloadStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ReloadHook is called after every reload with its outcome
+type ReloadHook func(status ReloadStatus)
+
+type drainedTarget struct {
+	upstreamID string
+	addr       string
 }
 
 func (b *Bifrost) Run() {
-	i := 0
+	if b.admin != nil {
+		go b.admin.Run()
+	}
+
+	if b.onReload != nil {
+		stop := b.reloadOnSignal()
+		defer stop()
+	}
+
+	runs := make([]func(), 0, len(b.httpServers)+len(b.tcpServers))
+	for _, server := range b.tcpServers {
+		runs = append(runs, server.Run)
+	}
 	for _, server := range b.httpServers {
-		if i == len(b.httpServers)-1 {
+		runs = append(runs, server.Run)
+	}
+
+	for i, run := range runs {
+		if i == len(runs)-1 {
 			// last server need to blocked
-			server.Run()
+			run()
+			break
 		}
-		go server.Run()
-		i++
+		go run()
 	}
 }
 
+// stop stops the background tasks of the bifrost, the tasks of the upstreams are stopped by their engines, so an
+// engine handed over to another bifrost by a reload keeps running
 func (b *Bifrost) stop() {
-	b.stopCh <- true
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
 }
 
+// Shutdown stops accepting new connections on every entry and waits for the in-flight requests and connections
+// to finish, up to the graceful_timeout of each entry, before the background tasks are stopped.
+// The entries are drained together, so an entry doesn't have to wait for the others.
 func (b *Bifrost) Shutdown() {
-	b.stop()
+	wg := sync.WaitGroup{}
+
+	for _, server := range b.httpServers {
+		wg.Add(1)
+		go func(server *HTTPServer) {
+			defer wg.Done()
+			// the server waits graceful_timeout at most and logs the requests which didn't finish in time
+			_ = server.Shutdown(context.Background())
+		}(server)
+	}
+
+	for id, server := range b.tcpServers {
+		wg.Add(1)
+		go func(id string, server *TCPServer) {
+			defer wg.Done()
+			if err := server.Shutdown(context.Background()); err != nil {
+				slog.Warn("entry is closed before in-flight connections finished", "id", id, "error", err)
+			}
+		}(id, server)
+	}
+
+	wg.Wait()
+
+	for _, server := range b.httpServers {
+		server.switcher.Engine().OnShutdown()
+	}
+
+	if b.admin != nil {
+		_ = b.admin.Shutdown(context.Background())
+	}
+
+	// the spans which are not exported yet are flushed
+	if b.otel != nil {
+		_ = b.otel.Shutdown(context.Background())
+	}
 
+	for _, p := range b.providers {
+		if closer, ok := p.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+	b.stop()
 }
 
 func LoadFromConfig(path string) (*Bifrost, error) {
-	return loadFromConfig(path, false)
+	return loadFromConfig(path, os.Getenv(profileEnv), false)
+}
+
+// LoadFromConfigWithProfile loads the config with the profile merged over it, BIFROST_PROFILE is used when profile is empty
+func LoadFromConfigWithProfile(path string, profile string) (*Bifrost, error) {
+	if len(profile) == 0 {
+		profile = os.Getenv(profileEnv)
+	}
+	return loadFromConfig(path, profile, false)
+}
+
+func loadFromConfig(path string, profile string, isReload bool) (*Bifrost, error) {
+	mainOpts, providers, err := readConfig(path, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	bifrost, err := load(mainOpts, isReload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isReload {
+		bifrost.providers = providers
+		bifrost.configPath = path
+		bifrost.profile = profile
+		bifrost.onReload = reload
+
+		onChanged := func() error {
+			bifrost.requestReload()
+			return nil
+		}
+
+		watched := false
+		for _, p := range providers {
+			switch p := p.(type) {
+			case *file.FileProvider:
+				if !mainOpts.Providers.File.Watch {
+					continue
+				}
+				p.Add(path)
+			case *remote.HTTPProvider:
+				if !mainOpts.Providers.HTTP.Watch {
+					continue
+				}
+			}
+
+			p.SetOnChanged(onChanged)
+			_ = p.Watch()
+			watched = true
+		}
+
+		if watched {
+			bifrost.watch()
+		}
+	}
+
+	return bifrost, nil
 }
 
-func loadFromConfig(path string, isReload bool) (*Bifrost, error) {
+// readConfig reads the config file with the profile merged over it, the contents of the providers are merged
+// over it in order. A provider which can't be read fails the load, a reload keeps the running config then.
+func readConfig(path string, profile string) (config.Options, []provider.Provider, error) {
 	if !fileExist(path) {
-		return nil, fmt.Errorf("config file not found, path: %s", path)
+		return config.Options{}, nil, fmt.Errorf("config file not found, path: %s", path)
 	}
 
 	// main config file
@@ -66,12 +230,17 @@ func loadFromConfig(path string, isReload bool) (*Bifrost, error) {
 
 	cInfo, err := fileProvider.Open()
 	if err != nil {
-		return nil, err
+		return config.Options{}, nil, err
 	}
 
-	mainOpts, err := parseContent(cInfo[0].Content)
+	content, err := applyProfile(cInfo[0].Content, profile)
 	if err != nil {
-		return nil, err
+		return config.Options{}, nil, err
+	}
+
+	mainOpts, err := parseContent(content)
+	if err != nil {
+		return config.Options{}, nil, err
 	}
 	fileProvider.Reset()
 
@@ -83,42 +252,40 @@ func loadFromConfig(path string, isReload bool) (*Bifrost, error) {
 
 		cInfo, err = fileProvider.Open()
 		if err != nil {
-			return nil, err
+			return config.Options{}, nil, err
 		}
 
 		for _, c := range cInfo {
 			mainOpts, err = mergeOptions(mainOpts, c.Content)
 			if err != nil {
 				errMsg := fmt.Sprintf("path: %s, error: %s", c.Path, err.Error())
-				return nil, fmt.Errorf(errMsg)
+				return config.Options{}, nil, fmt.Errorf(errMsg)
 			}
 		}
 	}
 
-	bifrost, err := load(mainOpts, isReload)
-	if err != nil {
-		return nil, err
-	}
+	providers := []provider.Provider{fileProvider}
 
-	if !isReload {
-		reloadCh := make(chan bool)
-		bifrost.fileProvider = fileProvider
-		bifrost.configPath = path
-		bifrost.onReload = reload
-		bifrost.reloadCh = reloadCh
+	// http provider
+	if mainOpts.Providers.HTTP.Enabled {
+		httpProvider := remote.NewHTTPProvider(mainOpts.Providers.HTTP)
 
-		if mainOpts.Providers.File.Watch {
-			fileProvider.Add(path)
-			fileProvider.OnChanged = func() error {
-				reloadCh <- true
-				return nil
+		cInfo, err = httpProvider.Open()
+		if err != nil {
+			return config.Options{}, nil, err
+		}
+
+		for _, c := range cInfo {
+			mainOpts, err = mergeOptions(mainOpts, c.Content)
+			if err != nil {
+				return config.Options{}, nil, fmt.Errorf("url: %s, error: %w", c.Path, err)
 			}
-			_ = fileProvider.Watch()
-			bifrost.watch()
 		}
+
+		providers = append(providers, httpProvider)
 	}
 
-	return bifrost, nil
+	return mainOpts, providers, nil
 }
 
 func Load(opts config.Options) (*Bifrost, error) {
@@ -126,6 +293,12 @@ func Load(opts config.Options) (*Bifrost, error) {
 }
 
 func load(opts config.Options, isReload bool) (*Bifrost, error) {
+	// the invalid options are skipped in non-strict mode, the rest is validated as usual
+	var skipped []SkippedOption
+	if opts.Strict != nil && !*opts.Strict {
+		opts, skipped = skipInvalidOptions(opts)
+	}
+
 	// validate
 	err := validateOptions(opts)
 	if err != nil {
@@ -135,9 +308,12 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 	bifrsot := &Bifrost{
 		resolver:    &dnscache.Resolver{},
 		httpServers: make(map[string]*HTTPServer),
+		tcpServers:  make(map[string]*TCPServer),
+		acme:        make(map[string]*autocert.Manager),
 		opts:        &opts,
 		stopCh:      make(chan bool),
-		reloadCh:    make(chan bool),
+		reloadCh:    make(chan bool, 1),
+		skipped:     skipped,
 	}
 
 	go func() {
@@ -162,6 +338,10 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 	}
 	slog.SetDefault(logger)
 
+	for _, option := range skipped {
+		slog.Warn("bifrost: invalid option is skipped", "kind", option.Kind, "id", option.ID, "error", option.Err)
+	}
+
 	tracers := []tracer.Tracer{}
 
 	// prometheus tracer
@@ -175,10 +355,28 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 			promOpts = append(promOpts, prometheus.WithHistogramBuckets(opts.Metrics.Prometheus.Buckets))
 		}
 
+		if opts.Metrics.Prometheus.Exemplars && opts.Tracing.Enabled {
+			promOpts = append(promOpts, prometheus.WithEnableExemplars(true))
+		}
+
+		for _, label := range opts.Metrics.Prometheus.Labels {
+			promOpts = append(promOpts, prometheus.WithContextLabel(label.Name, label.Variable, label.Values))
+		}
+
 		promTracer := prometheus.NewTracer(":9091", "/metrics", promOpts...)
 		tracers = append(tracers, promTracer)
 	}
 
+	// opentelemetry
+	if opts.Tracing.Enabled && !isReload {
+		bifrsot.otel = newTracingProvider(opts.Tracing)
+	}
+
+	// admin api
+	if opts.Admin.Enabled && !isReload {
+		bifrsot.admin = newAdminServer(bifrsot, opts.Admin)
+	}
+
 	// access log
 	accessLogTracers := map[string]*accesslog.Tracer{}
 	if len(opts.AccessLogs) > 0 && !isReload {
@@ -199,6 +397,20 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 		}
 	}
 
+	// acme managers are created before entries, plaintext entries answer their http-01 challenges
+	for id, entry := range opts.Entries {
+		if entry.Protocol == config.ProtocolTCP || !entry.TLS.Enabled || !entry.TLS.ACME.Enabled {
+			continue
+		}
+
+		entry.ID = id
+		manager, err := newACMEManager(entry)
+		if err != nil {
+			return nil, err
+		}
+		bifrsot.acme[id] = manager
+	}
+
 	for id, entry := range opts.Entries {
 		if id == "" {
 			return nil, fmt.Errorf("http server id can't be empty")
@@ -215,6 +427,16 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 			return nil, fmt.Errorf("http server '%s' already exists", id)
 		}
 
+		if entry.Protocol == config.ProtocolTCP {
+			tcpServer, err := newTCPServer(bifrsot, entry)
+			if err != nil {
+				return nil, err
+			}
+
+			bifrsot.tcpServers[id] = tcpServer
+			continue
+		}
+
 		if len(entry.AccessLogID) > 0 {
 			_, found := opts.AccessLogs[entry.AccessLogID]
 			if !found {
@@ -235,9 +457,31 @@ func load(opts config.Options, isReload bool) (*Bifrost, error) {
 		bifrsot.httpServers[id] = httpServer
 	}
 
+	slog.Info("bifrost: config is loaded",
+		"entries", len(opts.Entries),
+		"routes", len(opts.Routes),
+		"services", len(opts.Services),
+		"upstreams", len(opts.Upstreams),
+		"skipped", skipped,
+	)
+
 	return bifrsot, nil
 }
 
+// Skipped returns the options which were excluded because they are invalid and strict is false
+func (b *Bifrost) Skipped() []SkippedOption {
+	_, skipped := b.options()
+	return skipped
+}
+
+// options returns the running options and the options skipped from them, both are replaced by a reload
+func (b *Bifrost) options() (*config.Options, []SkippedOption) {
+	b.optsMu.RLock()
+	defer b.optsMu.RUnlock()
+
+	return b.opts, b.skipped
+}
+
 func (b *Bifrost) watch() {
 	go func() {
 		defer func() {
@@ -250,7 +494,7 @@ func (b *Bifrost) watch() {
 		for {
 			select {
 			case <-b.reloadCh:
-				err := b.onReload(b)
+				err := b.Reload()
 				if err != nil {
 					slog.Error("bifrost: fail to reload config", "error", err)
 				}
@@ -261,10 +505,94 @@ func (b *Bifrost) watch() {
 	}()
 }
 
+// reloadOnSignal reloads the config in the same process on SIGHUP, the entries keep serving with the running
+// engines when the new config fails to load. The returned func stops listening to SIGHUP.
+func (b *Bifrost) reloadOnSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				slog.Info("bifrost: SIGHUP is received, reloading config")
+				err := b.Reload()
+				if err != nil {
+					slog.Error("bifrost: fail to reload config on SIGHUP, the running config is kept", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// requestReload queues a reload for the watcher without blocking. A burst of changes is served by a single
+// reload, because the queued reload reads the latest config anyway.
+func (b *Bifrost) requestReload() {
+	select {
+	case b.reloadCh <- true:
+	default:
+	}
+}
+
+// Reload reloads the config file, it waits for the running reload to finish, so the engines are never swapped
+// by two reloads at the same time
+func (b *Bifrost) Reload() error {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	var err error
+	if b.onReload == nil {
+		err = fmt.Errorf("bifrost: reload needs a config file")
+	} else {
+		err = b.onReload(b)
+	}
+
+	status := ReloadStatus{
+		Time:    time.Now(),
+		Success: err == nil,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	b.reloadStatus.Store(&status)
+
+	b.hooksMu.Lock()
+	hooks := b.reloadHooks
+	b.hooksMu.Unlock()
+
+	for _, hook := range hooks {
+		hook(status)
+	}
+
+	return err
+}
+
+// OnReloaded registers a hook which is called after every reload, successful or not, including the reloads of
+// the watched providers and SIGHUP. The hooks are called one by one, a slow hook delays the next reload.
+func (b *Bifrost) OnReloaded(hook ReloadHook) {
+	b.hooksMu.Lock()
+	defer b.hooksMu.Unlock()
+
+	b.reloadHooks = append(b.reloadHooks, hook)
+}
+
+// LastReloadStatus returns the outcome of the last reload, nil before the first reload
+func (b *Bifrost) LastReloadStatus() *ReloadStatus {
+	return b.reloadStatus.Load()
+}
+
 func reload(bifrost *Bifrost) error {
 	slog.Info("bifrost: reloading...")
 
-	newBifrost, err := loadFromConfig(bifrost.configPath, true)
+	newBifrost, err := loadFromConfig(bifrost.configPath, bifrost.profile, true)
 	if err != nil {
 		return err
 	}
@@ -273,16 +601,161 @@ func reload(bifrost *Bifrost) error {
 	}()
 
 	isReloaded := false
+	used := map[string]bool{}
 
 	for id, server := range bifrost.httpServers {
 		newServer, found := newBifrost.httpServers[id]
 		if found && server.entryOpts.Bind == newServer.entryOpts.Bind {
-			server.switcher.SetEngine(newServer.switcher.Engine())
+			oldEngine := server.switcher.Engine()
+			engine := newServer.switcher.Engine()
+			if bifrost.opts.Tracing.Enabled == newBifrost.opts.Tracing.Enabled {
+				reuseTargets(oldEngine, engine)
+			}
+			bifrost.applyDrainedTargets(engine)
+			server.switcher.SetEngine(engine)
+			oldEngine.OnShutdown()
+			used[id] = true
 			isReloaded = true
 		}
 	}
 
-	slog.Info("bifrost is reloaded successfully", "isReloaded", isReloaded)
+	// the engines of the entries which are not reloaded are never served
+	for id, server := range newBifrost.httpServers {
+		if !used[id] {
+			server.switcher.Engine().OnShutdown()
+		}
+	}
+
+	for id, server := range bifrost.tcpServers {
+		newServer, found := newBifrost.tcpServers[id]
+		if found && server.entryOpts.Bind == newServer.entryOpts.Bind {
+			upstream := newServer.upstream.Load()
+			bifrost.applyDrainedUpstream(upstream)
+			server.SetUpstream(upstream)
+			isReloaded = true
+		}
+	}
+
+	diff := diffOptions(*bifrost.opts, *newBifrost.opts)
+	bifrost.optsMu.Lock()
+	bifrost.opts = newBifrost.opts
+	bifrost.skipped = newBifrost.skipped
+	bifrost.optsMu.Unlock()
+	bifrost.reloadDiff.Store(&diff)
+
+	slog.Info("bifrost is reloaded successfully", "isReloaded", isReloaded, "diff", diff)
+
+	return nil
+}
+
+// LastReloadDiff returns what the last successful reload changed, nil before the first reload
+func (b *Bifrost) LastReloadDiff() *ConfigDiff {
+	return b.reloadDiff.Load()
+}
+
+// DrainTarget stops sending new requests to the target of the upstream in every entry.
+// In-flight requests are allowed to finish. The target stays drained across reloads until EnableTarget is called.
+func (b *Bifrost) DrainTarget(upstreamID, addr string) error {
+	upstreams := b.findUpstreams(upstreamID)
+	if len(upstreams) == 0 {
+		return fmt.Errorf("upstream '%s' was not found", upstreamID)
+	}
+
+	for _, upstream := range upstreams {
+		err := upstream.DrainTarget(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.drained.Store(drainedTarget{upstreamID: upstreamID, addr: addr}, true)
+	slog.Info("target is drained", "upstream", upstreamID, "target", addr)
+	return nil
+}
 
+// EnableTarget puts a drained target of the upstream back into rotation in every entry.
+func (b *Bifrost) EnableTarget(upstreamID, addr string) error {
+	upstreams := b.findUpstreams(upstreamID)
+	if len(upstreams) == 0 {
+		return fmt.Errorf("upstream '%s' was not found", upstreamID)
+	}
+
+	for _, upstream := range upstreams {
+		err := upstream.EnableTarget(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.drained.Delete(drainedTarget{upstreamID: upstreamID, addr: addr})
+	slog.Info("target is enabled", "upstream", upstreamID, "target", addr)
 	return nil
 }
+
+func (b *Bifrost) findUpstreams(upstreamID string) []*Upstream {
+	result := make([]*Upstream, 0)
+
+	for _, server := range b.httpServers {
+		for _, svc := range server.switcher.Engine().services {
+			upstream, found := svc.upstreams[upstreamID]
+			if found {
+				result = append(result, upstream)
+			}
+		}
+	}
+
+	for _, server := range b.tcpServers {
+		upstream := server.upstream.Load()
+		if upstream.opts.ID == upstreamID {
+			result = append(result, upstream)
+		}
+	}
+
+	return result
+}
+
+func (b *Bifrost) applyDrainedUpstream(upstream *Upstream) {
+	b.drained.Range(func(key, value any) bool {
+		target := key.(drainedTarget)
+		if target.upstreamID != upstream.opts.ID {
+			return true
+		}
+
+		err := upstream.DrainTarget(target.addr)
+		if err != nil {
+			slog.Warn("fail to drain target after reload", "upstream", target.upstreamID, "target", target.addr, "error", err)
+		}
+		return true
+	})
+}
+
+// reuseTargets keeps the targets of the running engine which are not changed by the reload, so the keep-alive
+// connections of the targets are not dropped. Only the upstreams of the services whose options are not changed
+// are reused, see Upstream.reuseProxies.
+func reuseTargets(old *Engine, engine *Engine) {
+	for id, svc := range engine.services {
+		oldSvc, found := old.services[id]
+		if !found || !reflect.DeepEqual(oldSvc.options, svc.options) {
+			continue
+		}
+
+		for upstreamID, upstream := range svc.upstreams {
+			oldUpstream, found := oldSvc.upstreams[upstreamID]
+			if !found {
+				continue
+			}
+
+			if kept := upstream.reuseProxies(oldUpstream); kept > 0 {
+				slog.Debug("upstream targets are kept by reload", "service", id, "upstream", upstreamID, "kept", kept)
+			}
+		}
+	}
+}
+
+func (b *Bifrost) applyDrainedTargets(engine *Engine) {
+	for _, svc := range engine.services {
+		for _, upstream := range svc.upstreams {
+			b.applyDrainedUpstream(upstream)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"http-benchmark/pkg/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerializeReloads(t *testing.T) {
+	var running, maxRunning, reloads atomic.Int32
+	gate := make(chan bool)
+
+	bifrost := &Bifrost{
+		reloadCh: make(chan bool, 1),
+		stopCh:   make(chan bool),
+		onReload: func(bifrost *Bifrost) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+
+			<-gate
+			reloads.Add(1)
+			return nil
+		},
+	}
+	defer bifrost.stop()
+
+	t.Run("concurrent reloads", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, bifrost.Reload())
+			}()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int32(1), running.Load())
+
+		for i := 0; i < 10; i++ {
+			gate <- true
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), maxRunning.Load())
+		assert.Equal(t, int32(10), reloads.Load())
+	})
+
+	t.Run("burst of changes", func(t *testing.T) {
+		reloads.Store(0)
+		bifrost.watch()
+
+		bifrost.requestReload()
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int32(1), running.Load())
+
+		// the reload is running, the burst is queued as one reload
+		for i := 0; i < 10; i++ {
+			bifrost.requestReload()
+		}
+
+		gate <- true
+		gate <- true
+
+		select {
+		case gate <- true:
+			assert.Fail(t, "the burst should be served by a single reload")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		assert.Equal(t, int32(2), reloads.Load())
+		assert.Equal(t, int32(1), maxRunning.Load())
+	})
+
+	t.Run("reload without config file", func(t *testing.T) {
+		bifrost := &Bifrost{}
+		assert.Error(t, bifrost.Reload())
+	})
+}
+
+func TestReloadStatus(t *testing.T) {
+	reloadErr := errors.New("service 'orders' retries can't be negative")
+	var fail atomic.Bool
+
+	bifrost := &Bifrost{
+		onReload: func(bifrost *Bifrost) error {
+			if fail.Load() {
+				return reloadErr
+			}
+			return nil
+		},
+	}
+	assert.Nil(t, bifrost.LastReloadStatus())
+
+	statuses := []ReloadStatus{}
+	bifrost.OnReloaded(func(status ReloadStatus) {
+		statuses = append(statuses, status)
+	})
+
+	start := time.Now()
+	assert.NoError(t, bifrost.Reload())
+	fail.Store(true)
+	assert.ErrorIs(t, bifrost.Reload(), reloadErr)
+
+	status := bifrost.LastReloadStatus()
+	if assert.NotNil(t, status) {
+		assert.False(t, status.Success)
+		assert.Equal(t, reloadErr.Error(), status.Error)
+		assert.False(t, status.Time.Before(start))
+	}
+
+	if assert.Len(t, statuses, 2) {
+		assert.True(t, statuses[0].Success)
+		assert.Empty(t, statuses[0].Error)
+		assert.Equal(t, *status, statuses[1])
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	newOptions := func(strict *bool) config.Options {
+		return config.Options{
+			Strict: strict,
+			Entries: map[string]config.EntryOptions{
+				"http": {Bind: "127.0.0.1:9916"},
+			},
+			Routes: map[string]config.RouteOptions{
+				"orders":   {Paths: []string{"/orders"}, ServiceID: "orders"},
+				"payments": {Paths: []string{"/payments"}, ServiceID: "payments"},
+			},
+			Services: map[string]config.ServiceOptions{
+				"orders": {Url: "http://127.0.0.1:8001"},
+				// broken, retries can't be negative
+				"payments": {Url: "http://127.0.0.1:8002", Retries: -1},
+			},
+		}
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := Load(newOptions(nil))
+		assert.ErrorContains(t, err, "service 'payments' retries can't be negative")
+
+		strict := true
+		_, err = Load(newOptions(&strict))
+		assert.Error(t, err)
+	})
+
+	t.Run("non-strict", func(t *testing.T) {
+		strict := false
+		opts := newOptions(&strict)
+
+		bifrost, err := Load(opts)
+		assert.NoError(t, err)
+
+		skipped := bifrost.Skipped()
+		assert.Len(t, skipped, 2)
+		assert.Equal(t, "service 'payments'", skipped[0].String())
+		assert.ErrorContains(t, skipped[0].Err, "retries can't be negative")
+		// the route of the broken service is excluded too
+		assert.Equal(t, "route 'payments'", skipped[1].String())
+
+		assert.Contains(t, bifrost.opts.Services, "orders")
+		assert.NotContains(t, bifrost.opts.Services, "payments")
+		assert.NotContains(t, bifrost.opts.Routes, "payments")
+
+		// the options of the caller are kept
+		assert.Contains(t, opts.Services, "payments")
+	})
+
+	t.Run("nothing left", func(t *testing.T) {
+		strict := false
+		opts := newOptions(&strict)
+		opts.Services["orders"] = config.ServiceOptions{Url: "http://127.0.0.1:8001", Retries: -1}
+
+		_, err := Load(opts)
+		assert.ErrorContains(t, err, "no route found")
+	})
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9917"))
+	backend.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(time.Second)
+		ctx.String(200, "slow")
+	})
+	go backend.Spin()
+
+	bifrost, err := Load(config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {
+				Bind:    "127.0.0.1:9918",
+				Timeout: config.EntryTimeoutOptions{GracefulTimeOut: 5 * time.Second},
+			},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/slow"}, ServiceID: "slow"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"slow": {Url: "http://127.0.0.1:9917"},
+		},
+	})
+	assert.NoError(t, err)
+	go bifrost.Run()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	assert.NoError(t, err)
+
+	statuses := make(chan int, 1)
+	go func() {
+		status, _, err := cli.Get(context.Background(), nil, "http://127.0.0.1:9918/slow")
+		assert.NoError(t, err)
+		statuses <- status
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// the in-flight request finishes before the entry is closed
+	start := time.Now()
+	bifrost.Shutdown()
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, 200, <-statuses)
+
+	// no new connection is accepted
+	_, _, err = cli.Get(context.Background(), nil, "http://127.0.0.1:9918/slow")
+	assert.Error(t, err)
+}
+
+func TestHTTPProvider(t *testing.T) {
+	var content atomic.Value
+	var status atomic.Int32
+	content.Store(`
+routes:
+  orders:
+    paths: ["/orders"]
+    service_id: orders
+services:
+  orders:
+    url: http://127.0.0.1:8001
+`)
+	status.Store(200)
+
+	endpoint := server.New(server.WithHostPorts("127.0.0.1:9939"))
+	endpoint.GET("/config", func(c context.Context, ctx *app.RequestContext) {
+		if string(ctx.Request.Header.Peek("Authorization")) != "Bearer token" {
+			ctx.SetStatusCode(401)
+			return
+		}
+		ctx.String(int(status.Load()), content.Load().(string))
+	})
+	go endpoint.Spin()
+	time.Sleep(time.Second)
+
+	write := func(url string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		err := os.WriteFile(path, []byte(`
+providers:
+  http:
+    enabled: true
+    url: `+url+`
+    headers:
+      Authorization: Bearer token
+    watch: true
+    interval: 100ms
+entries:
+  http:
+    bind: "127.0.0.1:9940"
+`), 0o600)
+		assert.NoError(t, err)
+		return path
+	}
+
+	bifrost, err := LoadFromConfig(write("http://127.0.0.1:9939/config"))
+	assert.NoError(t, err)
+	defer bifrost.Shutdown()
+	assert.Contains(t, bifrost.opts.Routes, "orders")
+
+	t.Run("failed fetch keeps the config", func(t *testing.T) {
+		status.Store(500)
+		time.Sleep(300 * time.Millisecond)
+		assert.Nil(t, bifrost.LastReloadDiff())
+	})
+
+	t.Run("changed content is reloaded", func(t *testing.T) {
+		content.Store(content.Load().(string) + `
+  payments:
+    url: http://127.0.0.1:8002
+`)
+		status.Store(200)
+
+		assert.Eventually(t, func() bool {
+			return bifrost.LastReloadDiff() != nil
+		}, 2*time.Second, 50*time.Millisecond)
+		assert.Equal(t, []string{"payments"}, bifrost.LastReloadDiff().Services.Added)
+	})
+
+	t.Run("unreachable endpoint", func(t *testing.T) {
+		_, err := LoadFromConfig(write("http://127.0.0.1:9939/missing"))
+		assert.ErrorContains(t, err, "unexpected status code 404")
+	})
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	content := `
+entries:
+  http:
+    bind: "127.0.0.1:9900"
+routes:
+  orders:
+    paths: ["/orders"]
+    service_id: orders
+services:
+  orders:
+    url: http://127.0.0.1:8001
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	bifrost, err := LoadFromConfig(path)
+	assert.NoError(t, err)
+	defer bifrost.stop()
+
+	stop := bifrost.reloadOnSignal()
+	defer stop()
+
+	t.Run("invalid config keeps the running config", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte(content+"    retries: -1\n"), 0o600))
+		assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+		time.Sleep(200 * time.Millisecond)
+		assert.Nil(t, bifrost.LastReloadDiff())
+		assert.Contains(t, bifrost.opts.Routes, "orders")
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte(content+`  payments:
+    url: http://127.0.0.1:8002
+`), 0o600))
+		assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+		assert.Eventually(t, func() bool {
+			return bifrost.LastReloadDiff() != nil
+		}, 2*time.Second, 50*time.Millisecond)
+		assert.Equal(t, []string{"payments"}, bifrost.LastReloadDiff().Services.Added)
+	})
+}
+
+func TestReloadKeepsTargets(t *testing.T) {
+	content := `
+entries:
+  http:
+    bind: "127.0.0.1:9899"
+routes:
+  orders:
+    paths: ["/orders"]
+    service_id: orders
+services:
+  orders:
+    url: http://orders:8001
+upstreams:
+  orders:
+    strategy: weighted
+    targets:
+      - target: 127.0.0.1
+        weight: 1
+      - target: 127.0.0.2
+        weight: 1
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	bifrost, err := LoadFromConfig(path)
+	assert.NoError(t, err)
+	defer bifrost.stop()
+
+	upstreams := bifrost.findUpstreams("orders")
+	assert.Len(t, upstreams, 1)
+	kept := upstreams[0].findProxy("127.0.0.1")
+	removed := upstreams[0].findProxy("127.0.0.2")
+
+	t.Run("weight and targets are changed in place", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte(strings.Replace(content, `      - target: 127.0.0.1
+        weight: 1
+      - target: 127.0.0.2
+        weight: 1`, `      - target: 127.0.0.3
+        weight: 2
+      - target: 127.0.0.1
+        weight: 5`, 1)), 0o600))
+		assert.NoError(t, bifrost.Reload())
+
+		upstream := bifrost.findUpstreams("orders")[0]
+		assert.NotSame(t, upstreams[0], upstream)
+		assert.Same(t, kept, upstream.findProxy("127.0.0.1"))
+		assert.Equal(t, int64(5), kept.weight.Load())
+		assert.Nil(t, upstream.findProxy("127.0.0.2"))
+		assert.NotSame(t, removed, upstream.findProxy("127.0.0.3"))
+		assert.Equal(t, int64(2), upstream.findProxy("127.0.0.3").weight.Load())
+	})
+
+	t.Run("changed service recreates the targets", func(t *testing.T) {
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(content), "url: http://orders:8001", "url: http://orders:8002", 1)), 0o600))
+		assert.NoError(t, bifrost.Reload())
+
+		upstream := bifrost.findUpstreams("orders")[0]
+		assert.NotSame(t, kept, upstream.findProxy("127.0.0.1"))
+		assert.Equal(t, int64(5), upstream.findProxy("127.0.0.1").weight.Load())
+	})
+}
@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/proxy"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const (
+	defaultMaxBufferedBodySize = 1 * config.MB
+)
+
+// replayable buffers the request body up to max_buffered_body_size, a request with a larger body isn't retried
+// or mirrored. The body stream of a grpc call is never buffered, because the messages may depend on the responses.
+func (svc *Service) replayable(ctx *app.RequestContext) bool {
+	if svc.options.Protocol == config.ProtocolGRPC && ctx.Request.IsBodyStream() {
+		return false
+	}
+
+	maxSize := svc.options.MaxBufferedBodySize
+	if maxSize == 0 {
+		maxSize = defaultMaxBufferedBodySize
+	}
+
+	replayable, err := proxy.BufferRequestBody(ctx, maxSize)
+	return err == nil && replayable
+}
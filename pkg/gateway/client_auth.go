@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"os"
+	"slices"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+)
+
+// setClientAuth requires client certificates signed by ca_pem. With optional, clients without a certificate are accepted
+// but a certificate sent by the client is still verified.
+// allowed_subjects matches the common name or the whole subject, allowed_sans matches any dns, ip, email or uri san,
+// the certificate is accepted when either of them matches.
+func setClientAuth(tlsConfig *tls.Config, opts config.ClientAuthOptions) error {
+	caPEM, err := os.ReadFile(opts.CAPEM)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificate found in ca_pem '%s'", opts.CAPEM)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if opts.Optional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if len(opts.AllowedSubjects) == 0 && len(opts.AllowedSANs) == 0 {
+		return nil
+	}
+
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+
+		cert := state.PeerCertificates[0]
+
+		if slices.Contains(opts.AllowedSubjects, cert.Subject.CommonName) || slices.Contains(opts.AllowedSubjects, cert.Subject.String()) {
+			return nil
+		}
+
+		for _, san := range certificateSANs(cert) {
+			if slices.Contains(opts.AllowedSANs, san) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("client certificate '%s' is not allowed", cert.Subject.String())
+	}
+
+	return nil
+}
+
+// clientCertificate returns the verified certificate of the client, nil when the connection has no client certificate
+func clientCertificate(ctx *app.RequestContext) *x509.Certificate {
+	conn, ok := ctx.GetConn().(network.ConnTLSer)
+	if !ok {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+// tlsServerName returns the SNI of the client connection, it is empty for plaintext connections
+func tlsServerName(ctx *app.RequestContext) string {
+	conn, ok := ctx.GetConn().(network.ConnTLSer)
+	if !ok {
+		return ""
+	}
+
+	return conn.ConnectionState().ServerName
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses)+len(cert.EmailAddresses)+len(cert.URIs))
+
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	return sans
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600)
+	assert.NoError(t, err)
+	return path
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"bifrost"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	caPEM := ca.writePEM(t)
+
+	newServer := func(addr string, opts config.ClientAuthOptions) {
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+		opts.CAPEM = caPEM
+		err := setClientAuth(tlsConfig, opts)
+		assert.NoError(t, err)
+
+		h := server.New(server.WithHostPorts(addr), server.WithTLS(tlsConfig))
+		h.Use(newInitMiddleware(config.EntryOptions{}, slog.Default()).ServeHTTP)
+		h.GET("/mtls", func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.Set("X-Client-SAN", ctx.GetString(config.SSL_CLIENT_SAN))
+			ctx.String(200, ctx.GetString(config.SSL_CLIENT_S_DN))
+		})
+		go h.Spin()
+	}
+
+	newServer("127.0.0.1:9966", config.ClientAuthOptions{
+		AllowedSubjects: []string{"orders"},
+		AllowedSANs:     []string{"payments.internal"},
+	})
+	newServer("127.0.0.1:9965", config.ClientAuthOptions{Optional: true})
+	time.Sleep(time.Second)
+
+	send := func(uri string, certs ...tls.Certificate) (*protocol.Response, error) {
+		cli, err := client.NewClient(client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true, Certificates: certs}))
+		assert.NoError(t, err)
+
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		err = cli.Do(context.Background(), req, resp)
+		return resp, err
+	}
+
+	t.Run("allowed subject", func(t *testing.T) {
+		resp, err := send("https://127.0.0.1:9966/mtls", ca.issue(t, "orders", "orders.internal"))
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		assert.Equal(t, "CN=orders,O=bifrost", string(resp.Body()))
+		assert.Equal(t, "orders.internal", resp.Header.Get("X-Client-SAN"))
+	})
+
+	t.Run("allowed san", func(t *testing.T) {
+		resp, err := send("https://127.0.0.1:9966/mtls", ca.issue(t, "payments", "payments.internal"))
+		assert.NoError(t, err)
+		assert.Equal(t, "CN=payments,O=bifrost", string(resp.Body()))
+	})
+
+	t.Run("subject is not allowed", func(t *testing.T) {
+		_, err := send("https://127.0.0.1:9966/mtls", ca.issue(t, "users", "users.internal"))
+		assert.Error(t, err)
+	})
+
+	t.Run("certificate of another ca", func(t *testing.T) {
+		_, err := send("https://127.0.0.1:9966/mtls", newTestCA(t).issue(t, "orders"))
+		assert.Error(t, err)
+	})
+
+	t.Run("certificate is required", func(t *testing.T) {
+		_, err := send("https://127.0.0.1:9966/mtls")
+		assert.Error(t, err)
+	})
+
+	t.Run("optional", func(t *testing.T) {
+		resp, err := send("https://127.0.0.1:9965/mtls")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		assert.Equal(t, "", string(resp.Body()))
+
+		resp, err = send("https://127.0.0.1:9965/mtls", ca.issue(t, "users"))
+		assert.NoError(t, err)
+		assert.Equal(t, "CN=users,O=bifrost", string(resp.Body()))
+
+		_, err = send("https://127.0.0.1:9965/mtls", newTestCA(t).issue(t, "users"))
+		assert.Error(t, err)
+	})
+}
+
+func TestSSLServerName(t *testing.T) {
+	newServer := func(addr string, opts ...hzconfig.Option) {
+		h := server.New(append(opts, server.WithHostPorts(addr))...)
+		h.Use(newInitMiddleware(config.EntryOptions{}, slog.Default()).ServeHTTP)
+		h.GET("/sni", func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.Set("X-Host", string(ctx.Host()))
+			ctx.String(200, ctx.GetString(config.SSL_SERVER_NAME))
+		})
+		go h.Spin()
+	}
+
+	newServer("127.0.0.1:9914", server.WithTLS(&tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}))
+	newServer("127.0.0.1:9915")
+	time.Sleep(time.Second)
+
+	send := func(uri string, opts ...hzconfig.ClientOption) *protocol.Response {
+		cli, err := client.NewClient(opts...)
+		assert.NoError(t, err)
+
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		err = cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		resp := send("https://127.0.0.1:9914/sni", client.WithTLSConfig(&tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "tenant-a.example.com",
+		}))
+		assert.Equal(t, 200, resp.StatusCode())
+		assert.Equal(t, "tenant-a.example.com", string(resp.Body()))
+		assert.Equal(t, "127.0.0.1:9914", resp.Header.Get("X-Host"))
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9915/sni")
+		assert.Equal(t, 200, resp.StatusCode())
+		assert.Empty(t, resp.Body())
+	})
+}
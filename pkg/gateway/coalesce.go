@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/valyala/bytebufferpool"
+)
+
+// coalescedMethods are the methods whose concurrent identical requests can share one upstream call
+var coalescedMethods = []string{"GET", "HEAD"}
+
+// credentialHeaders are always part of the coalescing key, so a response of a user is never shared with another user
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+type coalesceCall struct {
+	done          chan struct{}
+	resp          protocol.Response
+	upstreamAddr  string
+	targetTimeout bool
+	targetError   bool
+	upstreamError string
+}
+
+// coalescer shares one upstream call between identical in-flight requests of a service.
+// The first request of a key calls the upstream, other requests of the same key wait and receive a copy of its response.
+// Nothing is kept after the call finishes, it is not a cache. Websocket and server-sent events requests are never
+// coalesced, their responses don't end.
+type coalescer struct {
+	headers []string
+	mu      sync.Mutex
+	calls   map[string]*coalesceCall
+}
+
+func newCoalescer(opts config.CoalesceOptions) *coalescer {
+	headers := slices.Clone(credentialHeaders)
+	for _, header := range opts.Headers {
+		if !slices.ContainsFunc(headers, func(h string) bool { return strings.EqualFold(h, header) }) {
+			headers = append(headers, header)
+		}
+	}
+
+	return &coalescer{
+		headers: headers,
+		calls:   make(map[string]*coalesceCall),
+	}
+}
+
+// key returns the coalescing key of the request, an empty key means the request is not coalesced
+func (co *coalescer) key(ctx *app.RequestContext) string {
+	if !slices.Contains(coalescedMethods, string(ctx.Request.Method())) || len(ctx.Request.Body()) > 0 || isWebSocketUpgrade(&ctx.Request) ||
+		isEventStreamRequest(&ctx.Request) {
+		return ""
+	}
+
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	_, _ = buf.Write(ctx.Request.Method())
+	_, _ = buf.Write(spaceByte)
+	_, _ = buf.Write(ctx.Request.Host())
+	_, _ = buf.Write(ctx.Request.URI().RequestURI())
+
+	for _, header := range co.headers {
+		_, _ = buf.WriteString("\n")
+		_, _ = buf.WriteString(header)
+		_, _ = buf.WriteString(": ")
+		_, _ = buf.Write(ctx.Request.Header.Peek(header))
+	}
+
+	return buf.String()
+}
+
+// do runs fn for the first request of the key and copies its result to the other requests waiting for the same key.
+// fn of the first request must not depend on the cancellation of the client, otherwise one canceled client fails all of them.
+func (co *coalescer) do(c context.Context, ctx *app.RequestContext, key string, fn func()) {
+	co.mu.Lock()
+	call, found := co.calls[key]
+	if found {
+		co.mu.Unlock()
+
+		select {
+		case <-call.done:
+			call.resp.CopyTo(&ctx.Response)
+			ctx.Set(config.UPSTREAM_ADDR, call.upstreamAddr)
+			ctx.Set("target_timeout", call.targetTimeout)
+			ctx.Set("target_error", call.targetError)
+			ctx.Set(config.UPSTREAM_ERROR, call.upstreamError)
+		case <-c.Done():
+		}
+		return
+	}
+
+	// waiting requests get a bad gateway when fn panics
+	call = &coalesceCall{done: make(chan struct{}), targetError: true}
+	call.resp.SetStatusCode(502)
+	co.calls[key] = call
+	co.mu.Unlock()
+
+	defer func() {
+		co.mu.Lock()
+		delete(co.calls, key)
+		co.mu.Unlock()
+		close(call.done)
+	}()
+
+	fn()
+
+	ctx.Response.CopyTo(&call.resp)
+	call.upstreamAddr = ctx.GetString(config.UPSTREAM_ADDR)
+	call.targetTimeout = ctx.GetBool("target_timeout")
+	call.targetError = ctx.GetBool("target_error")
+	call.upstreamError = ctx.GetString(config.UPSTREAM_ERROR)
+}
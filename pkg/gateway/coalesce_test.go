@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	var calls atomic.Int32
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9978"))
+	h.Any("/coalesce", func(c context.Context, ctx *app.RequestContext) {
+		n := calls.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		ctx.String(200, "call "+strconv.Itoa(int(n)))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"coalesce_upstream": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9978"},
+					},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:       "coalesce",
+		Url:      "http://coalesce_upstream",
+		Coalesce: config.CoalesceOptions{Enabled: true, Headers: []string{"Accept-Encoding"}},
+	})
+	assert.NoError(t, err)
+
+	serve := func(method string, uri string, acceptEncoding string) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetMethod(method)
+		hzCtx.Request.SetRequestURI(uri)
+		if len(acceptEncoding) > 0 {
+			hzCtx.Request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	fire := func(n int, fn func(i int) *app.RequestContext) []*app.RequestContext {
+		results := make([]*app.RequestContext, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = fn(i)
+			}(i)
+		}
+		wg.Wait()
+		return results
+	}
+
+	t.Run("identical requests share one upstream call", func(t *testing.T) {
+		calls.Store(0)
+
+		results := fire(50, func(int) *app.RequestContext {
+			return serve("GET", "http://localhost/coalesce?a=1", "")
+		})
+
+		assert.Equal(t, int32(1), calls.Load())
+		for _, hzCtx := range results {
+			assert.Equal(t, 200, hzCtx.Response.StatusCode())
+			assert.Equal(t, "call 1", string(hzCtx.Response.Body()))
+			assert.Equal(t, "127.0.0.1:9978", hzCtx.GetString(config.UPSTREAM_ADDR))
+		}
+	})
+
+	t.Run("keys differ by query and selected headers", func(t *testing.T) {
+		calls.Store(0)
+
+		fire(20, func(i int) *app.RequestContext {
+			switch i % 4 {
+			case 0:
+				return serve("GET", "http://localhost/coalesce?a=1", "")
+			case 1:
+				return serve("GET", "http://localhost/coalesce?a=2", "")
+			case 2:
+				return serve("GET", "http://localhost/coalesce?a=1", "gzip")
+			default:
+				return serve("HEAD", "http://localhost/coalesce?a=1", "")
+			}
+		})
+
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("requests of different users are not coalesced", func(t *testing.T) {
+		calls.Store(0)
+
+		results := fire(20, func(i int) *app.RequestContext {
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetMethod("GET")
+			hzCtx.Request.SetRequestURI("http://localhost/coalesce?a=1")
+			hzCtx.Request.Header.Set("Authorization", "Bearer user"+strconv.Itoa(i%2))
+			service.ServeHTTP(context.Background(), hzCtx)
+			return hzCtx
+		})
+
+		assert.Equal(t, int32(2), calls.Load())
+		for i, hzCtx := range results {
+			// the requests of a user share the response of the call of the same user
+			assert.Equal(t, string(results[i%2].Response.Body()), string(hzCtx.Response.Body()))
+		}
+		assert.NotEqual(t, string(results[0].Response.Body()), string(results[1].Response.Body()))
+	})
+
+	t.Run("non idempotent requests are not coalesced", func(t *testing.T) {
+		calls.Store(0)
+
+		fire(5, func(int) *app.RequestContext {
+			return serve("POST", "http://localhost/coalesce", "")
+		})
+
+		assert.Equal(t, int32(5), calls.Load())
+	})
+}
@@ -1,20 +1,35 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
 	"http-benchmark/pkg/config"
+	"maps"
+	"math"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+var metricLabelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 func parseContent(content string) (config.Options, error) {
 	result := config.Options{}
 
+	content, err := expandEnv(content)
+	if err != nil {
+		return result, err
+	}
+
 	b := []byte(content)
 
-	err := yaml.Unmarshal(b, &result)
+	err = yaml.Unmarshal(b, &result)
 	if err != nil {
 		return result, err
 	}
@@ -22,6 +37,56 @@ func parseContent(content string) (config.Options, error) {
 	return result, nil
 }
 
+// expandEnv replaces ${NAME} and ${NAME:-default} with the environment variables before the content is unmarshalled.
+// The default is used when the variable is unset or empty, an unset variable without a default is an error.
+// $$ is a literal $, other $ like the variables of the access log template are kept as they are.
+func expandEnv(content string) (string, error) {
+	if !strings.Contains(content, "$") {
+		return content, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(content); i++ {
+		if content[i] != '$' || i+1 == len(content) {
+			sb.WriteByte(content[i])
+			continue
+		}
+
+		switch content[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(content[i+2:], '}')
+			if end < 0 {
+				line, _, _ := strings.Cut(content[i:], "\n")
+				return "", fmt.Errorf("environment variable '%s' is not closed", line)
+			}
+			expr := content[i+2 : i+2+end]
+
+			name, defaultValue, hasDefault := strings.Cut(expr, ":-")
+			if !envNameRegexp.MatchString(name) {
+				return "", fmt.Errorf("environment variable '${%s}' is invalid", expr)
+			}
+
+			value, found := os.LookupEnv(name)
+			switch {
+			case hasDefault && value == "":
+				value = defaultValue
+			case !found:
+				return "", fmt.Errorf("environment variable '%s' is not set", name)
+			}
+
+			sb.WriteString(value)
+			i += 2 + end
+		default:
+			sb.WriteByte('$')
+		}
+	}
+
+	return sb.String(), nil
+}
+
 func mergeOptions(mainOpts config.Options, content string) (config.Options, error) {
 
 	otherOpts, err := parseContent(content)
@@ -107,63 +172,592 @@ func fileExist(file string) bool {
 	return true
 }
 
+// SkippedOption is an entry, route, service or upstream which was excluded by the non-strict mode
+type SkippedOption struct {
+	Kind string
+	ID   string
+	Err  error
+}
+
+func (o SkippedOption) String() string {
+	return fmt.Sprintf("%s '%s'", o.Kind, o.ID)
+}
+
+// skipInvalidOptions removes the invalid upstreams, services, entries and routes when strict is false, so a broken
+// entry doesn't fail the whole config. The options which reference a removed option are removed too.
+func skipInvalidOptions(mainOpts config.Options) (config.Options, []SkippedOption) {
+	skipped := []SkippedOption{}
+
+	mainOpts.Upstreams = maps.Clone(mainOpts.Upstreams)
+	for upstreamID, opts := range mainOpts.Upstreams {
+		if err := validateUpstream(upstreamID, opts); err != nil {
+			delete(mainOpts.Upstreams, upstreamID)
+			skipped = append(skipped, SkippedOption{Kind: "upstream", ID: upstreamID, Err: err})
+		}
+	}
+
+	isSkippedUpstream := func(id string) bool {
+		return slices.ContainsFunc(skipped, func(o SkippedOption) bool { return o.Kind == "upstream" && o.ID == id })
+	}
+
+	mainOpts.Services = maps.Clone(mainOpts.Services)
+	for serviceID, opts := range mainOpts.Services {
+		err := validateService(mainOpts, serviceID, opts)
+		if err == nil {
+			if addr, parseErr := url.Parse(opts.Url); parseErr == nil && isSkippedUpstream(addr.Hostname()) {
+				err = fmt.Errorf("upstream '%s' was skipped in service '%s'", addr.Hostname(), serviceID)
+			}
+		}
+
+		if err != nil {
+			delete(mainOpts.Services, serviceID)
+			skipped = append(skipped, SkippedOption{Kind: "service", ID: serviceID, Err: err})
+		}
+	}
+
+	mainOpts.Entries = maps.Clone(mainOpts.Entries)
+	for id, opts := range mainOpts.Entries {
+		if err := validateEntry(mainOpts, id, opts); err != nil {
+			delete(mainOpts.Entries, id)
+			skipped = append(skipped, SkippedOption{Kind: "entry", ID: id, Err: err})
+		}
+	}
+
+	mainOpts.Routes = maps.Clone(mainOpts.Routes)
+	for routeID, route := range mainOpts.Routes {
+		err := validateRoute(mainOpts, routeID, route)
+		if err == nil {
+			if _, found := mainOpts.Services[route.ServiceID]; !found {
+				err = fmt.Errorf("service_id '%s' was not found in route: %s", route.ServiceID, routeID)
+			}
+		}
+
+		if err != nil {
+			delete(mainOpts.Routes, routeID)
+			skipped = append(skipped, SkippedOption{Kind: "route", ID: routeID, Err: err})
+		}
+	}
+
+	return mainOpts, skipped
+}
+
+// validateOptions validates all the options, every problem is reported instead of the first one
 func validateOptions(mainOpts config.Options) error {
+	errs := []error{}
+
 	if len(mainOpts.Entries) == 0 {
-		return fmt.Errorf("no entry found")
+		errs = append(errs, fmt.Errorf("no entry found"))
 	}
 
-	if len(mainOpts.Routes) == 0 {
-		return fmt.Errorf("no route found")
+	hasHTTPEntry := false
+	for _, opts := range mainOpts.Entries {
+		if opts.Protocol != config.ProtocolTCP {
+			hasHTTPEntry = true
+			break
+		}
 	}
 
-	for id, opts := range mainOpts.AccessLogs {
-		if !opts.Enabled {
-			continue
+	if hasHTTPEntry && len(mainOpts.Routes) == 0 {
+		errs = append(errs, fmt.Errorf("no route found"))
+	}
+
+	if mainOpts.Tracing.SampleRate < 0 || mainOpts.Tracing.SampleRate > 1 {
+		errs = append(errs, fmt.Errorf("tracing sample_rate must be between 0 and 1"))
+	}
+
+	if mainOpts.Admin.Enabled {
+		if mainOpts.Admin.Bind == "" {
+			errs = append(errs, fmt.Errorf("admin bind can't be empty"))
+		}
+
+		for _, id := range sortedKeys(mainOpts.Entries) {
+			if bind := mainOpts.Entries[id].Bind; bind == mainOpts.Admin.Bind {
+				errs = append(errs, fmt.Errorf("admin bind '%s' is used by entry '%s'", bind, id))
+			}
+		}
+
+		auth := mainOpts.Admin.BasicAuth
+		if (auth.Username == "") != (auth.Password == "") {
+			errs = append(errs, fmt.Errorf("admin basic_auth username and password must be set together"))
+		}
+	}
+
+	metricLabels := []string{"entry", "method", "path", "statusCode"}
+	for _, label := range mainOpts.Metrics.Prometheus.Labels {
+		if err := validateMetricLabel(label, metricLabels); err != nil {
+			errs = append(errs, err)
 		}
+		metricLabels = append(metricLabels, label.Name)
+	}
 
-		if opts.Template == "" {
-			return fmt.Errorf("access log '%s' template can't be empty", id)
+	for _, id := range sortedKeys(mainOpts.AccessLogs) {
+		if err := validateAccessLog(id, mainOpts.AccessLogs[id]); err != nil {
+			errs = append(errs, err)
 		}
+	}
+
+	for _, id := range sortedKeys(mainOpts.Entries) {
+		if err := validateEntry(mainOpts, id, mainOpts.Entries[id]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, routeID := range sortedKeys(mainOpts.Routes) {
+		if err := validateRoute(mainOpts, routeID, mainOpts.Routes[routeID]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, serviceID := range sortedKeys(mainOpts.Services) {
+		if err := validateService(mainOpts, serviceID, mainOpts.Services[serviceID]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, upstreamID := range sortedKeys(mainOpts.Upstreams) {
+		if err := validateUpstream(upstreamID, mainOpts.Upstreams[upstreamID]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateMetricLabel(label config.MetricLabelOptions, metricLabels []string) error {
+	if !metricLabelNameRegexp.MatchString(label.Name) {
+		return fmt.Errorf("metrics label name '%s' is invalid", label.Name)
+	}
+
+	if slices.Contains(metricLabels, label.Name) {
+		return fmt.Errorf("metrics label '%s' is duplicate", label.Name)
+	}
+
+	if len(label.Variable) == 0 {
+		return fmt.Errorf("metrics label '%s' variable can't be empty", label.Name)
+	}
 
-		if len(opts.TimeFormat) > 0 {
-			_, err := time.Parse(opts.TimeFormat, time.Now().Format(opts.TimeFormat))
-			if err != nil {
-				return fmt.Errorf("access log '%s' time format is invalid", id)
+	// the allow-list caps the cardinality of the label
+	if len(label.Values) == 0 {
+		return fmt.Errorf("metrics label '%s' values can't be empty", label.Name)
+	}
+
+	return nil
+}
+
+func validateAccessLog(id string, opts config.AccessLogOptions) error {
+	if !opts.Enabled {
+		return nil
+	}
+
+	if opts.Template == "" {
+		return fmt.Errorf("access log '%s' template can't be empty", id)
+	}
+
+	switch opts.Format {
+	case config.TextAccessLogFormat, config.JSONAccessLogFormat, "":
+	default:
+		return fmt.Errorf("access log '%s' format '%s' is invalid", id, opts.Format)
+	}
+
+	if len(opts.TimeFormat) > 0 {
+		_, err := time.Parse(opts.TimeFormat, time.Now().Format(opts.TimeFormat))
+		if err != nil {
+			return fmt.Errorf("access log '%s' time format is invalid", id)
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns the ids of the options in order, so the errors are always reported in the same order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// validateEntry validates an entry, the services and upstreams it references must exist
+func validateEntry(mainOpts config.Options, id string, opts config.EntryOptions) error {
+	if opts.Bind == "" {
+		return fmt.Errorf("entry '%s' bind can't be empty", id)
+	}
+
+	if opts.MaxHeaderLineSize < 0 || opts.MaxHeaderTotalSize < 0 || opts.MaxHeaderCount < 0 {
+		return fmt.Errorf("entry '%s' header limits can't be negative", id)
+	}
+
+	if opts.TLS.ACME.Enabled {
+		if !opts.TLS.Enabled {
+			return fmt.Errorf("entry '%s' acme requires tls to be enabled", id)
+		}
+
+		if len(opts.TLS.ACME.Hosts) == 0 {
+			return fmt.Errorf("entry '%s' acme hosts can't be empty", id)
+		}
+	}
+
+	if len(opts.TLS.SNI.Routes) > 0 || opts.TLS.SNI.RejectUnknown {
+		if !opts.TLS.Enabled {
+			return fmt.Errorf("entry '%s' sni requires tls to be enabled", id)
+		}
+
+		if len(opts.TLS.SNI.Routes) == 0 {
+			return fmt.Errorf("entry '%s' sni routes can't be empty when reject_unknown is enabled", id)
+		}
+
+		for serverName, serviceID := range opts.TLS.SNI.Routes {
+			if len(serverName) == 0 || strings.ContainsAny(serverName, "/: ") {
+				return fmt.Errorf("entry '%s' sni server name '%s' is invalid", id, serverName)
+			}
+
+			if _, found := mainOpts.Services[serviceID]; !found {
+				return fmt.Errorf("entry '%s' sni service '%s' was not found", id, serviceID)
 			}
 		}
 	}
 
-	for id, opts := range mainOpts.Entries {
-		if opts.Bind == "" {
-			return fmt.Errorf("entry '%s' bind can't be empty", id)
+	if opts.TLS.ClientAuth.Enabled {
+		if !opts.TLS.Enabled {
+			return fmt.Errorf("entry '%s' client_auth requires tls to be enabled", id)
+		}
+
+		if len(opts.TLS.ClientAuth.CAPEM) == 0 {
+			return fmt.Errorf("entry '%s' client_auth ca_pem can't be empty", id)
 		}
 	}
 
-	for routeID, route := range mainOpts.Routes {
-		for _, entry := range route.Entries {
-			if _, found := mainOpts.Entries[entry]; !found {
-				return fmt.Errorf("entry '%s' is invalid in '%s' route section", entry, routeID)
+	if opts.ProxyProtocol && len(opts.ProxyProtocolTrustedCIDRs) == 0 {
+		return fmt.Errorf("entry '%s' proxy_protocol_trusted_cidrs can't be empty when proxy_protocol is enabled", id)
+	}
+
+	if _, err := parseCIDRs("proxy_protocol_trusted_cidrs", opts.ProxyProtocolTrustedCIDRs); err != nil {
+		return fmt.Errorf("entry '%s' %w", id, err)
+	}
+
+	if _, err := parseTrustedProxies(opts.TrustedProxies); err != nil {
+		return fmt.Errorf("entry '%s' %w", id, err)
+	}
+
+	switch opts.Protocol {
+	case config.ProtocolHTTP, "":
+	case config.ProtocolTCP:
+		if opts.ProxyProtocol {
+			return fmt.Errorf("entry '%s' proxy_protocol is not supported by tcp protocol", id)
+		}
+
+		if opts.Probes.Enabled {
+			return fmt.Errorf("entry '%s' probes are not supported by tcp protocol", id)
+		}
+
+		if len(opts.TrustedProxies) > 0 {
+			return fmt.Errorf("entry '%s' trusted_proxies are not supported by tcp protocol", id)
+		}
+
+		if opts.UpstreamID == "" {
+			return fmt.Errorf("entry '%s' upstream_id can't be empty", id)
+		}
+
+		if _, found := mainOpts.Upstreams[opts.UpstreamID]; !found {
+			return fmt.Errorf("upstream '%s' was not found in entry '%s'", opts.UpstreamID, id)
+		}
+
+		if opts.TLS.Enabled || opts.HTTP2 {
+			return fmt.Errorf("entry '%s' tls and http2 are not supported by tcp protocol", id)
+		}
+	default:
+		return fmt.Errorf("entry '%s' protocol '%s' is invalid", id, opts.Protocol)
+	}
+
+	return nil
+}
+
+// validateRoute validates a route, the entries it references must exist
+func validateRoute(mainOpts config.Options, routeID string, route config.RouteOptions) error {
+	for _, entry := range route.Entries {
+		entryOpts, found := mainOpts.Entries[entry]
+		if !found {
+			return fmt.Errorf("entry '%s' is invalid in '%s' route section", entry, routeID)
+		}
+
+		if entryOpts.Protocol == config.ProtocolTCP {
+			return fmt.Errorf("tcp entry '%s' can't be used in '%s' route section", entry, routeID)
+		}
+	}
+
+	if route.RateLimitCost < 0 {
+		return fmt.Errorf("rate_limit_cost can't be negative in '%s' route section", routeID)
+	}
+
+	return nil
+}
+
+// validateService validates a service, the upstreams it references must exist
+func validateService(mainOpts config.Options, serviceID string, opts config.ServiceOptions) error {
+	if opts.Retries < 0 {
+		return fmt.Errorf("service '%s' retries can't be negative", serviceID)
+	}
+
+	if _, err := parseRetryOn(opts.RetryOn); err != nil {
+		return fmt.Errorf("service '%s' %w", serviceID, err)
+	}
+
+	if opts.MaxRetryAfter < 0 {
+		return fmt.Errorf("service '%s' max_retry_after can't be negative", serviceID)
+	}
+
+	if opts.MaxBufferedBodySize < 0 {
+		return fmt.Errorf("service '%s' max_buffered_body_size can't be negative", serviceID)
+	}
+
+	if err := validateErrorResponse(opts.ErrorResponse); err != nil {
+		return fmt.Errorf("service '%s' %w", serviceID, err)
+	}
+
+	if status := opts.NoLiveUpstream.Status; status != 0 && (status < 400 || status > 599) {
+		return fmt.Errorf("service '%s' no_live_upstream status '%d' must be between 400 and 599", serviceID, status)
+	}
+
+	if opts.NoLiveUpstream.RetryAfter < 0 {
+		return fmt.Errorf("service '%s' no_live_upstream retry_after can't be negative", serviceID)
+	}
+
+	if opts.SlowRequestThreshold < 0 {
+		return fmt.Errorf("service '%s' slow_request_threshold can't be negative", serviceID)
+	}
+
+	if opts.MaxIdleConnDuration < 0 {
+		return fmt.Errorf("service '%s' max_idle_conn_duration can't be negative", serviceID)
+	}
+
+	if len(opts.MethodOverride) > 0 {
+		method := strings.ToUpper(opts.MethodOverride)
+		if !isValidHTTPMethod(method) || method == "CONNECT" {
+			return fmt.Errorf("service '%s' method_override '%s' is invalid", serviceID, opts.MethodOverride)
+		}
+	}
+
+	switch opts.ResponseBuffering {
+	case "", config.ResponseBufferingOn, config.ResponseBufferingOff:
+	default:
+		return fmt.Errorf("service '%s' response_buffering '%s' is invalid", serviceID, opts.ResponseBuffering)
+	}
+
+	if opts.Streaming && opts.ResponseBuffering == config.ResponseBufferingOn {
+		return fmt.Errorf("service '%s' response_buffering on can't be used with streaming", serviceID)
+	}
+
+	if isStreaming(opts) && opts.Coalesce.Enabled {
+		return fmt.Errorf("service '%s' coalesce can't be used with streaming", serviceID)
+	}
+
+	if opts.MaxResponseBodySize < 0 {
+		return fmt.Errorf("service '%s' max_response_body_size can't be negative", serviceID)
+	}
+
+	if opts.Timeout.WebSocketIdle < 0 {
+		return fmt.Errorf("service '%s' timeout websocket_idle can't be negative", serviceID)
+	}
+
+	if opts.Timeout.WebSocketPing < 0 {
+		return fmt.Errorf("service '%s' timeout websocket_ping can't be negative", serviceID)
+	}
+
+	// the pong of the client keeps the tunnel open, so it must come back before the idle timeout
+	if opts.Timeout.WebSocketPing > 0 && opts.Timeout.WebSocketIdle > 0 && opts.Timeout.WebSocketPing >= opts.Timeout.WebSocketIdle {
+		return fmt.Errorf("service '%s' timeout websocket_ping must be shorter than websocket_idle", serviceID)
+	}
+
+	if opts.PreserveHost != nil && *opts.PreserveHost && len(opts.UpstreamHost) > 0 {
+		return fmt.Errorf("service '%s' preserve_host and upstream_host can't be used together", serviceID)
+	}
+
+	for from, to := range opts.StatusMap {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return fmt.Errorf("service '%s' status_map '%d: %d' is invalid", serviceID, from, to)
+		}
+	}
+
+	switch opts.ForwardedHeaders {
+	case "", config.ForwardedHeadersAppend, config.ForwardedHeadersOverwrite, config.ForwardedHeadersOff:
+	default:
+		return fmt.Errorf("service '%s' forwarded_headers '%s' is invalid", serviceID, opts.ForwardedHeaders)
+	}
+
+	switch opts.ClientIPForwarding {
+	case "", config.ClientIPForwardingAppend, config.ClientIPForwardingReplace, config.ClientIPForwardingOmit, config.ClientIPForwardingAnonymize:
+	default:
+		return fmt.Errorf("service '%s' client_ip_forwarding '%s' is invalid", serviceID, opts.ClientIPForwarding)
+	}
+
+	if _, err := parseTrustedProxies(opts.TrustedProxies); err != nil {
+		return fmt.Errorf("service '%s' %w", serviceID, err)
+	}
+
+	if len(opts.SourceAddr) > 0 {
+		if err := validateSourceAddr(opts.SourceAddr); err != nil {
+			return fmt.Errorf("service '%s' %w", serviceID, err)
+		}
+	}
+
+	switch opts.Protocol {
+	case "", config.ProtocolHTTP:
+	case config.ProtocolHTTP3:
+		// quic always uses tls
+		if !strings.HasPrefix(strings.ToLower(opts.Url), "https://") {
+			return fmt.Errorf("service '%s' protocol http3 requires an https url", serviceID)
+		}
+	case config.ProtocolGRPC:
+		if strings.HasPrefix(strings.ToLower(opts.Url), "unix://") {
+			return fmt.Errorf("service '%s' protocol grpc doesn't support unix socket urls", serviceID)
+		}
+	default:
+		return fmt.Errorf("service '%s' protocol '%s' is invalid", serviceID, opts.Protocol)
+	}
+
+	switch opts.HTTP3Fallback {
+	case "", config.HTTP3FallbackHTTP1, config.HTTP3FallbackHTTP2, config.HTTP3FallbackOff:
+	default:
+		return fmt.Errorf("service '%s' http3_fallback '%s' is invalid", serviceID, opts.HTTP3Fallback)
+	}
+
+	if err := validateProxyProtocol(opts.ProxyProtocol); err != nil {
+		return fmt.Errorf("service '%s' %w", serviceID, err)
+	}
+
+	// the header is sent by the dialer of the http/1.1 client, http3 and grpc have their own clients
+	proxyProtocol := opts.ProxyProtocol != "" && opts.ProxyProtocol != config.ProxyProtocolOff
+	if addr, err := url.Parse(opts.Url); err == nil {
+		if upstream, found := mainOpts.Upstreams[addr.Hostname()]; found && usesProxyProtocol(upstream) {
+			proxyProtocol = true
+		}
+	}
+	if proxyProtocol && (opts.Protocol == config.ProtocolHTTP3 || opts.Protocol == config.ProtocolGRPC) {
+		return fmt.Errorf("service '%s' proxy_protocol isn't supported by protocol %s", serviceID, opts.Protocol)
+	}
+
+	if len(opts.FallbackUpstream) > 0 {
+		if _, found := mainOpts.Upstreams[opts.FallbackUpstream]; !found {
+			return fmt.Errorf("fallback upstream '%s' was not found in service '%s'", opts.FallbackUpstream, serviceID)
+		}
+	}
+
+	if len(opts.Mirror.Upstream) > 0 {
+		if _, found := mainOpts.Upstreams[opts.Mirror.Upstream]; !found {
+			return fmt.Errorf("mirror upstream '%s' was not found in service '%s'", opts.Mirror.Upstream, serviceID)
+		}
+
+		if opts.Mirror.Percentage < 0 || opts.Mirror.Percentage > 100 {
+			return fmt.Errorf("service '%s' mirror percentage must be between 0 and 100", serviceID)
+		}
+	}
+
+	if len(opts.Split.Upstreams) > 0 {
+		addr, err := url.Parse(opts.Url)
+		if err != nil {
+			return fmt.Errorf("service '%s' split requires the url to be an upstream", serviceID)
+		}
+		if _, found := mainOpts.Upstreams[addr.Hostname()]; !found {
+			return fmt.Errorf("service '%s' split requires the url to be an upstream", serviceID)
+		}
+
+		var total float64
+		for _, bucket := range opts.Split.Upstreams {
+			if _, found := mainOpts.Upstreams[bucket.Upstream]; !found {
+				return fmt.Errorf("split upstream '%s' was not found in service '%s'", bucket.Upstream, serviceID)
+			}
+
+			if bucket.Percentage < 0 || bucket.Percentage > 100 {
+				return fmt.Errorf("service '%s' split percentage must be between 0 and 100", serviceID)
 			}
+			total += bucket.Percentage
+		}
+
+		if math.Abs(total-100) > 1e-9 {
+			return fmt.Errorf("service '%s' split percentages must add up to 100", serviceID)
 		}
 	}
 
-	for upstreamID, opts := range mainOpts.Upstreams {
+	return nil
+}
+
+// validateUpstream validates an upstream
+func validateUpstream(upstreamID string, opts config.UpstreamOptions) error {
+	if upstreamID[0] == '$' {
+		return fmt.Errorf("upstream '%s' is invalid.  name can't start with '$", upstreamID)
+	}
+
+	switch opts.Strategy {
+	case config.WeightedStrategy, config.RandomStrategy, config.HashingStrategy, config.RoundRobinStrategy:
+	case "":
+		return fmt.Errorf("upstream '%s' strategy field can't be empty", upstreamID)
+	default:
+		return fmt.Errorf("upstream '%s' strategy field '%s' is invalid", upstreamID, opts.Strategy)
+	}
 
-		if upstreamID[0] == '$' {
-			return fmt.Errorf("upstream '%s' is invalid.  name can't start with '$", upstreamID)
+	if opts.Strategy == config.HashingStrategy && opts.HashOn == "" {
+		return fmt.Errorf("upstream '%s' hash_on field can't be empty", upstreamID)
+	}
+
+	if opts.Debug.SampleRate < 0 || opts.Debug.SampleRate > 1 {
+		return fmt.Errorf("upstream '%s' debug sample_rate must be between 0 and 1", upstreamID)
+	}
+
+	if opts.DNSRefreshInterval < 0 {
+		return fmt.Errorf("upstream '%s' dns_refresh_interval can't be negative", upstreamID)
+	}
+
+	if len(opts.SourceAddr) > 0 {
+		if err := validateSourceAddr(opts.SourceAddr); err != nil {
+			return fmt.Errorf("upstream '%s' %w", upstreamID, err)
 		}
+	}
 
-		switch opts.Strategy {
-		case config.WeightedStrategy, config.RandomStrategy, config.HashingStrategy, config.RoundRobinStrategy:
-		case "":
-			return fmt.Errorf("upstream '%s' strategy field can't be empty", upstreamID)
-		default:
-			return fmt.Errorf("upstream '%s' strategy field '%s' is invalid", upstreamID, opts.Strategy)
+	if err := validateOutlierDetection(opts.OutlierDetection); err != nil {
+		return fmt.Errorf("upstream '%s' %w", upstreamID, err)
+	}
+
+	if err := validateRetryBudget(opts.RetryBudget); err != nil {
+		return fmt.Errorf("upstream '%s' %w", upstreamID, err)
+	}
+
+	if err := validateTLSSessionCache(opts.TLSSessionCache); err != nil {
+		return fmt.Errorf("upstream '%s' %w", upstreamID, err)
+	}
+
+	if err := validateConnPool(opts.MaxIdleConnsPerHost, opts.MaxIdleConnDuration); err != nil {
+		return fmt.Errorf("upstream '%s' %w", upstreamID, err)
+	}
+
+	if err := validateProxyProtocol(opts.ProxyProtocol); err != nil {
+		return fmt.Errorf("upstream '%s' %w", upstreamID, err)
+	}
+
+	totalWeight := 0
+	for _, target := range opts.Targets {
+		if target.Weight < 0 {
+			return fmt.Errorf("upstream '%s' target '%s' weight can't be negative", upstreamID, target.Target)
+		}
+		totalWeight += target.Weight
+
+		if target.PreserveHost != nil && *target.PreserveHost && len(target.UpstreamHost) > 0 {
+			return fmt.Errorf("upstream '%s' target '%s' preserve_host and upstream_host can't be used together", upstreamID, target.Target)
 		}
 
-		if opts.Strategy == config.HashingStrategy && opts.HashOn == "" {
-			return fmt.Errorf("upstream '%s' hash_on field can't be empty", upstreamID)
+		if err := validateConnPool(target.MaxIdleConnsPerHost, target.MaxIdleConnDuration); err != nil {
+			return fmt.Errorf("upstream '%s' target '%s' %w", upstreamID, target.Target, err)
 		}
+
+		if err := validateProxyProtocol(target.ProxyProtocol); err != nil {
+			return fmt.Errorf("upstream '%s' target '%s' %w", upstreamID, target.Target, err)
+		}
+	}
+
+	// a target with weight 0 is drained, at least one target must be left
+	if opts.Strategy == config.WeightedStrategy && len(opts.Targets) > 0 && totalWeight == 0 {
+		return fmt.Errorf("upstream '%s' weight of all targets can't be 0", upstreamID)
 	}
 
 	return nil
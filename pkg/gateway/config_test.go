@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("BIFROST_ORDERS_URL", "http://127.0.0.1:8000")
+	t.Setenv("BIFROST_EMPTY", "")
+
+	cases := map[string]string{
+		"url: ${BIFROST_ORDERS_URL}":                  "url: http://127.0.0.1:8000",
+		"url: ${BIFROST_ORDERS_URL:-http://orders}":   "url: http://127.0.0.1:8000",
+		"url: ${BIFROST_PAYMENTS_URL:-http://orders}": "url: http://orders",
+		"url: ${BIFROST_EMPTY:-http://orders}":        "url: http://orders",
+		"url: ${BIFROST_EMPTY}":                       "url: ",
+		"template: $client_ip $upstream_addr":         "template: $client_ip $upstream_addr",
+		"password: $${BIFROST_ORDERS_URL}":            "password: ${BIFROST_ORDERS_URL}",
+		"password: a$$b$":                             "password: a$b$",
+	}
+
+	for content, expected := range cases {
+		result, err := expandEnv(content)
+		assert.NoError(t, err, content)
+		assert.Equal(t, expected, result)
+	}
+
+	_, err := expandEnv("url: ${BIFROST_PAYMENTS_URL}")
+	assert.ErrorContains(t, err, "environment variable 'BIFROST_PAYMENTS_URL' is not set")
+
+	_, err = expandEnv("url: ${BIFROST-URL}")
+	assert.ErrorContains(t, err, "environment variable '${BIFROST-URL}' is invalid")
+
+	_, err = expandEnv("url: ${BIFROST_ORDERS_URL\nbind: :8001")
+	assert.ErrorContains(t, err, "environment variable '${BIFROST_ORDERS_URL' is not closed")
+}
+
+func TestParseContentWithEnv(t *testing.T) {
+	t.Setenv("BIFROST_BIND", "127.0.0.1:8001")
+
+	opts, err := parseContent(`
+entries:
+  http:
+    bind: ${BIFROST_BIND}
+services:
+  orders:
+    url: ${BIFROST_ORDERS_URL:-http://127.0.0.1:8000}
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8001", opts.Entries["http"].Bind)
+	assert.Equal(t, "http://127.0.0.1:8000", opts.Services["orders"].Url)
+
+	_, err = mergeOptions(opts, `
+upstreams:
+  orders:
+    targets:
+      - target: ${BIFROST_ORDERS_TARGET}
+`)
+	assert.ErrorContains(t, err, "environment variable 'BIFROST_ORDERS_TARGET' is not set")
+}
@@ -3,14 +3,22 @@ package gateway
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	errs "github.com/cloudwego/hertz/pkg/common/errors"
 	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/cloudwego/hertz/pkg/network/netpoll"
 	"github.com/cloudwego/hertz/pkg/network/standard"
+	cwnetpoll "github.com/cloudwego/netpoll"
 	"github.com/rs/dnscache"
 )
 
@@ -20,34 +28,31 @@ type httpDialer struct {
 	random   *rand.Rand
 }
 
-func newHTTPDialer(resolver dnscache.DNSResolver) network.Dialer {
+func newHTTPDialer(resolver dnscache.DNSResolver, dialer network.Dialer) network.Dialer {
+	if dialer == nil {
+		dialer = netpoll.NewDialer()
+	}
+
 	return &httpDialer{
-		dialer:   netpoll.NewDialer(),
+		dialer:   dialer,
 		resolver: resolver,
 		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 func (d *httpDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (conn network.Conn, err error) {
-	if d.resolver != nil {
-		host, port, err := net.SplitHostPort(address)
-		if err != nil {
-			return nil, err
-		}
-
-		ips, err := d.resolver.LookupHost(context.Background(), host)
-		if err != nil {
-			return nil, err
-		}
-
-		randomIndex := d.random.Intn(len(ips))
-		address = net.JoinHostPort(ips[randomIndex], port)
-		slog.Debug("http dns resolver info", "host", host, "ip", address)
+	address, err = d.resolve(address)
+	if err != nil {
+		return nil, err
 	}
 
 	return d.dialer.DialConnection(n, address, timeout, tlsConfig)
 }
 
+func (d *httpDialer) resolve(address string) (string, error) {
+	return resolveAddress(d.resolver, d.random, address, "http")
+}
+
 func (d *httpDialer) DialTimeout(network, address string, timeout time.Duration, tlsConfig *tls.Config) (conn net.Conn, err error) {
 	return d.dialer.DialConnection(network, address, timeout, tlsConfig)
 }
@@ -62,38 +67,525 @@ type httpsDialer struct {
 	random   *rand.Rand
 }
 
-func newHTTPSDialer(resolver dnscache.DNSResolver) network.Dialer {
+func newHTTPSDialer(resolver dnscache.DNSResolver, dialer network.Dialer) network.Dialer {
+	if dialer == nil {
+		dialer = standard.NewDialer()
+	}
+
 	return &httpsDialer{
-		dialer:   standard.NewDialer(),
+		dialer:   dialer,
 		resolver: resolver,
 		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 func (d *httpsDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (conn network.Conn, err error) {
-	if d.resolver != nil {
-		host, port, err := net.SplitHostPort(address)
+	address, err = d.resolve(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.dialer.DialConnection(n, address, timeout, tlsConfig)
+}
+
+func (d *httpsDialer) resolve(address string) (string, error) {
+	return resolveAddress(d.resolver, d.random, address, "https")
+}
+
+// addressResolver is implemented by the dialers which look up the host of the target before dialing,
+// so the dns time of a new connection is measured apart from the connect time
+type addressResolver interface {
+	resolve(address string) (string, error)
+}
+
+// resolveAddress replaces the host of the address with one of its ips, the address is kept when it is an ip
+func resolveAddress(resolver dnscache.DNSResolver, random *rand.Rand, address string, scheme string) (string, error) {
+	if resolver == nil {
+		return address, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+
+	ips, err := resolver.LookupHost(context.Background(), host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			err = &net.DNSError{Err: err.Error(), Name: host}
+		}
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	randomIndex := random.Intn(len(ips))
+	address = net.JoinHostPort(ips[randomIndex], port)
+	slog.Debug(scheme+" dns resolver info", "host", host, "ip", address)
+	return address, nil
+}
+
+func (d *httpsDialer) DialTimeout(network, address string, timeout time.Duration, tlsConfig *tls.Config) (conn net.Conn, err error) {
+	return d.dialer.DialConnection(network, address, timeout, tlsConfig)
+}
+
+func (d *httpsDialer) AddTLS(conn network.Conn, tlsConfig *tls.Config) (network.Conn, error) {
+	return d.dialer.AddTLS(conn, tlsConfig)
+}
+
+// dialTimeoutDialer reports a dial which fails after the dial timeout as a timeout. The netpoll dialer returns an
+// i/o timeout error which isn't a net.Error, so a dial timeout can't be told apart from a refused connection.
+// It also measures the dns, connect and tls handshake time of the new connections for wrapConn.
+type dialTimeoutDialer struct {
+	network.Dialer
+
+	// wrapConn replaces the new connections and keeps their timing, see trackedConn
+	wrapConn func(conn network.Conn, timing dialTiming) network.Conn
+}
+
+// dialTiming is the time spent by the phases of a new connection
+type dialTiming struct {
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+}
+
+// dialTimeoutError is a net.Error whose Timeout is true
+type dialTimeoutError struct {
+	err error
+}
+
+func (e *dialTimeoutError) Error() string   { return e.err.Error() }
+func (e *dialTimeoutError) Unwrap() error   { return e.err }
+func (e *dialTimeoutError) Timeout() bool   { return true }
+func (e *dialTimeoutError) Temporary() bool { return true }
+
+func (d *dialTimeoutDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (network.Conn, error) {
+	start := time.Now()
+	timing := dialTiming{}
+
+	if resolver, ok := d.Dialer.(addressResolver); ok {
+		resolved, err := resolver.resolve(address)
 		if err != nil {
 			return nil, err
 		}
+		address = resolved
+		timing.dns = time.Since(start)
+	}
+
+	connectStart := time.Now()
+	conn, err := d.Dialer.DialConnection(n, address, timeout, tlsConfig)
+	if err != nil && timeout > 0 && time.Since(start) >= timeout {
+		return nil, &dialTimeoutError{err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	timing.connect = time.Since(connectStart)
+
+	// the standard dialer defers the handshake to the first write, it is done here so it can be measured
+	if tlsConn, ok := conn.(network.ConnTLSer); ok && tlsConfig != nil && !tlsConn.ConnectionState().HandshakeComplete {
+		handshakeStart := time.Now()
+		if timeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(timeout))
+		}
+
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			if timeout > 0 && time.Since(start) >= timeout {
+				return nil, &dialTimeoutError{err: err}
+			}
+			return nil, err
+		}
+
+		_ = conn.SetDeadline(time.Time{})
+		timing.tls = time.Since(handshakeStart)
+	}
+
+	if d.wrapConn != nil {
+		conn = d.wrapConn(conn, timing)
+	}
+	return conn, nil
+}
+
+func (d *dialTimeoutDialer) DialTimeout(n, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.Dialer.DialTimeout(n, address, timeout, tlsConfig)
+	if err != nil && timeout > 0 && time.Since(start) >= timeout {
+		return nil, &dialTimeoutError{err: err}
+	}
+	return conn, err
+}
+
+// errConnAbandoned is returned by the reads of an upstream connection whose response body was abandoned, the
+// client closes the connection instead of reading the rest of the body and putting it back to the pool
+var errConnAbandoned = errors.New("upstream connection is abandoned")
+
+// trackedAddr is the remote address of a tracked connection. The connections of a target share the same remote
+// address, so it tells them apart by its pointer. It keeps the timing of the dial until the first response of the
+// connection takes it, the timing is dropped with the connection when no response does.
+type trackedAddr struct {
+	net.Addr
+	timing atomic.Pointer[dialTiming]
+}
+
+// trackedConn calls onClose once when the connection is closed, onClose may be nil. The hertz errors and the tls
+// state of the wrapped connection stay visible to the client.
+// The reads and the writes of a closed connection fail with ErrConnectionClosed rather than touching the released
+// buffers of the wrapped connection. The reads of an abandoned connection fail until the client sets the read
+// timeout of the next request, see abandon.
+type trackedConn struct {
+	network.Conn
+	addr      *trackedAddr
+	onClose   func()
+	closeOnce sync.Once
+	closed    atomic.Bool
+	abandoned atomic.Bool
+}
+
+type trackedTLSConn struct {
+	*trackedConn
+	tlsConn network.ConnTLSer
+}
+
+func newTrackedConn(conn network.Conn, timing dialTiming, onClose func()) network.Conn {
+	tracked := &trackedConn{Conn: conn, onClose: onClose}
+	if addr := conn.RemoteAddr(); addr != nil {
+		tracked.addr = &trackedAddr{Addr: addr}
+		tracked.addr.timing.Store(&timing)
+	}
+
+	if tlsConn, ok := conn.(network.ConnTLSer); ok {
+		return &trackedTLSConn{trackedConn: tracked, tlsConn: tlsConn}
+	}
+	return tracked
+}
+
+func (c *trackedConn) Close() error {
+	c.closed.Store(true)
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	if c.addr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.addr
+}
+
+// abandon makes the client close the connection when it releases a response body which isn't read to the end, the
+// reads of the rest of the body fail. A body which was read to the end doesn't need a read, so its connection is put
+// back to the pool and the next request resets the mark by setting the read timeout.
+func (c *trackedConn) abandon() {
+	c.abandoned.Store(true)
+}
+
+func (c *trackedConn) readErr() error {
+	if c.closed.Load() {
+		return errs.ErrConnectionClosed
+	}
+	if c.abandoned.Load() {
+		return errConnAbandoned
+	}
+	return nil
+}
+
+func (c *trackedConn) SetReadTimeout(t time.Duration) error {
+	if c.closed.Load() {
+		return errs.ErrConnectionClosed
+	}
+	c.abandoned.Store(false)
+	return c.Conn.SetReadTimeout(t)
+}
+
+func (c *trackedConn) SetWriteTimeout(t time.Duration) error {
+	if c.closed.Load() {
+		return errs.ErrConnectionClosed
+	}
+	return c.Conn.SetWriteTimeout(t)
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	if err := c.readErr(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
 
-		ips, err := d.resolver.LookupHost(context.Background(), host)
+func (c *trackedConn) Peek(n int) ([]byte, error) {
+	if err := c.readErr(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Peek(n)
+}
+
+func (c *trackedConn) Skip(n int) error {
+	if err := c.readErr(); err != nil {
+		return err
+	}
+	return c.Conn.Skip(n)
+}
+
+func (c *trackedConn) Release() error {
+	if c.closed.Load() {
+		return nil
+	}
+	return c.Conn.Release()
+}
+
+func (c *trackedConn) Len() int {
+	if c.readErr() != nil {
+		return 0
+	}
+	return c.Conn.Len()
+}
+
+func (c *trackedConn) ReadByte() (byte, error) {
+	if err := c.readErr(); err != nil {
+		return 0, err
+	}
+	return c.Conn.ReadByte()
+}
+
+func (c *trackedConn) ReadBinary(n int) ([]byte, error) {
+	if err := c.readErr(); err != nil {
+		return nil, err
+	}
+	return c.Conn.ReadBinary(n)
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, errs.ErrConnectionClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *trackedConn) Malloc(n int) ([]byte, error) {
+	if c.closed.Load() {
+		return nil, errs.ErrConnectionClosed
+	}
+	return c.Conn.Malloc(n)
+}
+
+func (c *trackedConn) WriteBinary(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, errs.ErrConnectionClosed
+	}
+	return c.Conn.WriteBinary(b)
+}
+
+func (c *trackedConn) Flush() error {
+	if c.closed.Load() {
+		return errs.ErrConnectionClosed
+	}
+	return c.Conn.Flush()
+}
+
+func (c *trackedConn) ToHertzError(err error) error {
+	if errNorm, ok := c.Conn.(network.ErrorNormalization); ok {
+		return errNorm.ToHertzError(err)
+	}
+	return err
+}
+
+func (c *trackedTLSConn) Handshake() error {
+	return c.tlsConn.Handshake()
+}
+
+func (c *trackedTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// unixDialer dials the unix domain socket of the target, the address of the request is ignored
+type unixDialer struct {
+	dialer     network.Dialer
+	tlsDialer  network.Dialer
+	socketPath string
+}
+
+func newUnixDialer(socketPath string) network.Dialer {
+	return &unixDialer{
+		dialer:     netpoll.NewDialer(),
+		tlsDialer:  standard.NewDialer(),
+		socketPath: socketPath,
+	}
+}
+
+func (d *unixDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (conn network.Conn, err error) {
+	if tlsConfig != nil {
+		return d.tlsDialer.DialConnection("unix", d.socketPath, timeout, tlsConfig)
+	}
+	return d.dialer.DialConnection("unix", d.socketPath, timeout, nil)
+}
+
+func (d *unixDialer) DialTimeout(n, address string, timeout time.Duration, tlsConfig *tls.Config) (conn net.Conn, err error) {
+	return d.DialConnection(n, address, timeout, tlsConfig)
+}
+
+func (d *unixDialer) AddTLS(conn network.Conn, tlsConfig *tls.Config) (network.Conn, error) {
+	return d.tlsDialer.AddTLS(conn, tlsConfig)
+}
+
+// sourceDialer binds the local address of the upstream connections to sourceIP, for example to pick the egress
+// interface of a multi-homed host. Plaintext connections are netpoll connections like the default dialer,
+// tls is added by the standard dialer.
+type sourceDialer struct {
+	localAddr *cwnetpoll.TCPAddr
+	tlsDialer network.Dialer
+}
+
+func newSourceDialer(sourceAddr string) (network.Dialer, error) {
+	ip := net.ParseIP(sourceAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("source_addr '%s' is invalid", sourceAddr)
+	}
+
+	return &sourceDialer{
+		localAddr: &cwnetpoll.TCPAddr{TCPAddr: net.TCPAddr{IP: ip}},
+		tlsDialer: standard.NewDialer(),
+	}, nil
+}
+
+// validateSourceAddr checks that the source address is an ip of the host, binding fails otherwise
+func validateSourceAddr(sourceAddr string) error {
+	if net.ParseIP(sourceAddr) == nil {
+		return fmt.Errorf("source_addr '%s' is invalid", sourceAddr)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(sourceAddr, "0"))
+	if err != nil {
+		return fmt.Errorf("source_addr '%s' is not assignable: %w", sourceAddr, err)
+	}
+	_ = l.Close()
+	return nil
+}
+
+func (d *sourceDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (network.Conn, error) {
+	remoteAddr, err := cwnetpoll.ResolveTCPAddr(n, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	c, err := cwnetpoll.DialTCP(ctx, n, d.localAddr, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn network.Conn = &sourceConn{Conn: c}
+	if tlsConfig != nil {
+		conn, err = d.tlsDialer.AddTLS(conn, tlsConfig)
 		if err != nil {
+			_ = c.Close()
 			return nil, err
 		}
+	}
+	return conn, nil
+}
 
-		randomIndex := d.random.Intn(len(ips))
-		address = net.JoinHostPort(ips[randomIndex], port)
-		slog.Debug("https dns resolver info", "host", host, "ip", address)
+func (d *sourceDialer) DialTimeout(n, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: &d.localAddr.TCPAddr,
 	}
 
-	return d.dialer.DialConnection(n, address, timeout, tlsConfig)
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, n, address, tlsConfig)
+	}
+	return dialer.Dial(n, address)
 }
 
-func (d *httpsDialer) DialTimeout(network, address string, timeout time.Duration, tlsConfig *tls.Config) (conn net.Conn, err error) {
-	return d.dialer.DialConnection(network, address, timeout, tlsConfig)
+func (d *sourceDialer) AddTLS(conn network.Conn, tlsConfig *tls.Config) (network.Conn, error) {
+	return d.tlsDialer.AddTLS(conn, tlsConfig)
 }
 
-func (d *httpsDialer) AddTLS(conn network.Conn, tlsConfig *tls.Config) (network.Conn, error) {
-	return d.dialer.AddTLS(conn, tlsConfig)
+// sourceConn reports the errors of the netpoll connection the way the client of hertz expects them,
+// the same as the connection of the netpoll dialer of hertz. Deadlines are mapped to the timeouts of netpoll
+// because tls sets them on the underlying connection.
+type sourceConn struct {
+	network.Conn
+}
+
+func (c *sourceConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *sourceConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadTimeout(deadlineToTimeout(t))
+}
+
+func (c *sourceConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteTimeout(deadlineToTimeout(t))
+}
+
+// deadlineToTimeout converts a deadline to a timeout, zero means no timeout for both
+func deadlineToTimeout(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+
+	timeout := time.Until(t)
+	if timeout <= 0 {
+		// already expired, use the smallest timeout instead of none
+		return time.Nanosecond
+	}
+	return timeout
+}
+
+func (c *sourceConn) ToHertzError(err error) error {
+	if errors.Is(err, cwnetpoll.ErrConnClosed) || errors.Is(err, syscall.EPIPE) {
+		return errs.ErrConnectionClosed
+	}
+
+	if errors.Is(err, cwnetpoll.ErrReadTimeout) {
+		return errs.ErrTimeout
+	}
+	return err
+}
+
+func (c *sourceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	return n, normalizeNetpollErr(err)
+}
+
+func (c *sourceConn) Peek(n int) ([]byte, error) {
+	b, err := c.Conn.Peek(n)
+	return b, normalizeNetpollErr(err)
+}
+
+func (c *sourceConn) ReadByte() (byte, error) {
+	b, err := c.Conn.ReadByte()
+	return b, normalizeNetpollErr(err)
+}
+
+func (c *sourceConn) ReadBinary(n int) ([]byte, error) {
+	b, err := c.Conn.ReadBinary(n)
+	return b, normalizeNetpollErr(err)
+}
+
+func normalizeNetpollErr(err error) error {
+	if errors.Is(err, cwnetpoll.ErrEOF) {
+		return io.EOF
+	}
+	return err
 }
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"http-benchmark/pkg/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceAddr(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9941"))
+	backend.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		host, _, _ := net.SplitHostPort(ctx.RemoteAddr().String())
+		ctx.String(200, host)
+	})
+	go backend.Spin()
+	time.Sleep(time.Second)
+
+	t.Run("dialer binds the local address", func(t *testing.T) {
+		dialer, err := newSourceDialer("127.0.0.2")
+		assert.NoError(t, err)
+
+		conn, err := dialer.DialConnection("tcp", "127.0.0.1:9941", time.Second, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.2", host)
+	})
+
+	t.Run("dialer binds the local address over tls", func(t *testing.T) {
+		tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			_, _ = w.Write([]byte(host))
+		}))
+		defer tlsBackend.Close()
+
+		dialer, err := newSourceDialer("127.0.0.2")
+		assert.NoError(t, err)
+
+		c, err := client.NewClient(client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}), client.WithDialer(dialer))
+		assert.NoError(t, err)
+
+		statusCode, body, err := c.Get(context.Background(), nil, tlsBackend.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, statusCode)
+		assert.Equal(t, "127.0.0.2", string(body))
+	})
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"default": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9941"}},
+				},
+				"egress": {
+					Strategy:   config.RoundRobinStrategy,
+					Targets:    []config.TargetOptions{{Target: "127.0.0.1:9941"}},
+					SourceAddr: "127.0.0.3",
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{name: "direct proxy", url: "http://127.0.0.1:9941", expected: "127.0.0.2"},
+		{name: "upstream", url: "http://default", expected: "127.0.0.2"},
+		{name: "upstream overrides the service", url: "http://egress", expected: "127.0.0.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, err := newService(bifrost, config.ServiceOptions{
+				ID:         "source_addr",
+				Url:        tt.url,
+				SourceAddr: "127.0.0.2",
+			})
+			assert.NoError(t, err)
+
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/")
+			service.ServeHTTP(context.Background(), hzCtx)
+
+			assert.Equal(t, 200, hzCtx.Response.StatusCode())
+			assert.Equal(t, tt.expected, string(hzCtx.Response.Body()))
+		})
+	}
+
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":9955"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"all": {Url: "http://127.0.0.1:9941", SourceAddr: "eth0"},
+		},
+	}
+	err := validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' source_addr 'eth0' is invalid")
+
+	// TEST-NET-1 isn't assigned to any interface of the host
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9941", SourceAddr: "192.0.2.1"}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' source_addr '192.0.2.1' is not assignable")
+
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9941", SourceAddr: "127.0.0.2"}
+	err = validateOptions(opts)
+	assert.NoError(t, err)
+}
+
+func TestUpstreamTimings(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	seconds := func(ctx *app.RequestContext, key string) float64 {
+		val, err := strconv.ParseFloat(ctx.GetString(key), 64)
+		assert.NoError(t, err, key)
+		return val
+	}
+
+	serve := func(proxy *Proxy) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		proxy.ServeHTTP(context.Background(), ctx)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		return ctx
+	}
+
+	t.Run("new and reused connection", func(t *testing.T) {
+		backend := httptest.NewServer(handler)
+		defer backend.Close()
+
+		_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+		resolver := &fakeResolver{ips: []string{"127.0.0.1"}, delay: 10 * time.Millisecond}
+
+		proxy, err := newProxy("http://orders.test:"+port, false, 1, client.WithDialer(newHTTPDialer(resolver, nil)))
+		assert.NoError(t, err)
+
+		ctx := serve(proxy)
+		assert.GreaterOrEqual(t, seconds(ctx, config.UPSTREAM_DNS_TIME), 0.01)
+		assert.Greater(t, seconds(ctx, config.UPSTREAM_CONNECT_TIME), 0.0)
+		assert.Equal(t, "0", ctx.GetString(config.UPSTREAM_TLS_TIME))
+		assert.GreaterOrEqual(t, seconds(ctx, config.UPSTREAM_TTFB), 0.02)
+
+		// the connection is reused from the pool
+		ctx = serve(proxy)
+		assert.Equal(t, "0", ctx.GetString(config.UPSTREAM_DNS_TIME))
+		assert.Equal(t, "0", ctx.GetString(config.UPSTREAM_CONNECT_TIME))
+		assert.GreaterOrEqual(t, seconds(ctx, config.UPSTREAM_TTFB), 0.02)
+	})
+
+	t.Run("tls handshake", func(t *testing.T) {
+		backend := httptest.NewTLSServer(handler)
+		defer backend.Close()
+
+		proxy, err := newProxy(backend.URL, false, 1, client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+		assert.NoError(t, err)
+
+		ctx := serve(proxy)
+		assert.Equal(t, "0", ctx.GetString(config.UPSTREAM_DNS_TIME))
+		assert.Greater(t, seconds(ctx, config.UPSTREAM_TLS_TIME), 0.0)
+
+		ctx = serve(proxy)
+		assert.Equal(t, "0", ctx.GetString(config.UPSTREAM_TLS_TIME))
+	})
+}
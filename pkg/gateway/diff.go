@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"reflect"
+	"slices"
+)
+
+// ConfigDiff is what a reload changed, the ids of the added, removed and modified items of every section
+type ConfigDiff struct {
+	Entries     DiffSet `json:"entries"`
+	Routes      DiffSet `json:"routes"`
+	Middlewares DiffSet `json:"middlewares"`
+	Services    DiffSet `json:"services"`
+	Upstreams   DiffSet `json:"upstreams"`
+}
+
+type DiffSet struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// diffOptions compares the items of every section by id, an item is modified when any of its options is changed
+func diffOptions(oldOpts, newOpts config.Options) ConfigDiff {
+	return ConfigDiff{
+		Entries:     diffMap(oldOpts.Entries, newOpts.Entries),
+		Routes:      diffMap(oldOpts.Routes, newOpts.Routes),
+		Middlewares: diffMap(oldOpts.Middlewares, newOpts.Middlewares),
+		Services:    diffMap(oldOpts.Services, newOpts.Services),
+		Upstreams:   diffMap(oldOpts.Upstreams, newOpts.Upstreams),
+	}
+}
+
+func diffMap[T any](oldItems, newItems map[string]T) DiffSet {
+	set := DiffSet{
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []string{},
+	}
+
+	for id, newItem := range newItems {
+		oldItem, found := oldItems[id]
+		if !found {
+			set.Added = append(set.Added, id)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldItem, newItem) {
+			set.Modified = append(set.Modified, id)
+		}
+	}
+
+	for id := range oldItems {
+		if _, found := newItems[id]; !found {
+			set.Removed = append(set.Removed, id)
+		}
+	}
+
+	slices.Sort(set.Added)
+	slices.Sort(set.Removed)
+	slices.Sort(set.Modified)
+	return set
+}
+
+func (d ConfigDiff) IsEmpty() bool {
+	return d.Entries.IsEmpty() && d.Routes.IsEmpty() && d.Middlewares.IsEmpty() && d.Services.IsEmpty() && d.Upstreams.IsEmpty()
+}
+
+func (s DiffSet) IsEmpty() bool {
+	return len(s.Added) == 0 && len(s.Removed) == 0 && len(s.Modified) == 0
+}
+
+// LogValue only logs the changes, unchanged sections are omitted
+func (d ConfigDiff) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, 5)
+
+	sections := []struct {
+		name string
+		set  DiffSet
+	}{
+		{"entries", d.Entries},
+		{"routes", d.Routes},
+		{"middlewares", d.Middlewares},
+		{"services", d.Services},
+		{"upstreams", d.Upstreams},
+	}
+
+	for _, section := range sections {
+		if section.set.IsEmpty() {
+			continue
+		}
+		attrs = append(attrs, slog.Any(section.name, section.set))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+func (s DiffSet) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, 3)
+
+	if len(s.Added) > 0 {
+		attrs = append(attrs, slog.Any("added", s.Added))
+	}
+	if len(s.Removed) > 0 {
+		attrs = append(attrs, slog.Any("removed", s.Removed))
+	}
+	if len(s.Modified) > 0 {
+		attrs = append(attrs, slog.Any("modified", s.Modified))
+	}
+
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"http-benchmark/pkg/config"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffOptions(t *testing.T) {
+	oldOpts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":8001"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"orders": {Paths: []string{"/orders"}, ServiceID: "orders"},
+			"users":  {Paths: []string{"/users"}, ServiceID: "users"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"orders": {Url: "http://orders"},
+			"users":  {Url: "http://127.0.0.1:8000"},
+		},
+		Upstreams: map[string]config.UpstreamOptions{
+			"orders": {Targets: []config.TargetOptions{{Target: "127.0.0.1:8000"}}},
+		},
+	}
+
+	t.Run("no change", func(t *testing.T) {
+		diff := diffOptions(oldOpts, oldOpts)
+		assert.True(t, diff.IsEmpty())
+	})
+
+	t.Run("added, removed and modified", func(t *testing.T) {
+		newOpts := config.Options{
+			Entries: map[string]config.EntryOptions{
+				"http":  {Bind: ":8001"},
+				"https": {Bind: ":8443"},
+			},
+			Routes: map[string]config.RouteOptions{
+				"orders": {Paths: []string{"/orders", "/v2/orders"}, ServiceID: "orders"},
+			},
+			Services: map[string]config.ServiceOptions{
+				"orders": {Url: "http://orders"},
+			},
+			Upstreams: map[string]config.UpstreamOptions{
+				"orders": {Targets: []config.TargetOptions{{Target: "127.0.0.1:8000"}, {Target: "127.0.0.1:8001"}}},
+			},
+		}
+
+		diff := diffOptions(oldOpts, newOpts)
+		assert.False(t, diff.IsEmpty())
+
+		assert.Equal(t, []string{"https"}, diff.Entries.Added)
+		assert.Empty(t, diff.Entries.Removed)
+		assert.Empty(t, diff.Entries.Modified)
+
+		assert.Equal(t, []string{"users"}, diff.Routes.Removed)
+		assert.Equal(t, []string{"orders"}, diff.Routes.Modified)
+
+		assert.Equal(t, []string{"users"}, diff.Services.Removed)
+		assert.Empty(t, diff.Services.Modified)
+
+		assert.Equal(t, []string{"orders"}, diff.Upstreams.Modified)
+		assert.True(t, diff.Middlewares.IsEmpty())
+	})
+
+	t.Run("ids are sorted", func(t *testing.T) {
+		diff := diffOptions(config.Options{}, oldOpts)
+		assert.Equal(t, []string{"orders", "users"}, diff.Services.Added)
+	})
+}
+
+const reloadContent = `
+entries:
+  http:
+    bind: ":9961"
+routes:
+  orders:
+    paths: ["/orders"]
+    service_id: orders
+services:
+  orders:
+    url: http://127.0.0.1:8000
+`
+
+func TestReloadDiff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(reloadContent), 0o600)
+	assert.NoError(t, err)
+
+	bifrost, err := loadFromConfig(path, "", false)
+	assert.NoError(t, err)
+	assert.Nil(t, bifrost.LastReloadDiff())
+
+	err = os.WriteFile(path, []byte(reloadContent+`
+    timeout:
+      request: 3s
+  users:
+    url: http://127.0.0.1:8001
+`), 0o600)
+	assert.NoError(t, err)
+
+	err = reload(bifrost)
+	assert.NoError(t, err)
+
+	diff := bifrost.LastReloadDiff()
+	assert.NotNil(t, diff)
+	assert.Equal(t, []string{"users"}, diff.Services.Added)
+	assert.Equal(t, []string{"orders"}, diff.Services.Modified)
+
+	// the next reload is compared with the applied config
+	err = reload(bifrost)
+	assert.NoError(t, err)
+	assert.True(t, bifrost.LastReloadDiff().IsEmpty())
+	assert.Empty(t, bifrost.Skipped())
+
+	// the skipped options are the ones of the applied config
+	err = os.WriteFile(path, []byte("strict: false\n"+reloadContent+`
+  users:
+    url: http://127.0.0.1:8001
+    retries: -1
+`), 0o600)
+	assert.NoError(t, err)
+
+	err = reload(bifrost)
+	assert.NoError(t, err)
+	if assert.Len(t, bifrost.Skipped(), 1) {
+		assert.Equal(t, "service 'users'", bifrost.Skipped()[0].String())
+	}
+}
@@ -0,0 +1,196 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/client"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/rs/dnscache"
+)
+
+const defaultDNSRefreshInterval = 30 * time.Second
+
+type discoveryTarget struct {
+	host       string
+	port       string
+	weight     int
+	hostHeader string
+
+	proxyProtocol config.ProxyProtocol
+}
+
+// dnsDiscovery resolves dns targets of an upstream periodically and creates one proxy per ip
+type dnsDiscovery struct {
+	upstream       *Upstream
+	resolver       dnscache.DNSResolver
+	scheme         string
+	path           string
+	tlsVerify      bool
+	tracingEnabled bool
+	serviceOpts    config.ServiceOptions
+	clientOpts     []hzconfig.ClientOption
+	sourceDialer   network.Dialer
+	targets        []discoveryTarget
+
+	mu      sync.Mutex
+	proxies map[string]*Proxy
+}
+
+// newDiscoveryResolver bypasses the dns cache, otherwise changes of the record set are only seen after the cache is refreshed
+func newDiscoveryResolver(resolver *dnscache.Resolver) dnscache.DNSResolver {
+	if resolver != nil && resolver.Resolver != nil {
+		return resolver.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// refresh resolves every dns target and swaps the proxies of the upstream when the record set is changed.
+// Proxies of removed ips are only taken out of rotation, in-flight requests are allowed to finish.
+func (d *dnsDiscovery) refresh(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	proxies := make(map[string]*Proxy)
+
+	for _, target := range d.targets {
+		ips, err := d.resolver.LookupHost(ctx, target.host)
+		if err != nil {
+			return fmt.Errorf("lookup upstream host error: %w", err)
+		}
+
+		if len(ips) == 0 {
+			return fmt.Errorf("lookup upstream host error: no ip found for '%s'", target.host)
+		}
+
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, target.port)
+			if target.port == "" {
+				addr = ip
+			}
+
+			if proxy, found := d.proxies[addr]; found {
+				proxies[addr] = proxy
+				continue
+			}
+
+			proxy, err := d.newProxy(target, addr)
+			if err != nil {
+				return err
+			}
+			proxies[addr] = proxy
+		}
+	}
+
+	if d.proxies != nil && sameKeys(d.proxies, proxies) {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(proxies))
+	for addr := range proxies {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+
+	list := make([]*Proxy, 0, len(d.upstream.proxies)+len(proxies))
+	list = append(list, d.upstream.proxies...)
+	for _, addr := range addrs {
+		list = append(list, proxies[addr])
+	}
+
+	d.upstream.current.Store(&list)
+
+	if d.proxies != nil {
+		slog.Info("upstream targets are changed by dns discovery", "upstream", d.upstream.opts.ID, "targets", strings.Join(addrs, ","))
+	}
+
+	d.proxies = proxies
+	return nil
+}
+
+func (d *dnsDiscovery) newProxy(target discoveryTarget, addr string) (*Proxy, error) {
+	clientOpts := slices.Clone(d.clientOpts)
+
+	if d.scheme == "https" {
+		clientOpts = append(clientOpts, client.WithTLSConfig(&tls.Config{
+			ServerName:         target.host,
+			InsecureSkipVerify: !d.tlsVerify,
+			ClientSessionCache: d.upstream.tlsSessionCache,
+		}))
+
+		// the tls config option resets the dialer of the client
+		if d.sourceDialer != nil {
+			clientOpts = append(clientOpts, client.WithDialer(d.sourceDialer))
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", d.scheme, addr, d.path)
+	proxy, err := newProxy(url, d.tracingEnabled, target.weight, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.hostHeader = target.hostHeader
+	proxy.SetErrorHandler(newErrorHandler(d.serviceOpts))
+
+	if d.serviceOpts.Protocol == config.ProtocolHTTP3 {
+		if err := proxy.enableHTTP3(d.serviceOpts, target.host, d.tracingEnabled, clientOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.serviceOpts.Protocol == config.ProtocolGRPC {
+		if err := proxy.enableGRPC(d.serviceOpts, target.host, d.tracingEnabled, clientOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	proxy.enableProxyProtocol(target.proxyProtocol, d.tracingEnabled, clientOpts)
+
+	return proxy, nil
+}
+
+func (d *dnsDiscovery) watch(interval time.Duration, doneCh chan bool) {
+	if interval <= 0 {
+		interval = defaultDNSRefreshInterval
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-t.C:
+				err := d.refresh(context.Background())
+				if err != nil {
+					slog.Error("fail to refresh upstream targets", "upstream", d.upstream.opts.ID, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func sameKeys(a, b map[string]*Proxy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key := range a {
+		if _, found := b[key]; !found {
+			return false
+		}
+	}
+
+	return true
+}
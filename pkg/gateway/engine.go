@@ -8,7 +8,6 @@ import (
 
 	"github.com/cloudwego/hertz/pkg/app"
 	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
-	"github.com/hertz-contrib/obs-opentelemetry/provider"
 	"github.com/hertz-contrib/obs-opentelemetry/tracing"
 )
 
@@ -18,6 +17,8 @@ type Engine struct {
 	handlers        app.HandlersChain
 	middlewares     app.HandlersChain
 	notFoundHandler app.HandlerFunc
+	services        map[string]*Service
+	sni             *sniRouter
 
 	options []hzconfig.Option
 }
@@ -47,17 +48,12 @@ func newEngine(bifrost *Bifrost, entryOpts config.EntryOptions) (*Engine, error)
 		opts:            *bifrost.opts,
 		handlers:        make([]app.HandlerFunc, 0),
 		notFoundHandler: nil,
+		services:        services,
 		options:         make([]hzconfig.Option, 0),
 	}
 
 	// tracing
 	if bifrost.opts.Tracing.Enabled {
-
-		provider.NewOpenTelemetryProvider(
-			provider.WithEnableMetrics(false),
-			provider.WithServiceName("bifrost"),
-		)
-
 		tracer, cfg := tracing.NewServerTracer()
 		engine.options = append(engine.options, tracer)
 		tracingServerMiddleware := tracing.ServerMiddleware(cfg)
@@ -69,9 +65,25 @@ func newEngine(bifrost *Bifrost, entryOpts config.EntryOptions) (*Engine, error)
 	if err != nil {
 		return nil, err
 	}
-	initMiddleware := newInitMiddleware(entryOpts.ID, logger)
+	initMiddleware := newInitMiddleware(entryOpts, logger)
 	engine.Use(initMiddleware.ServeHTTP)
 
+	// acme http-01 challenges
+	if !entryOpts.TLS.Enabled && len(bifrost.acme) > 0 {
+		challenge := newACMEChallenge(bifrost.acme, bifrost.opts.Entries)
+		engine.Use(challenge.ServeHTTP)
+	}
+
+	// robots.txt and favicon.ico
+	staticResponder, err := newStaticResponder(entryOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if staticResponder != nil {
+		engine.Use(staticResponder.ServeHTTP)
+	}
+
 	// set entry's middlewares
 	for _, middleware := range entryOpts.Middlewares {
 
@@ -102,6 +114,16 @@ func newEngine(bifrost *Bifrost, entryOpts config.EntryOptions) (*Engine, error)
 		engine.Use(m)
 	}
 
+	// tls server name routes run before the routes of the entry
+	if len(entryOpts.TLS.SNI.Routes) > 0 {
+		sni, err := newSNIRouter(entryOpts.TLS.SNI, services)
+		if err != nil {
+			return nil, err
+		}
+		engine.sni = sni
+		engine.Use(sni.ServeHTTP)
+	}
+
 	engine.Use(router.ServeHTTP)
 
 	return engine, nil
@@ -114,8 +136,12 @@ func (e *Engine) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	ctx.Abort()
 }
 
+// OnShutdown stops the background tasks of the services when the engine is replaced by a reload or the entry is
+// shut down
 func (e *Engine) OnShutdown() {
-
+	for _, svc := range e.services {
+		svc.stop()
+	}
 }
 
 func (e *Engine) Use(middleware ...app.HandlerFunc) {
@@ -7,4 +7,15 @@ import (
 var (
 	ErrConfigNotFound = errors.New("config not found")
 	ErrAlreadyExists  = errors.New("already exists")
+
+	// ErrUpstreamTimeout is returned when the upstream doesn't respond within the timeout, the response status is 504
+	ErrUpstreamTimeout = errors.New("upstream request timeout")
+
+	// ErrResponseTooLarge is returned when the upstream response body exceeds max_response_body_size, the response
+	// status is 502
+	ErrResponseTooLarge = errors.New("upstream response body too large")
+
+	// ErrClientCanceled is rendered by error_response when the client went away before the upstream responded, the
+	// response status is 499
+	ErrClientCanceled = errors.New("client canceled the request")
 )
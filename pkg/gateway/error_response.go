@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+const defaultErrorContentType = "text/plain; charset=utf-8"
+
+var headerEscaper = strings.NewReplacer("\r", " ", "\n", " ")
+
+func validateErrorResponse(opts config.ErrorResponseOptions) error {
+	for name := range opts.Headers {
+		if len(strings.TrimSpace(name)) == 0 {
+			return fmt.Errorf("error_response header name can't be empty")
+		}
+	}
+
+	for status, override := range opts.Statuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("error_response status '%d' must be between 400 and 599", status)
+		}
+
+		for name := range override.Headers {
+			if len(strings.TrimSpace(name)) == 0 {
+				return fmt.Errorf("error_response status '%d' header name can't be empty", status)
+			}
+		}
+	}
+	return nil
+}
+
+// newErrorHandler renders the upstream errors of the service with error_response, nil is returned when it isn't
+// configured and the default handler of the proxy only sets the status
+func newErrorHandler(opts config.ServiceOptions) func(*app.RequestContext, error) {
+	if !hasErrorResponse(opts.ErrorResponse) {
+		return nil
+	}
+
+	return func(ctx *app.RequestContext, err error) {
+		writeErrorResponse(ctx, opts, upstreamErrorStatus(err), err)
+	}
+}
+
+func hasErrorResponse(opts config.ErrorResponseOptions) bool {
+	return len(opts.Body) > 0 || len(opts.Headers) > 0 || len(opts.Statuses) > 0
+}
+
+// writeErrorResponse sets the status of an error generated by the gateway, the body and the headers are rendered
+// when error_response is configured
+func writeErrorResponse(ctx *app.RequestContext, opts config.ServiceOptions, status int, err error) {
+	ctx.Response.SetStatusCode(status)
+
+	errOpts := opts.ErrorResponse
+	if !hasErrorResponse(errOpts) {
+		return
+	}
+
+	contentType := errOpts.ContentType
+	body := errOpts.Body
+	override, found := errOpts.Statuses[status]
+	if found {
+		if len(override.ContentType) > 0 {
+			contentType = override.ContentType
+		}
+		if len(override.Body) > 0 {
+			body = override.Body
+		}
+	}
+
+	if len(contentType) == 0 {
+		contentType = defaultErrorContentType
+	}
+
+	// line breaks of the values can't be sent in a header
+	headerReplacer := newErrorReplacer(ctx, opts.ID, status, err, headerEscaper.Replace)
+	for name, val := range errOpts.Headers {
+		ctx.Response.Header.Set(name, headerReplacer.Replace(val))
+	}
+	for name, val := range override.Headers {
+		ctx.Response.Header.Set(name, headerReplacer.Replace(val))
+	}
+
+	writeErrorBody(ctx, opts.ID, status, err, contentType, body)
+}
+
+// writeNoLiveUpstream responds when no target of the upstream can be picked. no_live_upstream overrides the status
+// and the body of error_response and adds Retry-After, so the clients can back off.
+func writeNoLiveUpstream(ctx *app.RequestContext, opts config.ServiceOptions, err error) {
+	noLive := opts.NoLiveUpstream
+
+	status := noLive.Status
+	if status == 0 {
+		status = consts.StatusServiceUnavailable
+	}
+
+	ctx.Set(config.NO_LIVE_UPSTREAM, true)
+	writeErrorResponse(ctx, opts, status, err)
+
+	if noLive.RetryAfter > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(noLive.RetryAfter.Seconds()))))
+	}
+
+	if len(noLive.Body) > 0 {
+		contentType := noLive.ContentType
+		if len(contentType) == 0 {
+			contentType = defaultErrorContentType
+		}
+		writeErrorBody(ctx, opts.ID, status, err, contentType, noLive.Body)
+	}
+}
+
+func writeErrorBody(ctx *app.RequestContext, serviceID string, status int, err error, contentType string, body string) {
+	// the values are escaped, so a json body stays valid whatever the error is
+	escape := func(val string) string { return val }
+	if strings.Contains(contentType, "json") {
+		escape = jsonEscape
+	}
+
+	ctx.Response.Header.SetContentType(contentType)
+	ctx.Response.SetBodyString(newErrorReplacer(ctx, serviceID, status, err, escape).Replace(body))
+}
+
+func newErrorReplacer(ctx *app.RequestContext, serviceID string, status int, err error, escape func(string) string) *strings.Replacer {
+	return strings.NewReplacer(
+		config.STATUS, strconv.Itoa(status),
+		config.TRACE_ID, escape(ctx.GetString(config.TRACE_ID)),
+		"$service_id", escape(serviceID),
+		"$error", escape(err.Error()),
+	)
+}
+
+func jsonEscape(val string) string {
+	b, _ := json.Marshal(val)
+	return string(b[1 : len(b)-1])
+}
@@ -0,0 +1,229 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"http-benchmark/pkg/config"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9908"))
+	h.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(time.Second)
+		ctx.String(200, "slow")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"down": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:1"}},
+				},
+			},
+		},
+	}
+
+	errorResponse := config.ErrorResponseOptions{
+		ContentType: "application/json",
+		Body:        `{"status":$status,"trace_id":"$trace_id","service":"$service_id","error":"$error"}`,
+		Statuses: map[int]config.ErrorResponseStatus{
+			504: {Body: `{"status":$status,"message":"upstream timeout"}`},
+		},
+	}
+
+	serve := func(service *Service, path string) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost" + path)
+		hzCtx.Set(config.TRACE_ID, "4bf92f3577b34da6a3ce929d0e0e4736")
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	t.Run("bad gateway", func(t *testing.T) {
+		for _, url := range []string{"http://127.0.0.1:1", "http://down"} {
+			service, err := newService(bifrost, config.ServiceOptions{
+				ID:            "orders",
+				Url:           url,
+				ErrorResponse: errorResponse,
+			})
+			assert.NoError(t, err)
+
+			hzCtx := serve(service, "/orders")
+			assert.Equal(t, 502, hzCtx.Response.StatusCode())
+			assert.Equal(t, "application/json", string(hzCtx.Response.Header.ContentType()))
+
+			body := map[string]any{}
+			err = json.Unmarshal(hzCtx.Response.Body(), &body)
+			assert.NoError(t, err, string(hzCtx.Response.Body()))
+			assert.Equal(t, float64(502), body["status"])
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", body["trace_id"])
+			assert.Equal(t, "orders", body["service"])
+			assert.NotEmpty(t, body["error"])
+		}
+	})
+
+	t.Run("gateway timeout", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:            "orders",
+			Url:           "http://127.0.0.1:9908",
+			Timeout:       config.ServiceTimeoutOptions{RequestTimeout: 100 * time.Millisecond},
+			ErrorResponse: errorResponse,
+		})
+		assert.NoError(t, err)
+
+		hzCtx := serve(service, "/slow")
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Equal(t, "application/json", string(hzCtx.Response.Header.ContentType()))
+		assert.Equal(t, `{"status":504,"message":"upstream timeout"}`, string(hzCtx.Response.Body()))
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:  "orders",
+			Url: "http://127.0.0.1:9908",
+			Timeout: config.ServiceTimeoutOptions{
+				RequestTimeout: 100 * time.Millisecond,
+			},
+			ErrorResponse: config.ErrorResponseOptions{
+				Body: "service $service_id is unavailable ($status)",
+			},
+		})
+		assert.NoError(t, err)
+
+		hzCtx := serve(service, "/slow")
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Equal(t, "text/plain; charset=utf-8", string(hzCtx.Response.Header.ContentType()))
+		assert.Equal(t, "service orders is unavailable (504)", string(hzCtx.Response.Body()))
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:      "orders",
+			Url:     "http://127.0.0.1:9908",
+			Timeout: config.ServiceTimeoutOptions{RequestTimeout: 100 * time.Millisecond},
+			ErrorResponse: config.ErrorResponseOptions{
+				Body:    "unavailable",
+				Headers: map[string]string{"Retry-After": "10", "X-Trace-ID": "$trace_id"},
+				Statuses: map[int]config.ErrorResponseStatus{
+					504: {Headers: map[string]string{"Retry-After": "1"}},
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		hzCtx := serve(service, "/slow")
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Equal(t, "1", string(hzCtx.Response.Header.Peek("Retry-After")))
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", string(hzCtx.Response.Header.Peek("X-Trace-ID")))
+		assert.Equal(t, "unavailable", string(hzCtx.Response.Body()))
+	})
+
+	t.Run("no live upstream", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:            "orders",
+			Url:           "http://down",
+			ErrorResponse: errorResponse,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, service.upstream.DrainTarget("127.0.0.1:1"))
+
+		hzCtx := serve(service, "/orders")
+		assert.Equal(t, 503, hzCtx.Response.StatusCode())
+		assert.JSONEq(t, `{"status":503,"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","service":"orders","error":"all targets are administratively drained"}`,
+			string(hzCtx.Response.Body()))
+	})
+
+	t.Run("no live upstream options", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:            "orders",
+			Url:           "http://down",
+			ErrorResponse: errorResponse,
+			NoLiveUpstream: config.NoLiveUpstreamOptions{
+				Status:      502,
+				RetryAfter:  1500 * time.Millisecond,
+				ContentType: "application/problem+json",
+				Body:        `{"title":"all targets are down","status":$status}`,
+			},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, service.upstream.DrainTarget("127.0.0.1:1"))
+
+		hzCtx := serve(service, "/orders")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, "2", string(hzCtx.Response.Header.Peek("Retry-After")))
+		assert.Equal(t, "application/problem+json", string(hzCtx.Response.Header.ContentType()))
+		assert.Equal(t, `{"title":"all targets are down","status":502}`, string(hzCtx.Response.Body()))
+		assert.True(t, hzCtx.GetBool(config.NO_LIVE_UPSTREAM))
+
+		// the body of error_response is used when no_live_upstream has no body
+		service, err = newService(bifrost, config.ServiceOptions{
+			ID:             "orders",
+			Url:            "http://down",
+			ErrorResponse:  errorResponse,
+			NoLiveUpstream: config.NoLiveUpstreamOptions{RetryAfter: 10 * time.Second},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, service.upstream.DrainTarget("127.0.0.1:1"))
+
+		hzCtx = serve(service, "/orders")
+		assert.Equal(t, 503, hzCtx.Response.StatusCode())
+		assert.Equal(t, "10", string(hzCtx.Response.Header.Peek("Retry-After")))
+		assert.Equal(t, "application/json", string(hzCtx.Response.Header.ContentType()))
+		assert.Contains(t, string(hzCtx.Response.Body()), `"status":503`)
+	})
+
+	t.Run("client canceled", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:  "orders",
+			Url: "http://127.0.0.1:9908",
+			ErrorResponse: config.ErrorResponseOptions{
+				Statuses: map[int]config.ErrorResponseStatus{
+					499: {Body: "canceled: $error"},
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		c, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/slow")
+		service.ServeHTTP(c, hzCtx)
+		assert.Equal(t, 499, hzCtx.Response.StatusCode())
+		assert.Equal(t, "canceled: client canceled the request", string(hzCtx.Response.Body()))
+	})
+
+	t.Run("default error handler", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:  "orders",
+			Url: "http://127.0.0.1:1",
+		})
+		assert.NoError(t, err)
+
+		hzCtx := serve(service, "/orders")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Empty(t, hzCtx.Response.Body())
+	})
+
+	t.Run("invalid status", func(t *testing.T) {
+		err := validateErrorResponse(config.ErrorResponseOptions{
+			Statuses: map[int]config.ErrorResponseStatus{200: {Body: "ok"}},
+		})
+		assert.Error(t, err)
+
+		err = validateErrorResponse(config.ErrorResponseOptions{
+			Headers: map[string]string{"": "10"},
+		})
+		assert.Error(t, err)
+	})
+}
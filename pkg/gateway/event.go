@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type UpstreamEventType string
+
+const (
+	TargetDown     UpstreamEventType = "target_down"
+	TargetUp       UpstreamEventType = "target_up"
+	NoLiveUpstream UpstreamEventType = "no_live_upstream"
+)
+
+type UpstreamEvent struct {
+	Type       UpstreamEventType
+	UpstreamID string
+	Target     string
+	Reason     string
+	Time       time.Time
+}
+
+type UpstreamEventHandler func(e UpstreamEvent)
+
+var upstreamEvents = newEventDispatcher(1024)
+
+// OnUpstreamEvent registers a handler which is invoked for every upstream event.
+// Handlers run on a dedicated goroutine, so a slow handler never blocks the proxy path.
+// When the queue is full, new events are dropped and counted by DroppedUpstreamEvents.
+func OnUpstreamEvent(handler UpstreamEventHandler) {
+	upstreamEvents.register(handler)
+}
+
+// DroppedUpstreamEvents returns the number of events dropped because the queue was full.
+func DroppedUpstreamEvents() uint64 {
+	return upstreamEvents.dropped.Load()
+}
+
+type eventDispatcher struct {
+	mu       sync.RWMutex
+	handlers []UpstreamEventHandler
+	queue    chan UpstreamEvent
+	dropped  atomic.Uint64
+	once     sync.Once
+}
+
+func newEventDispatcher(size int) *eventDispatcher {
+	return &eventDispatcher{
+		handlers: make([]UpstreamEventHandler, 0),
+		queue:    make(chan UpstreamEvent, size),
+	}
+}
+
+func (d *eventDispatcher) register(handler UpstreamEventHandler) {
+	d.mu.Lock()
+	d.handlers = append(d.handlers, handler)
+	d.mu.Unlock()
+
+	d.once.Do(func() {
+		go d.run()
+	})
+}
+
+func (d *eventDispatcher) emit(event UpstreamEvent) {
+	d.mu.RLock()
+	hasHandlers := len(d.handlers) > 0
+	d.mu.RUnlock()
+
+	if !hasHandlers {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case d.queue <- event:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+func (d *eventDispatcher) run() {
+	for event := range d.queue {
+		d.mu.RLock()
+		handlers := d.handlers
+		d.mu.RUnlock()
+
+		for _, handler := range handlers {
+			d.invoke(handler, event)
+		}
+	}
+}
+
+func (d *eventDispatcher) invoke(handler UpstreamEventHandler, event UpstreamEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("upstream event handler panic recovered", "event", event.Type, "panic", r)
+		}
+	}()
+
+	handler(event)
+}
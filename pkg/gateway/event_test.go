@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamEvents(t *testing.T) {
+	received := make(chan UpstreamEvent, 10)
+
+	OnUpstreamEvent(func(e UpstreamEvent) {
+		if e.UpstreamID == "test_events" {
+			received <- e
+		}
+	})
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"test_events": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9961"}, {Target: "127.0.0.1:9962"}},
+					OutlierDetection: config.OutlierDetectionOptions{
+						Enabled:          true,
+						Interval:         time.Hour,
+						BaseEjectionTime: time.Minute,
+						MinHosts:         2,
+						MinRequests:      10,
+						StdevFactor:      0.5,
+					},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{ID: "events", Url: "http://test_events"})
+	assert.NoError(t, err)
+	defer service.stop()
+
+	upstream := service.upstream
+	proxies := upstream.targets()
+	healthy, failing := proxies[0], proxies[1]
+
+	expect := func(eventType UpstreamEventType, target string) {
+		select {
+		case e := <-received:
+			assert.Equal(t, eventType, e.Type)
+			assert.Equal(t, target, e.Target)
+			assert.False(t, e.Time.IsZero())
+		case <-time.After(time.Second):
+			t.Fatalf("event %s was not received", eventType)
+		}
+	}
+
+	// every request to the failing target fails, it is ejected
+	for _, proxy := range proxies {
+		proxy.stats.requests.Store(100)
+	}
+	failing.stats.failures.Store(100)
+
+	now := time.Now()
+	upstream.outlier.analyze(now)
+	assert.True(t, failing.isEjected(now))
+	expect(TargetDown, failing.targetHost)
+
+	// the only target in rotation is drained, so the request has no live upstream
+	healthy.drained.Store(true)
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	service.ServeHTTP(context.Background(), hzCtx)
+	assert.Equal(t, 503, hzCtx.Response.StatusCode())
+	expect(NoLiveUpstream, "")
+
+	// the ejection time is over, the target is back in rotation
+	now = now.Add(time.Minute)
+	upstream.outlier.analyze(now)
+	assert.False(t, failing.isEjected(now))
+	expect(TargetUp, failing.targetHost)
+
+	select {
+	case e := <-received:
+		t.Fatalf("unexpected event %s", e.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpstreamEventsDropped(t *testing.T) {
+	dispatcher := newEventDispatcher(1)
+	dispatcher.handlers = append(dispatcher.handlers, func(e UpstreamEvent) {})
+
+	dispatcher.emit(UpstreamEvent{Type: TargetDown})
+	dispatcher.emit(UpstreamEvent{Type: TargetUp})
+
+	assert.Equal(t, uint64(1), dispatcher.dropped.Load())
+}
@@ -0,0 +1,343 @@
+package gateway
+
+import (
+	"fmt"
+	"http-benchmark/pkg/config"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/valyala/bytebufferpool"
+)
+
+// forwardedHeadersKey overrides how the proxy sends X-Forwarded-* headers for the service
+const forwardedHeadersKey = "forwarded_headers"
+
+// forwardedKey is set when the service also sends the Forwarded header of RFC 7239
+const forwardedKey = "forwarded"
+
+// clientIPForwardingKey overrides how the proxy sends the client ip in X-Forwarded-For for the service
+const clientIPForwardingKey = "client_ip_forwarding"
+
+// untrustedPeerKey is set when the entry has trusted_proxies and the client isn't one of them
+const untrustedPeerKey = "untrusted_peer"
+
+// trustedPeerKey is set when the client is one of the trusted_proxies of the entry
+const trustedPeerKey = "trusted_peer"
+
+// forwarded holds the client-facing scheme, host and port of the request, captured before the director rewrites the uri
+type forwarded struct {
+	proto string
+	host  string
+	port  string
+}
+
+func newForwarded(ctx *app.RequestContext) forwarded {
+	f := forwarded{
+		proto: "http",
+		host:  string(ctx.Request.Header.Host()),
+	}
+
+	// the director marks the request as plaintext for http targets and hertz only sets it once per connection,
+	// so the connection decides whether the listener had tls
+	if conn := ctx.GetConn(); conn != nil {
+		if _, ok := conn.(network.ConnTLSer); ok {
+			f.proto = "https"
+		}
+	} else if string(ctx.Request.URI().Scheme()) == "https" {
+		f.proto = "https"
+	}
+
+	if len(f.host) == 0 {
+		f.host = string(ctx.Request.Host())
+	}
+
+	if conn := ctx.GetConn(); conn != nil && conn.LocalAddr() != nil {
+		if _, port, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+			f.port = port
+		}
+	}
+
+	if len(f.port) == 0 {
+		if _, port, err := net.SplitHostPort(f.host); err == nil {
+			f.port = port
+		} else if f.proto == "https" {
+			f.port = "443"
+		} else {
+			f.port = "80"
+		}
+	}
+
+	return f
+}
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	return parseCIDRs("trusted_proxies", cidrs)
+}
+
+// parseCIDRs parses the cidrs of the field, a single ip is accepted too
+func parseCIDRs(field string, cidrs []string) ([]*net.IPNet, error) {
+	trustedProxies := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		// a single ip is trusted as a /32 or /128
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s '%s' is invalid", field, cidr)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	return trustedProxies, nil
+}
+
+// realClientIP returns the client ip and whether the peer is one of the trusted proxies. X-Forwarded-For of a
+// trusted peer is walked from right to left, the first hop which isn't trusted is the client, the leftmost hop is
+// used when all of them are trusted. An invalid hop stops the walk, the hops on its left can't be trusted.
+func realClientIP(peer string, forwardedFor [][]byte, trustedProxies []*net.IPNet) (string, bool) {
+	ip := net.ParseIP(peer)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return peer, false
+	}
+
+	clientIP := peer
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hops := strings.Split(string(forwardedFor[i]), ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := strings.TrimSpace(hops[j])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				return clientIP, true
+			}
+
+			clientIP = hop
+			if !containsIP(trustedProxies, ip) {
+				return clientIP, true
+			}
+		}
+	}
+
+	return clientIP, true
+}
+
+// forwardedHeadersMode returns the forwarded_headers mode for the request. The forwarded headers sent by the client
+// are only kept and appended to when the client is one of the trusted_proxies of the entry or the service, any other
+// client could forge them, so they are overwritten and X-Forwarded-For starts a new chain.
+func (svc *Service) forwardedHeadersMode(ctx *app.RequestContext) config.ForwardedHeadersMode {
+	mode := svc.options.ForwardedHeaders
+	if mode != "" && mode != config.ForwardedHeadersAppend {
+		return mode
+	}
+
+	if ctx.GetBool(untrustedPeerKey) {
+		return config.ForwardedHeadersOverwrite
+	}
+
+	if ctx.GetBool(trustedPeerKey) {
+		return mode
+	}
+
+	if len(svc.trustedProxies) > 0 && ctx.RemoteAddr() != nil {
+		if host, _, err := net.SplitHostPort(ctx.RemoteAddr().String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil && containsIP(svc.trustedProxies, ip) {
+				return mode
+			}
+		}
+	}
+
+	return config.ForwardedHeadersOverwrite
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port,
+// and Forwarded when it is enabled for the service.
+// append keeps the values set by a trusted proxy in front of us and appends the client ip to X-Forwarded-For and
+// Forwarded, overwrite replaces them because the client isn't trusted, off leaves the request headers untouched.
+func setForwardedHeaders(ctx *app.RequestContext, f forwarded) {
+	mode := config.ForwardedHeadersMode(ctx.GetString(forwardedHeadersKey))
+	if mode == config.ForwardedHeadersOff {
+		return
+	}
+
+	req := &ctx.Request
+	overwrite := mode == config.ForwardedHeadersOverwrite
+
+	forwarding := config.ClientIPForwarding(ctx.GetString(clientIPForwardingKey))
+	clientIP, _, err := net.SplitHostPort(ctx.RemoteAddr().String())
+	if err == nil {
+		setForwardedFor(req, clientIP, forwarding, overwrite)
+	}
+
+	setHeader := func(key, value string) {
+		if len(value) == 0 {
+			return
+		}
+		if overwrite || len(req.Header.Peek(key)) == 0 {
+			req.Header.Set(key, value)
+		}
+	}
+
+	setHeader("X-Forwarded-Proto", f.proto)
+	setHeader("X-Forwarded-Host", f.host)
+	setHeader("X-Forwarded-Port", f.port)
+
+	if ctx.GetBool(forwardedKey) {
+		setForwarded(req, clientIP, f, forwarding, overwrite)
+	}
+}
+
+// setForwardedFor sets X-Forwarded-For by the client_ip_forwarding of the service. append appends the client ip
+// to the chain, replace sends only the client ip, omit removes the header and anonymize appends the client ip
+// with every ip of the chain anonymized. overwrite drops the chain like replace.
+func setForwardedFor(req *protocol.Request, clientIP string, forwarding config.ClientIPForwarding, overwrite bool) {
+	if forwarding == config.ClientIPForwardingOmit {
+		req.Header.Del("X-Forwarded-For")
+		return
+	}
+
+	var prior []byte
+	if !overwrite && forwarding != config.ClientIPForwardingReplace {
+		prior = req.Header.Peek("X-Forwarded-For")
+	}
+
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	if len(prior) > 0 {
+		if forwarding == config.ClientIPForwardingAnonymize {
+			for _, hop := range strings.Split(string(prior), ",") {
+				buf.WriteString(anonymizeIP(strings.TrimSpace(hop)))
+				buf.WriteString(", ")
+			}
+		} else {
+			buf.Write(prior)
+			buf.WriteString(", ")
+		}
+	}
+
+	if forwarding == config.ClientIPForwardingAnonymize {
+		clientIP = anonymizeIP(clientIP)
+	}
+	buf.WriteString(clientIP)
+
+	req.Header.Set("X-Forwarded-For", buf.String())
+}
+
+// anonymizeIP zeroes the last octet of an ipv4 and the last 80 bits of an ipv6, other values are kept
+func anonymizeIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// setForwarded appends the element of this hop to the Forwarded header, for example
+// for=192.0.2.60;host="example.com:8080";proto=https. An ipv6 client is written as "[2001:db8::1]".
+// The client_ip_forwarding of the service applies to the for= parameters like it does to X-Forwarded-For:
+// omit drops the chain and the for= of this hop, replace drops the chain and anonymize anonymizes every for=.
+func setForwarded(req *protocol.Request, clientIP string, f forwarded, forwarding config.ClientIPForwarding, overwrite bool) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	keepChain := !overwrite && forwarding != config.ClientIPForwardingOmit && forwarding != config.ClientIPForwardingReplace
+	if prior := req.Header.Peek("Forwarded"); len(prior) > 0 && keepChain {
+		if forwarding == config.ClientIPForwardingAnonymize {
+			for _, element := range strings.Split(string(prior), ",") {
+				buf.WriteString(anonymizeForwardedElement(strings.TrimSpace(element)))
+				buf.WriteString(", ")
+			}
+		} else {
+			buf.Write(prior)
+			buf.WriteString(", ")
+		}
+	}
+
+	if forwarding != config.ClientIPForwardingOmit {
+		if forwarding == config.ClientIPForwardingAnonymize {
+			clientIP = anonymizeIP(clientIP)
+		}
+
+		node := clientIP
+		if len(node) == 0 {
+			node = "unknown"
+		} else if strings.Contains(node, ":") {
+			node = "[" + node + "]"
+		}
+
+		buf.WriteString("for=")
+		buf.WriteString(forwardedValue(node))
+		buf.WriteString(";")
+	}
+
+	if len(f.host) > 0 {
+		buf.WriteString("host=")
+		buf.WriteString(forwardedValue(f.host))
+		buf.WriteString(";")
+	}
+	buf.WriteString("proto=")
+	buf.WriteString(f.proto)
+
+	req.Header.Set("Forwarded", buf.String())
+}
+
+// anonymizeForwardedElement anonymizes the ip of the for= parameter of a Forwarded element, the port and
+// the other parameters are kept
+func anonymizeForwardedElement(element string) string {
+	pairs := strings.Split(element, ";")
+	for i, pair := range pairs {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(key, "for") {
+			continue
+		}
+
+		node := strings.Trim(value, `"`)
+		host, port := node, ""
+		if h, p, err := net.SplitHostPort(node); err == nil {
+			host, port = h, p
+		}
+		host = anonymizeIP(strings.Trim(host, "[]"))
+
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if len(port) > 0 {
+			host += ":" + port
+		}
+		pairs[i] = key + "=" + forwardedValue(host)
+	}
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue quotes the value unless it is a token, see RFC 7239 section 4
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if !isTokenRune(r) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func isTokenRune(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
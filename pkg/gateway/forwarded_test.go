@@ -0,0 +1,449 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9975"))
+	backend.GET("/forwarded/*mode", func(c context.Context, ctx *app.RequestContext) {
+		for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port"} {
+			ctx.Response.Header.Set("Got-"+key, ctx.Request.Header.Get(key))
+		}
+		ctx.String(200, "ok")
+	})
+	go backend.Spin()
+
+	services := map[string]*Service{}
+	for name, opts := range map[string]config.ServiceOptions{
+		"default":   {},
+		"overwrite": {ForwardedHeaders: config.ForwardedHeadersOverwrite},
+		"off":       {ForwardedHeaders: config.ForwardedHeadersOff},
+		"trusted":   {TrustedProxies: []string{"127.0.0.1"}},
+	} {
+		opts.ID = "forwarded"
+		opts.Url = "http://127.0.0.1:9975"
+		service, err := newService(&Bifrost{opts: &config.Options{}}, opts)
+		assert.NoError(t, err)
+		services[name] = service
+	}
+
+	register := func(h *server.Hertz) {
+		for name, service := range services {
+			h.GET("/forwarded/"+name, service.ServeHTTP)
+		}
+	}
+
+	plain := server.New(server.WithHostPorts("127.0.0.1:9976"))
+	register(plain)
+	go plain.Spin()
+
+	secure := server.New(
+		server.WithHostPorts("127.0.0.1:9977"),
+		server.WithTLS(&tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}),
+	)
+	register(secure)
+	go secure.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient(client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	assert.NoError(t, err)
+
+	send := func(uri string, headers map[string]string) *protocol.Response {
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		err := cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		return resp
+	}
+
+	t.Run("plaintext listener", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9976/forwarded/default", nil)
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "http", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "127.0.0.1:9976", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "9976", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+
+	t.Run("tls listener", func(t *testing.T) {
+		resp := send("https://localhost:9977/forwarded/default", nil)
+		assert.Equal(t, "https", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "localhost:9977", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "9977", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+
+	prior := map[string]string{
+		"X-Forwarded-For":   "10.0.0.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "www.example.com",
+		"X-Forwarded-Port":  "443",
+	}
+
+	t.Run("append keeps values of a trusted proxy", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9976/forwarded/trusted", prior)
+		assert.Equal(t, "10.0.0.1, 127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "https", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "www.example.com", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "443", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+
+	t.Run("values of an untrusted client are overwritten", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9976/forwarded/default", prior)
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "http", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "127.0.0.1:9976", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "9976", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+
+	t.Run("overwrite replaces values sent by the client", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9976/forwarded/overwrite", prior)
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "http", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "127.0.0.1:9976", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "9976", resp.Header.Get("Got-X-Forwarded-Port"))
+
+		resp = send("https://localhost:9977/forwarded/overwrite", prior)
+		assert.Equal(t, "https", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "localhost:9977", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "9977", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+
+	t.Run("off leaves the headers untouched", func(t *testing.T) {
+		resp := send("https://localhost:9977/forwarded/off", nil)
+		assert.Equal(t, "", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, "", resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal(t, "", resp.Header.Get("Got-X-Forwarded-Port"))
+	})
+}
+
+func TestForwardedTrustedProxies(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9953"))
+	backend.GET("/trusted/*name", func(c context.Context, ctx *app.RequestContext) {
+		for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "Forwarded"} {
+			ctx.Response.Header.Set("Got-"+key, ctx.Request.Header.Get(key))
+		}
+		ctx.String(200, "ok")
+	})
+	go backend.Spin()
+
+	trusted, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:             "trusted",
+		Url:            "http://127.0.0.1:9953",
+		Forwarded:      true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+	})
+	assert.NoError(t, err)
+
+	untrusted, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:             "untrusted",
+		Url:            "http://127.0.0.1:9953",
+		Forwarded:      true,
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"},
+	})
+	assert.NoError(t, err)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9952"))
+	h.GET("/trusted/trusted", trusted.ServeHTTP)
+	h.GET("/trusted/untrusted", untrusted.ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	assert.NoError(t, err)
+
+	send := func(uri string) *protocol.Response {
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=1.2.3.4;proto=https")
+
+		err := cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		return resp
+	}
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9952/trusted/trusted")
+		assert.Equal(t, "1.2.3.4, 127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "https", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, `for=1.2.3.4;proto=https, for=127.0.0.1;host="127.0.0.1:9952";proto=http`, resp.Header.Get("Got-Forwarded"))
+	})
+
+	t.Run("untrusted client", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9952/trusted/untrusted")
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+		assert.Equal(t, "http", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Equal(t, `for=127.0.0.1;host="127.0.0.1:9952";proto=http`, resp.Header.Get("Got-Forwarded"))
+	})
+
+	t.Run("invalid cidr", func(t *testing.T) {
+		_, err := parseTrustedProxies([]string{"10.0.0.0/33"})
+		assert.EqualError(t, err, "trusted_proxies '10.0.0.0/33' is invalid")
+	})
+}
+
+func TestEntryTrustedProxies(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9934"))
+	backend.GET("/proxy", func(c context.Context, ctx *app.RequestContext) {
+		ctx.Response.Header.Set("Got-X-Forwarded-For", ctx.Request.Header.Get("X-Forwarded-For"))
+		ctx.String(200, "ok")
+	})
+	go backend.Spin()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:  "orders",
+		Url: "http://127.0.0.1:9934",
+	})
+	assert.NoError(t, err)
+
+	newEntry := func(bind string, trustedProxies []string) {
+		h := server.New(server.WithHostPorts(bind))
+		h.Use(newInitMiddleware(config.EntryOptions{ID: "http", TrustedProxies: trustedProxies}, slog.Default()).ServeHTTP)
+		h.GET("/client", func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.Set("Client-IP", ctx.ClientIP())
+			ctx.Response.Header.Set("Client-IP-Variable", ctx.GetString(config.CLIENT_IP))
+			ctx.String(200, "ok")
+		})
+		h.GET("/proxy", service.ServeHTTP)
+		go h.Spin()
+	}
+	newEntry("127.0.0.1:9935", []string{"127.0.0.0/8", "10.0.0.0/8"})
+	newEntry("127.0.0.1:9936", []string{"10.0.0.0/8"})
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	assert.NoError(t, err)
+
+	send := func(uri string, forwardedFor ...string) *protocol.Response {
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		for _, v := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		req.Header.Set("X-Real-IP", "6.6.6.6")
+
+		err := cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		return resp
+	}
+
+	t.Run("trusted peer", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9935/client", "6.6.6.6, 1.2.3.4, 10.0.0.1")
+		assert.Equal(t, "1.2.3.4", resp.Header.Get("Client-IP"))
+		assert.Equal(t, "1.2.3.4", resp.Header.Get("Client-IP-Variable"))
+
+		resp = send("http://127.0.0.1:9935/proxy", "6.6.6.6, 1.2.3.4, 10.0.0.1")
+		assert.Equal(t, "6.6.6.6, 1.2.3.4, 10.0.0.1, 127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+	})
+
+	t.Run("trusted peer without forwarded for", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9935/client")
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Client-IP"))
+	})
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		resp := send("http://127.0.0.1:9936/client", "1.2.3.4")
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Client-IP"))
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Client-IP-Variable"))
+
+		resp = send("http://127.0.0.1:9936/proxy", "1.2.3.4")
+		assert.Equal(t, "127.0.0.1", resp.Header.Get("Got-X-Forwarded-For"))
+	})
+}
+
+func TestRealClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name         string
+		peer         string
+		forwardedFor []string
+		clientIP     string
+		trusted      bool
+	}{
+		{"untrusted peer", "1.2.3.4", []string{"5.6.7.8"}, "1.2.3.4", false},
+		{"no forwarded for", "10.0.0.1", nil, "10.0.0.1", true},
+		{"first untrusted hop", "10.0.0.1", []string{"6.6.6.6, 1.2.3.4, 192.168.1.1"}, "1.2.3.4", true},
+		{"multiple headers", "10.0.0.1", []string{"6.6.6.6", "1.2.3.4", "10.0.0.2"}, "1.2.3.4", true},
+		{"all trusted", "10.0.0.1", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3", true},
+		{"invalid hop", "10.0.0.1", []string{"1.2.3.4, unknown, 10.0.0.2"}, "10.0.0.2", true},
+		{"ipv6", "10.0.0.1", []string{"2001:db8::1"}, "2001:db8::1", true},
+	}
+
+	for _, c := range cases {
+		var forwardedFor [][]byte
+		for _, v := range c.forwardedFor {
+			forwardedFor = append(forwardedFor, []byte(v))
+		}
+
+		clientIP, trusted := realClientIP(c.peer, forwardedFor, trustedProxies)
+		assert.Equal(t, c.clientIP, clientIP, c.name)
+		assert.Equal(t, c.trusted, trusted, c.name)
+	}
+}
+
+func TestClientIPForwarding(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9937"))
+	backend.GET("/forwarding/*mode", func(c context.Context, ctx *app.RequestContext) {
+		if v := ctx.Request.Header.Peek("X-Forwarded-For"); v != nil {
+			ctx.Response.Header.Set("Got-X-Forwarded-For", string(v))
+		} else {
+			ctx.Response.Header.Set("Got-X-Forwarded-For", "none")
+		}
+		if v := ctx.Request.Header.Peek("Forwarded"); v != nil {
+			ctx.Response.Header.Set("Got-Forwarded", string(v))
+		}
+		ctx.String(200, "ok")
+	})
+	go backend.Spin()
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9938"))
+	for _, mode := range []config.ClientIPForwarding{config.ClientIPForwardingAppend, config.ClientIPForwardingReplace, config.ClientIPForwardingOmit, config.ClientIPForwardingAnonymize} {
+		service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+			ID:                 "forwarding",
+			Url:                "http://127.0.0.1:9937",
+			ClientIPForwarding: mode,
+			TrustedProxies:     []string{"127.0.0.1"},
+		})
+		assert.NoError(t, err)
+		h.GET("/forwarding/"+string(mode), service.ServeHTTP)
+
+		service, err = newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+			ID:                 "forwarding",
+			Url:                "http://127.0.0.1:9937",
+			ClientIPForwarding: mode,
+			TrustedProxies:     []string{"127.0.0.1"},
+			Forwarded:          true,
+		})
+		assert.NoError(t, err)
+		h.GET("/forwarding/"+string(mode)+"/forwarded", service.ServeHTTP)
+	}
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	assert.NoError(t, err)
+
+	send := func(mode config.ClientIPForwarding, forwardedFor *string) string {
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI("http://127.0.0.1:9938/forwarding/" + string(mode))
+		if forwardedFor != nil {
+			req.Header.Set("X-Forwarded-For", *forwardedFor)
+		}
+
+		err := cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		return resp.Header.Get("Got-X-Forwarded-For")
+	}
+
+	prior := "1.2.3.4, 2001:db8:1:2:3:4:5:6"
+	empty := ""
+
+	assert.Equal(t, "1.2.3.4, 2001:db8:1:2:3:4:5:6, 127.0.0.1", send(config.ClientIPForwardingAppend, &prior))
+	assert.Equal(t, "127.0.0.1", send(config.ClientIPForwardingAppend, &empty))
+	assert.Equal(t, "127.0.0.1", send(config.ClientIPForwardingReplace, &prior))
+	assert.Equal(t, "none", send(config.ClientIPForwardingOmit, &prior))
+	assert.Equal(t, "none", send(config.ClientIPForwardingOmit, nil))
+	assert.Equal(t, "1.2.3.0, 2001:db8:1::, 127.0.0.0", send(config.ClientIPForwardingAnonymize, &prior))
+	assert.Equal(t, "127.0.0.0", send(config.ClientIPForwardingAnonymize, nil))
+
+	t.Run("forwarded header", func(t *testing.T) {
+		send := func(mode config.ClientIPForwarding) string {
+			req := protocol.AcquireRequest()
+			defer protocol.ReleaseRequest(req)
+			resp := &protocol.Response{}
+
+			req.SetRequestURI("http://127.0.0.1:9938/forwarding/" + string(mode) + "/forwarded")
+			req.Header.Set("Forwarded", `for=1.2.3.4;proto=https, for="[2001:db8:1:2:3:4:5:6]:8080"`)
+
+			err := cli.Do(context.Background(), req, resp)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode())
+			return resp.Header.Get("Got-Forwarded")
+		}
+
+		assert.Equal(t, `for=1.2.3.4;proto=https, for="[2001:db8:1:2:3:4:5:6]:8080", for=127.0.0.1;host="127.0.0.1:9938";proto=http`, send(config.ClientIPForwardingAppend))
+		assert.Equal(t, `for=127.0.0.1;host="127.0.0.1:9938";proto=http`, send(config.ClientIPForwardingReplace))
+		assert.Equal(t, `host="127.0.0.1:9938";proto=http`, send(config.ClientIPForwardingOmit))
+		assert.Equal(t, `for=1.2.3.0;proto=https, for="[2001:db8:1::]:8080", for=127.0.0.0;host="127.0.0.1:9938";proto=http`, send(config.ClientIPForwardingAnonymize))
+	})
+
+	// an empty X-Forwarded-For of the client is replaced by the client ip
+	req := &protocol.Request{}
+	req.Header.Set("X-Forwarded-For", "")
+	setForwardedFor(req, "127.0.0.1", "", false)
+	assert.Equal(t, "127.0.0.1", req.Header.Get("X-Forwarded-For"))
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.0", anonymizeIP("192.0.2.60"))
+	assert.Equal(t, "2001:db8:85a3::", anonymizeIP("2001:db8:85a3:8d3:1319:8a2e:370:7348"))
+	assert.Equal(t, "192.0.2.0", anonymizeIP("::ffff:192.0.2.60"))
+	assert.Equal(t, "unknown", anonymizeIP("unknown"))
+}
+
+func TestForwardedValue(t *testing.T) {
+	assert.Equal(t, "192.0.2.60", forwardedValue("192.0.2.60"))
+	assert.Equal(t, `"[2001:db8::1]"`, forwardedValue("[2001:db8::1]"))
+	assert.Equal(t, `"example.com:8080"`, forwardedValue("example.com:8080"))
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"http-benchmark/pkg/config"
+	"io"
+	"slices"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/hertz-contrib/http2"
+	http2config "github.com/hertz-contrib/http2/config"
+	http2factory "github.com/hertz-contrib/http2/factory"
+)
+
+// enableGRPC sends the requests of the proxy over http2, h2c for http urls and tls for https urls.
+// The request keeps HTTP/2.0 and TE: trailers, the response body is streamed to the client
+// and the trailers of the upstream (grpc-status, grpc-message) are forwarded after it.
+func (r *Proxy) enableGRPC(opts config.ServiceOptions, serverName string, tracingEnabled bool, clientOpts []hzconfig.ClientOption) error {
+	c, err := client.NewClient(slices.Clone(clientOpts)...)
+	if err != nil {
+		return err
+	}
+
+	c.SetClientFactory(http2factory.NewClientFactory(
+		http2config.WithAllowHTTP(true),
+		http2config.WithDialer(standard.NewDialer()),
+		http2config.WithDialTimeout(http3DialTimeout(opts)),
+		http2config.WithTLSConfig(&tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: !opts.TLSVerify,
+			NextProtos:         []string{"h2"},
+		}),
+	))
+	c.Use(keepRequestBodyOpen)
+	if tracingEnabled {
+		c.Use(tracingClientMiddleware())
+	}
+
+	director := r.director
+	r.director = func(req *protocol.Request) {
+		director(req)
+		req.Header.SetProtocol("HTTP/2.0")
+	}
+
+	r.client = c
+	r.transferTrailer = true
+	r.grpc = true
+	return nil
+}
+
+// keepRequestBodyOpen hides the request body stream of the http2 server from the client. The client closes the body
+// when the upstream ends the stream while the server closes it when the stream is recycled, so it is only closed
+// by the server.
+func keepRequestBodyOpen(next client.Endpoint) client.Endpoint {
+	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+		if !req.IsBodyStream() {
+			return next(ctx, req, resp)
+		}
+
+		body := req.BodyStream()
+		req.ConstructBodyStream(nil, struct{ io.Reader }{body})
+		defer req.ConstructBodyStream(nil, body)
+
+		return next(ctx, req, resp)
+	}
+}
+
+// grpcTrailers are declared on the response, the http2 client only copies the trailers declared by the Trailer header
+// and grpc servers don't send it
+var grpcTrailers = []byte("Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+
+// streamGRPCResponse flushes the messages of a streamed grpc response as soon as they are read from the upstream and
+// forwards its trailers. The http2 server buffers the body until the handler is done otherwise, which holds back
+// server streaming calls.
+func streamGRPCResponse(ctx *app.RequestContext) {
+	if !ctx.Response.IsBodyStream() {
+		return
+	}
+
+	writer, err := http2.NewResponseWriter(ctx.GetConn())
+	if err != nil {
+		// the entry doesn't serve http2, the response is written as it is
+		return
+	}
+
+	ctx.Response.SetBodyStreamNoReset(&grpcResponseBody{
+		reader:   ctx.Response.BodyStream(),
+		writer:   writer,
+		response: &ctx.Response,
+	}, ctx.Response.Header.ContentLength())
+}
+
+// grpcResponseBody flushes what the server has written before waiting for the next read of the upstream body.
+// Nothing is flushed and no trailer is declared before the first message, so a trailers-only response
+// still ends the stream with its headers.
+type grpcResponseBody struct {
+	reader   io.Reader
+	writer   network.ExtWriter
+	response *protocol.Response
+	written  bool
+}
+
+func (b *grpcResponseBody) Read(p []byte) (int, error) {
+	if b.written {
+		_ = b.writer.Flush()
+	}
+
+	n, err := b.reader.Read(p)
+	if n > 0 && !b.written {
+		b.written = true
+		trailers := grpcTrailers
+		if declared := b.response.Header.Trailer().GetBytes(); len(declared) > 0 {
+			trailers = append(append(declared, ", "...), grpcTrailers...)
+		}
+		_ = b.response.Header.Trailer().SetTrailers(trailers)
+	}
+
+	if err == io.EOF {
+		// trailers which were declared but not sent by the upstream
+		var missing []string
+		b.response.Header.Trailer().VisitAll(func(key, value []byte) {
+			if len(value) == 0 {
+				missing = append(missing, string(key))
+			}
+		})
+		for _, key := range missing {
+			b.response.Header.Trailer().Del(key)
+		}
+	}
+
+	return n, err
+}
+
+func (b *grpcResponseBody) Close() error {
+	if closer, ok := b.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
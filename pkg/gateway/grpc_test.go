@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/hertz-contrib/http2/factory"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPC(t *testing.T) {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("bifrost", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	grpcServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:9957")
+	assert.NoError(t, err)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	defer grpcServer.Stop()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:       "grpc",
+		Protocol: config.ProtocolGRPC,
+		Url:      "http://127.0.0.1:9957",
+	})
+	assert.NoError(t, err)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9956"), server.WithH2C(true))
+	h.AddProtocol("h2", factory.NewServerFactory())
+	h.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		service.ServeHTTP(c, ctx)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	conn, err := grpc.NewClient("127.0.0.1:9956", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	healthClient := grpc_health_v1.NewHealthClient(conn)
+
+	t.Run("unary", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		resp, err := healthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "bifrost"})
+		assert.NoError(t, err)
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+	})
+
+	t.Run("failing rpc", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err := healthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Equal(t, "unknown service", status.Convert(err).Message())
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		stream, err := healthClient.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: "bifrost"})
+		assert.NoError(t, err)
+
+		resp, err := stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+
+		// the stream is still open, so the message must not wait for the end of the response
+		healthServer.SetServingStatus("bifrost", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+		resp, err = stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	})
+}
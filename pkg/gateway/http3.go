@@ -0,0 +1,222 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"http-benchmark/pkg/config"
+	"io"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/common/adaptor"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	protocolclient "github.com/cloudwego/hertz/pkg/protocol/client"
+	"github.com/cloudwego/hertz/pkg/protocol/suite"
+	http2config "github.com/hertz-contrib/http2/config"
+	http2factory "github.com/hertz-contrib/http2/factory"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	defaultHTTP3DialTimeout = 10 * time.Second
+	defaultHTTP3ReadTimeout = 60 * time.Second
+	// http3RetryInterval is how long the fallback is used after a failed quic handshake before http3 is tried again
+	http3RetryInterval = 30 * time.Second
+)
+
+// http3HandshakeError means the quic connection can't be established and the request was not sent,
+// so it can be sent again by the fallback client
+type http3HandshakeError struct {
+	err error
+}
+
+func (e *http3HandshakeError) Error() string {
+	return "http3 handshake error: " + e.err.Error()
+}
+
+func (e *http3HandshakeError) Unwrap() error {
+	return e.err
+}
+
+// enableHTTP3 sends the requests of the proxy over http3. The fallback client sends the request over http1 or http2
+// when the quic handshake fails, unless http3_fallback is off.
+func (r *Proxy) enableHTTP3(opts config.ServiceOptions, serverName string, tracingEnabled bool, clientOpts []hzconfig.ClientOption) error {
+	newClient := func(factory suite.ClientFactory, options ...hzconfig.ClientOption) (*client.Client, error) {
+		c, err := client.NewClient(append(slices.Clone(clientOpts), options...)...)
+		if err != nil {
+			return nil, err
+		}
+		if factory != nil {
+			c.SetClientFactory(factory)
+		}
+		if tracingEnabled {
+			c.Use(tracingClientMiddleware())
+		}
+		return c, nil
+	}
+
+	c, err := newClient(newHTTP3ClientFactory(opts, serverName))
+	if err != nil {
+		return err
+	}
+
+	var fallback *client.Client
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !opts.TLSVerify,
+	}
+
+	switch opts.HTTP3Fallback {
+	case config.HTTP3FallbackOff:
+	case config.HTTP3FallbackHTTP2:
+		tlsConfig.NextProtos = []string{"h2"}
+		fallback, err = newClient(http2factory.NewClientFactory(
+			http2config.WithDialer(standard.NewDialer()),
+			http2config.WithDialTimeout(http3DialTimeout(opts)),
+			http2config.WithTLSConfig(tlsConfig),
+		))
+	default:
+		fallback, err = newClient(nil, client.WithTLSConfig(tlsConfig))
+	}
+	if err != nil {
+		return err
+	}
+
+	// the events are read from the buffered responses of the http3 client
+	r.client = c
+	r.fallbackClient = fallback
+	return nil
+}
+
+func http3DialTimeout(opts config.ServiceOptions) time.Duration {
+	if opts.Timeout.DailTimeout > 0 {
+		return opts.Timeout.DailTimeout
+	}
+	return defaultHTTP3DialTimeout
+}
+
+// http3ClientFactory creates host clients of the hertz client which send requests with quic-go
+type http3ClientFactory struct {
+	tlsConfig   *tls.Config
+	dialTimeout time.Duration
+	readTimeout time.Duration
+}
+
+func newHTTP3ClientFactory(opts config.ServiceOptions, serverName string) suite.ClientFactory {
+	f := &http3ClientFactory{
+		tlsConfig: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: !opts.TLSVerify,
+		},
+		dialTimeout: http3DialTimeout(opts),
+		readTimeout: defaultHTTP3ReadTimeout,
+	}
+
+	if opts.Timeout.ReadTimeout > 0 {
+		f.readTimeout = opts.Timeout.ReadTimeout
+	}
+
+	return f
+}
+
+func (f *http3ClientFactory) NewHostClient() (protocolclient.HostClient, error) {
+	return &http3HostClient{
+		readTimeout: f.readTimeout,
+		transport: &http3.Transport{
+			TLSClientConfig: f.tlsConfig,
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: f.dialTimeout,
+			},
+			Dial: dialQUIC,
+		},
+	}, nil
+}
+
+func dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyConnection, error) {
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, &http3HandshakeError{err: err}
+	}
+	return conn, nil
+}
+
+// http3HostClient sends the requests of one host over a quic connection
+type http3HostClient struct {
+	transport   *http3.Transport
+	readTimeout time.Duration
+	// failedAt is the unix nano time of the last failed handshake
+	failedAt atomic.Int64
+}
+
+func (c *http3HostClient) Do(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+	if failedAt := c.failedAt.Load(); failedAt > 0 && time.Since(time.Unix(0, failedAt)) < http3RetryInterval {
+		return &http3HandshakeError{err: errors.New("the last handshake failed, http3 is retried later")}
+	}
+
+	// the whole request is bounded by the request timeout of the service or the read timeout
+	timeout := req.Options().RequestTimeout()
+	if timeout <= 0 {
+		timeout = c.readTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	httpReq, err := adaptor.GetCompatRequest(req)
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	// the host header is sent as :authority
+	httpReq.Host = string(req.Header.Host())
+	if len(httpReq.Host) == 0 {
+		httpReq.Host = string(req.URI().Host())
+	}
+	httpReq.Header.Del("Host")
+
+	httpResp, err := c.transport.RoundTrip(httpReq)
+	if err != nil {
+		var handshakeErr *http3HandshakeError
+		if errors.As(err, &handshakeErr) {
+			c.failedAt.Store(time.Now().UnixNano())
+		}
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	resp.Reset()
+	resp.SetStatusCode(httpResp.StatusCode)
+	for key, values := range httpResp.Header {
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+	resp.SetBody(body)
+
+	return nil
+}
+
+func (c *http3HostClient) SetDynamicConfig(dc *protocolclient.DynamicConfig) {
+}
+
+func (c *http3HostClient) CloseIdleConnections() {
+	c.transport.CloseIdleConnections()
+}
+
+func (c *http3HostClient) ShouldRemove() bool {
+	return false
+}
+
+func (c *http3HostClient) ConnectionCount() int {
+	return 0
+}
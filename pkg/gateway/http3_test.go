@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"http-benchmark/pkg/config"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/hertz-contrib/http2/factory"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP3(t *testing.T) {
+	cert := newTestCertificate(t)
+
+	h3 := &http3.Server{
+		Addr:      "127.0.0.1:9964",
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Proto", r.Proto)
+			w.Header().Set("X-Host", r.Host)
+			w.WriteHeader(201)
+			_, _ = w.Write([]byte("hello " + r.URL.Path))
+		}),
+	}
+	go func() {
+		_ = h3.ListenAndServe()
+	}()
+	defer h3.Close()
+
+	// tcp only servers, the quic handshake never succeeds
+	newTCPServer := func(addr string, http2 bool) {
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if http2 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		h := server.New(server.WithHostPorts(addr), server.WithTLS(tlsConfig), server.WithALPN(http2))
+		if http2 {
+			h.AddProtocol("h2", factory.NewServerFactory())
+		}
+		h.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.Set("X-Proto", ctx.Request.Header.GetProtocol())
+			ctx.String(200, "fallback")
+		})
+		go h.Spin()
+	}
+	newTCPServer("127.0.0.1:9963", false)
+	newTCPServer("127.0.0.1:9962", true)
+	time.Sleep(time.Second)
+
+	serve := func(t *testing.T, opts config.ServiceOptions) *app.RequestContext {
+		opts.ID = "http3"
+		opts.Protocol = config.ProtocolHTTP3
+		opts.Timeout.DailTimeout = time.Second
+		service, err := newService(&Bifrost{opts: &config.Options{}}, opts)
+		assert.NoError(t, err)
+
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://client.example.com/h3")
+		hzCtx.Request.Header.SetHost("client.example.com")
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	t.Run("proxy over http3", func(t *testing.T) {
+		hzCtx := serve(t, config.ServiceOptions{Url: "https://127.0.0.1:9964"})
+		assert.Equal(t, 201, hzCtx.Response.StatusCode())
+		assert.Equal(t, "hello /h3", string(hzCtx.Response.Body()))
+		assert.Equal(t, "HTTP/3.0", string(hzCtx.Response.Header.Peek("X-Proto")))
+		assert.Equal(t, "client.example.com", string(hzCtx.Response.Header.Peek("X-Host")))
+	})
+
+	t.Run("fallback to http1", func(t *testing.T) {
+		hzCtx := serve(t, config.ServiceOptions{Url: "https://127.0.0.1:9963"})
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "fallback", string(hzCtx.Response.Body()))
+		assert.Equal(t, "HTTP/1.1", string(hzCtx.Response.Header.Peek("X-Proto")))
+	})
+
+	t.Run("fallback to http2", func(t *testing.T) {
+		hzCtx := serve(t, config.ServiceOptions{Url: "https://127.0.0.1:9962", HTTP3Fallback: config.HTTP3FallbackHTTP2})
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "fallback", string(hzCtx.Response.Body()))
+		assert.Equal(t, "HTTP/2.0", string(hzCtx.Response.Header.Peek("X-Proto")))
+	})
+
+	t.Run("fallback off", func(t *testing.T) {
+		hzCtx := serve(t, config.ServiceOptions{Url: "https://127.0.0.1:9963", HTTP3Fallback: config.HTTP3FallbackOff})
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+	})
+}
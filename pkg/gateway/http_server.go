@@ -9,6 +9,9 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,21 +19,54 @@ import (
 	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
 	"github.com/cloudwego/hertz/pkg/common/hlog"
 	"github.com/cloudwego/hertz/pkg/common/tracer"
+	"github.com/cloudwego/hertz/pkg/network"
 	configHTTP2 "github.com/hertz-contrib/http2/config"
 	"github.com/hertz-contrib/http2/factory"
 	hertzslog "github.com/hertz-contrib/logger/slog"
 	"github.com/hertz-contrib/pprof"
-	"golang.org/x/sys/unix"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// the logger of hertz is global and read by every running server, so it is set once before any server starts
+func init() {
+	logger := hertzslog.NewLogger(hertzslog.WithOutput(io.Discard))
+	hlog.SetLevel(hlog.LevelError)
+	hlog.SetLogger(logger)
+	hlog.SetSilentMode(true)
+}
+
 type HTTPServer struct {
 	entryOpts *config.EntryOptions
 	switcher  *switcher
 	server    *server.Hertz
+	acme      *autocert.Manager
+	tunnels   *websocketTunnels
+
+	// shutdownCh starts the graceful shutdown of Spin, stopped is closed when Spin returns after the in-flight
+	// requests are drained
+	running      atomic.Bool
+	shutdownOnce sync.Once
+	shutdownCh   chan struct{}
+	stopped      chan struct{}
+
+	// proxyProtocolTrusted are the sources allowed to send the PROXY header, see acceptProxyProtocol
+	proxyProtocolTrusted []*net.IPNet
+	proxyProtocolErrors  atomic.Uint64
+
+	// draining is set when the graceful shutdown starts, /readyz fails so no new traffic is sent to the entry
+	draining atomic.Bool
 }
 
 func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tracer.Tracer) (*HTTPServer, error) {
 
+	httpServer := &HTTPServer{
+		entryOpts:  &entryOpts,
+		acme:       bifrost.acme[entryOpts.ID],
+		tunnels:    newWebSocketTunnels(entryOpts.ID),
+		shutdownCh: make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
 	hzOpts := []hzconfig.Option{
 		server.WithHostPorts(entryOpts.Bind),
 		server.WithDisableDefaultDate(true),
@@ -39,6 +75,7 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 		server.WithReadTimeout(time.Second * 60),
 		server.WithKeepAlive(true),
 		server.WithALPN(true),
+		server.WithOnConnect(httpServer.onConnect),
 		withDefaultServerHeader(true),
 	}
 
@@ -78,11 +115,6 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 	switcher := newSwitcher(engine)
 
 	// hertz server
-	logger := hertzslog.NewLogger(hertzslog.WithOutput(io.Discard))
-	hlog.SetLevel(hlog.LevelError)
-	hlog.SetLogger(logger)
-	hlog.SetSilentMode(true)
-
 	hzOpts = append(hzOpts, engine.options...)
 
 	for _, tracer := range tracers {
@@ -95,17 +127,23 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 
 	if entryOpts.ReusePort {
 		hzOpts = append(hzOpts, server.WithListenConfig(&net.ListenConfig{
-			Control: func(network, address string, c syscall.RawConn) error {
-				return c.Control(func(fd uintptr) {
-					err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-					if err != nil {
-						return
-					}
-				})
-			},
+			Control: reusePortControl,
 		}))
 	}
 
+	if entryOpts.ProxyProtocol {
+		trusted, err := parseCIDRs("proxy_protocol_trusted_cidrs", entryOpts.ProxyProtocolTrustedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		httpServer.proxyProtocolTrusted = trusted
+
+		hzOpts = append(hzOpts,
+			server.WithTransport(httpServer.newProxyProtocolTransport),
+			server.WithOnAccept(httpServer.acceptProxyProtocol),
+		)
+	}
+
 	var tlsConfig *tls.Config
 	if entryOpts.TLS.Enabled {
 		tlsConfig = &tls.Config{
@@ -119,37 +157,53 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 			},
 		}
 
-		if entryOpts.TLS.CertPEM == "" {
-			return nil, fmt.Errorf("cert_pem can't be empty")
+		manager := bifrost.acme[entryOpts.ID]
+
+		// cert_pem and key_pem are optional with acme, they are used for hosts which are not managed by acme
+		if manager == nil || entryOpts.TLS.CertPEM != "" || entryOpts.TLS.KeyPEM != "" {
+			if entryOpts.TLS.CertPEM == "" {
+				return nil, fmt.Errorf("cert_pem can't be empty")
+			}
+
+			if entryOpts.TLS.KeyPEM == "" {
+				return nil, fmt.Errorf("key_pem can't be empty")
+			}
+
+			certPEM, err := os.ReadFile(entryOpts.TLS.CertPEM)
+			if err != nil {
+				return nil, err
+			}
+
+			keyPEM, err := os.ReadFile(entryOpts.TLS.KeyPEM)
+			if err != nil {
+				return nil, err
+			}
+
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
 		}
 
-		if entryOpts.TLS.KeyPEM == "" {
-			return nil, fmt.Errorf("key_pem can't be empty")
+		if manager != nil {
+			setACMECertificate(tlsConfig, manager)
 		}
 
-		certPEM, err := os.ReadFile(entryOpts.TLS.CertPEM)
-		if err != nil {
-			return nil, err
-		}
-
-		keyPEM, err := os.ReadFile(entryOpts.TLS.KeyPEM)
-		if err != nil {
-			return nil, err
-		}
+		setSNIRejection(tlsConfig, func() *sniRouter {
+			return switcher.Engine().sni
+		})
 
-		cert, err := tls.X509KeyPair(certPEM, keyPEM)
-		if err != nil {
-			return nil, err
+		if entryOpts.TLS.ClientAuth.Enabled {
+			if err := setClientAuth(tlsConfig, entryOpts.TLS.ClientAuth); err != nil {
+				return nil, err
+			}
 		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
 		hzOpts = append(hzOpts, server.WithTLS(tlsConfig))
 	}
 
-	httpServer := &HTTPServer{
-		entryOpts: &entryOpts,
-	}
-
 	h := server.Default(hzOpts...)
+	h.SetCustomSignalWaiter(httpServer.waitSignal)
 
 	if entryOpts.HTTP2 {
 		http2opts := []configHTTP2.Option{}
@@ -177,10 +231,17 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 
 	})
 
+	// websocket tunnels are hijacked from the server, so it doesn't wait for them
+	h.OnShutdown = append(h.OnShutdown, httpServer.tunnels.Shutdown)
+
 	if entryOpts.PPROF {
 		pprof.Register(h)
 	}
 
+	if entryOpts.Probes.Enabled {
+		h.Use(httpServer.serveProbes)
+	}
+
 	h.Use(switcher.ServeHTTP)
 
 	httpServer.switcher = switcher
@@ -189,11 +250,70 @@ func newHTTPServer(bifrost *Bifrost, entryOpts config.EntryOptions, tracers []tr
 	return httpServer, nil
 }
 
+type connStateKey struct{}
+
+// connState holds the state shared by every request of a client connection
+type connState struct {
+	requests atomic.Int64
+
+	// tunnels of the entry, the connection is tracked there once it is upgraded to websocket
+	tunnels *websocketTunnels
+}
+
+func (s *HTTPServer) onConnect(ctx context.Context, conn network.Conn) context.Context {
+	return context.WithValue(ctx, connStateKey{}, &connState{tunnels: s.tunnels})
+}
+
 func (s *HTTPServer) Run() {
 	slog.Info("starting entry", "id", s.entryOpts.ID, "bind", s.entryOpts.Bind)
+
+	if s.acme != nil {
+		go prefetchACMECertificates(s.entryOpts.ID, s.acme, s.entryOpts.TLS.ACME.Hosts)
+	}
+
+	s.running.Store(true)
+	defer close(s.stopped)
+
 	s.server.Spin()
 }
 
+// Shutdown closes the listener, so no new connection is accepted, and waits for the in-flight requests to finish.
+// The connections which are still active after graceful_timeout are closed.
 func (s *HTTPServer) Shutdown(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	if !s.running.Load() {
+		return nil
+	}
+
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownCh)
+	})
+
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitSignal replaces the signal waiter of hertz, which closes every connection at once on SIGTERM.
+// SIGTERM drains the entry like SIGINT does, and Shutdown starts the same graceful shutdown.
+// SIGHUP reloads the config instead, see Bifrost.Run.
+func (s *HTTPServer) waitSignal(errCh chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		s.draining.Store(true)
+		slog.Info("draining entry", "id", s.entryOpts.ID, "signal", sig.String())
+		return nil
+	case <-s.shutdownCh:
+		s.draining.Store(true)
+		slog.Info("draining entry", "id", s.entryOpts.ID)
+		return nil
+	case err := <-errCh:
+		return err
+	}
 }
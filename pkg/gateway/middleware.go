@@ -6,35 +6,94 @@ import (
 	"http-benchmark/pkg/config"
 	"http-benchmark/pkg/log"
 	"http-benchmark/pkg/middleware/addprefix"
+	"http-benchmark/pkg/middleware/decompress"
+	"http-benchmark/pkg/middleware/geoip"
+	"http-benchmark/pkg/middleware/hsts"
+	"http-benchmark/pkg/middleware/keyauth"
+	"http-benchmark/pkg/middleware/ratelimit"
 	"http-benchmark/pkg/middleware/replacepath"
 	"http-benchmark/pkg/middleware/replacepathregex"
+	"http-benchmark/pkg/middleware/requestid"
 	"http-benchmark/pkg/middleware/stripprefix"
 	"http-benchmark/pkg/middleware/timinglogger"
+	"http-benchmark/pkg/middleware/transformbody"
 	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type initMiddleware struct {
-	logger  *slog.Logger
-	entryID string
+	logger         *slog.Logger
+	entryID        string
+	trustedProxies []*net.IPNet
+
+	maxHeaderLineSize  int
+	maxHeaderTotalSize int
+	maxHeaderCount     int
 }
 
-func newInitMiddleware(entryID string, logger *slog.Logger) *initMiddleware {
+func newInitMiddleware(entryOpts config.EntryOptions, logger *slog.Logger) *initMiddleware {
+	// the trusted proxies are validated by validateEntry
+	trustedProxies, _ := parseTrustedProxies(entryOpts.TrustedProxies)
+
 	return &initMiddleware{
-		logger:  logger,
-		entryID: entryID,
+		logger:             logger,
+		entryID:            entryOpts.ID,
+		trustedProxies:     trustedProxies,
+		maxHeaderLineSize:  entryOpts.MaxHeaderLineSize,
+		maxHeaderTotalSize: entryOpts.MaxHeaderTotalSize,
+		maxHeaderCount:     entryOpts.MaxHeaderCount,
 	}
 }
 
+func clientIPFunc(ctx *app.RequestContext) string {
+	return ctx.GetString(config.CLIENT_IP)
+}
+
 func (m *initMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	logger := m.logger
 
+	if msg := m.checkHeaderLimits(ctx); len(msg) > 0 {
+		logger.WarnContext(c, "request header fields too large", slog.String("reason", msg))
+		ctx.Response.Header.SetContentType("text/plain; charset=utf-8")
+		ctx.Response.SetStatusCode(431)
+		ctx.Response.SetBodyString("Request Header Fields Too Large: " + msg)
+		ctx.Abort()
+		return
+	}
+
 	if len(ctx.Request.Header.Get("X-Forwarded-For")) > 0 {
 		ctx.Set("X-Forwarded-For", ctx.Request.Header.Get("X-Forwarded-For"))
 	}
 
+	// the client ip is the ip of the connection unless it is a trusted proxy, ctx.ClientIP of hertz
+	// would trust X-Forwarded-For and X-Real-IP of any client
+	if addr := ctx.RemoteAddr(); addr != nil {
+		peer, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			peer = addr.String()
+		}
+
+		clientIP := peer
+		if len(m.trustedProxies) > 0 {
+			var trusted bool
+			clientIP, trusted = realClientIP(peer, ctx.Request.Header.PeekAll("X-Forwarded-For"), m.trustedProxies)
+			if trusted {
+				ctx.Set(trustedPeerKey, true)
+			} else {
+				ctx.Set(untrustedPeerKey, true)
+			}
+		}
+
+		ctx.Set(config.CLIENT_IP, clientIP)
+		ctx.SetClientIPFunc(clientIPFunc)
+	}
+
 	spanCtx := trace.SpanContextFromContext(c)
 	if spanCtx.HasTraceID() {
 		traceID := spanCtx.TraceID().String()
@@ -45,10 +104,57 @@ func (m *initMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 
 	ctx.Set(config.ENTRY_ID, m.entryID)
 
+	// the server name requested in the tls ClientHello, it may differ from the Host header
+	if serverName := tlsServerName(ctx); len(serverName) > 0 {
+		ctx.Set(config.SSL_SERVER_NAME, serverName)
+	}
+
+	if cert := clientCertificate(ctx); cert != nil {
+		ctx.Set(config.SSL_CLIENT_S_DN, cert.Subject.String())
+		ctx.Set(config.SSL_CLIENT_SAN, strings.Join(certificateSANs(cert), ","))
+	}
+
+	if state, ok := c.Value(connStateKey{}).(*connState); ok {
+		ctx.Set(config.CONNECTION_REQUESTS, strconv.FormatInt(state.requests.Add(1), 10))
+	}
+
 	c = log.NewContext(c, logger)
 	ctx.Next(c)
 }
 
+// checkHeaderLimits returns the reason when a request header exceeds the limits of the entry.
+// A header line is counted as "name: value".
+func (m *initMiddleware) checkHeaderLimits(ctx *app.RequestContext) string {
+	if m.maxHeaderLineSize <= 0 && m.maxHeaderTotalSize <= 0 && m.maxHeaderCount <= 0 {
+		return ""
+	}
+
+	var reason string
+	count := 0
+	total := 0
+
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		if len(reason) > 0 {
+			return
+		}
+
+		size := len(key) + len(value) + 2
+		count++
+		total += size
+
+		switch {
+		case m.maxHeaderLineSize > 0 && size > m.maxHeaderLineSize:
+			reason = fmt.Sprintf("header '%s' exceeds %d bytes", key, m.maxHeaderLineSize)
+		case m.maxHeaderTotalSize > 0 && total > m.maxHeaderTotalSize:
+			reason = fmt.Sprintf("total header size exceeds %d bytes", m.maxHeaderTotalSize)
+		case m.maxHeaderCount > 0 && count > m.maxHeaderCount:
+			reason = fmt.Sprintf("header count exceeds %d", m.maxHeaderCount)
+		}
+	})
+
+	return reason
+}
+
 type CreateMiddlewareHandler func(param map[string]any) (app.HandlerFunc, error)
 
 var middlewareFactory map[string]CreateMiddlewareHandler = make(map[string]CreateMiddlewareHandler)
@@ -109,7 +215,10 @@ func init() {
 	})
 
 	_ = RegisterMiddleware("add_prefix", func(params map[string]any) (app.HandlerFunc, error) {
-		prefix := params["prefix"].(string)
+		prefix, ok := params["prefix"].(string)
+		if !ok {
+			return nil, fmt.Errorf("add_prefix prefix must be a string")
+		}
 		m := addprefix.NewMiddleware(prefix)
 		return m.ServeHTTP, nil
 	})
@@ -121,9 +230,20 @@ func init() {
 	})
 
 	_ = RegisterMiddleware("replace_path_regex", func(params map[string]any) (app.HandlerFunc, error) {
-		regex := params["regex"].(string)
-		replacement := params["replacement"].(string)
-		m := replacepathregex.NewMiddleware(regex, replacement)
+		regex, ok := params["regex"].(string)
+		if !ok {
+			return nil, fmt.Errorf("replace_path_regex regex must be a string")
+		}
+
+		replacement, ok := params["replacement"].(string)
+		if !ok {
+			return nil, fmt.Errorf("replace_path_regex replacement must be a string")
+		}
+
+		m, err := replacepathregex.NewMiddleware(regex, replacement)
+		if err != nil {
+			return nil, fmt.Errorf("replace_path_regex regex '%s' is invalid: %w", regex, err)
+		}
 		return m.ServeHTTP, nil
 	})
 
@@ -131,4 +251,437 @@ func init() {
 		m := timinglogger.NewMiddleware()
 		return m.ServeHTTP, nil
 	})
+
+	_ = RegisterMiddleware("hsts", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := hsts.Options{MaxAge: hsts.DefaultMaxAge}
+
+		if val, found := params["max_age"]; found {
+			maxAge, ok := val.(int)
+			if !ok || maxAge < 0 {
+				return nil, fmt.Errorf("hsts max_age must be a non-negative number of seconds")
+			}
+			opts.MaxAge = maxAge
+		}
+
+		opts.IncludeSubDomains, _ = params["include_subdomains"].(bool)
+		opts.Preload, _ = params["preload"].(bool)
+		opts.Redirect, _ = params["redirect"].(bool)
+		opts.RedirectPort, _ = params["redirect_port"].(int)
+
+		m := hsts.NewMiddleware(opts)
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("rate_limit", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := ratelimit.Options{}
+
+		algorithm, _ := params["algorithm"].(string)
+		switch ratelimit.Algorithm(algorithm) {
+		case "", ratelimit.FixedWindow, ratelimit.SlidingWindow:
+			opts.Algorithm = ratelimit.Algorithm(algorithm)
+
+			limit, ok := params["limit"].(int)
+			if !ok || limit <= 0 {
+				return nil, fmt.Errorf("rate_limit limit must be a positive number")
+			}
+
+			val, _ := params["window"].(string)
+			window, err := time.ParseDuration(val)
+			if err != nil || window <= 0 {
+				return nil, fmt.Errorf("rate_limit window '%s' is invalid", val)
+			}
+
+			opts.Limit = limit
+			opts.Window = window
+		case ratelimit.TokenBucket:
+			opts.Algorithm = ratelimit.TokenBucket
+
+			switch rate := params["rate"].(type) {
+			case int:
+				opts.Rate = float64(rate)
+			case float64:
+				opts.Rate = rate
+			}
+			if opts.Rate <= 0 {
+				return nil, fmt.Errorf("rate_limit rate must be a positive number of tokens per second")
+			}
+
+			burst, ok := params["burst"].(int)
+			if !ok || burst <= 0 {
+				return nil, fmt.Errorf("rate_limit burst must be a positive number")
+			}
+
+			opts.Burst = burst
+			opts.Limit = burst
+		default:
+			return nil, fmt.Errorf("rate_limit algorithm '%s' is invalid", algorithm)
+		}
+
+		switch key := params["key"].(type) {
+		case string:
+			opts.Keys = []string{key}
+		case []any:
+			for _, v := range key {
+				expr, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("rate_limit key must be a list of variables")
+				}
+				opts.Keys = append(opts.Keys, expr)
+			}
+		}
+
+		if val, found := params["limit_by"]; found {
+			if len(opts.Keys) > 0 {
+				return nil, fmt.Errorf("rate_limit key and limit_by can't be both set")
+			}
+
+			var values []any
+			switch limitBy := val.(type) {
+			case string:
+				values = []any{limitBy}
+			case []any:
+				values = limitBy
+			default:
+				return nil, fmt.Errorf("rate_limit limit_by must be a string or a list")
+			}
+
+			for _, v := range values {
+				s, _ := v.(string)
+				variable, err := ratelimit.LimitBy(s)
+				if err != nil {
+					return nil, fmt.Errorf("rate_limit %w", err)
+				}
+				opts.Keys = append(opts.Keys, variable)
+			}
+		}
+
+		opts.FallbackKey, _ = params["fallback_key"].(string)
+
+		emptyKey, _ := params["empty_key"].(string)
+		switch ratelimit.EmptyKeyPolicy(emptyKey) {
+		case "", ratelimit.EmptyKeyClientIP:
+		case ratelimit.EmptyKeyAllow, ratelimit.EmptyKeyDeny:
+			if len(opts.FallbackKey) > 0 {
+				return nil, fmt.Errorf("rate_limit fallback_key can't be set when empty_key is '%s'", emptyKey)
+			}
+		default:
+			return nil, fmt.Errorf("rate_limit empty_key '%s' is invalid", emptyKey)
+		}
+		opts.EmptyKey = ratelimit.EmptyKeyPolicy(emptyKey)
+
+		if val, found := params["cost"]; found {
+			cost, ok := val.(int)
+			if !ok || cost <= 0 {
+				return nil, fmt.Errorf("rate_limit cost must be a positive number")
+			}
+			if cost > opts.Limit {
+				return nil, fmt.Errorf("rate_limit cost %d exceeds the limit %d", cost, opts.Limit)
+			}
+			opts.Cost = cost
+		}
+
+		headers, _ := params["headers"].(string)
+		switch ratelimit.HeaderStyle(headers) {
+		case "", ratelimit.HeadersDraft, ratelimit.HeadersLegacy:
+			opts.Headers = ratelimit.HeaderStyle(headers)
+		default:
+			return nil, fmt.Errorf("rate_limit headers '%s' is invalid", headers)
+		}
+
+		if val, found := params["reject_status"]; found {
+			status, ok := val.(int)
+			if !ok || status < 400 || status > 599 {
+				return nil, fmt.Errorf("rate_limit reject_status must be a 4xx or 5xx status")
+			}
+			opts.RejectStatus = status
+		}
+
+		opts.RejectBody, _ = params["reject_body"].(string)
+		opts.RejectContentType, _ = params["reject_content_type"].(string)
+
+		if val, found := params["max_keys"]; found {
+			maxKeys, ok := val.(int)
+			if !ok || maxKeys <= 0 {
+				return nil, fmt.Errorf("rate_limit max_keys must be a positive number")
+			}
+			opts.MaxKeys = maxKeys
+		}
+
+		if name, found := params["limiter"]; found {
+			s, _ := name.(string)
+			factory, ok := ratelimit.GetLimiter(s)
+			if !ok {
+				return nil, fmt.Errorf("rate_limit limiter '%v' is not registered", name)
+			}
+
+			failover, _ := params["failover"].(string)
+			switch ratelimit.FailoverPolicy(failover) {
+			case "", ratelimit.FailOpen, ratelimit.FailClosed, ratelimit.LocalFallback:
+				opts.Failover = ratelimit.FailoverPolicy(failover)
+			default:
+				return nil, fmt.Errorf("rate_limit failover '%s' is invalid", failover)
+			}
+
+			if val, found := params["latency_budget"]; found {
+				s, _ := val.(string)
+				budget, err := time.ParseDuration(s)
+				if err != nil || budget <= 0 {
+					return nil, fmt.Errorf("rate_limit latency_budget '%v' is invalid", val)
+				}
+				opts.LatencyBudget = budget
+			}
+
+			limiter, err := factory(opts)
+			if err != nil {
+				return nil, fmt.Errorf("rate_limit fail to create limiter '%s': %w", s, err)
+			}
+			opts.Limiter = limiter
+		} else if _, found := params["failover"]; found {
+			return nil, fmt.Errorf("rate_limit failover requires a limiter")
+		}
+
+		m := ratelimit.NewMiddleware(opts)
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("decompress", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := decompress.Options{MaxSize: decompress.DefaultMaxSize}
+
+		if val, found := params["max_size"]; found {
+			maxSize, ok := val.(int)
+			if !ok || maxSize <= 0 {
+				return nil, fmt.Errorf("decompress max_size must be a positive number of bytes")
+			}
+			opts.MaxSize = maxSize
+		}
+
+		m := decompress.NewMiddleware(opts)
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("transform_body", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := transformbody.Options{MaxSize: transformbody.DefaultMaxSize}
+
+		for key, fn := range map[string]*transformbody.Func{"request": &opts.Request, "response": &opts.Response} {
+			val, found := params[key]
+			if !found {
+				continue
+			}
+
+			name, ok := val.(string)
+			if !ok || len(name) == 0 {
+				return nil, fmt.Errorf("transform_body %s must be the name of a registered transform", key)
+			}
+
+			if *fn, ok = transformbody.Get(name); !ok {
+				return nil, fmt.Errorf("transform_body %s '%s' is not registered", key, name)
+			}
+		}
+
+		if opts.Request == nil && opts.Response == nil {
+			return nil, fmt.Errorf("transform_body request or response must be set")
+		}
+
+		if val, found := params["content_types"]; found {
+			contentTypes, ok := val.([]any)
+			if !ok {
+				return nil, fmt.Errorf("transform_body content_types must be a list")
+			}
+
+			for _, c := range contentTypes {
+				contentType, ok := c.(string)
+				if !ok || len(contentType) == 0 {
+					return nil, fmt.Errorf("transform_body content_types can't contain an empty content type")
+				}
+				opts.ContentTypes = append(opts.ContentTypes, contentType)
+			}
+		}
+
+		if val, found := params["max_size"]; found {
+			maxSize, ok := val.(int)
+			if !ok || maxSize <= 0 {
+				return nil, fmt.Errorf("transform_body max_size must be a positive number of bytes")
+			}
+			opts.MaxSize = maxSize
+		}
+
+		m := transformbody.NewMiddleware(opts)
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("request_id", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := requestid.Options{Header: requestid.DefaultHeader, TrustIncoming: true}
+
+		if val, found := params["header"]; found {
+			header, ok := val.(string)
+			if !ok || len(header) == 0 {
+				return nil, fmt.Errorf("request_id header can't be empty")
+			}
+			opts.Header = header
+		}
+
+		if val, found := params["trust_incoming"]; found {
+			trustIncoming, ok := val.(bool)
+			if !ok {
+				return nil, fmt.Errorf("request_id trust_incoming must be a boolean")
+			}
+			opts.TrustIncoming = trustIncoming
+		}
+
+		m := requestid.NewMiddleware(opts)
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("key_auth", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := keyauth.Options{Header: keyauth.DefaultHeader}
+
+		if val, found := params["header"]; found {
+			header, ok := val.(string)
+			if !ok || len(header) == 0 {
+				return nil, fmt.Errorf("key_auth header can't be empty")
+			}
+			opts.Header = header
+		}
+
+		if val, found := params["query"]; found {
+			query, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("key_auth query must be a string")
+			}
+			opts.Query = query
+		}
+
+		val, found := params["keys"]
+		if !found {
+			return nil, fmt.Errorf("key_auth keys can't be empty")
+		}
+
+		keys, ok := val.([]any)
+		if !ok || len(keys) == 0 {
+			return nil, fmt.Errorf("key_auth keys must be a non-empty list")
+		}
+
+		for i, k := range keys {
+			key, err := parseAPIKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("key_auth keys[%d] %w", i, err)
+			}
+			opts.Keys = append(opts.Keys, key)
+		}
+
+		m, err := keyauth.NewMiddleware(opts)
+		if err != nil {
+			return nil, fmt.Errorf("key_auth %w", err)
+		}
+		return m.ServeHTTP, nil
+	})
+
+	_ = RegisterMiddleware("geoip", func(params map[string]any) (app.HandlerFunc, error) {
+		opts := geoip.Options{}
+
+		database, ok := params["database"].(string)
+		if !ok || len(database) == 0 {
+			return nil, fmt.Errorf("geoip database can't be empty")
+		}
+		opts.Database = database
+
+		if val, found := params["asn_database"]; found {
+			asnDatabase, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("geoip asn_database must be a string")
+			}
+			opts.ASNDatabase = asnDatabase
+		}
+
+		for key, countries := range map[string]*[]string{"allow_countries": &opts.AllowCountries, "deny_countries": &opts.DenyCountries} {
+			val, found := params[key]
+			if !found {
+				continue
+			}
+
+			list, ok := val.([]any)
+			if !ok {
+				return nil, fmt.Errorf("geoip %s must be a list", key)
+			}
+
+			for _, c := range list {
+				country, ok := c.(string)
+				if !ok {
+					return nil, fmt.Errorf("geoip %s must be a list of country codes", key)
+				}
+				*countries = append(*countries, country)
+			}
+		}
+
+		if val, found := params["unknown_action"]; found {
+			action, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("geoip unknown_action must be a string")
+			}
+			opts.UnknownAction = action
+		}
+
+		if val, found := params["error_action"]; found {
+			action, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("geoip error_action must be a string")
+			}
+			opts.ErrorAction = action
+		}
+
+		m, err := geoip.NewMiddleware(opts)
+		if err != nil {
+			return nil, fmt.Errorf("geoip %w", err)
+		}
+		return m.ServeHTTP, nil
+	})
+}
+
+func parseAPIKey(val any) (keyauth.Key, error) {
+	key := keyauth.Key{}
+
+	params, ok := val.(map[string]any)
+	if !ok {
+		return key, fmt.Errorf("must be a map")
+	}
+
+	if key.Hash, ok = params["hash"].(string); !ok {
+		return key, fmt.Errorf("hash must be a string")
+	}
+
+	if key.Owner, ok = params["owner"].(string); !ok {
+		return key, fmt.Errorf("owner must be a string")
+	}
+
+	if val, found := params["expires_at"]; found {
+		switch expiresAt := val.(type) {
+		case time.Time:
+			key.ExpiresAt = expiresAt
+		case string:
+			t, err := time.Parse(time.RFC3339, expiresAt)
+			if err != nil {
+				return key, fmt.Errorf("expires_at '%s' must be in RFC3339 format", expiresAt)
+			}
+			key.ExpiresAt = t
+		default:
+			return key, fmt.Errorf("expires_at must be a time in RFC3339 format")
+		}
+	}
+
+	if val, found := params["paths"]; found {
+		paths, ok := val.([]any)
+		if !ok {
+			return key, fmt.Errorf("paths must be a list")
+		}
+
+		for _, p := range paths {
+			path, ok := p.(string)
+			if !ok || len(path) == 0 {
+				return key, fmt.Errorf("paths can't contain an empty path")
+			}
+			key.Paths = append(key.Paths, path)
+		}
+	}
+
+	return key, nil
 }
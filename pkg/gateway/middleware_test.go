@@ -0,0 +1,1487 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/log"
+	"http-benchmark/pkg/middleware/decompress"
+	"http-benchmark/pkg/middleware/keyauth"
+	"http-benchmark/pkg/middleware/ratelimit"
+	"http-benchmark/pkg/middleware/transformbody"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	m := newInitMiddleware(config.EntryOptions{
+		ID:                 "test",
+		MaxHeaderLineSize:  64,
+		MaxHeaderTotalSize: 128,
+	}, slog.Default())
+
+	serve := func(headers map[string]string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/")
+		for k, v := range headers {
+			ctx.Request.Header.Set(k, v)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m.ServeHTTP, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	ctx := serve(map[string]string{"X-Token": "abc"})
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	// oversized single header
+	ctx = serve(map[string]string{"Cookie": "session=" + strings.Repeat("a", 64)})
+	assert.Equal(t, 431, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "exceeds 64 bytes")
+
+	// oversized total
+	ctx = serve(map[string]string{
+		"X-A": strings.Repeat("a", 40),
+		"X-B": strings.Repeat("b", 40),
+		"X-C": strings.Repeat("c", 40),
+	})
+	assert.Equal(t, 431, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "total header size exceeds 128 bytes")
+}
+
+func TestHeaderCountLimit(t *testing.T) {
+	m := newInitMiddleware(config.EntryOptions{
+		ID:             "test",
+		MaxHeaderCount: 2,
+	}, slog.Default())
+
+	ctx := app.NewContext(0)
+	ctx.Request.SetRequestURI("http://localhost/")
+	ctx.Request.Header.Set("X-A", "a")
+	ctx.Request.Header.Set("X-B", "b")
+	ctx.Request.Header.Set("X-C", "c")
+	ctx.SetHandlers([]app.HandlerFunc{m.ServeHTTP})
+	ctx.Next(context.Background())
+
+	assert.Equal(t, 431, ctx.Response.StatusCode())
+}
+
+func TestHSTS(t *testing.T) {
+	serve := func(m app.HandlerFunc, method, uri string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, "ok")
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	m, err := middlewareFactory["hsts"](map[string]any{
+		"max_age":            63072000,
+		"include_subdomains": true,
+		"preload":            true,
+	})
+	assert.NoError(t, err)
+
+	ctx := serve(m, "GET", "https://localhost/orders")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "max-age=63072000; includeSubDomains; preload", string(ctx.Response.Header.Peek("Strict-Transport-Security")))
+
+	// plaintext responses never carry the header
+	ctx = serve(m, "GET", "http://localhost/orders")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Header.Peek("Strict-Transport-Security"))
+
+	m, err = middlewareFactory["hsts"](map[string]any{
+		"redirect":      true,
+		"redirect_port": 8443,
+	})
+	assert.NoError(t, err)
+
+	ctx = serve(m, "GET", "https://localhost:8443/orders")
+	assert.Equal(t, "max-age=31536000", string(ctx.Response.Header.Peek("Strict-Transport-Security")))
+
+	ctx = serve(m, "GET", "http://localhost:8080/orders?id=1")
+	assert.Equal(t, 301, ctx.Response.StatusCode())
+	assert.Equal(t, "https://localhost:8443/orders?id=1", string(ctx.Response.Header.Peek("Location")))
+	assert.Empty(t, ctx.Response.Header.Peek("Strict-Transport-Security"))
+
+	ctx = serve(m, "POST", "http://localhost/orders")
+	assert.Equal(t, 308, ctx.Response.StatusCode())
+	assert.Equal(t, "https://localhost:8443/orders", string(ctx.Response.Header.Peek("Location")))
+
+	_, err = middlewareFactory["hsts"](map[string]any{"max_age": "1y"})
+	assert.Error(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	serve := func(m app.HandlerFunc, headers map[string]string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		for k, v := range headers {
+			ctx.Request.Header.Set(k, v)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, "ok")
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	m, err := middlewareFactory["rate_limit"](map[string]any{
+		"limit":        2,
+		"window":       "1m",
+		"key":          []any{"$header_X-Api-Key"},
+		"fallback_key": "anonymous",
+	})
+	assert.NoError(t, err)
+
+	ctx := serve(m, map[string]string{"X-Api-Key": "a"})
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "2", string(ctx.Response.Header.Peek("RateLimit-Limit")))
+	assert.Equal(t, "1", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+	assert.Equal(t, "60", string(ctx.Response.Header.Peek("RateLimit-Reset")))
+
+	ctx = serve(m, map[string]string{"X-Api-Key": "a"})
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+
+	ctx = serve(m, map[string]string{"X-Api-Key": "a"})
+	assert.Equal(t, 429, ctx.Response.StatusCode())
+	assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+	assert.Equal(t, "60", string(ctx.Response.Header.Peek("Retry-After")))
+
+	// every key has its own window
+	ctx = serve(m, map[string]string{"X-Api-Key": "b"})
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	// requests without the key share the fallback key
+	ctx = serve(m, nil)
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	ctx = serve(m, nil)
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	ctx = serve(m, nil)
+	assert.Equal(t, 429, ctx.Response.StatusCode())
+
+	_, err = middlewareFactory["rate_limit"](map[string]any{"limit": 0, "window": "1m"})
+	assert.Error(t, err)
+
+	_, err = middlewareFactory["rate_limit"](map[string]any{"limit": 1, "window": "soon"})
+	assert.Error(t, err)
+
+	_, err = middlewareFactory["rate_limit"](map[string]any{"limit": 1, "window": "1m", "algorithm": "leaky_bucket"})
+	assert.Error(t, err)
+
+	t.Run("token bucket", func(t *testing.T) {
+		m, err := middlewareFactory["rate_limit"](map[string]any{
+			"algorithm": "token_bucket",
+			"rate":      5,
+			"burst":     3,
+		})
+		assert.NoError(t, err)
+
+		// the full bucket allows a burst
+		for _, remaining := range []string{"2", "1", "0"} {
+			ctx := serve(m, nil)
+			assert.Equal(t, 200, ctx.Response.StatusCode())
+			assert.Equal(t, "3", string(ctx.Response.Header.Peek("RateLimit-Limit")))
+			assert.Equal(t, remaining, string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+			assert.Equal(t, "1", string(ctx.Response.Header.Peek("RateLimit-Reset")))
+		}
+
+		// the next token is available in 200ms
+		ctx := serve(m, nil)
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+		assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+		assert.Equal(t, "1", string(ctx.Response.Header.Peek("Retry-After")))
+
+		// one token is refilled, not the whole burst
+		time.Sleep(250 * time.Millisecond)
+		ctx = serve(m, nil)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+		ctx = serve(m, nil)
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+
+		// the bucket is full again after burst / rate
+		time.Sleep(650 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, 200, serve(m, nil).Response.StatusCode())
+		}
+		assert.Equal(t, 429, serve(m, nil).Response.StatusCode())
+
+		// a fractional rate
+		m, err = middlewareFactory["rate_limit"](map[string]any{"algorithm": "token_bucket", "rate": 0.5, "burst": 1})
+		assert.NoError(t, err)
+		assert.Equal(t, 200, serve(m, nil).Response.StatusCode())
+		ctx = serve(m, nil)
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+		assert.Equal(t, "2", string(ctx.Response.Header.Peek("Retry-After")))
+
+		for _, params := range []map[string]any{
+			{"algorithm": "token_bucket", "burst": 3},
+			{"algorithm": "token_bucket", "rate": 0, "burst": 3},
+			{"algorithm": "token_bucket", "rate": 5},
+		} {
+			_, err := middlewareFactory["rate_limit"](params)
+			assert.Error(t, err, params)
+		}
+	})
+
+	// one request at the start and one at the end of a window, then two more right after the window.
+	// The fixed window allows both, the sliding window still counts the request at the end of the window.
+	burst := func(algorithm string) []int {
+		m, err := middlewareFactory["rate_limit"](map[string]any{
+			"limit":     2,
+			"window":    "300ms",
+			"algorithm": algorithm,
+		})
+		assert.NoError(t, err)
+
+		statuses := make([]int, 0, 4)
+		statuses = append(statuses, serve(m, nil).Response.StatusCode())
+		time.Sleep(200 * time.Millisecond)
+		statuses = append(statuses, serve(m, nil).Response.StatusCode())
+		time.Sleep(150 * time.Millisecond)
+		statuses = append(statuses, serve(m, nil).Response.StatusCode())
+		statuses = append(statuses, serve(m, nil).Response.StatusCode())
+		return statuses
+	}
+
+	assert.Equal(t, []int{200, 200, 200, 200}, burst("fixed_window"))
+	assert.Equal(t, []int{200, 200, 200, 429}, burst("sliding_window"))
+
+	// an expensive route consumes more of the quota shared with the other routes
+	for _, algorithm := range []string{"fixed_window", "sliding_window"} {
+		m, err := middlewareFactory["rate_limit"](map[string]any{
+			"limit":     10,
+			"window":    "1m",
+			"algorithm": algorithm,
+			"cost":      2,
+		})
+		assert.NoError(t, err)
+
+		search := func(c context.Context, ctx *app.RequestContext) {
+			ctx.Set(ratelimit.Cost, 5)
+			ctx.Next(c)
+		}
+		serveRoute := func(handlers ...app.HandlerFunc) *app.RequestContext {
+			ctx := app.NewContext(0)
+			ctx.Request.SetRequestURI("http://localhost/search")
+			ctx.SetHandlers(append(handlers, m, func(c context.Context, ctx *app.RequestContext) {
+				ctx.String(200, "ok")
+			}))
+			ctx.Next(context.Background())
+			return ctx
+		}
+
+		ctx = serveRoute()
+		assert.Equal(t, 200, ctx.Response.StatusCode(), algorithm)
+		assert.Equal(t, "8", string(ctx.Response.Header.Peek("RateLimit-Remaining")), algorithm)
+
+		ctx = serveRoute(search)
+		assert.Equal(t, 200, ctx.Response.StatusCode(), algorithm)
+		assert.Equal(t, "3", string(ctx.Response.Header.Peek("RateLimit-Remaining")), algorithm)
+
+		// the remaining quota isn't enough for the search, but it is for a cheaper request
+		ctx = serveRoute(search)
+		assert.Equal(t, 429, ctx.Response.StatusCode(), algorithm)
+		assert.Equal(t, "3", string(ctx.Response.Header.Peek("RateLimit-Remaining")), algorithm)
+		assert.Equal(t, "60", string(ctx.Response.Header.Peek("Retry-After")), algorithm)
+
+		ctx = serveRoute()
+		assert.Equal(t, 200, ctx.Response.StatusCode(), algorithm)
+		assert.Equal(t, "1", string(ctx.Response.Header.Peek("RateLimit-Remaining")), algorithm)
+
+		// a request which costs more than the limit is never allowed
+		ctx = serveRoute(func(c context.Context, ctx *app.RequestContext) {
+			ctx.Set(ratelimit.Cost, 11)
+			ctx.Next(c)
+		})
+		assert.Equal(t, 429, ctx.Response.StatusCode(), algorithm)
+		assert.Empty(t, ctx.Response.Header.Peek("Retry-After"), algorithm)
+	}
+
+	_, err = middlewareFactory["rate_limit"](map[string]any{"limit": 1, "window": "1m", "cost": 2})
+	assert.Error(t, err)
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	serve := func(m app.HandlerFunc) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, "ok")
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	headers := func(ctx *app.RequestContext, prefix string) []string {
+		return []string{
+			string(ctx.Response.Header.Peek(prefix + "Limit")),
+			string(ctx.Response.Header.Peek(prefix + "Remaining")),
+			string(ctx.Response.Header.Peek(prefix + "Reset")),
+		}
+	}
+
+	t.Run("fixed window", func(t *testing.T) {
+		m, err := middlewareFactory["rate_limit"](map[string]any{
+			"limit":               2,
+			"window":              "1s",
+			"reject_status":       503,
+			"reject_body":         `{"error":"rate limited","limit":$limit,"retry_after":$reset}`,
+			"reject_content_type": "application/json",
+		})
+		assert.NoError(t, err)
+
+		ctx := serve(m)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, []string{"2", "1", "1"}, headers(ctx, "RateLimit-"))
+		assert.Empty(t, ctx.Response.Header.Peek("X-RateLimit-Limit"))
+		assert.False(t, ctx.GetBool(config.RATE_LIMITED))
+
+		ctx = serve(m)
+		assert.Equal(t, []string{"2", "0", "1"}, headers(ctx, "RateLimit-"))
+
+		ctx = serve(m)
+		assert.Equal(t, 503, ctx.Response.StatusCode())
+		assert.Equal(t, []string{"2", "0", "1"}, headers(ctx, "RateLimit-"))
+		assert.Equal(t, "1", string(ctx.Response.Header.Peek("Retry-After")))
+		assert.Equal(t, `{"error":"rate limited","limit":2,"retry_after":1}`, string(ctx.Response.Body()))
+		assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+		assert.True(t, ctx.GetBool(config.RATE_LIMITED))
+
+		// the next window starts with the full limit
+		time.Sleep(1100 * time.Millisecond)
+		ctx = serve(m)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, []string{"2", "1", "1"}, headers(ctx, "RateLimit-"))
+		assert.Empty(t, ctx.Response.Header.Peek("Retry-After"))
+	})
+
+	t.Run("sliding window", func(t *testing.T) {
+		m, err := middlewareFactory["rate_limit"](map[string]any{
+			"limit":     2,
+			"window":    "1s",
+			"algorithm": "sliding_window",
+			"headers":   "legacy",
+		})
+		assert.NoError(t, err)
+
+		ctx := serve(m)
+		assert.Equal(t, []string{"2", "1", "1"}, headers(ctx, "X-RateLimit-"))
+		assert.Empty(t, ctx.Response.Header.Peek("RateLimit-Limit"))
+
+		time.Sleep(600 * time.Millisecond)
+		ctx = serve(m)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		// the first request leaves the window in 400ms
+		assert.Equal(t, []string{"2", "0", "1"}, headers(ctx, "X-RateLimit-"))
+
+		ctx = serve(m)
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+		assert.Equal(t, "1", string(ctx.Response.Header.Peek("Retry-After")))
+		assert.Empty(t, ctx.Response.Body())
+
+		// the first request is out of the window, the second one is still in it
+		time.Sleep(500 * time.Millisecond)
+		ctx = serve(m)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, []string{"2", "0", "1"}, headers(ctx, "X-RateLimit-"))
+
+		ctx = serve(m)
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+	})
+
+	t.Run("request costs more than the limit", func(t *testing.T) {
+		m, err := middlewareFactory["rate_limit"](map[string]any{"limit": 2, "window": "1s", "reject_body": "limit $limit"})
+		assert.NoError(t, err)
+
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/search")
+		ctx.Set(ratelimit.Cost, 3)
+		ctx.SetHandlers([]app.HandlerFunc{m})
+		ctx.Next(context.Background())
+		assert.Equal(t, 429, ctx.Response.StatusCode())
+		assert.Equal(t, "limit 2", string(ctx.Response.Body()))
+		assert.Empty(t, ctx.Response.Header.Peek("Retry-After"))
+		assert.True(t, ctx.GetBool(config.RATE_LIMITED))
+	})
+
+	t.Run("no bucket is consulted", func(t *testing.T) {
+		m, err := middlewareFactory["rate_limit"](map[string]any{"limit": 2, "window": "1s", "key": "$header_X-Api-Key", "empty_key": "allow"})
+		assert.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			ctx := serve(m)
+			assert.Equal(t, 200, ctx.Response.StatusCode())
+			assert.Equal(t, []string{"2", "2", "0"}, headers(ctx, "RateLimit-"))
+		}
+
+		for policy, status := range map[ratelimit.FailoverPolicy]int{ratelimit.FailOpen: 200, ratelimit.FailClosed: 503} {
+			shared := &fakeSharedLimiter{limiter: ratelimit.NewMemoryLimiter(2, time.Second, 0)}
+			shared.down.Store(true)
+			m := ratelimit.NewMiddleware(ratelimit.Options{Limit: 2, Window: time.Second, Limiter: shared, Failover: policy})
+
+			ctx := serve(m.ServeHTTP)
+			assert.Equal(t, status, ctx.Response.StatusCode(), policy)
+			assert.Equal(t, []string{"2", "2", "0"}, headers(ctx, "RateLimit-"), policy)
+			assert.False(t, ctx.GetBool(config.RATE_LIMITED), policy)
+		}
+	})
+
+	for _, params := range []map[string]any{{"headers": "ietf"}, {"reject_status": 200}, {"reject_status": "429"}} {
+		params["limit"] = 1
+		params["window"] = "1m"
+		_, err := middlewareFactory["rate_limit"](params)
+		assert.Error(t, err, params)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	type request struct {
+		path    string
+		headers map[string]string
+		vars    map[string]string
+	}
+
+	serve := func(m app.HandlerFunc, r request) int {
+		ctx := app.NewContext(0)
+		path := r.path
+		if len(path) == 0 {
+			path = "/orders"
+		}
+		ctx.Request.SetRequestURI("http://localhost" + path)
+		for k, v := range r.headers {
+			ctx.Request.Header.Set(k, v)
+		}
+		for k, v := range r.vars {
+			ctx.Set(k, v)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, "ok")
+		}})
+		ctx.Next(context.Background())
+		return ctx.Response.StatusCode()
+	}
+
+	newMiddleware := func(params map[string]any) app.HandlerFunc {
+		params["limit"] = 1
+		params["window"] = "1m"
+		m, err := middlewareFactory["rate_limit"](params)
+		assert.NoError(t, err)
+		return m
+	}
+
+	// the first request of a key is allowed and the second is limited, so other and another don't share the key
+	testCases := []struct {
+		name    string
+		params  map[string]any
+		other   request
+		another request
+	}{
+		{
+			name:    "client ip",
+			params:  map[string]any{"key": "$client_ip"},
+			other:   request{vars: map[string]string{config.CLIENT_IP: "10.0.0.1"}},
+			another: request{vars: map[string]string{config.CLIENT_IP: "10.0.0.2"}},
+		},
+		{
+			name:    "header",
+			params:  map[string]any{"key": "$header_X-Api-Key"},
+			other:   request{headers: map[string]string{"X-Api-Key": "a"}},
+			another: request{headers: map[string]string{"X-Api-Key": "b"}},
+		},
+		{
+			name:    "header with underscores",
+			params:  map[string]any{"key": "$header_x_api_key"},
+			other:   request{headers: map[string]string{"X-Api-Key": "a"}},
+			another: request{headers: map[string]string{"X-Api-Key": "b"}},
+		},
+		{
+			name:    "cookie",
+			params:  map[string]any{"key": "$cookie_session"},
+			other:   request{headers: map[string]string{"Cookie": "session=a"}},
+			another: request{headers: map[string]string{"Cookie": "session=b"}},
+		},
+		{
+			name:    "context variable",
+			params:  map[string]any{"key": "$jwt_sub"},
+			other:   request{vars: map[string]string{"$jwt_sub": "alice"}},
+			another: request{vars: map[string]string{"$jwt_sub": "bob"}},
+		},
+		{
+			name:    "composite",
+			params:  map[string]any{"key": "$client_ip:$request_path"},
+			other:   request{path: "/orders", vars: map[string]string{config.CLIENT_IP: "10.0.0.1"}},
+			another: request{path: "/users", vars: map[string]string{config.CLIENT_IP: "10.0.0.1"}},
+		},
+		{
+			name:    "path before rewrite",
+			params:  map[string]any{"key": "$request_path"},
+			other:   request{path: "/api/orders", vars: map[string]string{config.REQUEST_PATH: "/orders"}},
+			another: request{path: "/api/orders", vars: map[string]string{config.REQUEST_PATH: "/users"}},
+		},
+		{
+			name:    "limit_by",
+			params:  map[string]any{"limit_by": "header:X-Api-Key"},
+			other:   request{headers: map[string]string{"X-Api-Key": "a"}},
+			another: request{headers: map[string]string{"X-Api-Key": "b"}},
+		},
+		{
+			name:    "composite limit_by",
+			params:  map[string]any{"limit_by": []any{"ip", "path"}},
+			other:   request{path: "/orders", vars: map[string]string{config.CLIENT_IP: "10.0.0.1"}},
+			another: request{path: "/orders", vars: map[string]string{config.CLIENT_IP: "10.0.0.2"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMiddleware(tc.params)
+			assert.Equal(t, 200, serve(m, tc.other))
+			assert.Equal(t, 429, serve(m, tc.other))
+			assert.Equal(t, 200, serve(m, tc.another))
+			assert.Equal(t, 429, serve(m, tc.another))
+		})
+	}
+
+	// the requests without the api key
+	anonymous := func(ip string) request {
+		return request{vars: map[string]string{config.CLIENT_IP: ip}}
+	}
+
+	t.Run("empty key falls back to client ip", func(t *testing.T) {
+		m := newMiddleware(map[string]any{"key": "$header_X-Api-Key"})
+		assert.Equal(t, 200, serve(m, anonymous("10.0.0.1")))
+		assert.Equal(t, 429, serve(m, anonymous("10.0.0.1")))
+		assert.Equal(t, 200, serve(m, anonymous("10.0.0.2")))
+
+		m = newMiddleware(map[string]any{"key": "$header_X-Api-Key", "empty_key": "client_ip"})
+		assert.Equal(t, 200, serve(m, anonymous("10.0.0.1")))
+		assert.Equal(t, 429, serve(m, anonymous("10.0.0.1")))
+	})
+
+	t.Run("empty key is allowed", func(t *testing.T) {
+		m := newMiddleware(map[string]any{"key": "$header_X-Api-Key", "empty_key": "allow"})
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, 200, serve(m, anonymous("10.0.0.1")))
+		}
+
+		// a composite key is empty only when all of its variables are
+		m = newMiddleware(map[string]any{"key": "$header_X-Api-Key:$jwt_sub", "empty_key": "allow"})
+		partial := request{vars: map[string]string{"$jwt_sub": "alice"}}
+		assert.Equal(t, 200, serve(m, partial))
+		assert.Equal(t, 429, serve(m, partial))
+	})
+
+	t.Run("empty key is denied", func(t *testing.T) {
+		m := newMiddleware(map[string]any{"key": "$header_X-Api-Key", "empty_key": "deny"})
+		assert.Equal(t, 429, serve(m, anonymous("10.0.0.1")))
+		assert.Equal(t, 200, serve(m, request{headers: map[string]string{"X-Api-Key": "a"}}))
+	})
+
+	t.Run("constant key", func(t *testing.T) {
+		m := newMiddleware(map[string]any{"key": "global", "empty_key": "deny"})
+		assert.Equal(t, 200, serve(m, anonymous("10.0.0.1")))
+		assert.Equal(t, 429, serve(m, anonymous("10.0.0.2")))
+	})
+
+	invalid := []map[string]any{
+		{"empty_key": "skip"},
+		{"empty_key": "deny", "fallback_key": "anonymous"},
+		{"key": "$client_ip", "limit_by": "ip"},
+		{"limit_by": "query:id"},
+		{"limit_by": "header:"},
+		{"limit_by": 1},
+	}
+	for _, params := range invalid {
+		params["limit"] = 1
+		params["window"] = "1m"
+		_, err := middlewareFactory["rate_limit"](params)
+		assert.Error(t, err, params)
+	}
+}
+
+// fakeSharedLimiter stands for a limiter backed by redis, it fails while it is down and honours the latency budget
+type fakeSharedLimiter struct {
+	limiter *ratelimit.MemoryLimiter
+	down    atomic.Bool
+	delay   atomic.Int64
+}
+
+func (l *fakeSharedLimiter) Allow(ctx context.Context, key string, cost int) (ratelimit.AllowResult, error) {
+	if l.down.Load() {
+		return ratelimit.AllowResult{}, errors.New("connection refused")
+	}
+
+	select {
+	case <-time.After(time.Duration(l.delay.Load())):
+	case <-ctx.Done():
+		return ratelimit.AllowResult{}, ctx.Err()
+	}
+	return l.limiter.Allow(ctx, key, cost)
+}
+
+func TestRateLimitFailover(t *testing.T) {
+	serve := func(m app.HandlerFunc) int {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		ctx.Set(config.CLIENT_IP, "10.0.0.1")
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, "ok")
+		}})
+		ctx.Next(context.Background())
+		return ctx.Response.StatusCode()
+	}
+
+	newMiddleware := func(policy ratelimit.FailoverPolicy) (app.HandlerFunc, *fakeSharedLimiter) {
+		shared := &fakeSharedLimiter{limiter: ratelimit.NewMemoryLimiter(10, time.Minute, 0)}
+		m := ratelimit.NewMiddleware(ratelimit.Options{
+			Limit:         10,
+			Window:        time.Minute,
+			Limiter:       shared,
+			Failover:      policy,
+			LatencyBudget: 50 * time.Millisecond,
+		})
+		return m.ServeHTTP, shared
+	}
+
+	count := func(m app.HandlerFunc, n int) map[int]int {
+		statuses := map[int]int{}
+		for i := 0; i < n; i++ {
+			statuses[serve(m)]++
+		}
+		return statuses
+	}
+
+	t.Run("local fallback", func(t *testing.T) {
+		m, shared := newMiddleware(ratelimit.LocalFallback)
+		assert.Equal(t, map[int]int{200: 4}, count(m, 4))
+
+		// the local limiter takes over with its own window
+		shared.down.Store(true)
+		assert.Equal(t, map[int]int{200: 10, 429: 5}, count(m, 15))
+
+		// the shared limiter still holds the requests before it went down
+		shared.down.Store(false)
+		assert.Equal(t, map[int]int{200: 6, 429: 2}, count(m, 8))
+	})
+
+	t.Run("latency budget", func(t *testing.T) {
+		m, shared := newMiddleware(ratelimit.LocalFallback)
+		shared.delay.Store(int64(time.Second))
+
+		start := time.Now()
+		assert.Equal(t, map[int]int{200: 10, 429: 2}, count(m, 12))
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Equal(t, 0, shared.limiter.Len())
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		m, shared := newMiddleware(ratelimit.FailOpen)
+		shared.down.Store(true)
+		assert.Equal(t, map[int]int{200: 15}, count(m, 15))
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		m, shared := newMiddleware(ratelimit.FailClosed)
+		assert.Equal(t, map[int]int{200: 2}, count(m, 2))
+		shared.down.Store(true)
+		assert.Equal(t, map[int]int{503: 3}, count(m, 3))
+	})
+
+	t.Run("config", func(t *testing.T) {
+		_ = ratelimit.RegisterLimiter("failover_test", func(opts ratelimit.Options) (ratelimit.Limiter, error) {
+			return &fakeSharedLimiter{limiter: ratelimit.NewMemoryLimiter(opts.Limit, opts.Window, 0)}, nil
+		})
+		assert.Error(t, ratelimit.RegisterLimiter("failover_test", nil))
+
+		_, err := middlewareFactory["rate_limit"](map[string]any{
+			"limit": 10, "window": "1m", "limiter": "failover_test", "failover": "local_fallback", "latency_budget": "20ms", "max_keys": 1000,
+		})
+		assert.NoError(t, err)
+
+		invalid := []map[string]any{
+			{"limiter": "memcached"},
+			{"limiter": "failover_test", "failover": "retry"},
+			{"limiter": "failover_test", "latency_budget": "fast"},
+			{"failover": "fail_closed"},
+			{"max_keys": 0},
+		}
+		for _, params := range invalid {
+			params["limit"] = 10
+			params["window"] = "1m"
+			_, err := middlewareFactory["rate_limit"](params)
+			assert.Error(t, err, params)
+		}
+	})
+}
+
+func TestRateLimitMaxKeys(t *testing.T) {
+	limiters := map[string]interface {
+		ratelimit.Limiter
+		Len() int
+	}{
+		"fixed_window":   ratelimit.NewMemoryLimiter(1, time.Minute, 100),
+		"sliding_window": ratelimit.NewSlidingWindowLimiter(1, time.Minute, 100),
+		"token_bucket":   ratelimit.NewTokenBucketLimiter(0.01, 1, 100),
+	}
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < 1000; i++ {
+				result, err := limiter.Allow(ctx, strconv.Itoa(i), 1)
+				assert.NoError(t, err)
+				assert.True(t, result.Allowed)
+			}
+			assert.Equal(t, 100, limiter.Len())
+
+			// the recent keys are still limited, the least recently used keys were evicted and start a new window
+			result, _ := limiter.Allow(ctx, "999", 1)
+			assert.False(t, result.Allowed)
+			result, _ = limiter.Allow(ctx, "0", 1)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, 100, limiter.Len())
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	body := strings.Repeat("orders ", 100)
+
+	compress := func(encoding string, data []byte) []byte {
+		buf := bytes.Buffer{}
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		}
+		_, err := w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	serve := func(m app.HandlerFunc, acceptEncoding string, encoding string, respBody []byte) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		if len(acceptEncoding) > 0 {
+			ctx.Request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.Set("Content-Encoding", encoding)
+			ctx.Response.Header.Set("ETag", `"v1"`)
+			ctx.Response.SetBody(respBody)
+			ctx.Response.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	m, err := middlewareFactory["decompress"](map[string]any{})
+	assert.NoError(t, err)
+
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			ctx := serve(m, "identity", encoding, compress(encoding, []byte(body)))
+			assert.Equal(t, 200, ctx.Response.StatusCode())
+			assert.Equal(t, body, string(ctx.Response.Body()))
+			assert.Empty(t, ctx.Response.Header.Peek("Content-Encoding"))
+			assert.Equal(t, len(body), ctx.Response.Header.ContentLength())
+			assert.Equal(t, `W/"v1"`, string(ctx.Response.Header.Peek("ETag")))
+		})
+	}
+
+	t.Run("accepted encoding", func(t *testing.T) {
+		compressed := compress("gzip", []byte(body))
+
+		ctx := serve(m, "br, gzip;q=0.8", "gzip", compressed)
+		assert.Equal(t, compressed, ctx.Response.Body())
+		assert.Equal(t, "gzip", string(ctx.Response.Header.Peek("Content-Encoding")))
+
+		ctx = serve(m, "*", "gzip", compressed)
+		assert.Equal(t, compressed, ctx.Response.Body())
+
+		// q=0 refuses the encoding
+		ctx = serve(m, "gzip;q=0, br", "gzip", compressed)
+		assert.Equal(t, body, string(ctx.Response.Body()))
+	})
+
+	t.Run("corrupt body", func(t *testing.T) {
+		compressed := compress("gzip", []byte(body))
+		ctx := serve(m, "", "gzip", compressed[:len(compressed)/2])
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+		assert.Empty(t, ctx.Response.Header.Peek("Content-Encoding"))
+
+		ctx = serve(m, "", "br", []byte("not brotli"))
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+	})
+
+	t.Run("zip bomb", func(t *testing.T) {
+		// decodes to twice the default max_size
+		bomb := compress("gzip", make([]byte, 2*decompress.DefaultMaxSize))
+
+		ctx := serve(m, "", "gzip", bomb)
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+
+		_, err := decompress.Decode("gzip", bomb, decompress.DefaultMaxSize)
+		assert.ErrorIs(t, err, decompress.ErrTooLarge)
+
+		// the decoder rejects the body at the first byte after max_size
+		decoded, err := decompress.Decode("gzip", compress("gzip", make([]byte, decompress.DefaultMaxSize)), decompress.DefaultMaxSize)
+		assert.NoError(t, err)
+		assert.Len(t, decoded, decompress.DefaultMaxSize)
+
+		_, err = decompress.Decode("gzip", compress("gzip", make([]byte, decompress.DefaultMaxSize+1)), decompress.DefaultMaxSize)
+		assert.ErrorIs(t, err, decompress.ErrTooLarge)
+
+		small, err := middlewareFactory["decompress"](map[string]any{"max_size": len(body) - 1})
+		assert.NoError(t, err)
+		ctx = serve(small, "", "gzip", compress("gzip", []byte(body)))
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+	})
+
+	_, err = middlewareFactory["decompress"](map[string]any{"max_size": "32MB"})
+	assert.Error(t, err)
+}
+
+func TestRequestID(t *testing.T) {
+	serve := func(m app.HandlerFunc, header string, id string) (*app.RequestContext, string, string) {
+		logs := bytes.Buffer{}
+		c := log.NewContext(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)))
+
+		var upstreamID string
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		if len(id) > 0 {
+			ctx.Request.Header.Set(header, id)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			upstreamID = string(ctx.Request.Header.Peek(header))
+			log.FromContext(c).InfoContext(c, "proxy request")
+			ctx.Response.Reset()
+			ctx.Response.SetStatusCode(200)
+		}})
+		ctx.Next(c)
+		return ctx, upstreamID, logs.String()
+	}
+
+	m, err := middlewareFactory["request_id"](map[string]any{})
+	assert.NoError(t, err)
+
+	t.Run("incoming id", func(t *testing.T) {
+		ctx, upstreamID, logs := serve(m, "X-Request-ID", "orders-1")
+		assert.Equal(t, "orders-1", ctx.GetString(config.REQUEST_ID))
+		assert.Equal(t, "orders-1", upstreamID)
+		assert.Equal(t, "orders-1", string(ctx.Response.Header.Peek("X-Request-ID")))
+		assert.Contains(t, logs, "request_id=orders-1")
+	})
+
+	t.Run("generated id", func(t *testing.T) {
+		ctx, upstreamID, logs := serve(m, "X-Request-ID", "")
+		id, err := uuid.Parse(ctx.GetString(config.REQUEST_ID))
+		assert.NoError(t, err)
+		assert.Equal(t, uuid.Version(7), id.Version())
+		assert.Equal(t, id.String(), upstreamID)
+		assert.Equal(t, id.String(), string(ctx.Response.Header.Peek("X-Request-ID")))
+		assert.Contains(t, logs, "request_id="+id.String())
+
+		// an id which can't be logged as is, is replaced
+		ctx, _, _ = serve(m, "X-Request-ID", strings.Repeat("a", 129))
+		assert.Len(t, ctx.GetString(config.REQUEST_ID), 36)
+	})
+
+	t.Run("untrusted incoming id", func(t *testing.T) {
+		untrusted, err := middlewareFactory["request_id"](map[string]any{"header": "X-Correlation-ID", "trust_incoming": false})
+		assert.NoError(t, err)
+
+		ctx, upstreamID, _ := serve(untrusted, "X-Correlation-ID", "orders-1")
+		id := ctx.GetString(config.REQUEST_ID)
+		assert.NotEqual(t, "orders-1", id)
+		assert.Len(t, id, 36)
+		assert.Equal(t, id, upstreamID)
+		assert.Equal(t, id, string(ctx.Response.Header.Peek("X-Correlation-ID")))
+	})
+
+	_, err = middlewareFactory["request_id"](map[string]any{"trust_incoming": "no"})
+	assert.Error(t, err)
+}
+
+func TestKeyAuth(t *testing.T) {
+	serve := func(m app.HandlerFunc, uri string, header string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI(uri)
+		if len(header) > 0 {
+			ctx.Request.Header.Set("X-API-Key", header)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	m, err := middlewareFactory["key_auth"](map[string]any{
+		"query": "api_key",
+		"keys": []any{
+			map[string]any{"hash": keyauth.HashKey("mobile-key"), "owner": "mobile", "paths": []any{"/api/v1/"}},
+			map[string]any{"hash": keyauth.HashKey("partner-key"), "owner": "partner", "expires_at": time.Now().Add(time.Hour).Format(time.RFC3339)},
+			map[string]any{"hash": keyauth.HashKey("old-key"), "owner": "old", "expires_at": time.Now().Add(-time.Hour)},
+			map[string]any{"hash": keyauth.HashKey("internal-key"), "owner": "internal", "paths": []any{"/api/v1"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("header", func(t *testing.T) {
+		ctx := serve(m, "http://localhost/api/v1/orders", "mobile-key")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "mobile", ctx.GetString(config.API_KEY_OWNER))
+
+		ctx = serve(m, "http://localhost/api/v1/orders", "partner-key")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "partner", ctx.GetString(config.API_KEY_OWNER))
+	})
+
+	t.Run("query", func(t *testing.T) {
+		ctx := serve(m, "http://localhost/api/v1/orders?api_key=mobile-key", "")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "mobile", ctx.GetString(config.API_KEY_OWNER))
+	})
+
+	t.Run("missing or unknown key", func(t *testing.T) {
+		ctx := serve(m, "http://localhost/api/v1/orders", "")
+		assert.Equal(t, 401, ctx.Response.StatusCode())
+		assert.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+		assert.JSONEq(t, `{"error":"api key is missing"}`, string(ctx.Response.Body()))
+
+		ctx = serve(m, "http://localhost/api/v1/orders", "unknown-key")
+		assert.Equal(t, 401, ctx.Response.StatusCode())
+		assert.Empty(t, ctx.GetString(config.API_KEY_OWNER))
+	})
+
+	t.Run("expired key", func(t *testing.T) {
+		ctx := serve(m, "http://localhost/api/v1/orders", "old-key")
+		assert.Equal(t, 401, ctx.Response.StatusCode())
+		assert.JSONEq(t, `{"error":"api key is expired"}`, string(ctx.Response.Body()))
+		assert.Empty(t, ctx.GetString(config.API_KEY_OWNER))
+	})
+
+	t.Run("path restriction", func(t *testing.T) {
+		ctx := serve(m, "http://localhost/api/v2/orders", "mobile-key")
+		assert.Equal(t, 403, ctx.Response.StatusCode())
+		assert.JSONEq(t, `{"error":"api key can't access the path"}`, string(ctx.Response.Body()))
+
+		// a prefix only matches whole path segments
+		ctx = serve(m, "http://localhost/api/v1", "internal-key")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		ctx = serve(m, "http://localhost/api/v1/orders", "internal-key")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		ctx = serve(m, "http://localhost/api/v1-admin", "internal-key")
+		assert.Equal(t, 403, ctx.Response.StatusCode())
+		ctx = serve(m, "http://localhost/api/v1beta/orders", "internal-key")
+		assert.Equal(t, 403, ctx.Response.StatusCode())
+
+		// the original path is checked after the path is rewritten
+		ctx = app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		ctx.Request.Header.Set("X-API-Key", "mobile-key")
+		ctx.Set(config.REQUEST_PATH, "/api/v1/orders")
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+	})
+
+	t.Run("verify key", func(t *testing.T) {
+		assert.True(t, keyauth.VerifyKey(keyauth.HashKey("mobile-key"), "mobile-key"))
+		assert.False(t, keyauth.VerifyKey(keyauth.HashKey("mobile-key"), "partner-key"))
+	})
+
+	_, err = middlewareFactory["key_auth"](map[string]any{"keys": []any{map[string]any{"hash": "mobile-key", "owner": "mobile"}}})
+	assert.Error(t, err)
+
+	_, err = middlewareFactory["key_auth"](map[string]any{"keys": []any{map[string]any{"hash": keyauth.HashKey("mobile-key"), "owner": ""}}})
+	assert.Error(t, err)
+
+	_, err = middlewareFactory["key_auth"](map[string]any{})
+	assert.Error(t, err)
+}
+
+func TestGeoIP(t *testing.T) {
+	serve := func(m app.HandlerFunc, clientIP string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/")
+		ctx.Set(config.CLIENT_IP, clientIP)
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	t.Run("allow countries", func(t *testing.T) {
+		m, err := middlewareFactory["geoip"](map[string]any{
+			"database":        "./testdata/geoip.mmdb",
+			"allow_countries": []any{"au", "JP"},
+		})
+		assert.NoError(t, err)
+
+		ctx := serve(m, "1.1.1.1")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "AU", ctx.GetString(config.GEOIP_COUNTRY))
+		assert.Equal(t, "13335", ctx.GetString(config.GEOIP_ASN))
+
+		ctx = serve(m, "8.8.8.8")
+		assert.Equal(t, 403, ctx.Response.StatusCode())
+		assert.Equal(t, "US", ctx.GetString(config.GEOIP_COUNTRY))
+		assert.Equal(t, "15169", ctx.GetString(config.GEOIP_ASN))
+
+		// registered_country is used when country is absent
+		ctx = serve(m, "2001:db8::1")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "JP", ctx.GetString(config.GEOIP_COUNTRY))
+		assert.Empty(t, ctx.GetString(config.GEOIP_ASN))
+	})
+
+	t.Run("deny countries", func(t *testing.T) {
+		m, err := middlewareFactory["geoip"](map[string]any{
+			"database":       "./testdata/geoip.mmdb",
+			"deny_countries": []any{"US"},
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 200, serve(m, "1.1.1.1").Response.StatusCode())
+		assert.Equal(t, 403, serve(m, "8.8.8.8").Response.StatusCode())
+	})
+
+	t.Run("unknown ip", func(t *testing.T) {
+		m, err := middlewareFactory["geoip"](map[string]any{
+			"database":       "./testdata/geoip.mmdb",
+			"deny_countries": []any{"US"},
+		})
+		assert.NoError(t, err)
+
+		ctx := serve(m, "10.0.0.1")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Empty(t, ctx.GetString(config.GEOIP_COUNTRY))
+
+		m, err = middlewareFactory["geoip"](map[string]any{
+			"database":        "./testdata/geoip.mmdb",
+			"allow_countries": []any{"AU"},
+			"unknown_action":  "deny",
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 403, serve(m, "10.0.0.1").Response.StatusCode())
+		assert.Equal(t, 403, serve(m, "fd00::1").Response.StatusCode())
+		assert.Equal(t, 200, serve(m, "1.1.1.1").Response.StatusCode())
+	})
+
+	t.Run("lookup error", func(t *testing.T) {
+		b, err := os.ReadFile("./testdata/geoip.mmdb")
+		assert.NoError(t, err)
+
+		db, err := maxminddb.FromBytes(b)
+		assert.NoError(t, err)
+		treeSize := int(db.Metadata.NodeCount * db.Metadata.RecordSize / 4)
+
+		// the search tree is kept and the data section is overwritten, so the records can't be decoded
+		dataEnd := bytes.LastIndex(b, []byte("\xAB\xCD\xEFMaxMind.com"))
+		for i := treeSize + 16; i < dataEnd; i++ {
+			b[i] = 0xFF
+		}
+		path := filepath.Join(t.TempDir(), "corrupted.mmdb")
+		assert.NoError(t, os.WriteFile(path, b, 0644))
+
+		m, err := middlewareFactory["geoip"](map[string]any{
+			"database":       path,
+			"deny_countries": []any{"US"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 403, serve(m, "8.8.8.8").Response.StatusCode())
+
+		m, err = middlewareFactory["geoip"](map[string]any{
+			"database":       path,
+			"deny_countries": []any{"US"},
+			"error_action":   "allow",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 200, serve(m, "8.8.8.8").Response.StatusCode())
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		_, err := middlewareFactory["geoip"](map[string]any{})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["geoip"](map[string]any{
+			"database":        "./testdata/geoip.mmdb",
+			"allow_countries": []any{"AU"},
+			"deny_countries":  []any{"US"},
+		})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["geoip"](map[string]any{
+			"database":       "./testdata/geoip.mmdb",
+			"unknown_action": "block",
+		})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["geoip"](map[string]any{
+			"database":     "./testdata/geoip.mmdb",
+			"error_action": "block",
+		})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["geoip"](map[string]any{
+			"database": "./testdata/not_found.mmdb",
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("reload database", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "geoip.mmdb")
+
+		copyFile := func(src, dst string) {
+			b, err := os.ReadFile(src)
+			assert.NoError(t, err)
+			assert.NoError(t, os.WriteFile(dst, b, 0644))
+		}
+		copyFile("./testdata/geoip.mmdb", path)
+
+		m, err := middlewareFactory["geoip"](map[string]any{
+			"database":        path,
+			"allow_countries": []any{"AU"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 200, serve(m, "1.1.1.1").Response.StatusCode())
+
+		// the database is replaced by a rename like geoipupdate does
+		copyFile("./testdata/geoip_reloaded.mmdb", filepath.Join(dir, "geoip.mmdb.tmp"))
+		assert.NoError(t, os.Rename(filepath.Join(dir, "geoip.mmdb.tmp"), path))
+
+		assert.Eventually(t, func() bool {
+			return serve(m, "1.1.1.1").GetString(config.GEOIP_COUNTRY) == "NZ"
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Equal(t, 403, serve(m, "1.1.1.1").Response.StatusCode())
+	})
+}
+
+func TestTransformBody(t *testing.T) {
+	// the internal fields are removed and id is renamed to order_id
+	_ = transformbody.Register("test_orders", func(c context.Context, ctx *app.RequestContext, body []byte) ([]byte, error) {
+		fields := map[string]any{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, err
+		}
+
+		delete(fields, "internal")
+		if id, found := fields["id"]; found {
+			fields["order_id"] = id
+			delete(fields, "id")
+		}
+		return json.Marshal(fields)
+	})
+
+	gzipBody := func(data string) []byte {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write([]byte(data))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	serve := func(m app.HandlerFunc, req func(req *protocol.Request), handler app.HandlerFunc) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		if req != nil {
+			req(&ctx.Request)
+		}
+		ctx.SetHandlers([]app.HandlerFunc{m, handler})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	m, err := middlewareFactory["transform_body"](map[string]any{
+		"request":       "test_orders",
+		"response":      "test_orders",
+		"content_types": []any{"application/json"},
+		"max_size":      1024,
+	})
+	assert.NoError(t, err)
+
+	t.Run("compressed and chunked response", func(t *testing.T) {
+		ctx := serve(m, nil, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+			ctx.Response.Header.Set("Content-Encoding", "gzip")
+			ctx.Response.Header.Set("ETag", `"v1"`)
+			ctx.Response.SetBodyStream(bytes.NewReader(gzipBody(`{"id":1,"internal":"secret","status":"paid"}`)), -1)
+		})
+
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.JSONEq(t, `{"order_id":1,"status":"paid"}`, string(ctx.Response.Body()))
+		assert.Equal(t, len(ctx.Response.Body()), ctx.Response.Header.ContentLength())
+		assert.Empty(t, ctx.Response.Header.Peek("Content-Encoding"))
+		assert.Equal(t, `W/"v1"`, string(ctx.Response.Header.Peek("ETag")))
+	})
+
+	t.Run("compressed request", func(t *testing.T) {
+		var received []byte
+		ctx := serve(m, func(req *protocol.Request) {
+			req.Header.SetMethod("POST")
+			req.Header.SetContentTypeBytes([]byte("application/json"))
+			req.Header.Set("Content-Encoding", "gzip")
+			req.SetBody(gzipBody(`{"id":2,"internal":true}`))
+		}, func(c context.Context, ctx *app.RequestContext) {
+			received = append([]byte(nil), ctx.Request.Body()...)
+			assert.Empty(t, ctx.Request.Header.Peek("Content-Encoding"))
+			assert.Equal(t, len(received), ctx.Request.Header.ContentLength())
+			ctx.SetStatusCode(204)
+		})
+
+		assert.Equal(t, 204, ctx.Response.StatusCode())
+		assert.JSONEq(t, `{"order_id":2}`, string(received))
+	})
+
+	t.Run("other content types are untouched", func(t *testing.T) {
+		ctx := serve(m, nil, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.SetContentType("text/plain")
+			ctx.Response.SetBodyString("id=1")
+		})
+
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.Equal(t, "id=1", string(ctx.Response.Body()))
+	})
+
+	t.Run("untransformable body", func(t *testing.T) {
+		ctx := serve(m, nil, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.SetContentType("application/json")
+			ctx.Response.SetBodyString(`{"internal":`)
+		})
+
+		// the untransformed body isn't sent to the client
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+		assert.NotContains(t, string(ctx.Response.Body()), "internal")
+
+		called := false
+		ctx = serve(m, func(req *protocol.Request) {
+			req.Header.SetMethod("POST")
+			req.Header.SetContentTypeBytes([]byte("application/json"))
+			req.SetBodyString("not json")
+		}, func(c context.Context, ctx *app.RequestContext) {
+			called = true
+		})
+		assert.Equal(t, 400, ctx.Response.StatusCode())
+		assert.False(t, called)
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		large := `{"id":"` + strings.Repeat("x", 2048) + `"}`
+
+		ctx := serve(m, nil, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Response.Header.SetContentType("application/json")
+			ctx.Response.SetBodyStream(strings.NewReader(large), -1)
+		})
+		assert.Equal(t, 502, ctx.Response.StatusCode())
+
+		ctx = serve(m, func(req *protocol.Request) {
+			req.Header.SetMethod("POST")
+			req.Header.SetContentTypeBytes([]byte("application/json"))
+			req.SetBodyStream(strings.NewReader(large), -1)
+		}, func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(200)
+		})
+		assert.Equal(t, 413, ctx.Response.StatusCode())
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		_, err := middlewareFactory["transform_body"](map[string]any{})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["transform_body"](map[string]any{"response": "not_registered"})
+		assert.Error(t, err)
+
+		_, err = middlewareFactory["transform_body"](map[string]any{"response": "test_orders", "max_size": -1})
+		assert.Error(t, err)
+	})
+}
+
+func TestAddPrefix(t *testing.T) {
+	serve := func(m app.HandlerFunc, uri string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI(uri)
+		ctx.SetHandlers([]app.HandlerFunc{m, func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(200)
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	testCases := []struct {
+		prefix string
+		uri    string
+		path   string
+	}{
+		{prefix: "/api", uri: "http://localhost/orders", path: "/api/orders"},
+		{prefix: "/api/", uri: "http://localhost/orders", path: "/api/orders"},
+		{prefix: "api", uri: "http://localhost/orders", path: "/api/orders"},
+		{prefix: "/api/v1", uri: "http://localhost/orders/", path: "/api/v1/orders/"},
+		{prefix: "/api", uri: "http://localhost/", path: "/api/"},
+		{prefix: "/api", uri: "http://localhost", path: "/api/"},
+		{prefix: "/", uri: "http://localhost/orders", path: "/orders"},
+		{prefix: "", uri: "http://localhost/orders", path: "/orders"},
+		{prefix: "/api", uri: "http://localhost/orders?id=1&sort=desc", path: "/api/orders"},
+	}
+
+	for _, tc := range testCases {
+		m, err := middlewareFactory["add_prefix"](map[string]any{"prefix": tc.prefix})
+		assert.NoError(t, err)
+
+		ctx := serve(m, tc.uri)
+		assert.Equal(t, tc.path, string(ctx.Request.Path()), "prefix '%s' uri '%s'", tc.prefix, tc.uri)
+
+		// the path of the client is kept for the access log
+		original, _, _ := strings.Cut(strings.TrimPrefix(tc.uri, "http://localhost"), "?")
+		if len(original) == 0 {
+			original = "/"
+		}
+		assert.Equal(t, original, ctx.GetString(config.REQUEST_PATH))
+	}
+
+	t.Run("query string is kept", func(t *testing.T) {
+		m, err := middlewareFactory["add_prefix"](map[string]any{"prefix": "/api/"})
+		assert.NoError(t, err)
+
+		ctx := serve(m, "http://localhost/orders?id=1&sort=desc")
+		assert.Equal(t, "/api/orders?id=1&sort=desc", string(ctx.Request.URI().RequestURI()))
+	})
+
+	t.Run("requests don't share the path", func(t *testing.T) {
+		m, err := middlewareFactory["add_prefix"](map[string]any{"prefix": "/api"})
+		assert.NoError(t, err)
+
+		first := serve(m, "http://localhost/orders")
+		second := serve(m, "http://localhost/users")
+		assert.Equal(t, "/api/orders", string(first.Request.Path()))
+		assert.Equal(t, "/api/users", string(second.Request.Path()))
+	})
+
+	_, err := middlewareFactory["add_prefix"](map[string]any{})
+	assert.Error(t, err)
+}
+
+func TestReplacePathRegex(t *testing.T) {
+	strip, err := middlewareFactory["strip_prefix"](map[string]any{"prefixes": []any{"/api"}})
+	assert.NoError(t, err)
+
+	m, err := middlewareFactory["replace_path_regex"](map[string]any{"regex": "^/v1/(.*)$", "replacement": "/internal/$1"})
+	assert.NoError(t, err)
+
+	replace, err := middlewareFactory["replace_path"](map[string]any{"path": "/v1/health"})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name           string
+		uri            string
+		handlers       []app.HandlerFunc
+		expectedPath   string
+		expectedHeader string
+		requestPath    string
+	}{
+		{
+			name:           "rewrite",
+			uri:            "http://localhost/v1/orders?id=1",
+			handlers:       []app.HandlerFunc{m},
+			expectedPath:   "/internal/orders",
+			expectedHeader: "/v1/orders",
+			requestPath:    "/v1/orders",
+		},
+		{
+			name:           "no match",
+			uri:            "http://localhost/v2/orders",
+			handlers:       []app.HandlerFunc{m},
+			expectedPath:   "/v2/orders",
+			expectedHeader: "",
+			requestPath:    "",
+		},
+		{
+			// the upstream sees the path of the client rather than the path of the previous rewrite
+			name:           "chained rewrite",
+			uri:            "http://localhost/api/v1/orders",
+			handlers:       []app.HandlerFunc{strip, m},
+			expectedPath:   "/internal/orders",
+			expectedHeader: "/api/v1/orders",
+			requestPath:    "/api/v1/orders",
+		},
+		{
+			name:           "replace_path then replace_path_regex",
+			uri:            "http://localhost/status",
+			handlers:       []app.HandlerFunc{replace, m},
+			expectedPath:   "/internal/health",
+			expectedHeader: "/status",
+			requestPath:    "/status",
+		},
+		{
+			name:           "replace_path_regex then replace_path",
+			uri:            "http://localhost/v1/orders",
+			handlers:       []app.HandlerFunc{m, replace},
+			expectedPath:   "/v1/health",
+			expectedHeader: "/v1/orders",
+			requestPath:    "/v1/orders",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var header string
+			ctx := app.NewContext(0)
+			ctx.Request.SetRequestURI(tc.uri)
+			ctx.SetHandlers(append(tc.handlers, func(c context.Context, ctx *app.RequestContext) {
+				header = ctx.Request.Header.Get("X-Replaced-Path")
+				ctx.SetStatusCode(200)
+			}))
+			ctx.Next(context.Background())
+
+			assert.Equal(t, tc.expectedPath, string(ctx.Request.Path()))
+			assert.Equal(t, tc.expectedHeader, header)
+			assert.Equal(t, tc.requestPath, ctx.GetString(config.REQUEST_PATH))
+		})
+	}
+
+	_, err = middlewareFactory["replace_path_regex"](map[string]any{"regex": "^/v1/(.*$", "replacement": "/internal/$1"})
+	assert.Error(t, err)
+
+	_, err = middlewareFactory["replace_path_regex"](map[string]any{"regex": "^/v1/(.*)$"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+const (
+	defaultMirrorTimeout     = 1 * time.Second
+	defaultMirrorMaxBodySize = 64 * 1024
+	mirrorWorkers            = 8
+	mirrorQueueSize          = 256
+)
+
+type mirrorTask struct {
+	proxy *Proxy
+	req   *protocol.Request
+}
+
+// mirror copies sampled requests of a service and sends them to the mirror upstream asynchronously.
+// Responses are discarded. When the queue is full, requests are dropped so the primary request is never delayed.
+type mirror struct {
+	opts      config.MirrorOptions
+	serviceID string
+	upstream  *Upstream
+	queue     chan mirrorTask
+	dropped   atomic.Uint64
+	once      sync.Once
+	// mu guards the queue against the close by stop, the queued requests are still sent by the workers
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newMirror(serviceID string, opts config.MirrorOptions, upstreams map[string]*Upstream) (*mirror, error) {
+	upstream, found := upstreams[opts.Upstream]
+	if !found {
+		return nil, fmt.Errorf("mirror upstream '%s' was not found in service '%s'", opts.Upstream, serviceID)
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultMirrorTimeout
+	}
+
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultMirrorMaxBodySize
+	}
+
+	return &mirror{
+		opts:      opts,
+		serviceID: serviceID,
+		upstream:  upstream,
+		queue:     make(chan mirrorTask, mirrorQueueSize),
+	}, nil
+}
+
+// send copies the request when it is sampled, the request is dropped when the body exceeds max_body_size
+func (m *mirror) send(ctx *app.RequestContext) {
+	// a websocket tunnel can't be replayed to another target
+	if isWebSocketUpgrade(&ctx.Request) {
+		return
+	}
+
+	if m.opts.Percentage < 100 && rand.Float64()*100 >= m.opts.Percentage {
+		return
+	}
+
+	if len(ctx.Request.Body()) > m.opts.MaxBodySize {
+		m.dropped.Add(1)
+		return
+	}
+
+	proxy, _ := m.upstream.pick(ctx)
+	if proxy == nil {
+		m.dropped.Add(1)
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// the engine of the service is replaced, the request is served by the new one
+	if m.closed {
+		return
+	}
+
+	m.once.Do(func() {
+		for i := 0; i < mirrorWorkers; i++ {
+			go m.run()
+		}
+	})
+
+	req := protocol.AcquireRequest()
+	ctx.Request.CopyTo(req)
+
+	select {
+	case m.queue <- mirrorTask{proxy: proxy, req: req}:
+	default:
+		protocol.ReleaseRequest(req)
+		m.dropped.Add(1)
+	}
+}
+
+// stop closes the queue when the engine of the service is replaced by a reload or shut down, the workers exit
+// once the queued requests are sent
+func (m *mirror) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.queue)
+}
+
+func (m *mirror) run() {
+	for task := range m.queue {
+		m.do(task)
+	}
+}
+
+func (m *mirror) do(task mirrorTask) {
+	req := task.req
+	resp := protocol.AcquireResponse()
+	defer func() {
+		// a mirrored request must never take down the worker, let alone the gateway
+		if r := recover(); r != nil {
+			slog.Error("mirror request panic recovered",
+				slog.Bool("mirror", true),
+				slog.String("service", m.serviceID),
+				slog.Any("panic", r),
+			)
+		}
+		protocol.ReleaseRequest(req)
+		protocol.ReleaseResponse(resp)
+	}()
+
+	if task.proxy.director != nil {
+		task.proxy.director(req)
+	}
+	if len(task.proxy.hostHeader) > 0 {
+		req.Header.SetHost(task.proxy.hostHeader)
+	}
+
+	for _, h := range hopHeaders {
+		req.Header.DelBytes(s2b(h))
+	}
+
+	fn := client.DoTimeout
+	if task.proxy.client != nil {
+		fn = task.proxy.client.DoTimeout
+	}
+
+	startTime := time.Now()
+	err := fn(context.Background(), req, resp, m.opts.Timeout)
+	if err != nil {
+		slog.Warn("mirror request error",
+			slog.Bool("mirror", true),
+			slog.String("service", m.serviceID),
+			slog.String("upstream_addr", task.proxy.targetHost),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	slog.Debug("mirror request",
+		slog.Bool("mirror", true),
+		slog.String("service", m.serviceID),
+		slog.String("upstream_addr", task.proxy.targetHost),
+		slog.String("request_uri", string(req.URI().RequestURI())),
+		slog.Int("status", resp.StatusCode()),
+		slog.Duration("duration", time.Since(startTime)),
+	)
+}
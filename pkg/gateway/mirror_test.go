@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	primary := server.New(server.WithHostPorts("127.0.0.1:9988"))
+	primary.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, "primary")
+	})
+	go primary.Spin()
+
+	var mirrored atomic.Int64
+	var mirroredBody atomic.Value
+	hanging := server.New(server.WithHostPorts("127.0.0.1:9989"))
+	hanging.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		mirrored.Add(1)
+		mirroredBody.Store(string(ctx.Request.Body()))
+		time.Sleep(3 * time.Second)
+		ctx.String(500, "mirror")
+	})
+	go hanging.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"primary": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9988"}},
+				},
+				"shadow": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9989"}},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:  "mirror",
+		Url: "http://primary",
+		Mirror: config.MirrorOptions{
+			Upstream:   "shadow",
+			Percentage: 100,
+			Timeout:    200 * time.Millisecond,
+		},
+	})
+	assert.NoError(t, err)
+
+	startTime := time.Now()
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	hzCtx.Request.Header.SetMethod("POST")
+	hzCtx.Request.SetBodyString("order")
+	service.ServeHTTP(context.Background(), hzCtx)
+
+	// the hanging mirror doesn't delay the primary request
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	assert.Equal(t, "primary", string(hzCtx.Response.Body()))
+	assert.Equal(t, "127.0.0.1:9988", hzCtx.GetString(config.UPSTREAM_ADDR))
+
+	assert.Eventually(t, func() bool {
+		return mirrored.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "order", mirroredBody.Load())
+
+	// the workers exit once the engine of the service is replaced, the in-flight requests aren't mirrored anymore
+	service.stop()
+	_, open := <-service.mirror.queue
+	assert.False(t, open)
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	service.ServeHTTP(context.Background(), hzCtx)
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int64(1), mirrored.Load())
+}
+
+func TestMirrorDrop(t *testing.T) {
+	proxy, _ := newProxy("http://127.0.0.1:9985", false, 1)
+	upstream := &Upstream{
+		opts:    &config.UpstreamOptions{ID: "shadow"},
+		proxies: []*Proxy{proxy},
+	}
+
+	m, err := newMirror("mirror", config.MirrorOptions{
+		Upstream:    "shadow",
+		Percentage:  100,
+		MaxBodySize: 4,
+	}, map[string]*Upstream{"shadow": upstream})
+	assert.NoError(t, err)
+
+	// the body exceeds max_body_size
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	hzCtx.Request.SetBodyString("too large")
+	m.send(hzCtx)
+	assert.Equal(t, uint64(1), m.dropped.Load())
+
+	// the queue is full, workers are not started so nothing is consumed
+	m.once.Do(func() {})
+	hzCtx.Request.SetBodyString("ok")
+	for i := 0; i < mirrorQueueSize+10; i++ {
+		m.send(hzCtx)
+	}
+	assert.Equal(t, uint64(11), m.dropped.Load())
+
+	_, err = newMirror("mirror", config.MirrorOptions{Upstream: "unknown"}, map[string]*Upstream{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,315 @@
+package gateway
+
+import (
+	"fmt"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const (
+	defaultOutlierInterval           = 10 * time.Second
+	defaultOutlierBaseEjectionTime   = 30 * time.Second
+	defaultOutlierMaxEjectionTime    = 300 * time.Second
+	defaultOutlierMaxEjectionPercent = 10
+	defaultOutlierMinHosts           = 5
+	defaultOutlierMinRequests        = 100
+	defaultOutlierStdevFactor        = 1.9
+
+	// a slow target must also be this many times slower than the mean, otherwise the small
+	// differences between fast targets would be ejected
+	outlierLatencyRatio = 2
+)
+
+// targetStats counts the requests sent to a target since the last analysis of the outlier detector
+type targetStats struct {
+	requests atomic.Int64
+	failures atomic.Int64
+	latency  atomic.Int64
+}
+
+func (s *targetStats) reset() (requests int64, failures int64, latency time.Duration) {
+	return s.requests.Swap(0), s.failures.Swap(0), time.Duration(s.latency.Swap(0))
+}
+
+// observe records the result of a request sent to the target. Errors, timeouts and 5xx responses are failures,
+// requests canceled by the client are not counted.
+func (r *Proxy) observe(ctx *app.RequestContext, duration time.Duration) {
+	if ctx.GetBool(clientAbortedKey) {
+		return
+	}
+
+	r.stats.requests.Add(1)
+	r.stats.latency.Add(int64(duration))
+
+	if ctx.GetBool("target_error") || ctx.GetBool("target_timeout") || ctx.Response.StatusCode() >= 500 {
+		r.stats.failures.Add(1)
+	}
+}
+
+func (r *Proxy) isEjected(now time.Time) bool {
+	return now.UnixNano() < r.ejectedUntil.Load()
+}
+
+// outlierDetector periodically compares the failure rate and the latency of every target with the mean
+// of the upstream and ejects the statistical outliers, like the success rate detection of envoy.
+// The ejection time grows with the consecutive ejections of a target and the ejected targets are capped
+// by max_ejection_percent, so the upstream always keeps a target.
+type outlierDetector struct {
+	upstream *Upstream
+	opts     config.OutlierDetectionOptions
+	doneCh   chan bool
+	doneOnce sync.Once
+}
+
+type outlierCandidate struct {
+	proxy       *Proxy
+	failureRate float64
+	latency     float64
+}
+
+func validateOutlierDetection(opts config.OutlierDetectionOptions) error {
+	if opts.Interval < 0 || opts.BaseEjectionTime < 0 || opts.MaxEjectionTime < 0 {
+		return fmt.Errorf("outlier_detection interval and ejection time can't be negative")
+	}
+
+	if opts.MaxEjectionPercent < 0 || opts.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier_detection max_ejection_percent must be between 0 and 100")
+	}
+
+	if opts.MinHosts < 0 || opts.MinRequests < 0 || opts.StdevFactor < 0 {
+		return fmt.Errorf("outlier_detection min_hosts, min_requests and stdev_factor can't be negative")
+	}
+
+	return nil
+}
+
+func newOutlierDetector(upstream *Upstream, opts config.OutlierDetectionOptions) *outlierDetector {
+	if opts.Interval == 0 {
+		opts.Interval = defaultOutlierInterval
+	}
+	if opts.BaseEjectionTime == 0 {
+		opts.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if opts.MaxEjectionTime == 0 {
+		opts.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if opts.MaxEjectionTime < opts.BaseEjectionTime {
+		opts.MaxEjectionTime = opts.BaseEjectionTime
+	}
+	if opts.MaxEjectionPercent == 0 {
+		opts.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+	if opts.MinHosts == 0 {
+		opts.MinHosts = defaultOutlierMinHosts
+	}
+	if opts.MinRequests == 0 {
+		opts.MinRequests = defaultOutlierMinRequests
+	}
+	if opts.StdevFactor == 0 {
+		opts.StdevFactor = defaultOutlierStdevFactor
+	}
+
+	return &outlierDetector{
+		upstream: upstream,
+		opts:     opts,
+		doneCh:   make(chan bool),
+	}
+}
+
+func (d *outlierDetector) watch() {
+	go func() {
+		t := time.NewTicker(d.opts.Interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-d.doneCh:
+				return
+			case now := <-t.C:
+				d.analyze(now)
+			}
+		}
+	}()
+}
+
+// stop stops the detector when its targets are handed over to the upstream of a reload, so the stats of a
+// target are only consumed by one detector, or when the engine of the upstream is replaced or shut down
+func (d *outlierDetector) stop() {
+	d.doneOnce.Do(func() {
+		close(d.doneCh)
+	})
+}
+
+// analyze consumes the stats of the last interval, puts the targets whose ejection time is over back
+// into rotation and ejects the new outliers
+func (d *outlierDetector) analyze(now time.Time) {
+	proxies := d.upstream.targets()
+	candidates := make([]outlierCandidate, 0, len(proxies))
+	ejected := 0
+
+	for _, proxy := range proxies {
+		requests, failures, latency := proxy.stats.reset()
+
+		if until := proxy.ejectedUntil.Load(); until > 0 && now.UnixNano() >= until {
+			proxy.ejectedUntil.Store(0)
+
+			slog.Info("outlier target is back in rotation", "upstream", d.upstream.opts.ID, "target", proxy.targetHost)
+			upstreamEvents.emit(UpstreamEvent{
+				Type:       TargetUp,
+				UpstreamID: d.upstream.opts.ID,
+				Target:     proxy.targetHost,
+				Reason:     "outlier ejection time is over",
+			})
+		}
+
+		if proxy.isEjected(now) {
+			ejected++
+			continue
+		}
+
+		if proxy.drained.Load() || requests < int64(d.opts.MinRequests) {
+			continue
+		}
+
+		candidates = append(candidates, outlierCandidate{
+			proxy:       proxy,
+			failureRate: float64(failures) / float64(requests),
+			latency:     float64(latency) / float64(requests),
+		})
+	}
+
+	outliers := d.outliers(candidates)
+
+	// a target which behaves again is forgiven one ejection per interval
+	for _, candidate := range candidates {
+		isOutlier := slices.ContainsFunc(outliers, func(outlier outlierCandidate) bool {
+			return outlier.proxy == candidate.proxy
+		})
+
+		if candidate.proxy.ejections > 0 && !isOutlier {
+			candidate.proxy.ejections--
+		}
+	}
+
+	maxEjected := len(proxies) * d.opts.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if maxEjected > len(proxies)-1 {
+		maxEjected = len(proxies) - 1
+	}
+
+	for _, outlier := range outliers {
+		if ejected >= maxEjected {
+			slog.Warn("outlier target is not ejected, max_ejection_percent is reached",
+				"upstream", d.upstream.opts.ID,
+				"target", outlier.proxy.targetHost,
+			)
+			continue
+		}
+
+		d.eject(now, outlier)
+		ejected++
+	}
+}
+
+// outliers returns the candidates whose failure rate or latency is above mean + stdev_factor * stdev,
+// the worst one comes first
+func (d *outlierDetector) outliers(candidates []outlierCandidate) []outlierCandidate {
+	if len(candidates) < d.opts.MinHosts {
+		return nil
+	}
+
+	failureRates := make([]float64, 0, len(candidates))
+	latencies := make([]float64, 0, len(candidates))
+	for _, candidate := range candidates {
+		failureRates = append(failureRates, candidate.failureRate)
+		latencies = append(latencies, candidate.latency)
+	}
+
+	failureMean, failureStdev := meanStdev(failureRates)
+	latencyMean, latencyStdev := meanStdev(latencies)
+
+	outliers := make([]outlierCandidate, 0)
+	for _, candidate := range candidates {
+		if candidate.failureRate > failureMean+d.opts.StdevFactor*failureStdev {
+			outliers = append(outliers, candidate)
+			continue
+		}
+
+		if candidate.latency > latencyMean+d.opts.StdevFactor*latencyStdev && candidate.latency >= outlierLatencyRatio*latencyMean {
+			outliers = append(outliers, candidate)
+		}
+	}
+
+	slices.SortFunc(outliers, func(a, b outlierCandidate) int {
+		if a.failureRate != b.failureRate {
+			if a.failureRate > b.failureRate {
+				return -1
+			}
+			return 1
+		}
+
+		if a.latency > b.latency {
+			return -1
+		}
+		if a.latency < b.latency {
+			return 1
+		}
+		return 0
+	})
+
+	return outliers
+}
+
+func (d *outlierDetector) eject(now time.Time, outlier outlierCandidate) {
+	proxy := outlier.proxy
+	proxy.ejections++
+
+	ejectionTime := d.opts.BaseEjectionTime * time.Duration(proxy.ejections)
+	if ejectionTime > d.opts.MaxEjectionTime {
+		ejectionTime = d.opts.MaxEjectionTime
+	}
+	proxy.ejectedUntil.Store(now.Add(ejectionTime).UnixNano())
+
+	slog.Warn("outlier target is ejected",
+		"upstream", d.upstream.opts.ID,
+		"target", proxy.targetHost,
+		"failure_rate", outlier.failureRate,
+		"latency", time.Duration(outlier.latency),
+		"ejection_time", ejectionTime,
+	)
+
+	upstreamEvents.emit(UpstreamEvent{
+		Type:       TargetDown,
+		UpstreamID: d.upstream.opts.ID,
+		Target:     proxy.targetHost,
+		Reason:     fmt.Sprintf("outlier ejected for %s", ejectionTime),
+	})
+}
+
+func meanStdev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
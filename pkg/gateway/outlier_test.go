@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	hosts := []string{"127.0.0.1:9901", "127.0.0.1:9902", "127.0.0.1:9903", "127.0.0.1:9904"}
+
+	for _, host := range hosts {
+		statusCode := 200
+		if host == "127.0.0.1:9904" {
+			statusCode = 500
+		}
+
+		backend := server.New(server.WithHostPorts(host))
+		backend.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(statusCode, host)
+		})
+		go backend.Spin()
+	}
+	time.Sleep(time.Second)
+
+	targets := make([]config.TargetOptions, 0, len(hosts))
+	for _, host := range hosts {
+		targets = append(targets, config.TargetOptions{Target: host})
+	}
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"default": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  targets,
+					OutlierDetection: config.OutlierDetectionOptions{
+						Enabled:            true,
+						Interval:           time.Hour,
+						BaseEjectionTime:   time.Minute,
+						MaxEjectionPercent: 25,
+						MinHosts:           4,
+						MinRequests:        10,
+						StdevFactor:        1,
+					},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:  "outlier",
+		Url: "http://default",
+	})
+	assert.NoError(t, err)
+
+	upstream := service.upstream
+	detector := upstream.outlier
+	assert.NotNil(t, detector)
+
+	sendRequests := func() {
+		for i := 0; i < 80; i++ {
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/")
+			service.ServeHTTP(context.Background(), hzCtx)
+		}
+	}
+
+	assertEjected := func(now time.Time, expected string) {
+		for _, proxy := range upstream.targets() {
+			if proxy.targetHost == expected {
+				assert.True(t, proxy.isEjected(now), proxy.targetHost)
+				continue
+			}
+			assert.False(t, proxy.isEjected(now), proxy.targetHost)
+		}
+	}
+
+	findProxy := func(host string) *Proxy {
+		for _, proxy := range upstream.targets() {
+			if proxy.targetHost == host {
+				return proxy
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	for round := 0; round < 3; round++ {
+		sendRequests()
+		detector.analyze(now)
+		assertEjected(now, "127.0.0.1:9904")
+	}
+
+	bad := findProxy("127.0.0.1:9904")
+	assert.Equal(t, now.Add(time.Minute).UnixNano(), bad.ejectedUntil.Load())
+
+	// the ejection time is over, the target is ejected again for a longer time
+	now = now.Add(time.Minute)
+	detector.analyze(now)
+	assertEjected(now, "")
+
+	sendRequests()
+	detector.analyze(now)
+	assertEjected(now, "127.0.0.1:9904")
+	assert.Equal(t, now.Add(2*time.Minute).UnixNano(), bad.ejectedUntil.Load())
+
+	t.Run("max ejection percent", func(t *testing.T) {
+		proxies := make([]*Proxy, 0, 4)
+		for _, target := range []string{"http://backend1", "http://backend2", "http://backend3", "http://backend4"} {
+			proxy, _ := newProxy(target, false, 1)
+			proxies = append(proxies, proxy)
+		}
+
+		upstream := &Upstream{
+			opts:    &config.UpstreamOptions{ID: "test"},
+			proxies: proxies,
+		}
+		detector := newOutlierDetector(upstream, config.OutlierDetectionOptions{
+			MaxEjectionPercent: 25,
+			MinHosts:           4,
+			MinRequests:        10,
+			StdevFactor:        0.5,
+		})
+
+		for i, proxy := range proxies {
+			proxy.stats.requests.Store(100)
+			proxy.stats.latency.Store(int64(100 * time.Millisecond))
+			if i >= 2 {
+				proxy.stats.failures.Store(int64(i * 10))
+			}
+		}
+
+		now := time.Now()
+		detector.analyze(now)
+
+		// both failing targets are outliers, only the worst one is ejected
+		assert.False(t, proxies[0].isEjected(now))
+		assert.False(t, proxies[1].isEjected(now))
+		assert.False(t, proxies[2].isEjected(now))
+		assert.True(t, proxies[3].isEjected(now))
+	})
+
+	t.Run("slow target", func(t *testing.T) {
+		proxies := make([]*Proxy, 0, 4)
+		for _, target := range []string{"http://backend1", "http://backend2", "http://backend3", "http://backend4"} {
+			proxy, _ := newProxy(target, false, 1)
+			proxies = append(proxies, proxy)
+		}
+
+		upstream := &Upstream{
+			opts:    &config.UpstreamOptions{ID: "test"},
+			proxies: proxies,
+		}
+		detector := newOutlierDetector(upstream, config.OutlierDetectionOptions{
+			MinHosts:    4,
+			MinRequests: 10,
+			StdevFactor: 1,
+		})
+
+		latencies := []time.Duration{10 * time.Millisecond, 11 * time.Millisecond, 12 * time.Millisecond, 500 * time.Millisecond}
+		for i, proxy := range proxies {
+			proxy.stats.requests.Store(100)
+			proxy.stats.latency.Store(100 * int64(latencies[i]))
+		}
+
+		now := time.Now()
+		detector.analyze(now)
+
+		assert.False(t, proxies[0].isEjected(now))
+		assert.False(t, proxies[1].isEjected(now))
+		assert.False(t, proxies[2].isEjected(now))
+		assert.True(t, proxies[3].isEjected(now))
+
+		// small differences between fast targets are not outliers, even above the stdev
+		proxies[3].ejectedUntil.Store(0)
+		latencies = []time.Duration{10 * time.Millisecond, 11 * time.Millisecond, 12 * time.Millisecond, 14 * time.Millisecond}
+		for i, proxy := range proxies {
+			proxy.stats.requests.Store(100)
+			proxy.stats.latency.Store(100 * int64(latencies[i]))
+		}
+
+		detector.analyze(now)
+		for _, proxy := range proxies {
+			assert.False(t, proxy.isEjected(now))
+		}
+	})
+}
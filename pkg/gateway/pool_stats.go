@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+)
+
+// poolStatsInterval is how often hertz reports the connection pool of a host client, the stats are read from the
+// last report, so reading them never takes the lock of the dial path
+var poolStatsInterval = time.Second
+
+// PoolStats is the connection pool of a proxy reported by the hertz client
+type PoolStats struct {
+	// Established is the number of the open connections, including the idle connections
+	Established int `json:"established"`
+	// Idle is the number of the connections kept alive in the pool
+	Idle int `json:"idle"`
+	// Waiters is the number of the requests waiting for a connection because max_idle_conns_per_host is reached
+	Waiters int `json:"waiters"`
+	// MaxConnsPerHost is the configured limit of the connections, 0 is unlimited
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+}
+
+func (s *PoolStats) add(other PoolStats) {
+	s.Established += other.Established
+	s.Idle += other.Idle
+	s.Waiters += other.Waiters
+	s.MaxConnsPerHost += other.MaxConnsPerHost
+}
+
+// UpstreamStats aggregates the connection pools of the targets of an upstream
+type UpstreamStats struct {
+	Pool    PoolStats            `json:"pool"`
+	Targets map[string]PoolStats `json:"targets"`
+}
+
+// poolStates keeps the last report of each host client of a proxy, a client usually has a single host client,
+// but redirects may create more
+type poolStates struct {
+	states sync.Map // addr -> hzconfig.ConnPoolState
+}
+
+func (p *poolStates) observe(hcs hzconfig.HostClientState) {
+	state := hcs.ConnPoolState()
+	p.states.Store(state.Addr, state)
+}
+
+// PoolStats returns the connection pool of the proxy, the numbers are refreshed every poolStatsInterval
+func (r *Proxy) PoolStats() PoolStats {
+	stats := PoolStats{MaxConnsPerHost: r.maxConnsPerHost}
+
+	r.poolStates.states.Range(func(_, val any) bool {
+		state := val.(hzconfig.ConnPoolState)
+		stats.Established += state.TotalConnNum
+		stats.Idle += state.PoolConnNum
+		stats.Waiters += state.WaitConnNum
+		return true
+	})
+
+	return stats
+}
+
+// Stats returns the connection pools of the targets in rotation and their sum
+func (u *Upstream) Stats() UpstreamStats {
+	stats := UpstreamStats{Targets: map[string]PoolStats{}}
+
+	for _, proxy := range u.targets() {
+		pool := proxy.PoolStats()
+		stats.Targets[proxy.target] = pool
+		stats.Pool.add(pool)
+	}
+
+	return stats
+}
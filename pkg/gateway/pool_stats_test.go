@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolStats(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9913"))
+	h.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(time.Second)
+		ctx.String(200, "slow")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	oldInterval := poolStatsInterval
+	poolStatsInterval = 100 * time.Millisecond
+	defer func() { poolStatsInterval = oldInterval }()
+
+	maxConns := 1
+	bifrost := &Bifrost{opts: &config.Options{}}
+	upstream, err := newUpstream(bifrost, config.ServiceOptions{
+		Url:                 "http://orders",
+		MaxIdleConnsPerHost: &maxConns,
+		Timeout:             config.ServiceTimeoutOptions{MaxConnWaitTimeout: 10 * time.Second},
+	}, config.UpstreamOptions{
+		ID:       "orders",
+		Strategy: config.RoundRobinStrategy,
+		Targets:  []config.TargetOptions{{Target: "127.0.0.1:9913"}},
+	})
+	assert.NoError(t, err)
+
+	proxy := upstream.targets()[0]
+	assert.Equal(t, PoolStats{MaxConnsPerHost: 1}, proxy.PoolStats())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/slow")
+			proxy.ServeHTTP(context.Background(), hzCtx)
+			assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		}()
+	}
+
+	// the first request holds the only connection, the others wait for it
+	time.Sleep(500 * time.Millisecond)
+	stats := proxy.PoolStats()
+	assert.Equal(t, 1, stats.Established)
+	assert.Equal(t, 0, stats.Idle)
+	assert.Equal(t, 3, stats.Waiters)
+	assert.Equal(t, 1, stats.MaxConnsPerHost)
+
+	upstreamStats := upstream.Stats()
+	assert.Equal(t, stats, upstreamStats.Pool)
+	assert.Equal(t, stats, upstreamStats.Targets["http://127.0.0.1:9913"])
+
+	wg.Wait()
+	time.Sleep(300 * time.Millisecond)
+
+	stats = proxy.PoolStats()
+	assert.Equal(t, 0, stats.Waiters)
+	assert.Equal(t, 1, stats.Idle)
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// serveProbes answers the liveness and readiness probes of the entry. It runs before the engine, so the probes
+// don't go through the middlewares and the routes, and a reload never changes them.
+func (s *HTTPServer) serveProbes(c context.Context, ctx *app.RequestContext) {
+	method := string(ctx.Request.Method())
+	path := string(ctx.Request.Path())
+	if (method != "GET" && method != "HEAD") || (path != livenessPath && path != readinessPath) {
+		ctx.Next(c)
+		return
+	}
+
+	if !s.entryOpts.Probes.AccessLog {
+		ctx.Set(config.HEALTH_PROBE, true)
+	}
+	ctx.Abort()
+
+	if path == livenessPath {
+		ctx.String(200, "ok")
+		return
+	}
+
+	if err := s.ready(); err != nil {
+		ctx.String(503, err.Error())
+		return
+	}
+	ctx.String(200, "ok")
+}
+
+// ready returns the reason the entry can't take traffic: the graceful shutdown has started, or an upstream of the
+// services has no target in rotation because every target is drained or ejected by the outlier detection
+func (s *HTTPServer) ready() error {
+	if s.draining.Load() {
+		return fmt.Errorf("draining")
+	}
+
+	for id, service := range s.switcher.Engine().services {
+		if service.upstream != nil && !service.upstream.isReady() {
+			return fmt.Errorf("upstream '%s' of service '%s' has no available target", service.upstream.opts.ID, id)
+		}
+	}
+
+	return nil
+}
+
+// isReady returns true when a target of the upstream can be selected
+func (u *Upstream) isReady() bool {
+	for _, proxy := range u.targets() {
+		if proxy.isAvailable() {
+			return true
+		}
+	}
+	return false
+}
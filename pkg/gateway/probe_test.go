@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes(t *testing.T) {
+	newBifrost := func(probes config.ProbeOptions) *Bifrost {
+		bifrost, err := Load(config.Options{
+			Entries: map[string]config.EntryOptions{
+				"http": {Bind: "127.0.0.1:9924", Probes: probes},
+			},
+			Routes: map[string]config.RouteOptions{
+				"all": {Paths: []string{"/"}, ServiceID: "orders"},
+			},
+			Services: map[string]config.ServiceOptions{
+				"orders": {Url: "http://orders"},
+			},
+			Upstreams: map[string]config.UpstreamOptions{
+				"orders": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:8001"}, {Target: "127.0.0.1:8002"}},
+				},
+			},
+		})
+		assert.NoError(t, err)
+		return bifrost
+	}
+
+	serve := func(server *HTTPServer, method, path string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost" + path)
+		ctx.Request.Header.SetMethod(method)
+		ctx.SetHandlers([]app.HandlerFunc{server.serveProbes, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(418, "engine")
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	t.Run("readiness", func(t *testing.T) {
+		server := newBifrost(config.ProbeOptions{Enabled: true}).httpServers["http"]
+
+		ctx := serve(server, "GET", "/readyz")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.True(t, ctx.GetBool(config.HEALTH_PROBE))
+
+		// one target is enough
+		upstream := server.switcher.Engine().services["orders"].upstream
+		assert.NoError(t, upstream.DrainTarget("127.0.0.1:8001"))
+		ctx = serve(server, "GET", "/readyz")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+
+		assert.NoError(t, upstream.DrainTarget("127.0.0.1:8002"))
+		ctx = serve(server, "GET", "/readyz")
+		assert.Equal(t, 503, ctx.Response.StatusCode())
+		assert.Equal(t, "upstream 'orders' of service 'orders' has no available target", string(ctx.Response.Body()))
+
+		// liveness doesn't depend on the upstreams
+		ctx = serve(server, "GET", "/healthz")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+
+		assert.NoError(t, upstream.EnableTarget("127.0.0.1:8002"))
+		server.draining.Store(true)
+		ctx = serve(server, "GET", "/readyz")
+		assert.Equal(t, 503, ctx.Response.StatusCode())
+		assert.Equal(t, "draining", string(ctx.Response.Body()))
+	})
+
+	t.Run("other requests go to the engine", func(t *testing.T) {
+		server := newBifrost(config.ProbeOptions{Enabled: true}).httpServers["http"]
+
+		ctx := serve(server, "GET", "/orders")
+		assert.Equal(t, 418, ctx.Response.StatusCode())
+
+		ctx = serve(server, "POST", "/healthz")
+		assert.Equal(t, 418, ctx.Response.StatusCode())
+		assert.False(t, ctx.GetBool(config.HEALTH_PROBE))
+	})
+
+	t.Run("access log", func(t *testing.T) {
+		server := newBifrost(config.ProbeOptions{Enabled: true, AccessLog: true}).httpServers["http"]
+
+		ctx := serve(server, "HEAD", "/healthz")
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+		assert.False(t, ctx.GetBool(config.HEALTH_PROBE))
+	})
+
+	t.Run("tcp entry", func(t *testing.T) {
+		err := validateEntry(config.Options{Upstreams: map[string]config.UpstreamOptions{"redis": {}}}, "redis", config.EntryOptions{
+			Bind:       ":6379",
+			Protocol:   config.ProtocolTCP,
+			UpstreamID: "redis",
+			Probes:     config.ProbeOptions{Enabled: true},
+		})
+		assert.ErrorContains(t, err, "probes are not supported")
+	})
+}
@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// profileEnv selects the profile when LoadFromConfig doesn't get one
+	profileEnv = "BIFROST_PROFILE"
+	profileKey = "profiles"
+)
+
+// applyProfile deep merges the selected profile of the profiles section over the rest of the config.
+// Maps are merged key by key, other values like lists are replaced by the profile.
+// The profiles section is removed from the result, an empty profile only removes it.
+func applyProfile(content string, profile string) (string, error) {
+	base := map[string]any{}
+
+	err := yaml.Unmarshal([]byte(content), &base)
+	if err != nil {
+		return "", err
+	}
+
+	profiles, _ := base[profileKey].(map[string]any)
+	delete(base, profileKey)
+
+	if len(profile) > 0 {
+		values, found := profiles[profile]
+		if !found {
+			return "", fmt.Errorf("profile '%s' is not found", profile)
+		}
+
+		if values != nil {
+			overrides, ok := values.(map[string]any)
+			if !ok {
+				return "", fmt.Errorf("profile '%s' is invalid", profile)
+			}
+			mergeMap(base, overrides)
+		}
+	}
+
+	b, err := yaml.Marshal(base)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func mergeMap(dst, src map[string]any) {
+	for k, v := range src {
+		srcMap, srcOK := v.(map[string]any)
+		dstMap, dstOK := dst[k].(map[string]any)
+
+		if srcOK && dstOK {
+			mergeMap(dstMap, srcMap)
+			continue
+		}
+
+		dst[k] = v
+	}
+}
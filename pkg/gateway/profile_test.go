@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const profileContent = `
+services:
+  orders:
+    url: http://localhost:8000
+    tls_verify: true
+    timeout:
+      request: 10s
+upstreams:
+  orders:
+    targets:
+      - target: "127.0.0.1:8000"
+      - target: "127.0.0.1:8001"
+profiles:
+  dev:
+  prod:
+    services:
+      orders:
+        url: http://orders
+        timeout:
+          request: 3s
+    upstreams:
+      orders:
+        targets:
+          - target: "10.0.0.1:8000"
+`
+
+func TestApplyProfile(t *testing.T) {
+	t.Run("no profile", func(t *testing.T) {
+		content, err := applyProfile(profileContent, "")
+		assert.NoError(t, err)
+		assert.NotContains(t, content, "profiles")
+
+		opts, err := parseContent(content)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8000", opts.Services["orders"].Url)
+		assert.Len(t, opts.Upstreams["orders"].Targets, 2)
+	})
+
+	t.Run("empty profile", func(t *testing.T) {
+		content, err := applyProfile(profileContent, "dev")
+		assert.NoError(t, err)
+
+		opts, err := parseContent(content)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8000", opts.Services["orders"].Url)
+	})
+
+	t.Run("profile overrides base", func(t *testing.T) {
+		content, err := applyProfile(profileContent, "prod")
+		assert.NoError(t, err)
+
+		opts, err := parseContent(content)
+		assert.NoError(t, err)
+
+		service := opts.Services["orders"]
+		assert.Equal(t, "http://orders", service.Url)
+		assert.Equal(t, "3s", service.Timeout.RequestTimeout.String())
+		// values which are not in the profile are kept
+		assert.True(t, service.TLSVerify)
+
+		// lists are replaced
+		targets := opts.Upstreams["orders"].Targets
+		assert.Len(t, targets, 1)
+		assert.Equal(t, "10.0.0.1:8000", targets[0].Target)
+	})
+
+	t.Run("profile not found", func(t *testing.T) {
+		_, err := applyProfile(profileContent, "staging")
+		assert.ErrorContains(t, err, "profile 'staging' is not found")
+	})
+}
+
+func TestLoadFromConfigWithProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(profileContent), 0o600)
+	assert.NoError(t, err)
+
+	_, err = LoadFromConfigWithProfile(path, "staging")
+	assert.ErrorContains(t, err, "profile 'staging' is not found")
+
+	t.Setenv(profileEnv, "staging")
+	_, err = LoadFromConfig(path)
+	assert.ErrorContains(t, err, "profile 'staging' is not found")
+}
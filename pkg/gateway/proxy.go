@@ -26,34 +26,56 @@ package gateway
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"http-benchmark/pkg/config"
 	"http-benchmark/pkg/log"
+	"io"
 	"log/slog"
 	"net"
 	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	errs "github.com/cloudwego/hertz/pkg/common/errors"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/network/dialer"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
-	hertztracing "github.com/hertz-contrib/obs-opentelemetry/tracing"
 	"github.com/valyala/bytebufferpool"
 )
 
+// methodOverrideKey replaces the method of the request sent to the upstream, the body is kept
+const methodOverrideKey = "method_override"
+
 type Proxy struct {
 	client *client.Client
 
+	// fallbackClient sends the request when the http3 handshake of client fails
+	fallbackClient *client.Client
+
 	// target is set as a reverse proxy address
 	target string
 
 	// transferTrailer is whether to forward Trailer-related header
 	transferTrailer bool
 
+	// grpc is set when the requests are sent over http2 with a streamed response, see enableGRPC
+	grpc bool
+
+	// streaming is set when the response bodies of the service are streamed to the client, see streamResponse.
+	// client always reads the response body as a stream, so the server-sent events of a buffered proxy are streamed
+	// as they are sent and any other body is read to the end, see bufferResponse.
+	streaming           bool
+	maxResponseBodySize int
+
 	// saveOriginResponse is whether to save the original response header
 	saveOriginResHeader bool
 
@@ -75,6 +97,11 @@ type Proxy struct {
 	// implementation is used.
 	modifyResponse func(*protocol.Response) error
 
+	// modifyResponseWithContext is like modifyResponse but it also gets the request context, so the
+	// request, the route and the variables can be used. It is called before the hop-by-hop headers
+	// are removed from the response.
+	modifyResponseWithContext func(*app.RequestContext, *protocol.Response) error
+
 	// errorHandler is an optional function that handles errors
 	// reaching the backend or errors from modifyResponse.
 	//
@@ -84,7 +111,42 @@ type Proxy struct {
 
 	targetHost string
 
-	weight int
+	// hostHeader replaces the Host header sent to the target, the Host of the client is kept when it is empty
+	hostHeader string
+
+	// weight is changed in place when the target is kept by a reload, see reuseProxies
+	weight atomic.Int64
+
+	// drained is set when the target is administratively drained, no new requests are sent to it
+	drained atomic.Bool
+
+	// stats are analyzed by the outlier detector, ejectedUntil is the unix nano time the ejection ends
+	stats        targetStats
+	ejectedUntil atomic.Int64
+
+	// ejections is the number of consecutive ejections, it is only used by the outlier detector
+	ejections int
+
+	// poolStates is reported by the host clients of client, see PoolStats
+	poolStates      poolStates
+	maxConnsPerHost int
+
+	// proxyProtocol is the PROXY header sent on each new upstream connection, see enableProxyProtocol
+	proxyProtocol config.ProxyProtocol
+
+	// proxyProtocolClients are the clients of the client connections by their addresses when the proxy sends the
+	// PROXY header, see clientOf
+	proxyProtocolClients   sync.Map
+	newProxyProtocolClient func(src, dst net.Addr) (*client.Client, error)
+	proxyProtocolIdle      time.Duration
+	proxyProtocolSweep     atomic.Int64
+
+	// inFlight is the number of the requests being sent to the target, see the admin api
+	inFlight atomic.Int64
+
+	// conns are the upstream connections by their tracked remote address, so the connection of a response body
+	// which isn't read to the end can be abandoned, see abandonConn
+	conns sync.Map
 }
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -124,7 +186,6 @@ func newProxy(target string, tracingEnabled bool, weight int, options ...hzconfi
 	r := &Proxy{
 		target:     target,
 		targetHost: addr.Host,
-		weight:     weight,
 		director: func(req *protocol.Request) {
 			req.Header.SetProtocol("HTTP/1.1")
 
@@ -139,20 +200,51 @@ func newProxy(target string, tracingEnabled bool, weight int, options ...hzconfi
 			//req.Header.SetHostBytes(req.URI().Host())
 		},
 	}
+	r.weight.Store(int64(weight))
 
 	if len(options) != 0 {
-		c, err := client.NewClient(options...)
-		if tracingEnabled {
-			c.Use(hertztracing.ClientMiddleware())
+		// the options of the caller are copied, they may be shared by the proxies of other targets
+		options = append(options[:len(options):len(options)], client.WithConnStateObserve(r.poolStates.observe, poolStatsInterval))
+
+		// the dialer chosen by the options is wrapped, so a dial timeout is classified as one
+		clientOptions := hzconfig.NewClientOptions(options)
+		d := clientOptions.Dialer
+		if d == nil {
+			d = dialer.DefaultDialer()
 		}
+		r.streaming = clientOptions.ResponseBodyStream
+
+		c, err := client.NewClient(append(options[:len(options):len(options)],
+			client.WithResponseBodyStream(true),
+			client.WithDialer(&dialTimeoutDialer{Dialer: d, wrapConn: r.trackConn}),
+		)...)
 		if err != nil {
 			return nil, err
 		}
+		if tracingEnabled {
+			c.Use(tracingClientMiddleware())
+		}
 		r.client = c
+		r.maxConnsPerHost = c.GetOptions().MaxConnsPerHost
+		r.maxResponseBodySize = c.GetOptions().MaxResponseBodySize
 	}
 	return r, nil
 }
 
+// isEventStreamRequest reports whether the client asks for server-sent events, EventSource always sends
+// Accept: text/event-stream
+func isEventStreamRequest(req *protocol.Request) bool {
+	for _, accept := range req.Header.PeekAll("Accept") {
+		for _, value := range strings.Split(b2s(accept), ",") {
+			mediaType, _, _ := strings.Cut(value, ";")
+			if strings.EqualFold(textproto.TrimString(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func JoinURLPath(req *protocol.Request, target string) (path []byte) {
 	aslash := req.URI().Path()[0] == '/'
 	var bslash bool
@@ -196,7 +288,9 @@ func JoinURLPath(req *protocol.Request, target string) (path []byte) {
 		}
 		_, _ = buffer.Write(req.QueryString())
 	}
-	return buffer.Bytes()
+
+	// the buffer is put back to the pool when returning, so the bytes must be copied
+	return append([]byte(nil), buffer.Bytes()...)
 }
 
 // removeRequestConnHeaders removes hop-by-hop headers listed in the "Connection" header of h.
@@ -239,8 +333,8 @@ func checkTeHeader(header *protocol.RequestHeader) bool {
 	return false
 }
 
-func (r *Proxy) defaultErrorHandler(c *app.RequestContext, _ error) {
-	c.Response.Header.SetStatusCode(consts.StatusBadGateway)
+func (r *Proxy) defaultErrorHandler(c *app.RequestContext, err error) {
+	c.Response.Header.SetStatusCode(upstreamErrorStatus(err))
 }
 
 var respTmpHeaderPool = sync.Pool{
@@ -250,6 +344,9 @@ var respTmpHeaderPool = sync.Pool{
 }
 
 func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+
 	req := &ctx.Request
 	resp := &ctx.Response
 
@@ -269,9 +366,23 @@ func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 			}
 		})
 	}
+	fwd := newForwarded(ctx)
+	// the upgrade headers are hop-by-hop, so the upgrade is detected before they are removed
+	websocket := isWebSocketUpgrade(req)
+
+	if !websocket && !r.grpc && isEventStreamRequest(req) {
+		// a compressor of the upstream may hold the events until its buffer is full
+		req.Header.Del("Accept-Encoding")
+	}
 	if r.director != nil {
 		r.director(&ctx.Request)
 	}
+	if method := ctx.GetString(methodOverrideKey); len(method) > 0 {
+		req.Header.SetMethod(method)
+	}
+	if len(r.hostHeader) > 0 {
+		req.Header.SetHost(r.hostHeader)
+	}
 	req.Header.ResetConnectionClose()
 
 	hasTeTrailer := false
@@ -296,29 +407,33 @@ func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	}
 
 	// prepare request(replace headers and some URL host)
-	if ip, _, err := net.SplitHostPort(ctx.RemoteAddr().String()); err == nil {
-		tmp := req.Header.Peek("X-Forwarded-For")
+	setForwardedHeaders(ctx, fwd)
 
-		if len(tmp) > 0 {
-			buf := bytebufferpool.Get()
-			defer bytebufferpool.Put(buf)
-
-			buf.Write(tmp)
-			buf.WriteString(", ")
-			buf.WriteString(ip)
-			ip = buf.String()
-		}
-		if tmp == nil || string(tmp) != "" {
-			req.Header.Set("X-Forwarded-For", ip)
+	var err error
+	if websocket {
+		err = r.serveWebSocket(c, ctx)
+	} else {
+		start := time.Now()
+		var cli *client.Client
+		cli, err = r.clientOf(ctx)
+		if err == nil {
+			err = r.do(c, cli, req, resp)
 		}
+		r.setUpstreamTimings(ctx, resp.RemoteAddr(), time.Since(start))
 	}
 
-	fn := client.Do
-	if r.client != nil {
-		fn = r.client.Do
+	// server-sent events are streamed even when the responses of the proxy are buffered
+	streaming := r.streaming || resp.IsBodyStream()
+
+	// the client went away, it is not an upstream error and must not be retried
+	if err != nil && errors.Is(c.Err(), context.Canceled) {
+		ctx.Set(config.CLIENT_CANCELED_AT, time.Now())
+		ctx.Set(clientAbortedKey, true)
+		resp.Reset()
+		resp.SetStatusCode(499)
+		return
 	}
 
-	err := fn(c, req, resp)
 	if err != nil {
 		buf := bytebufferpool.Get()
 		defer bytebufferpool.Put(buf)
@@ -334,11 +449,15 @@ func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 			slog.String("upstream", uri),
 		)
 
-		if err.Error() == "timeout" {
+		upstreamErr := newUpstreamError(err)
+		ctx.Set(config.UPSTREAM_ERROR, upstreamErr.Class)
+		if isUpstreamTimeout(upstreamErr.Class) {
 			ctx.Set("target_timeout", true)
+		} else {
+			ctx.Set("target_error", true)
 		}
 
-		r.getErrorHandler()(ctx, err)
+		r.getErrorHandler()(ctx, upstreamErr)
 		return
 	}
 
@@ -355,13 +474,50 @@ func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	}
 	respTmpHeaderPool.Put(respTmpHeader)
 
-	removeResponseConnHeaders(ctx)
+	if r.modifyResponseWithContext != nil {
+		if err := r.modifyResponseWithContext(ctx, resp); err != nil {
+			// a streamed body is not read anymore, the upstream connection is released
+			if resp.IsBodyStream() {
+				_ = resp.CloseBodyStream()
+				resp.Reset()
+			}
+			r.getErrorHandler()(ctx, err)
+			return
+		}
+	}
+
+	// the client needs the upgrade headers when the target switched to websocket
+	if resp.StatusCode() != consts.StatusSwitchingProtocols {
+		removeResponseConnHeaders(ctx)
 
-	for _, h := range hopHeaders {
-		if r.transferTrailer && h == "Trailer" {
-			continue
+		for _, h := range hopHeaders {
+			if r.transferTrailer && h == "Trailer" {
+				continue
+			}
+			resp.Header.DelBytes(s2b(h))
+		}
+	}
+
+	if r.grpc {
+		streamGRPCResponse(ctx)
+	} else if streaming {
+		addr := resp.RemoteAddr()
+		abandonUpstream := func() { r.abandonConn(addr) }
+		if err := streamResponse(ctx, ctx.GetInt(maxResponseBodySizeKey), abandonUpstream); err != nil {
+			logger := log.FromContext(c)
+			logger.ErrorContext(c, "upstream response body is too large",
+				slog.Int("content_length", resp.Header.ContentLength()),
+				slog.Int("max_response_body_size", ctx.GetInt(maxResponseBodySizeKey)),
+			)
+
+			// the upstream connection is released before the error response replaces the body
+			_ = resp.CloseBodyStream()
+			resp.Reset()
+			ctx.Set("target_error", true)
+			ctx.Set(config.UPSTREAM_ERROR, upstreamErrorBodyTooLarge)
+			r.getErrorHandler()(ctx, &UpstreamError{Class: upstreamErrorBodyTooLarge, Err: err})
+			return
 		}
-		resp.Header.DelBytes(s2b(h))
 	}
 
 	if r.modifyResponse == nil {
@@ -375,6 +531,222 @@ func (r *Proxy) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 
 }
 
+// do sends the request to the upstream. A request which asks for server-sent events may wait for the upstream for
+// long, so when its client disconnects, do returns context.Canceled right away instead of waiting for the upstream
+// response; the upstream call keeps running on copies of the request and response, so the request context can be
+// recycled, and the copies are released when it finishes. Any other request waits for the upstream response, which
+// is bounded by the request timeout of the service, rather than paying for the copies.
+// grpc and streaming responses are read after the handler returns, so they are always sent on the request and
+// response of the client. The server-sent events of a buffered proxy are handed over to the response of the client.
+// cli is the client of the connection of the request, it is nil unless the proxy sends the PROXY header.
+func (r *Proxy) do(c context.Context, cli *client.Client, req *protocol.Request, resp *protocol.Response) error {
+	if c.Done() == nil || r.grpc || r.streaming || !isEventStreamRequest(req) {
+		return r.send(c, cli, req, resp)
+	}
+
+	upstreamReq := protocol.AcquireRequest()
+	upstreamResp := protocol.AcquireResponse()
+	req.CopyTo(upstreamReq)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.send(c, cli, upstreamReq, upstreamResp)
+	}()
+
+	release := func() {
+		protocol.ReleaseRequest(upstreamReq)
+		protocol.ReleaseResponse(upstreamResp)
+	}
+
+	select {
+	case err := <-done:
+		upstreamResp.CopyTo(resp)
+		if upstreamResp.IsBodyStream() {
+			// the stream reads the buffer of upstreamResp, so upstreamResp is released when the stream is closed
+			protocol.ReleaseRequest(upstreamReq)
+			resp.SetBodyStreamNoReset(&handedOverBody{resp: upstreamResp}, upstreamResp.Header.ContentLength())
+			return err
+		}
+		release()
+		return err
+	case <-c.Done():
+		go func() {
+			<-done
+			// nobody reads the events anymore, the connection is closed rather than read to the end
+			if upstreamResp.IsBodyStream() {
+				r.abandonConn(upstreamResp.RemoteAddr())
+			}
+			release()
+		}()
+
+		return c.Err()
+	}
+}
+
+func (r *Proxy) send(c context.Context, cli *client.Client, req *protocol.Request, resp *protocol.Response) error {
+	if cli == nil {
+		cli = r.client
+	}
+
+	err := r.sendWith(c, cli, req, resp)
+
+	var handshakeErr *http3HandshakeError
+	if err != nil && r.fallbackClient != nil && errors.As(err, &handshakeErr) {
+		resp.Reset()
+		err = r.sendWith(c, r.fallbackClient, req, resp)
+	}
+
+	if err != nil || r.grpc || r.streaming || isEventStreamResponse(resp) {
+		return err
+	}
+	return r.bufferResponse(resp)
+}
+
+func (r *Proxy) sendWith(c context.Context, cli *client.Client, req *protocol.Request, resp *protocol.Response) error {
+	if deadline, ok := c.Deadline(); ok {
+		// the request timeout of the service, the upstream connection is closed when the deadline is exceeded
+		if cli != nil {
+			return cli.DoDeadline(c, req, resp, deadline)
+		}
+		return client.DoDeadline(c, req, resp, deadline)
+	}
+
+	if cli != nil {
+		return cli.Do(c, req, resp)
+	}
+	return client.Do(c, req, resp)
+}
+
+// trackConn keeps the timing of the new connections, and the connections in conns until they are closed
+func (r *Proxy) trackConn(conn network.Conn, timing dialTiming) network.Conn {
+	if conn.RemoteAddr() == nil {
+		return conn
+	}
+
+	var addr net.Addr
+	tracked := newTrackedConn(conn, timing, func() { r.conns.Delete(addr) })
+	addr = tracked.RemoteAddr()
+	r.conns.Store(addr, tracked)
+	return tracked
+}
+
+// abandonConn makes the client close the upstream connection of a streaming response when the body is released
+// before the end, instead of reading the rest of the body and putting the connection back to the pool. The
+// connection is never closed here, a closed connection in the pool would be handed out to the next request.
+func (r *Proxy) abandonConn(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+
+	val, found := r.conns.Load(addr)
+	if !found {
+		return
+	}
+
+	switch conn := val.(type) {
+	case *trackedConn:
+		conn.abandon()
+	case *trackedTLSConn:
+		conn.abandon()
+	}
+}
+
+// bufferResponse reads the streamed body of a response which isn't server-sent events to the end, like a client
+// which buffers the response does. ErrResponseTooLarge is returned when the body exceeds the max_response_body_size
+// of the service, the upstream connection is closed rather than read to the end then.
+func (r *Proxy) bufferResponse(resp *protocol.Response) error {
+	if !resp.IsBodyStream() {
+		return nil
+	}
+
+	if r.maxResponseBodySize > 0 && resp.Header.ContentLength() > r.maxResponseBodySize {
+		r.abandonConn(resp.RemoteAddr())
+		_ = resp.CloseBodyStream()
+		return ErrResponseTooLarge
+	}
+
+	// the client reads a small body with the header, it is kept in the buffer of the response as it is
+	if n := resp.Header.ContentLength(); n >= 0 && len(resp.BodyBuffer().B) == n {
+		return resp.CloseBodyStream()
+	}
+
+	body := io.Reader(resp.BodyStream())
+	if r.maxResponseBodySize > 0 {
+		body = io.LimitReader(body, int64(r.maxResponseBodySize)+1)
+	}
+
+	// the stream reads the buffer of the response, so the body is read into another one
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	_, err := buf.ReadFrom(body)
+	if err == nil && r.maxResponseBodySize > 0 && buf.Len() > r.maxResponseBodySize {
+		err = ErrResponseTooLarge
+	}
+	if err != nil {
+		r.abandonConn(resp.RemoteAddr())
+		_ = resp.CloseBodyStream()
+		return err
+	}
+
+	if err := resp.CloseBodyStream(); err != nil {
+		return err
+	}
+	resp.SetBody(buf.B)
+	return nil
+}
+
+// handedOverBody is the event stream of a response sent on a copy of the request, the copy of the response is
+// released when the stream is closed
+type handedOverBody struct {
+	resp *protocol.Response
+}
+
+func (b *handedOverBody) Read(p []byte) (int, error) {
+	if b.resp == nil {
+		return 0, errs.ErrConnectionClosed
+	}
+	return b.resp.BodyStream().Read(p)
+}
+
+func (b *handedOverBody) Close() error {
+	if b.resp == nil {
+		return nil
+	}
+
+	err := b.resp.CloseBodyStream()
+	protocol.ReleaseResponse(b.resp)
+	b.resp = nil
+	return err
+}
+
+// setUpstreamTimings sets the dns, connect and tls handshake time of the connection and the time to first byte of
+// the response. A connection reused from the pool has no dns, connect and tls time.
+// A buffered response is read to the end before it is returned, so its time to first byte includes the body.
+func (r *Proxy) setUpstreamTimings(ctx *app.RequestContext, addr net.Addr, total time.Duration) {
+	timing := dialTiming{}
+	if tracked, ok := addr.(*trackedAddr); ok {
+		if dialed := tracked.timing.Swap(nil); dialed != nil {
+			timing = *dialed
+		}
+	}
+
+	ttfb := total - timing.dns - timing.connect - timing.tls
+	if ttfb < 0 {
+		ttfb = 0
+	}
+
+	ctx.Set(config.UPSTREAM_DNS_TIME, formatSeconds(timing.dns))
+	ctx.Set(config.UPSTREAM_CONNECT_TIME, formatSeconds(timing.connect))
+	ctx.Set(config.UPSTREAM_TLS_TIME, formatSeconds(timing.tls))
+	ctx.Set(config.UPSTREAM_TTFB, formatSeconds(ttfb))
+}
+
+// formatSeconds formats the duration in seconds with microsecond precision like $upstream_duration
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1e6, 'f', -1, 64)
+}
+
 // SetDirector use to customize protocol.Request
 func (r *Proxy) SetDirector(director func(req *protocol.Request)) {
 	r.director = director
@@ -390,6 +762,11 @@ func (r *Proxy) SetModifyResponse(mr func(*protocol.Response) error) {
 	r.modifyResponse = mr
 }
 
+// SetModifyResponseWithContext use to modify response with the request context
+func (r *Proxy) SetModifyResponseWithContext(mr func(ctx *app.RequestContext, resp *protocol.Response) error) {
+	r.modifyResponseWithContext = mr
+}
+
 // SetErrorHandler use to customize error handler
 func (r *Proxy) SetErrorHandler(eh func(c *app.RequestContext, err error)) {
 	r.errorHandler = eh
@@ -403,6 +780,10 @@ func (r *Proxy) SetSaveOriginResHeader(b bool) {
 	r.saveOriginResHeader = b
 }
 
+func (r *Proxy) isAvailable() bool {
+	return !r.drained.Load() && !r.isEjected(time.Now())
+}
+
 func (r *Proxy) getErrorHandler() func(c *app.RequestContext, err error) {
 	if r.errorHandler != nil {
 		return r.errorHandler
@@ -0,0 +1,522 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/network/dialer"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+const (
+	// proxyHeaderTimeout bounds the time to receive the PROXY header, load balancers send it right after connecting
+	proxyHeaderTimeout = 3 * time.Second
+
+	// proxyHeaderV1MaxLength is the longest v1 header, including the CRLF
+	proxyHeaderV1MaxLength = 107
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+func validateProxyProtocol(version config.ProxyProtocol) error {
+	switch version {
+	case "", config.ProxyProtocolOff, config.ProxyProtocolV1, config.ProxyProtocolV2:
+		return nil
+	default:
+		return fmt.Errorf("proxy_protocol '%s' is invalid", version)
+	}
+}
+
+// usesProxyProtocol returns true when the upstream or one of its targets sends the PROXY header
+func usesProxyProtocol(opts config.UpstreamOptions) bool {
+	for _, target := range opts.Targets {
+		if proxyProtocolOf(opts, target) != config.ProxyProtocolOff {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolOf returns the PROXY protocol version of the target, the target overrides the upstream
+func proxyProtocolOf(opts config.UpstreamOptions, target config.TargetOptions) config.ProxyProtocol {
+	version := target.ProxyProtocol
+	if version == "" {
+		version = opts.ProxyProtocol
+	}
+	if version == "" {
+		return config.ProxyProtocolOff
+	}
+	return version
+}
+
+// writeProxyHeader sends the PROXY header of the client connection, it must be written once, right after the
+// upstream connection is dialed and before any byte of the client. src is the client and dst is the address
+// the client connected to.
+func writeProxyHeader(w io.Writer, version config.ProxyProtocol, src, dst net.Addr) error {
+	var header []byte
+
+	switch version {
+	case config.ProxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case config.ProxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return nil
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// tcpAddrs returns the ips of the addresses in the same family, ok is false when they aren't tcp addresses
+func tcpAddrs(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, ipv4 bool, ok bool) {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return nil, nil, false, false
+	}
+
+	ipv4 = srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	return srcAddr, dstAddr, ipv4, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, dstAddr, ipv4, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family, srcIP, dstIP := "TCP6", srcAddr.IP.To16().String(), dstAddr.IP.To16().String()
+	if ipv4 {
+		family, srcIP, dstIP = "TCP4", srcAddr.IP.To4().String(), dstAddr.IP.To4().String()
+	}
+
+	return []byte("PROXY " + family + " " + srcIP + " " + dstIP + " " +
+		strconv.Itoa(srcAddr.Port) + " " + strconv.Itoa(dstAddr.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	buf := bytes.Buffer{}
+	buf.Write(proxyProtocolV2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	srcAddr, dstAddr, ipv4, ok := tcpAddrs(src, dst)
+	if !ok {
+		// unspecified family, the receiver ignores the addresses
+		buf.Write([]byte{0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var srcIP, dstIP net.IP
+	if ipv4 {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+	} else {
+		// TCP over IPv6
+		buf.WriteByte(0x21)
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+	}
+
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(srcIP)+len(dstIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(srcAddr.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dstAddr.Port))
+
+	return buf.Bytes()
+}
+
+// readProxyHeader reads the PROXY header, v1 or v2, at the start of the connection. The client address is nil when
+// the header doesn't carry it, like the health checks of the load balancer. Nothing after the header is read, so the
+// request, or the tls handshake, is left in the connection.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	sig := make([]byte, len(proxyProtocolV2Signature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errInvalidProxyHeader
+	}
+	return readProxyHeaderV1(r, sig)
+}
+
+func readProxyHeaderV1(r io.Reader, line []byte) (net.Addr, error) {
+	// the line is read byte by byte, a buffered reader would take the bytes of the request too
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyHeaderV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, errInvalidProxyHeader
+		}
+	case "TCP6":
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r io.Reader) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[0], header[1]
+	if verCmd>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL, the connection is opened by the load balancer itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(addrs) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(addrs) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		// unspecified, udp and unix sockets don't carry a tcp client
+		return nil, nil
+	}
+}
+
+// proxyConnKey keeps the accepted connection of a trusted source in the context of the connection, its PROXY header
+// is read by proxyProtocolTransport
+type proxyConnKey struct{}
+
+// acceptProxyProtocol is the OnAccept hook of an entry with proxy_protocol. It runs in the accept loop, so it only
+// tells the trusted sources apart, their header is read in the goroutine of the connection before the tls handshake
+// and a source which is slow to send it never delays the other connections. Sources which aren't trusted keep
+// their address and their header is never read.
+func (s *HTTPServer) acceptProxyProtocol(conn net.Conn) context.Context {
+	ctx := context.Background()
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(s.proxyProtocolTrusted, addr.IP) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, proxyConnKey{}, conn)
+}
+
+// ProxyProtocolErrors returns the number of the connections closed because of an invalid PROXY header
+func (s *HTTPServer) ProxyProtocolErrors() uint64 {
+	return s.proxyProtocolErrors.Load()
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolTransport serves the connections of the standard transport of hertz with the client of their PROXY
+// header. netpoll takes the file descriptor of the listener, so a wrapped listener can't be used.
+type proxyProtocolTransport struct {
+	network.Transporter
+	server *HTTPServer
+}
+
+func (s *HTTPServer) newProxyProtocolTransport(opts *hzconfig.Options) network.Transporter {
+	return &proxyProtocolTransport{Transporter: standard.NewTransporter(opts), server: s}
+}
+
+func (t *proxyProtocolTransport) ListenAndServe(onData network.OnData) error {
+	return t.Transporter.ListenAndServe(func(ctx context.Context, conn any) error {
+		raw, found := ctx.Value(proxyConnKey{}).(net.Conn)
+		c, ok := conn.(network.Conn)
+		if !found || !ok {
+			return onData(ctx, conn)
+		}
+
+		// nothing is read from the connection yet, the header is read from the accepted connection under the
+		// tls and the buffers of hertz, bounded by proxyHeaderTimeout
+		_ = raw.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(raw)
+		_ = raw.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			t.server.proxyProtocolErrors.Add(1)
+			slog.Debug("invalid proxy protocol header", "entry", t.server.entryOpts.ID, "remote_addr", raw.RemoteAddr().String(), "error", err)
+			_ = c.Close()
+			return nil
+		}
+
+		if addr != nil {
+			conn = newProxiedConn(c, addr)
+		}
+		return onData(ctx, conn)
+	})
+}
+
+// proxiedConn reports the client of the PROXY header as the remote address of the connection
+type proxiedConn struct {
+	network.Conn
+	remoteAddr net.Addr
+}
+
+// proxiedTLSConn keeps the tls state of the connection for alpn, sni and client_auth
+type proxiedTLSConn struct {
+	*proxiedConn
+	tlsConn network.ConnTLSer
+}
+
+func newProxiedConn(conn network.Conn, remoteAddr net.Addr) network.Conn {
+	c := &proxiedConn{Conn: conn, remoteAddr: remoteAddr}
+	if tlsConn, ok := conn.(network.ConnTLSer); ok {
+		return &proxiedTLSConn{proxiedConn: c, tlsConn: tlsConn}
+	}
+	return c
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxiedConn) HandleSpecificError(err error, rip string) bool {
+	if hsp, ok := c.Conn.(network.HandleSpecificError); ok {
+		return hsp.HandleSpecificError(err, rip)
+	}
+	return false
+}
+
+func (c *proxiedTLSConn) Handshake() error {
+	return c.tlsConn.Handshake()
+}
+
+func (c *proxiedTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// proxyProtocolDialer sends the PROXY header of a client connection on each new upstream connection, before the
+// tls handshake. Its connections carry the address of one client, so they are only pooled for that client.
+type proxyProtocolDialer struct {
+	network.Dialer
+	version  config.ProxyProtocol
+	src, dst net.Addr
+}
+
+func (d *proxyProtocolDialer) DialConnection(n, address string, timeout time.Duration, tlsConfig *tls.Config) (network.Conn, error) {
+	start := time.Now()
+	conn, err := d.Dialer.DialConnection(n, address, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		_ = conn.SetDeadline(start.Add(timeout))
+	}
+
+	if err := writeProxyHeader(conn, d.version, d.src, d.dst); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("fail to send proxy protocol header: %w", err)
+	}
+
+	if tlsConfig != nil {
+		tlsConn, err := d.Dialer.AddTLS(conn, tlsConfig)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// resolve keeps the dns time of the wrapped dialer apart from the connect time, see dialTimeoutDialer
+func (d *proxyProtocolDialer) resolve(address string) (string, error) {
+	if resolver, ok := d.Dialer.(addressResolver); ok {
+		return resolver.resolve(address)
+	}
+	return address, nil
+}
+
+// proxyProtocolClient sends the requests of one client connection
+type proxyProtocolClient struct {
+	client   *client.Client
+	lastUsed atomic.Int64
+}
+
+// enableProxyProtocol makes the proxy send the PROXY header of the client on each new upstream connection. The
+// header is per connection and a pooled connection is reused by the next request, so the requests of each client
+// connection are sent by a client of its own, see clientOf. Its responses are read as a stream like the ones of
+// the client of the proxy.
+func (r *Proxy) enableProxyProtocol(version config.ProxyProtocol, tracingEnabled bool, clientOpts []hzconfig.ClientOption) {
+	if version == "" || version == config.ProxyProtocolOff {
+		return
+	}
+
+	options := hzconfig.NewClientOptions(clientOpts)
+	d := options.Dialer
+	if d == nil {
+		d = dialer.DefaultDialer()
+	}
+
+	r.proxyProtocol = version
+	r.proxyProtocolIdle = options.MaxIdleConnDuration
+	if r.proxyProtocolIdle <= 0 {
+		r.proxyProtocolIdle = consts.DefaultMaxIdleConnDuration
+	}
+
+	r.newProxyProtocolClient = func(src, dst net.Addr) (*client.Client, error) {
+		ppd := &proxyProtocolDialer{Dialer: d, version: version, src: src, dst: dst}
+		c, err := client.NewClient(append(slices.Clone(clientOpts),
+			client.WithResponseBodyStream(true),
+			client.WithDialer(&dialTimeoutDialer{Dialer: ppd, wrapConn: r.trackConn}),
+		)...)
+		if err != nil {
+			return nil, err
+		}
+		if tracingEnabled {
+			c.Use(tracingClientMiddleware())
+		}
+		return c, nil
+	}
+}
+
+// clientOf returns the client of the connection of the request when the proxy sends the PROXY header, otherwise
+// nil. The clients which weren't used for the max idle duration are dropped when a new one is created.
+func (r *Proxy) clientOf(ctx *app.RequestContext) (*client.Client, error) {
+	if r.newProxyProtocolClient == nil {
+		return nil, nil
+	}
+
+	src := ctx.RemoteAddr()
+	var dst net.Addr
+	if conn := ctx.GetConn(); conn != nil {
+		dst = conn.LocalAddr()
+	}
+	key := addrKey(src) + "-" + addrKey(dst)
+	now := time.Now()
+
+	if val, found := r.proxyProtocolClients.Load(key); found {
+		pc := val.(*proxyProtocolClient)
+		pc.lastUsed.Store(now.UnixNano())
+		return pc.client, nil
+	}
+
+	c, err := r.newProxyProtocolClient(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	pc := &proxyProtocolClient{client: c}
+	pc.lastUsed.Store(now.UnixNano())
+
+	val, loaded := r.proxyProtocolClients.LoadOrStore(key, pc)
+	if !loaded {
+		r.sweepProxyProtocolClients(now)
+	}
+	return val.(*proxyProtocolClient).client, nil
+}
+
+// sweepProxyProtocolClients drops the idle clients at most once per max idle duration, a request which still holds
+// a dropped client finishes on it and its connections are closed by the idle cleaner of the client
+func (r *Proxy) sweepProxyProtocolClients(now time.Time) {
+	last := r.proxyProtocolSweep.Load()
+	if now.UnixNano()-last < int64(r.proxyProtocolIdle) || !r.proxyProtocolSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	r.proxyProtocolClients.Range(func(key, val any) bool {
+		pc := val.(*proxyProtocolClient)
+		if now.UnixNano()-pc.lastUsed.Load() >= int64(r.proxyProtocolIdle) {
+			r.proxyProtocolClients.Delete(key)
+			pc.client.CloseIdleConnections()
+		}
+		return true
+	})
+}
+
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
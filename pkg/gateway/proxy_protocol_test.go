@@ -0,0 +1,307 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"http-benchmark/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolEntry(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9921"))
+	backend.GET("/ip", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, string(ctx.Request.Header.Peek("X-Forwarded-For")))
+	})
+	go backend.Spin()
+
+	bifrost, err := Load(config.Options{
+		Entries: map[string]config.EntryOptions{
+			"nlb": {
+				Bind:                      "127.0.0.1:9922",
+				ProxyProtocol:             true,
+				ProxyProtocolTrustedCIDRs: []string{"127.0.0.1"},
+			},
+			"internal": {
+				Bind:                      "127.0.0.1:9923",
+				ProxyProtocol:             true,
+				ProxyProtocolTrustedCIDRs: []string{"10.0.0.0/8"},
+			},
+		},
+		Routes: map[string]config.RouteOptions{
+			"ip": {Paths: []string{"/ip"}, ServiceID: "ip"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"ip": {Url: "http://127.0.0.1:9921"},
+		},
+	})
+	assert.NoError(t, err)
+	go bifrost.Run()
+	defer bifrost.Shutdown()
+	time.Sleep(time.Second)
+
+	// send writes the preamble and a request on a new connection, the response is nil when the connection is closed
+	send := func(addr string, preamble []byte) *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(append(preamble, "GET /ip HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"...))
+		assert.NoError(t, err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+
+	body := func(resp *http.Response) string {
+		if !assert.NotNil(t, resp) {
+			return ""
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		resp := send("127.0.0.1:9922", []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 9922\r\n"))
+		assert.Equal(t, "203.0.113.7", body(resp))
+
+		// the health checks of the load balancer keep the address of the connection
+		resp = send("127.0.0.1:9922", []byte("PROXY UNKNOWN\r\n"))
+		assert.Equal(t, "127.0.0.1", body(resp))
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		header := bytes.Buffer{}
+		header.Write(proxyProtocolV2Signature)
+		header.Write([]byte{0x21, 0x21})
+		_ = binary.Write(&header, binary.BigEndian, uint16(36))
+		header.Write(net.ParseIP("2001:db8::1").To16())
+		header.Write(net.ParseIP("::1").To16())
+		_ = binary.Write(&header, binary.BigEndian, uint16(51234))
+		_ = binary.Write(&header, binary.BigEndian, uint16(9922))
+
+		resp := send("127.0.0.1:9922", header.Bytes())
+		assert.Equal(t, "2001:db8::1", body(resp))
+	})
+
+	t.Run("malformed header", func(t *testing.T) {
+		server := bifrost.httpServers["nlb"]
+		before := server.ProxyProtocolErrors()
+
+		assert.Nil(t, send("127.0.0.1:9922", []byte("PROXY TCP4 not-an-ip 127.0.0.1 51234 9922\r\n")))
+		assert.Nil(t, send("127.0.0.1:9922", nil))
+		assert.Equal(t, before+2, server.ProxyProtocolErrors())
+	})
+
+	t.Run("silent source doesn't delay the other connections", func(t *testing.T) {
+		silent, err := net.Dial("tcp", "127.0.0.1:9922")
+		assert.NoError(t, err)
+		defer silent.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		resp := send("127.0.0.1:9922", []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 9922\r\n"))
+		assert.Equal(t, "203.0.113.7", body(resp))
+		assert.Less(t, time.Since(start), proxyHeaderTimeout/2)
+	})
+
+	t.Run("untrusted source", func(t *testing.T) {
+		resp := send("127.0.0.1:9923", nil)
+		assert.Equal(t, "127.0.0.1", body(resp))
+
+		// the header of an untrusted source is never read, so it is a bad request
+		resp = send("127.0.0.1:9923", []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 9923\r\n"))
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, 400, resp.StatusCode)
+		}
+		assert.Zero(t, bifrost.httpServers["internal"].ProxyProtocolErrors())
+	})
+
+	t.Run("invalid trusted cidrs", func(t *testing.T) {
+		err := validateEntry(config.Options{}, "nlb", config.EntryOptions{
+			Bind:                      ":80",
+			ProxyProtocol:             true,
+			ProxyProtocolTrustedCIDRs: []string{"10.0.0.0/33"},
+		})
+		assert.ErrorContains(t, err, "proxy_protocol_trusted_cidrs")
+
+		// every source has to be trusted explicitly
+		err = validateEntry(config.Options{}, "nlb", config.EntryOptions{
+			Bind:          ":80",
+			ProxyProtocol: true,
+		})
+		assert.ErrorContains(t, err, "entry 'nlb' proxy_protocol_trusted_cidrs can't be empty when proxy_protocol is enabled")
+	})
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	// the bytes after the header are left in the connection
+	r := strings.NewReader("PROXY TCP6 2001:db8::1 ::1 51234 443\r\nGET / HTTP/1.1\r\n")
+	addr, err := readProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:51234", addr.String())
+
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+
+	// a header written by the tcp entry is read back
+	buf := bytes.Buffer{}
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6379}
+	for _, version := range []config.ProxyProtocol{config.ProxyProtocolV1, config.ProxyProtocolV2} {
+		buf.Reset()
+		assert.NoError(t, writeProxyHeader(&buf, version, src, dst))
+
+		addr, err := readProxyHeader(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, src.String(), addr.String())
+	}
+
+	_, err = readProxyHeader(strings.NewReader("PROXY TCP4 203.0.113.7 127.0.0.1 51234" + strings.Repeat(" ", 100) + "\r\n"))
+	assert.ErrorIs(t, err, errInvalidProxyHeader)
+}
+
+// proxyHeaderConn is a backend connection whose PROXY header was read by proxyHeaderListener
+type proxyHeaderConn struct {
+	net.Conn
+	r      *bufio.Reader
+	header string
+}
+
+func (c *proxyHeaderConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// proxyHeaderListener reads the PROXY header of each accepted connection before it is served
+type proxyHeaderListener struct {
+	net.Listener
+}
+
+func (l proxyHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	header, err := decodeProxyHeader(r)
+	if err != nil {
+		header = "error " + err.Error()
+	}
+	return &proxyHeaderConn{Conn: conn, r: r, header: header}, nil
+}
+
+type proxyHeaderKey struct{}
+
+func TestHTTPProxyProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// the backend echoes the header of the connection of each request
+	backend := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Context().Value(proxyHeaderKey{}).(string)))
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, proxyHeaderKey{}, c.(*proxyHeaderConn).header)
+		},
+	}
+	go func() {
+		_ = backend.Serve(proxyHeaderListener{Listener: listener})
+	}()
+	defer backend.Close()
+
+	bifrost, err := Load(config.Options{
+		Entries: map[string]config.EntryOptions{
+			"default": {Bind: "127.0.0.1:9893"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"direct":   {Paths: []string{"/direct"}, ServiceID: "direct"},
+			"upstream": {Paths: []string{"/upstream"}, ServiceID: "upstream"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"direct":   {Url: "http://" + listener.Addr().String(), ProxyProtocol: config.ProxyProtocolV1},
+			"upstream": {Url: "http://backend"},
+		},
+		Upstreams: map[string]config.UpstreamOptions{
+			"backend": {
+				Strategy: config.RoundRobinStrategy,
+				Targets:  []config.TargetOptions{{Target: listener.Addr().String(), ProxyProtocol: config.ProxyProtocolV2}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	go bifrost.Run()
+	defer bifrost.Shutdown()
+	time.Sleep(time.Second)
+
+	// newClient returns a client which sends its requests over one connection, and the address of the connection
+	newClient := func() (*http.Client, func() string) {
+		var localAddr string
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err == nil {
+					localAddr = conn.LocalAddr().String()
+				}
+				return conn, err
+			},
+			MaxConnsPerHost: 1,
+		}
+		return &http.Client{Transport: transport}, func() string { return localAddr }
+	}
+
+	get := func(c *http.Client, path string) string {
+		resp, err := c.Get("http://127.0.0.1:9893" + path)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	for _, tc := range []struct{ path, version string }{
+		{"/direct", "v1"},
+		{"/upstream", "v2"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			alice, aliceAddr := newClient()
+			bob, bobAddr := newClient()
+
+			// the upstream connections are pooled per client connection, so each request carries its own client
+			header := get(alice, tc.path)
+			assert.Equal(t, tc.version+" "+aliceAddr()+" 127.0.0.1:9893", header)
+
+			header = get(bob, tc.path)
+			assert.Equal(t, tc.version+" "+bobAddr()+" 127.0.0.1:9893", header)
+
+			header = get(alice, tc.path)
+			assert.Equal(t, tc.version+" "+aliceAddr()+" 127.0.0.1:9893", header)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		opts := config.Options{}
+		err := validateService(opts, "orders", config.ServiceOptions{Url: "http://127.0.0.1:8000", ProxyProtocol: "v3"})
+		assert.ErrorContains(t, err, "service 'orders' proxy_protocol 'v3' is invalid")
+
+		err = validateService(opts, "orders", config.ServiceOptions{Url: "http://127.0.0.1:8000", Protocol: config.ProtocolGRPC, ProxyProtocol: config.ProxyProtocolV1})
+		assert.ErrorContains(t, err, "service 'orders' proxy_protocol isn't supported by protocol grpc")
+	})
+}
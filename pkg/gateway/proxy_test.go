@@ -3,6 +3,7 @@ package gateway
 import (
 	"bytes"
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	"github.com/cloudwego/hertz/pkg/app/client"
 	"github.com/cloudwego/hertz/pkg/app/server"
 	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
 )
 
 // Reverse proxy tests.
@@ -372,3 +374,51 @@ func TestReverseProxy_Post(t *testing.T) {
 		t.Errorf("got body %q; expected %q", g, e)
 	}
 }
+
+func TestReverseProxyModifyResponseWithContext(t *testing.T) {
+	r := server.New(server.WithHostPorts("127.0.0.1:9906"))
+
+	r.GET("/*path", func(cc context.Context, ctx *app.RequestContext) {
+		ctx.Response.Header.Set("X-Version", "v1")
+		ctx.Response.Header.Set(fakeHopHeader, "foo")
+		ctx.Data(200, "text/plain", []byte("hi"))
+	})
+	go r.Spin()
+	time.Sleep(time.Second)
+
+	proxy, _ := newProxy("http://127.0.0.1:9906", false, 1)
+
+	var hopHeader string
+	proxy.SetModifyResponseWithContext(func(ctx *app.RequestContext, resp *protocol.Response) error {
+		// the hop-by-hop headers are not removed yet
+		hopHeader = resp.Header.Get(fakeHopHeader)
+
+		switch {
+		case strings.HasPrefix(string(ctx.Path()), "/v2/"):
+			resp.Header.Set("X-Version", "v2")
+		case strings.HasPrefix(string(ctx.Path()), "/broken/"):
+			return errors.New("broken response")
+		}
+		return nil
+	})
+
+	serve := func(path string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost" + path)
+		proxy.ServeHTTP(context.Background(), ctx)
+		return ctx
+	}
+
+	ctx := serve("/v1/orders")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "v1", string(ctx.Response.Header.Peek("X-Version")))
+	assert.Equal(t, "foo", hopHeader)
+	assert.Empty(t, ctx.Response.Header.Peek(fakeHopHeader))
+
+	ctx = serve("/v2/orders")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "v2", string(ctx.Response.Header.Peek("X-Version")))
+
+	ctx = serve("/broken/orders")
+	assert.Equal(t, 502, ctx.Response.StatusCode())
+}
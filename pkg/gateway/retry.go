@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/log"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+const (
+	retryOnError   = "error"
+	retryOnTimeout = "timeout"
+
+	// defaultMaxRetryAfter caps the wait for the Retry-After of a response before the next attempt,
+	// a target which is draining usually asks for much longer than a client wants to wait
+	defaultMaxRetryAfter = time.Second
+
+	// retryCountKey is the number of the retries of the request, it is added to the server span
+	retryCountKey = "retry_count"
+)
+
+var (
+	defaultRetryOn    = []string{retryOnError, retryOnTimeout}
+	idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+)
+
+// parseRetryOn validates the retry_on conditions, the format follows nginx's proxy_next_upstream,
+// for example: error, timeout, http_502, http_503, http_504
+func parseRetryOn(conditions []string) (map[string]bool, error) {
+	if len(conditions) == 0 {
+		conditions = defaultRetryOn
+	}
+
+	result := make(map[string]bool, len(conditions))
+	for _, condition := range conditions {
+		condition = strings.ToLower(strings.TrimSpace(condition))
+
+		switch {
+		case condition == retryOnError, condition == retryOnTimeout:
+		case strings.HasPrefix(condition, "http_"):
+			code, err := strconv.Atoi(condition[5:])
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("retry_on '%s' is invalid", condition)
+			}
+		default:
+			return nil, fmt.Errorf("retry_on '%s' is invalid", condition)
+		}
+
+		result[condition] = true
+	}
+
+	return result, nil
+}
+
+// retryable returns true when the request is allowed to be sent to another target
+func (svc *Service) retryable(ctx *app.RequestContext, upstream *Upstream) bool {
+	if svc.options.Retries <= 0 || upstream == nil || svc.proxy != nil {
+		return false
+	}
+
+	if svc.options.RetryNonIdempotent {
+		return true
+	}
+
+	return slices.Contains(idempotentMethods, string(ctx.Request.Method()))
+}
+
+// retryCondition returns the retry_on condition matched by the result of the last attempt
+func retryCondition(ctx *app.RequestContext) string {
+	if ctx.GetBool("target_timeout") {
+		return retryOnTimeout
+	}
+
+	if ctx.GetBool("target_error") {
+		return retryOnError
+	}
+
+	return "http_" + strconv.Itoa(ctx.Response.StatusCode())
+}
+
+// serveWithRetry sends the request to the proxy and retries on another target of the upstream
+// when the result matches retry_on. The request is copied before the first attempt because
+// the proxy rewrites it, so every attempt sends the original request and body again.
+func (svc *Service) serveWithRetry(c context.Context, ctx *app.RequestContext, upstream *Upstream, proxy *Proxy) {
+	logger := log.FromContext(c)
+	startTime := time.Now()
+
+	origin := protocol.AcquireRequest()
+	defer protocol.ReleaseRequest(origin)
+	ctx.Request.CopyTo(origin)
+
+	tried := make([]*Proxy, 0, svc.options.Retries+1)
+	addrs := make([]string, 0, svc.options.Retries+1)
+
+	for attempt := 0; ; attempt++ {
+		tried = append(tried, proxy)
+		attemptTime := time.Now()
+		proxy.ServeHTTP(c, ctx)
+		proxy.observe(ctx, time.Since(attemptTime))
+		addrs = append(addrs, proxy.targetHost)
+
+		condition := retryCondition(ctx)
+		if attempt == 0 && !svc.retryOn[condition] && upstream.retryBudget != nil {
+			upstream.retryBudget.deposit()
+		}
+
+		if !svc.retryOn[condition] || attempt >= svc.options.Retries || c.Err() != nil {
+			break
+		}
+
+		if svc.options.RetryTimeout > 0 && time.Since(startTime) >= svc.options.RetryTimeout {
+			break
+		}
+
+		next := upstream.pickExcluding(ctx, tried)
+		if next == nil {
+			break
+		}
+
+		if delay := svc.retryAfter(&ctx.Response); delay > 0 {
+			if svc.options.RetryTimeout > 0 && time.Since(startTime)+delay >= svc.options.RetryTimeout {
+				break
+			}
+
+			if !sleepContext(c, delay) {
+				break
+			}
+		}
+
+		if upstream.retryBudget != nil && !upstream.retryBudget.withdraw(time.Now()) {
+			ctx.Set(config.RETRY_BUDGET_EXHAUSTED, true)
+			logger.WarnContext(c, "retry budget is exhausted, the request is not retried",
+				slog.String("upstream", upstream.opts.ID),
+				slog.String("target", proxy.targetHost),
+				slog.String("condition", condition),
+			)
+			break
+		}
+
+		logger.WarnContext(c, "retry upstream request",
+			slog.String("target", proxy.targetHost),
+			slog.String("next_target", next.targetHost),
+			slog.String("condition", condition),
+			slog.Int("attempt", attempt+1),
+		)
+
+		origin.CopyTo(&ctx.Request)
+		ctx.Response.Reset()
+		ctx.Set("target_timeout", false)
+		ctx.Set("target_error", false)
+		ctx.Set(config.UPSTREAM_ERROR, "")
+		proxy = next
+	}
+
+	ctx.Set(config.UPSTREAM_ADDR, strings.Join(addrs, ", "))
+	ctx.Set(retryCountKey, len(addrs)-1)
+}
+
+// retryAfter returns how long to wait before the next attempt, the Retry-After header of the response
+// is either seconds or an http date. The wait is capped by max_retry_after.
+func (svc *Service) retryAfter(resp *protocol.Response) time.Duration {
+	value := strings.TrimSpace(string(resp.Header.Peek("Retry-After")))
+	if len(value) == 0 {
+		return 0
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	maxDelay := svc.options.MaxRetryAfter
+	if maxDelay == 0 {
+		maxDelay = defaultMaxRetryAfter
+	}
+
+	return min(delay, maxDelay)
+}
+
+// sleepContext waits for the delay, it returns false when the context is done first
+func sleepContext(c context.Context, delay time.Duration) bool {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-c.Done():
+		return false
+	}
+}
+
+// pickExcluding selects a target which was not tried yet. When the strategy picks a tried target,
+// for example hashing always picks the same one, the next available target is used instead.
+// A target with weight 0 is drained for the weighted strategy, so it isn't used either.
+func (u *Upstream) pickExcluding(ctx *app.RequestContext, tried []*Proxy) *Proxy {
+	proxy, _ := u.pick(ctx)
+	if proxy != nil && !slices.Contains(tried, proxy) {
+		return proxy
+	}
+
+	for _, proxy := range u.targets() {
+		if u.opts.Strategy == config.WeightedStrategy && proxy.weight.Load() <= 0 {
+			continue
+		}
+		if proxy.isAvailable() && !slices.Contains(tried, proxy) {
+			return proxy
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"fmt"
+	"http-benchmark/pkg/config"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryBudgetRatio = 0.2
+
+	// the deposits of this many successful primary requests are kept, so the budget follows the recent
+	// request volume instead of growing forever while the upstream is healthy
+	retryBudgetMaxDeposits = 100
+
+	// the deposits are fractions, 10 deposits of 0.2 must earn 2 retries
+	retryBudgetEpsilon = 1e-9
+)
+
+// retryBudget is a token bucket which limits the retries of an upstream to a ratio of the successful primary
+// requests, like the retry budget of finagle. A full outage of the upstream stops depositing, so the retries
+// stop after the budget is spent instead of multiplying the traffic. min_retries_per_sec is a separate
+// allowance, so an idle upstream can still retry a few requests.
+type retryBudget struct {
+	ratio     float64
+	minPerSec float64
+
+	mu         sync.Mutex
+	balance    float64
+	maxBalance float64
+	reserve    float64
+	refilledAt time.Time
+}
+
+func validateRetryBudget(opts config.RetryBudgetOptions) error {
+	if opts.Ratio < 0 || opts.Ratio > 1 {
+		return fmt.Errorf("retry_budget ratio must be between 0 and 1")
+	}
+
+	if opts.MinRetriesPerSec < 0 {
+		return fmt.Errorf("retry_budget min_retries_per_sec can't be negative")
+	}
+
+	return nil
+}
+
+func newRetryBudget(opts config.RetryBudgetOptions) *retryBudget {
+	ratio := opts.Ratio
+	if ratio == 0 {
+		ratio = defaultRetryBudgetRatio
+	}
+
+	return &retryBudget{
+		ratio:      ratio,
+		minPerSec:  float64(opts.MinRetriesPerSec),
+		maxBalance: ratio * retryBudgetMaxDeposits,
+		reserve:    float64(opts.MinRetriesPerSec),
+	}
+}
+
+// deposit adds the retries earned by a successful primary request
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balance = min(b.balance+b.ratio, b.maxBalance)
+}
+
+// withdraw takes a retry from the budget, it returns false when the budget is exhausted.
+// The allowance of min_retries_per_sec is spent first.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.refilledAt); elapsed > 0 {
+		b.reserve = min(b.reserve+elapsed.Seconds()*b.minPerSec, b.minPerSec)
+		b.refilledAt = now
+	}
+
+	if b.reserve >= 1 {
+		b.reserve--
+		return true
+	}
+
+	if b.balance >= 1-retryBudgetEpsilon {
+		b.balance = max(b.balance-1, 0)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,405 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	healthy := server.New(server.WithHostPorts("127.0.0.1:9986"))
+	healthy.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, "ok "+string(ctx.Request.Body()))
+	})
+	go healthy.Spin()
+
+	unavailable := server.New(server.WithHostPorts("127.0.0.1:9987"))
+	unavailable.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(503, "unavailable")
+	})
+	go unavailable.Spin()
+
+	draining := server.New(server.WithHostPorts("127.0.0.1:9905"))
+	draining.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		ctx.Response.Header.Set("Retry-After", "120")
+		ctx.String(503, "draining")
+	})
+	go draining.Spin()
+	time.Sleep(time.Second)
+
+	// 127.0.0.1:9985 is not listened, the first target is always dead
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"dead_first": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9985"},
+						{Target: "127.0.0.1:9986"},
+					},
+				},
+				"draining_first": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9905"},
+						{Target: "127.0.0.1:9986"},
+					},
+				},
+				"unavailable_first": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9987"},
+						{Target: "127.0.0.1:9986"},
+					},
+				},
+			},
+		},
+	}
+
+	serve := func(opts config.ServiceOptions, method string, body string) *app.RequestContext {
+		service, err := newService(bifrost, opts)
+		assert.NoError(t, err)
+
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/orders")
+		hzCtx.Request.Header.SetMethod(method)
+		hzCtx.Request.SetBodyString(body)
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	t.Run("retry on connect error", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:      "retry",
+			Url:     "http://dead_first",
+			Retries: 1,
+		}, "GET", "")
+
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9985, 127.0.0.1:9986", hzCtx.GetString(config.UPSTREAM_ADDR))
+	})
+
+	t.Run("non idempotent method is not retried by default", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:      "retry",
+			Url:     "http://dead_first",
+			Retries: 1,
+		}, "POST", "hello")
+
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+	})
+
+	t.Run("request body is sent again", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:                 "retry",
+			Url:                "http://dead_first",
+			Retries:            1,
+			RetryNonIdempotent: true,
+		}, "POST", "hello")
+
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "ok hello", string(hzCtx.Response.Body()))
+	})
+
+	t.Run("retry on status", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:      "retry",
+			Url:     "http://unavailable_first",
+			Retries: 1,
+		}, "GET", "")
+		assert.Equal(t, 503, hzCtx.Response.StatusCode())
+
+		hzCtx = serve(config.ServiceOptions{
+			ID:      "retry",
+			Url:     "http://unavailable_first",
+			Retries: 1,
+			RetryOn: []string{"error", "http_503"},
+		}, "GET", "")
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9987, 127.0.0.1:9986", hzCtx.GetString(config.UPSTREAM_ADDR))
+	})
+
+	t.Run("retry after is capped by max_retry_after", func(t *testing.T) {
+		startTime := time.Now()
+		hzCtx := serve(config.ServiceOptions{
+			ID:            "retry",
+			Url:           "http://draining_first",
+			Retries:       1,
+			RetryOn:       []string{"http_503"},
+			MaxRetryAfter: 200 * time.Millisecond,
+		}, "GET", "")
+
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9905, 127.0.0.1:9986", hzCtx.GetString(config.UPSTREAM_ADDR))
+		assert.GreaterOrEqual(t, time.Since(startTime), 200*time.Millisecond)
+		assert.Less(t, time.Since(startTime), time.Second)
+	})
+
+	t.Run("retry after exceeds retry_timeout", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:            "retry",
+			Url:           "http://draining_first",
+			Retries:       1,
+			RetryOn:       []string{"http_503"},
+			RetryTimeout:  500 * time.Millisecond,
+			MaxRetryAfter: 100 * time.Millisecond,
+		}, "GET", "")
+
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+
+		hzCtx = serve(config.ServiceOptions{
+			ID:            "retry",
+			Url:           "http://draining_first",
+			Retries:       1,
+			RetryOn:       []string{"http_503"},
+			RetryTimeout:  500 * time.Millisecond,
+			MaxRetryAfter: time.Second,
+		}, "GET", "")
+
+		assert.Equal(t, 503, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9905", hzCtx.GetString(config.UPSTREAM_ADDR))
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	svc := &Service{options: &config.ServiceOptions{MaxRetryAfter: time.Minute}}
+
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "none", value: "", expected: 0},
+		{name: "seconds", value: "3", expected: 3 * time.Second},
+		{name: "capped", value: "120", expected: time.Minute},
+		{name: "past date", value: "Wed, 21 Oct 2015 07:28:00 GMT", expected: 0},
+		{name: "invalid", value: "soon", expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := protocol.AcquireResponse()
+			defer protocol.ReleaseResponse(resp)
+
+			if len(tt.value) > 0 {
+				resp.Header.Set("Retry-After", tt.value)
+			}
+			assert.Equal(t, tt.expected, svc.retryAfter(resp))
+		})
+	}
+
+	resp := protocol.AcquireResponse()
+	defer protocol.ReleaseResponse(resp)
+	resp.Header.Set("Retry-After", time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, 30*time.Second, svc.retryAfter(resp), float64(2*time.Second))
+}
+
+func TestRetryBudget(t *testing.T) {
+	var healthy atomic.Bool
+	var hits atomic.Int32
+
+	for _, host := range []string{"127.0.0.1:9909", "127.0.0.1:9910"} {
+		backend := server.New(server.WithHostPorts(host))
+		backend.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+			hits.Add(1)
+			if healthy.Load() {
+				ctx.String(200, "ok")
+				return
+			}
+			ctx.String(503, "outage")
+		})
+		go backend.Spin()
+	}
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"orders": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9909"},
+						{Target: "127.0.0.1:9910"},
+					},
+					RetryBudget: config.RetryBudgetOptions{
+						Enabled: true,
+						Ratio:   0.2,
+					},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:      "orders",
+		Url:     "http://orders",
+		Retries: 1,
+		RetryOn: []string{"http_503"},
+	})
+	assert.NoError(t, err)
+
+	// serve returns the requests which were not retried because of the budget
+	serve := func(n int) int {
+		exhausted := 0
+		for i := 0; i < n; i++ {
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/orders")
+			service.ServeHTTP(context.Background(), hzCtx)
+
+			if hzCtx.GetBool(config.RETRY_BUDGET_EXHAUSTED) {
+				exhausted++
+			}
+		}
+		return exhausted
+	}
+
+	// the upstream is down from the start, there is no budget yet
+	assert.Equal(t, 3, serve(3))
+	assert.Equal(t, int32(3), hits.Swap(0))
+
+	// 10 successful requests earn 2 retries
+	healthy.Store(true)
+	assert.Equal(t, 0, serve(10))
+	hits.Store(0)
+
+	healthy.Store(false)
+	assert.Equal(t, 3, serve(5))
+	assert.Equal(t, int32(2*2+3), hits.Swap(0))
+
+	// retries resume after the upstream recovers
+	healthy.Store(true)
+	serve(5)
+	healthy.Store(false)
+	assert.Equal(t, 0, serve(1))
+	assert.Equal(t, 1, serve(1))
+
+	t.Run("min retries per sec", func(t *testing.T) {
+		budget := newRetryBudget(config.RetryBudgetOptions{MinRetriesPerSec: 2})
+
+		now := time.Now()
+		assert.True(t, budget.withdraw(now))
+		assert.True(t, budget.withdraw(now))
+		assert.False(t, budget.withdraw(now))
+
+		now = now.Add(500 * time.Millisecond)
+		assert.True(t, budget.withdraw(now))
+		assert.False(t, budget.withdraw(now))
+
+		// the allowance isn't accumulated while it is not used
+		now = now.Add(time.Minute)
+		assert.True(t, budget.withdraw(now))
+		assert.True(t, budget.withdraw(now))
+		assert.False(t, budget.withdraw(now))
+	})
+
+	t.Run("balance is capped", func(t *testing.T) {
+		budget := newRetryBudget(config.RetryBudgetOptions{Ratio: 0.5})
+		for i := 0; i < 1000; i++ {
+			budget.deposit()
+		}
+
+		retries := 0
+		for budget.withdraw(time.Now()) {
+			retries++
+		}
+		assert.Equal(t, 50, retries)
+	})
+}
+
+func TestParseRetryOn(t *testing.T) {
+	retryOn, err := parseRetryOn(nil)
+	assert.NoError(t, err)
+	assert.True(t, retryOn["error"])
+	assert.True(t, retryOn["timeout"])
+
+	_, err = parseRetryOn([]string{"http_5xx"})
+	assert.Error(t, err)
+
+	_, err = parseRetryOn([]string{"invalid"})
+	assert.Error(t, err)
+}
+
+func TestRetryBufferedBody(t *testing.T) {
+	bodies := make(chan string, 10)
+
+	// the first target always fails after reading the body, the second one echoes it
+	failing := server.New(server.WithHostPorts("127.0.0.1:9928"))
+	failing.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		bodies <- string(ctx.Request.Body())
+		ctx.String(502, "bad gateway")
+	})
+	go failing.Spin()
+
+	healthy := server.New(server.WithHostPorts("127.0.0.1:9929"))
+	healthy.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+		bodies <- string(ctx.Request.Body())
+		ctx.String(200, "ok "+string(ctx.Request.Body()))
+	})
+	go healthy.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"failing_first": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9928"},
+						{Target: "127.0.0.1:9929"},
+					},
+				},
+			},
+		},
+	}
+
+	body := strings.Repeat("order=1&", 1024)
+
+	serve := func(maxBufferedBodySize int) *app.RequestContext {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:                  "retry",
+			Url:                 "http://failing_first",
+			Retries:             1,
+			RetryOn:             []string{"http_502"},
+			RetryNonIdempotent:  true,
+			MaxBufferedBodySize: maxBufferedBodySize,
+		})
+		assert.NoError(t, err)
+
+		// a body stream, like the body of an http2 request, can only be read once
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/orders")
+		hzCtx.Request.Header.SetMethod("POST")
+		hzCtx.Request.SetBodyStream(strings.NewReader(body), -1)
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	t.Run("stream body is sent again", func(t *testing.T) {
+		hzCtx := serve(0)
+
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9928, 127.0.0.1:9929", hzCtx.GetString(config.UPSTREAM_ADDR))
+		assert.Equal(t, body, <-bodies)
+		assert.Equal(t, body, <-bodies)
+		assert.Equal(t, "ok "+body, string(hzCtx.Response.Body()))
+	})
+
+	t.Run("body larger than max_buffered_body_size is not retried", func(t *testing.T) {
+		hzCtx := serve(1024)
+
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, "127.0.0.1:9928", hzCtx.GetString(config.UPSTREAM_ADDR))
+		// the request is still sent once with the whole body
+		assert.Equal(t, body, <-bodies)
+		assert.Len(t, bodies, 0)
+	})
+}
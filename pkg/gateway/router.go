@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/middleware/ratelimit"
 	"regexp"
 	"slices"
 	"strings"
@@ -42,17 +43,45 @@ type methodHandler struct {
 	handlers map[string][]app.HandlerFunc // Associates HTTP methods with handler functions
 }
 
-// Router struct contains the Trie and handler chain
+// Router struct contains the Trie and handler chain.
+//
+// A request path is resolved in the following priority, independent of the declaration order:
+//  1. exact routes (= /path)
+//  2. prefix routes (^= /path), the longest matched prefix wins. ^= / matches every path
+//  3. regexp routes (~ expr), the first matched one in declaration order.
+//     loadRouter declares routes in ascending route id order, so the order is stable across reloads
+//  4. general routes (/path), the longest matched path wins
+//
+// The last segment of prefix and general routes matches as a string prefix, for example ^= /market/btc matches /market/btcusdt.
 type Router struct {
 	tree         *node // Root node of the Trie
 	regexpRoutes []routeSetting
+
+	// routes with hosts are added to the router of the host.
+	// exact hosts are matched first, then wildcard hosts (longest suffix first) and regexp hosts in order
+	exactHosts    map[string]*Router
+	wildcardHosts []hostRouter
+	regexpHosts   []hostRouter
+}
+
+type hostRouter struct {
+	host   string
+	regex  *regexp.Regexp
+	router *Router
 }
 
 func loadRouter(bifrost *Bifrost, entry config.EntryOptions, services map[string]*Service, middlewares map[string]app.HandlerFunc) (*Router, error) {
 	router := newRouter()
 
-	for routeID, routeOpts := range bifrost.opts.Routes {
+	// routes are a map, sort them so regexp routes are always matched in the same order
+	routeIDs := make([]string, 0, len(bifrost.opts.Routes))
+	for routeID := range bifrost.opts.Routes {
+		routeIDs = append(routeIDs, routeID)
+	}
+	slices.Sort(routeIDs)
 
+	for _, routeID := range routeIDs {
+		routeOpts := bifrost.opts.Routes[routeID]
 		routeOpts.ID = routeID
 
 		if len(routeOpts.Entries) > 0 && !slices.Contains(routeOpts.Entries, entry.ID) {
@@ -74,6 +103,14 @@ func loadRouter(bifrost *Bifrost, entry config.EntryOptions, services map[string
 
 		routeMiddlewares := make([]app.HandlerFunc, 0)
 
+		if routeOpts.RateLimitCost > 0 {
+			cost := routeOpts.RateLimitCost
+			routeMiddlewares = append(routeMiddlewares, func(c context.Context, ctx *app.RequestContext) {
+				ctx.Set(ratelimit.Cost, cost)
+				ctx.Next(c)
+			})
+		}
+
 		for _, middleware := range routeOpts.Middlewares {
 			if len(middleware.Use) > 0 {
 				val, found := middlewares[middleware.Use]
@@ -102,6 +139,14 @@ func loadRouter(bifrost *Bifrost, entry config.EntryOptions, services map[string
 			routeMiddlewares = append(routeMiddlewares, m)
 		}
 
+		if routeOpts.Timeout.RequestTimeout > 0 {
+			requestTimeout := routeOpts.Timeout.RequestTimeout
+			routeMiddlewares = append(routeMiddlewares, func(c context.Context, ctx *app.RequestContext) {
+				ctx.Set(routeRequestTimeoutKey, requestTimeout)
+				ctx.Next(c)
+			})
+		}
+
 		routeMiddlewares = append(routeMiddlewares, service.ServeHTTP)
 
 		err := router.AddRoute(routeOpts, routeMiddlewares...)
@@ -128,6 +173,22 @@ func (r *Router) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	method := b2s(ctx.Method())
 	path := b2s(ctx.Request.Path())
 
+	// host routes, routes without hosts are used when no route of the host matches the path
+	if len(r.exactHosts) > 0 || len(r.wildcardHosts) > 0 || len(r.regexpHosts) > 0 {
+		host := normalizeHost(ctx.Request.Host())
+
+		for _, hostRouter := range r.matchHost(host) {
+			if hostRouter.serve(c, ctx, method, path) {
+				return
+			}
+		}
+	}
+
+	r.serve(c, ctx, method, path)
+}
+
+// serve runs the handlers of the matched route and returns false when no route matches the path
+func (r *Router) serve(c context.Context, ctx *app.RequestContext, method string, path string) bool {
 	middleware, isDefered := r.find(method, path)
 
 	if len(middleware) > 0 && !isDefered {
@@ -135,7 +196,7 @@ func (r *Router) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 		ctx.SetHandlers(middleware)
 		ctx.Next(c)
 		ctx.Abort()
-		return
+		return true
 	}
 
 	// regexp routes
@@ -145,7 +206,7 @@ func (r *Router) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 			ctx.SetHandlers(route.middleware)
 			ctx.Next(c)
 			ctx.Abort()
-			return
+			return true
 		}
 	}
 
@@ -155,9 +216,111 @@ func (r *Router) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 		ctx.SetHandlers(middleware)
 		ctx.Next(c)
 		ctx.Abort()
-		return
+		return true
+	}
+
+	return false
+}
+
+// matchHost returns the routers of the hosts which match the host in priority order
+func (r *Router) matchHost(host string) []*Router {
+	result := make([]*Router, 0, 1)
+
+	if router, found := r.exactHosts[host]; found {
+		result = append(result, router)
 	}
 
+	for _, hostRouter := range r.wildcardHosts {
+		if strings.HasSuffix(host, hostRouter.host) {
+			result = append(result, hostRouter.router)
+		}
+	}
+
+	for _, hostRouter := range r.regexpHosts {
+		if hostRouter.regex.MatchString(host) {
+			result = append(result, hostRouter.router)
+		}
+	}
+
+	return result
+}
+
+// hostRouter returns the router of the host, the router is created if it doesn't exist.
+// A host can be exact (api.example.com), wildcard (*.example.com) or regexp (~ ^api[0-9]+\.example\.com$).
+func (r *Router) hostRouter(host string) (*Router, error) {
+	host = strings.TrimSpace(host)
+
+	switch {
+	case strings.HasPrefix(host, "~"):
+		expr := strings.TrimSpace(host[1:])
+		if len(expr) == 0 {
+			return nil, fmt.Errorf("router: regexp host can't be empty")
+		}
+
+		for _, hostRouter := range r.regexpHosts {
+			if hostRouter.host == expr {
+				return hostRouter.router, nil
+			}
+		}
+
+		regx, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, err
+		}
+
+		router := newRouter()
+		r.regexpHosts = append(r.regexpHosts, hostRouter{host: expr, regex: regx, router: router})
+		return router, nil
+	case strings.HasPrefix(host, "*."):
+		suffix := strings.ToLower(host[1:])
+		if len(suffix) == 1 {
+			return nil, fmt.Errorf("router: wildcard host '%s' is invalid", host)
+		}
+
+		for _, hostRouter := range r.wildcardHosts {
+			if hostRouter.host == suffix {
+				return hostRouter.router, nil
+			}
+		}
+
+		router := newRouter()
+		r.wildcardHosts = append(r.wildcardHosts, hostRouter{host: suffix, router: router})
+		slices.SortStableFunc(r.wildcardHosts, func(a, b hostRouter) int {
+			return len(b.host) - len(a.host)
+		})
+		return router, nil
+	default:
+		if len(host) == 0 || strings.ContainsAny(host, "*/ ") {
+			return nil, fmt.Errorf("router: host '%s' is invalid", host)
+		}
+
+		host = normalizeHost([]byte(host))
+
+		if r.exactHosts == nil {
+			r.exactHosts = make(map[string]*Router)
+		}
+
+		router, found := r.exactHosts[host]
+		if !found {
+			router = newRouter()
+			r.exactHosts[host] = router
+		}
+		return router, nil
+	}
+}
+
+// normalizeHost lowercases the host and strips the port
+func normalizeHost(host []byte) string {
+	h := string(host)
+
+	if i := strings.LastIndexByte(h, ':'); i != -1 && !strings.HasSuffix(h, "]") {
+		if !strings.Contains(h[:i], ":") || strings.HasPrefix(h, "[") {
+			h = h[:i]
+		}
+	}
+
+	h = strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+	return strings.ToLower(h)
 }
 
 func checkRegexpRoute(setting routeSetting, method string, path string) bool {
@@ -187,6 +350,25 @@ func (r *Router) AddRoute(routeOpts config.RouteOptions, middlewares ...app.Hand
 		return errors.New("paths can't be empty")
 	}
 
+	if len(routeOpts.Hosts) > 0 {
+		hosts := routeOpts.Hosts
+		routeOpts.Hosts = nil
+
+		for _, host := range hosts {
+			router, err := r.hostRouter(host)
+			if err != nil {
+				return fmt.Errorf("%w in route: '%s'", err, routeOpts.ID)
+			}
+
+			err = router.AddRoute(routeOpts, middlewares...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	for _, path := range routeOpts.Paths {
 		path = strings.TrimSpace(path)
 		var nodeType nodeType
@@ -435,6 +617,14 @@ func (r *Router) find(method string, path string) ([]app.HandlerFunc, bool) {
 		return prefixHandlers, false
 	}
 
+	// ^= / is the shortest prefix and matches every path
+	if rootPrefixNode := r.tree.findChildByName("/", nodeTypePrefix); rootPrefixNode != nil {
+		h := rootPrefixNode.findHandler(method)
+		if len(h) > 0 {
+			return h, false
+		}
+	}
+
 	if len(generalHandlers) > 0 {
 		return generalHandlers, true
 	}
@@ -492,22 +682,28 @@ func (n *node) matchChildByName(name string, nodeType nodeType) *node {
 			return child
 		}
 	case nodeTypePrefix:
-		for _, prefix := range n.prefixChildren {
-			if strings.HasPrefix(name, prefix.path) {
-				return prefix
-			}
-		}
+		return longestPrefixChild(n.prefixChildren, name)
 	case nodeTypeGeneral:
-		for _, general := range n.generalChildren {
-			if strings.HasPrefix(name, general.path) {
-				return general
-			}
-		}
+		return longestPrefixChild(n.generalChildren, name)
 	}
 
 	return nil
 }
 
+// longestPrefixChild returns the child with the longest path which is a prefix of name,
+// so the result doesn't depend on the iteration order of the map
+func longestPrefixChild(children map[string]*node, name string) *node {
+	var result *node
+
+	for _, child := range children {
+		if strings.HasPrefix(name, child.path) && (result == nil || len(child.path) > len(result.path)) {
+			result = child
+		}
+	}
+
+	return result
+}
+
 // addHandler adds handler functions to the node
 func (n *node) addHandler(method string, h []app.HandlerFunc) {
 	if n.handler.handlers == nil {
@@ -400,3 +400,163 @@ func BenchmarkMapLookup(b *testing.B) {
 		}
 	}
 }
+
+func TestHostRoutes(t *testing.T) {
+	router := newRouter()
+
+	statusHandler := func(status int) app.HandlerFunc {
+		return func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(status)
+		}
+	}
+
+	err := router.AddRoute(config.RouteOptions{
+		Hosts: []string{"api.example.com"},
+		Paths: []string{"/orders"},
+	}, statusHandler(201))
+	assert.NoError(t, err)
+
+	err = router.AddRoute(config.RouteOptions{
+		Hosts: []string{"*.example.com"},
+		Paths: []string{"~ ^/"},
+	}, statusHandler(202))
+	assert.NoError(t, err)
+
+	err = router.AddRoute(config.RouteOptions{
+		Hosts: []string{`~ ^app[0-9]+\.example\.org$`},
+		Paths: []string{"~ ^/"},
+	}, statusHandler(203))
+	assert.NoError(t, err)
+
+	err = router.AddRoute(config.RouteOptions{
+		Paths: []string{"~ ^/"},
+	}, statusHandler(204))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{host: "api.example.com", path: "/orders", status: 201},
+		{host: "API.Example.com:8080", path: "/orders", status: 201},
+		{host: "api.example.com", path: "/users", status: 202}, // falls back to the wildcard host
+		{host: "app.example.com", path: "/orders", status: 202},
+		{host: "a.b.example.com", path: "/", status: 202},
+		{host: "example.com", path: "/orders", status: 204},
+		{host: "APP12.example.org", path: "/", status: 203},
+		{host: "app.example.org", path: "/", status: 204},
+		{host: "localhost", path: "/orders", status: 204},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host+tc.path, func(t *testing.T) {
+			ctx := app.NewContext(0)
+			ctx.Request.SetRequestURI("http://localhost" + tc.path)
+			ctx.Request.SetHost(tc.host)
+			router.ServeHTTP(context.Background(), ctx)
+			assert.Equal(t, tc.status, ctx.Response.StatusCode())
+		})
+	}
+
+	err = router.AddRoute(config.RouteOptions{
+		Hosts: []string{"*."},
+		Paths: []string{"/"},
+	}, statusHandler(200))
+	assert.Error(t, err)
+}
+
+func TestNormalizeHost(t *testing.T) {
+	assert.Equal(t, "api.example.com", normalizeHost([]byte("API.example.com:443")))
+	assert.Equal(t, "::1", normalizeHost([]byte("[::1]:8080")))
+	assert.Equal(t, "::1", normalizeHost([]byte("[::1]")))
+	assert.Equal(t, "127.0.0.1", normalizeHost([]byte("127.0.0.1")))
+}
+
+func TestRoutePriorityIndependentOfOrder(t *testing.T) {
+	statusHandler := func(status int) app.HandlerFunc {
+		return func(c context.Context, ctx *app.RequestContext) {
+			ctx.SetStatusCode(status)
+		}
+	}
+
+	routes := []struct {
+		path   string
+		status int
+	}{
+		{path: "^= /api", status: 202},
+		{path: "^= /api/v1", status: 212},
+		{path: "~ ^/api/.*/items", status: 203},
+		{path: "= /api/v1/items", status: 201},
+		{path: "^= /", status: 222},
+	}
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{path: "/api/v1/items", status: 201},
+		{path: "/api/v1/orders/items", status: 212},
+		{path: "/api/v2/items", status: 202},
+		{path: "/api", status: 202},
+		{path: "/apis/items", status: 202},
+		{path: "/other", status: 222},
+	}
+
+	orders := [][]int{
+		{0, 1, 2, 3, 4},
+		{4, 3, 2, 1, 0},
+		{2, 4, 0, 3, 1},
+	}
+
+	for _, order := range orders {
+		router := newRouter()
+		for _, i := range order {
+			err := router.AddRoute(config.RouteOptions{
+				Paths: []string{routes[i].path},
+			}, statusHandler(routes[i].status))
+			assert.NoError(t, err)
+		}
+
+		for _, tc := range testCases {
+			c := app.NewContext(0)
+			c.Request.SetMethod("GET")
+			c.Request.URI().SetPath(tc.path)
+			router.ServeHTTP(context.Background(), c)
+			assert.Equal(t, tc.status, c.Response.StatusCode(), "order: %v, path: %s", order, tc.path)
+		}
+	}
+}
+
+func TestLongestPrefixInSegment(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		router := newRouter()
+		_ = router.AddRoute(config.RouteOptions{Paths: []string{"^= /market/btc"}}, prefixHandler)
+		_ = router.AddRoute(config.RouteOptions{Paths: []string{"^= /market/btcusdt"}}, exactkHandler)
+
+		c := app.NewContext(0)
+		c.Request.SetMethod("GET")
+		c.Request.URI().SetPath("/market/btcusdt/orders")
+		router.ServeHTTP(context.Background(), c)
+		assert.Equal(t, 201, c.Response.StatusCode())
+	}
+}
+
+func TestRegexpOnlyAfterPrefix(t *testing.T) {
+	router := newRouter()
+	_ = router.AddRoute(config.RouteOptions{Paths: []string{"~ ^/api/.*/items"}}, regexkHandler)
+	_ = router.AddRoute(config.RouteOptions{Paths: []string{"/api"}}, generalkHandler)
+
+	// general routes lose to regexp routes
+	c := app.NewContext(0)
+	c.Request.SetMethod("GET")
+	c.Request.URI().SetPath("/api/v1/items")
+	router.ServeHTTP(context.Background(), c)
+	assert.Equal(t, 203, c.Response.StatusCode())
+
+	c = app.NewContext(0)
+	c.Request.SetMethod("GET")
+	c.Request.URI().SetPath("/api/v1/orders")
+	router.ServeHTTP(context.Background(), c)
+	assert.Equal(t, 204, c.Response.StatusCode())
+}
@@ -3,10 +3,12 @@ package gateway
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"http-benchmark/pkg/config"
 	"http-benchmark/pkg/log"
 	"log/slog"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -14,10 +16,19 @@ import (
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
+	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/common/tracer/stats"
+	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/rs/dnscache"
 	"github.com/valyala/bytebufferpool"
 )
 
+// routeRequestTimeoutKey overrides the request timeout of the service for the route
+const routeRequestTimeoutKey = "route_request_timeout"
+
+// clientAbortedKey is set when the client disconnected before the upstream responded
+const clientAbortedKey = "client_aborted"
+
 type Service struct {
 	bifrost         *Bifrost
 	options         *config.ServiceOptions
@@ -26,6 +37,11 @@ type Service struct {
 	upstream        *Upstream
 	dynamicUpstream string
 	middlewares     []app.HandlerFunc
+	retryOn         map[string]bool
+	mirror          *mirror
+	splitter        *splitter
+	coalescer       *coalescer
+	trustedProxies  []*net.IPNet
 }
 
 func loadServices(bifrost *Bifrost, middlewares map[string]app.HandlerFunc) (map[string]*Service, error) {
@@ -70,11 +86,43 @@ func newService(bifrost *Bifrost, opts config.ServiceOptions) (*Service, error)
 		return nil, err
 	}
 
+	retryOn, err := parseRetryOn(opts.RetryOn)
+	if err != nil {
+		return nil, fmt.Errorf("service '%s' %w", opts.ID, err)
+	}
+
+	trustedProxies, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("service '%s' %w", opts.ID, err)
+	}
+
+	opts.MethodOverride = strings.ToUpper(opts.MethodOverride)
+
 	svc := &Service{
-		bifrost:     bifrost,
-		options:     &opts,
-		upstreams:   upstreams,
-		middlewares: make([]app.HandlerFunc, 0),
+		bifrost:        bifrost,
+		options:        &opts,
+		upstreams:      upstreams,
+		middlewares:    make([]app.HandlerFunc, 0),
+		retryOn:        retryOn,
+		trustedProxies: trustedProxies,
+	}
+
+	if len(opts.Mirror.Upstream) > 0 {
+		svc.mirror, err = newMirror(opts.ID, opts.Mirror, upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Split.Upstreams) > 0 {
+		svc.splitter, err = newSplitter(opts.ID, opts.Split, upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Coalesce.Enabled {
+		svc.coalescer = newCoalescer(opts.Coalesce)
 	}
 
 	addr, err := url.Parse(opts.Url)
@@ -82,6 +130,19 @@ func newService(bifrost *Bifrost, opts config.ServiceOptions) (*Service, error)
 		return nil, err
 	}
 
+	// direct proxy over unix domain socket
+	if socketPath, ok := unixSocketPath(opts.Url); ok {
+		proxy, err := newUnixProxy(socketPath, "", bifrost.opts.Tracing.Enabled, 0, opts.ProxyProtocol, newServiceClientOptions(opts))
+		if err != nil {
+			return nil, err
+		}
+		proxy.hostHeader = upstreamHostHeader(opts, config.TargetOptions{}, unixSyntheticHost)
+		proxy.SetErrorHandler(newErrorHandler(opts))
+
+		svc.proxy = proxy
+		return svc, nil
+	}
+
 	hostname := addr.Hostname()
 
 	// validate
@@ -107,26 +168,15 @@ func newService(bifrost *Bifrost, opts config.ServiceOptions) (*Service, error)
 	}
 
 	// direct proxy
-	clientOpts := newDefaultClientOptions()
-
-	if opts.Timeout.DailTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithDialTimeout(opts.Timeout.DailTimeout))
-	}
-
-	if opts.Timeout.ReadTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithClientReadTimeout(opts.Timeout.ReadTimeout))
-	}
-
-	if opts.Timeout.WriteTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithWriteTimeout(opts.Timeout.WriteTimeout))
-	}
-
-	if opts.Timeout.MaxConnWaitTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithMaxConnWaitTimeout(opts.Timeout.MaxConnWaitTimeout))
-	}
+	clientOpts := newServiceClientOptions(opts)
 
-	if opts.MaxIdleConnsPerHost != nil {
-		clientOpts = append(clientOpts, client.WithMaxConnsPerHost(*opts.MaxIdleConnsPerHost))
+	var localDialer network.Dialer
+	if len(opts.SourceAddr) > 0 {
+		localDialer, err = newSourceDialer(opts.SourceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("service '%s' %w", opts.ID, err)
+		}
+		clientOpts = append(clientOpts, client.WithDialer(localDialer))
 	}
 
 	var dnsResolver dnscache.DNSResolver
@@ -141,14 +191,14 @@ func newService(bifrost *Bifrost, opts config.ServiceOptions) (*Service, error)
 	switch strings.ToLower(addr.Scheme) {
 	case "http":
 		if dnsResolver != nil {
-			clientOpts = append(clientOpts, client.WithDialer(newHTTPDialer(dnsResolver)))
+			clientOpts = append(clientOpts, client.WithDialer(newHTTPDialer(dnsResolver, localDialer)))
 		}
 	case "https":
 		if dnsResolver != nil {
 			clientOpts = append(clientOpts, client.WithTLSConfig(&tls.Config{
 				InsecureSkipVerify: !opts.TLSVerify,
 			}))
-			clientOpts = append(clientOpts, client.WithDialer(newHTTPSDialer(dnsResolver)))
+			clientOpts = append(clientOpts, client.WithDialer(newHTTPSDialer(dnsResolver, localDialer)))
 		}
 	}
 
@@ -161,16 +211,97 @@ func newService(bifrost *Bifrost, opts config.ServiceOptions) (*Service, error)
 	if err != nil {
 		return nil, err
 	}
+	proxy.hostHeader = upstreamHostHeader(opts, config.TargetOptions{}, proxy.targetHost)
+	proxy.SetErrorHandler(newErrorHandler(opts))
+
+	if opts.Protocol == config.ProtocolHTTP3 {
+		if err := proxy.enableHTTP3(opts, hostname, bifrost.opts.Tracing.Enabled, clientOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Protocol == config.ProtocolGRPC {
+		if err := proxy.enableGRPC(opts, hostname, bifrost.opts.Tracing.Enabled, clientOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	proxy.enableProxyProtocol(opts.ProxyProtocol, bifrost.opts.Tracing.Enabled, clientOpts)
 
 	svc.proxy = proxy
 	return svc, nil
 }
 
+func newServiceClientOptions(opts config.ServiceOptions) []hzconfig.ClientOption {
+	clientOpts := newDefaultClientOptions()
+
+	if opts.Timeout.DailTimeout > 0 {
+		clientOpts = append(clientOpts, client.WithDialTimeout(opts.Timeout.DailTimeout))
+	}
+
+	if opts.Timeout.ReadTimeout > 0 {
+		clientOpts = append(clientOpts, client.WithClientReadTimeout(opts.Timeout.ReadTimeout))
+	}
+
+	if opts.Timeout.WriteTimeout > 0 {
+		clientOpts = append(clientOpts, client.WithWriteTimeout(opts.Timeout.WriteTimeout))
+	}
+
+	if opts.Timeout.MaxConnWaitTimeout > 0 {
+		clientOpts = append(clientOpts, client.WithMaxConnWaitTimeout(opts.Timeout.MaxConnWaitTimeout))
+	}
+
+	if opts.MaxIdleConnsPerHost != nil {
+		clientOpts = append(clientOpts, client.WithMaxConnsPerHost(*opts.MaxIdleConnsPerHost))
+	}
+
+	if opts.MaxIdleConnDuration > 0 {
+		clientOpts = append(clientOpts, client.WithMaxIdleConnDuration(opts.MaxIdleConnDuration))
+	}
+
+	if keepaliveDisabled(opts, config.UpstreamOptions{}, config.TargetOptions{}) {
+		clientOpts = append(clientOpts, client.WithKeepAlive(false))
+	}
+
+	if isStreaming(opts) {
+		clientOpts = append(clientOpts, client.WithResponseBodyStream(true))
+	} else if opts.MaxResponseBodySize > 0 {
+		clientOpts = append(clientOpts, withMaxResponseBodySize(opts.MaxResponseBodySize))
+	}
+
+	return clientOpts
+}
+
+// withMaxResponseBodySize limits the response body read by the client, the client returns errs.ErrBodyTooLarge
+// when it is exceeded. It is only a limit of buffered responses, a larger streamed body is just read as a stream.
+func withMaxResponseBodySize(size int) hzconfig.ClientOption {
+	return hzconfig.ClientOption{F: func(o *hzconfig.ClientOptions) {
+		o.MaxResponseBodySize = size
+	}}
+}
+
+// stop stops the background tasks of the upstreams and the mirror of the service
+func (svc *Service) stop() {
+	for _, upstream := range svc.upstreams {
+		upstream.stop()
+	}
+
+	if svc.mirror != nil {
+		svc.mirror.stop()
+	}
+}
+
 func (svc *Service) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 	logger := log.FromContext(c)
 	defer ctx.Abort()
 	done := make(chan bool)
 
+	if svc.options.SlowRequestThreshold > 0 {
+		// the proxy rewrites the request, so the request of the client is kept for the log
+		request := string(ctx.Request.Method()) + " " + string(ctx.Request.RequestURI())
+		defer svc.logSlowRequest(c, ctx, request, time.Now())
+	}
+
 	runTask(c, func() {
 		defer func() {
 			done <- true
@@ -180,66 +311,171 @@ func (svc *Service) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 			}
 		}()
 
+		upstream := svc.upstream
 		if len(svc.dynamicUpstream) > 0 {
-			upstreamName := ctx.GetString(svc.dynamicUpstream)
-
-			if len(upstreamName) == 0 {
-				logger.Warn("upstream is not found", slog.String("name", upstreamName))
-				ctx.Abort()
-				return
-			}
-
 			var found bool
-			svc.upstream, found = svc.upstreams[upstreamName]
+			upstream, found = svc.findDynamicUpstream(c, ctx)
 			if !found {
-				logger.Warn("upstream is not found", slog.String("name", upstreamName))
 				ctx.Abort()
 				return
 			}
 		}
 
+		if svc.splitter != nil {
+			upstream = svc.splitter.pick(ctx)
+			ctx.Set(config.UPSTREAM_SPLIT, upstream.opts.ID)
+		}
+
 		proxy := svc.proxy
-		if svc.upstream != nil && proxy == nil {
-			ctx.Set(config.UPSTREAM, svc.upstream.opts.ID)
-
-			switch svc.upstream.opts.Strategy {
-			case config.RoundRobinStrategy, "":
-				proxy = svc.upstream.roundRobin()
-			case config.WeightedStrategy:
-				proxy = svc.upstream.weighted()
-			case config.RandomStrategy:
-				proxy = svc.upstream.random()
-			case config.HashingStrategy:
-				hashon := svc.upstream.opts.HashOn
-				val := ctx.GetString(hashon)
-				proxy = svc.upstream.hasing(val)
-			}
+		if upstream != nil && proxy == nil {
+			ctx.Set(config.UPSTREAM, upstream.opts.ID)
+
+			var sel selection
+			proxy, sel = upstream.pick(ctx)
+			upstream.logSelection(c, ctx, proxy, sel)
 		}
 
 		if proxy == nil {
-			logger.ErrorContext(c, "no proxy found")
+			reason := "no target was selected"
+
+			if upstream != nil {
+				if upstream.isDrained() {
+					reason = "all targets are administratively drained"
+				}
+
+				upstreamEvents.emit(UpstreamEvent{
+					Type:       NoLiveUpstream,
+					UpstreamID: upstream.opts.ID,
+					Reason:     reason,
+				})
+			}
+
+			logger.ErrorContext(c, "no live upstream",
+				slog.String("service", svc.options.ID),
+				slog.String("upstream", ctx.GetString(config.UPSTREAM)),
+				slog.String("reason", reason),
+			)
+			writeNoLiveUpstream(ctx, *svc.options, errors.New(reason))
 			ctx.Abort()
 			return
 		}
 
+		if mode := svc.forwardedHeadersMode(ctx); len(mode) > 0 {
+			ctx.Set(forwardedHeadersKey, string(mode))
+		}
+
+		if svc.options.Forwarded {
+			ctx.Set(forwardedKey, true)
+		}
+
+		if len(svc.options.ClientIPForwarding) > 0 {
+			ctx.Set(clientIPForwardingKey, string(svc.options.ClientIPForwarding))
+		}
+
+		if len(svc.options.MethodOverride) > 0 {
+			ctx.Set(methodOverrideKey, svc.options.MethodOverride)
+		}
+
+		if svc.options.MaxResponseBodySize > 0 {
+			ctx.Set(maxResponseBodySizeKey, svc.options.MaxResponseBodySize)
+		}
+
+		if svc.options.Timeout.WebSocketIdle > 0 {
+			ctx.Set(websocketIdleTimeoutKey, svc.options.Timeout.WebSocketIdle)
+		}
+
+		if svc.options.Timeout.WebSocketPing > 0 {
+			ctx.Set(websocketPingIntervalKey, svc.options.Timeout.WebSocketPing)
+		}
+
+		if len(svc.options.OriginalURIHeader) > 0 {
+			setOriginalURIHeader(ctx, svc.options.OriginalURIHeader)
+		}
+
+		if svc.mirror != nil {
+			if svc.replayable(ctx) {
+				svc.mirror.send(ctx)
+			} else {
+				svc.mirror.dropped.Add(1)
+			}
+		}
+
+		var coalesceKey string
+		if svc.coalescer != nil {
+			coalesceKey = svc.coalescer.key(ctx)
+		}
+
+		// the deadline is shared by all attempts, so the remaining time shrinks across retries.
+		// a coalesced call is shared by other clients, so it is not canceled when this client goes away.
+		upstreamCtx := c
+		if len(coalesceKey) > 0 {
+			upstreamCtx = context.WithoutCancel(c)
+		}
+
+		// grpc responses are still streamed after the handler returns, their deadline comes from grpc-timeout of the client
+		if timeout := svc.requestTimeout(ctx); timeout > 0 && svc.options.Protocol != config.ProtocolGRPC {
+			var cancel context.CancelFunc
+			upstreamCtx, cancel = context.WithTimeout(upstreamCtx, timeout)
+			defer cancel()
+		}
+
 		startTime := time.Now()
-		proxy.ServeHTTP(c, ctx)
+		serve := func() {
+			if svc.retryable(ctx, upstream) && svc.replayable(ctx) {
+				svc.serveWithRetry(upstreamCtx, ctx, upstream, proxy)
+			} else {
+				attemptTime := time.Now()
+				proxy.ServeHTTP(upstreamCtx, ctx)
+				proxy.observe(ctx, time.Since(attemptTime))
+			}
+		}
 
-		dur := time.Since(startTime)
-		mic := dur.Microseconds()
-		duration := float64(mic) / 1e6
-		responseTime := strconv.FormatFloat(duration, 'f', -1, 64)
-		ctx.Set(config.UPSTREAM_DURATION, responseTime)
+		if len(coalesceKey) > 0 {
+			svc.coalescer.do(c, ctx, coalesceKey, serve)
+		} else {
+			serve()
+		}
+
+		setUpstreamDuration := func() {
+			dur := time.Since(startTime)
+			mic := dur.Microseconds()
+			duration := float64(mic) / 1e6
+			responseTime := strconv.FormatFloat(duration, 'f', -1, 64)
+			ctx.Set(config.UPSTREAM_DURATION, responseTime)
+		}
+		setUpstreamDuration()
 
-		if ctx.GetBool("target_timeout") {
+		// the body of a streamed response is still read from the upstream after the handler returns
+		if ctx.Response.IsBodyStream() {
+			if body, ok := ctx.Response.BodyStream().(*streamingBody); ok {
+				body.onDone = setUpstreamDuration
+			}
+		}
+
+		switch {
+		case ctx.GetBool(clientAbortedKey):
+			// 499 was set by the proxy, there is no upstream status
+			writeErrorResponse(ctx, *svc.options, 499, ErrClientCanceled)
+		case ctx.GetBool("target_timeout"):
 			ctx.Response.SetStatusCode(504)
-		} else {
+		default:
 			ctx.Set(config.UPSTREAM_STATUS, ctx.Response.StatusCode())
+
+			// statuses generated by the gateway are not mapped
+			if !ctx.GetBool("target_error") {
+				svc.transformStatus(ctx)
+			}
 		}
+
+		setUpstreamSpanAttributes(c, ctx)
 	})
 
 	select {
 	case <-c.Done():
+		// the proxy returns as soon as the client is gone, wait for it so the request context
+		// is not used after the handler returns
+		<-done
+
 		time := time.Now()
 		ctx.Set(config.CLIENT_CANCELED_AT, time)
 
@@ -254,7 +490,132 @@ func (svc *Service) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 			slog.String("full_uri", fullURI),
 		)
 
-		ctx.Response.SetStatusCode(499)
+		writeErrorResponse(ctx, *svc.options, 499, ErrClientCanceled)
 	case <-done:
 	}
 }
+
+// findDynamicUpstream returns the upstream named by the variable of the url, fallback_upstream is used
+// when the name is empty or unknown
+func (svc *Service) findDynamicUpstream(c context.Context, ctx *app.RequestContext) (*Upstream, bool) {
+	logger := log.FromContext(c)
+	upstreamName := ctx.GetString(svc.dynamicUpstream)
+
+	upstream, found := svc.upstreams[upstreamName]
+	if found {
+		return upstream, true
+	}
+
+	if len(svc.options.FallbackUpstream) == 0 {
+		logger.Warn("upstream is not found", slog.String("name", upstreamName))
+		return nil, false
+	}
+
+	logger.Warn("upstream is not found, fallback upstream is used",
+		slog.String("name", upstreamName),
+		slog.String("fallback_upstream", svc.options.FallbackUpstream),
+	)
+	upstream, found = svc.upstreams[svc.options.FallbackUpstream]
+	return upstream, found
+}
+
+// logSlowRequest writes a warn log and sets $slow_request when the request took longer than slow_request_threshold.
+// The duration is measured from the start of the http request, or from the service when the start isn't traced.
+func (svc *Service) logSlowRequest(c context.Context, ctx *app.RequestContext, request string, serviceStart time.Time) {
+	start := serviceStart
+	if traceInfo := ctx.GetTraceInfo(); traceInfo != nil {
+		if httpStart := traceInfo.Stats().GetEvent(stats.HTTPStart); httpStart != nil {
+			start = httpStart.Time()
+		}
+	}
+
+	end := time.Now()
+	if canceledAt, ok := ctx.Value(config.CLIENT_CANCELED_AT).(time.Time); ok {
+		end = canceledAt
+	}
+
+	duration := end.Sub(start)
+	if duration <= svc.options.SlowRequestThreshold {
+		return
+	}
+
+	ctx.Set(config.SLOW_REQUEST, true)
+
+	logger := log.FromContext(c)
+	logger.WarnContext(c, "slow request",
+		slog.String("service", svc.options.ID),
+		slog.String("request", request),
+		slog.String("upstream", ctx.GetString(config.UPSTREAM)),
+		slog.String("upstream_addr", ctx.GetString(config.UPSTREAM_ADDR)),
+		slog.Int("status", ctx.Response.StatusCode()),
+		slog.Int("upstream_status", ctx.GetInt(config.UPSTREAM_STATUS)),
+		slog.Duration("duration", duration),
+		slog.Duration("service_duration", end.Sub(serviceStart)),
+		slog.String("upstream_duration", ctx.GetString(config.UPSTREAM_DURATION)),
+		slog.Duration("threshold", svc.options.SlowRequestThreshold),
+	)
+}
+
+// transformStatus rewrites the upstream status with status_map, the body is left untouched.
+// $upstream_status keeps the original status.
+func (svc *Service) transformStatus(ctx *app.RequestContext) {
+	if len(svc.options.StatusMap) == 0 {
+		return
+	}
+
+	if status, found := svc.options.StatusMap[ctx.Response.StatusCode()]; found {
+		ctx.Response.SetStatusCode(status)
+	}
+}
+
+func (svc *Service) requestTimeout(ctx *app.RequestContext) time.Duration {
+	if val, found := ctx.Get(routeRequestTimeoutKey); found {
+		if timeout, ok := val.(time.Duration); ok && timeout > 0 {
+			return timeout
+		}
+	}
+
+	return svc.options.Timeout.RequestTimeout
+}
+
+// upstreamHostHeader returns the Host header sent to the target, an empty string keeps the Host of the client.
+// preserve_host and upstream_host of the target take precedence over the service.
+// preserve_host: false sends the host of the target unless upstream_host is set.
+func upstreamHostHeader(serviceOpts config.ServiceOptions, targetOpts config.TargetOptions, targetHost string) string {
+	preserveHost, upstreamHost := serviceOpts.PreserveHost, serviceOpts.UpstreamHost
+	if targetOpts.PreserveHost != nil || len(targetOpts.UpstreamHost) > 0 {
+		preserveHost, upstreamHost = targetOpts.PreserveHost, targetOpts.UpstreamHost
+	}
+
+	switch {
+	case preserveHost != nil && *preserveHost:
+		return ""
+	case len(upstreamHost) > 0:
+		return upstreamHost
+	case preserveHost != nil:
+		return targetHost
+	default:
+		return ""
+	}
+}
+
+// setOriginalURIHeader forwards the client-visible uri before any path rewrite.
+// Path rewrite middlewares save the original path in $request_path before rewriting.
+func setOriginalURIHeader(ctx *app.RequestContext, header string) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	path := ctx.GetString(config.REQUEST_PATH)
+	if len(path) > 0 {
+		_, _ = buf.WriteString(path)
+	} else {
+		_, _ = buf.Write(ctx.Request.Path())
+	}
+
+	if len(ctx.Request.QueryString()) > 0 {
+		_, _ = buf.WriteString("?")
+		_, _ = buf.Write(ctx.Request.QueryString())
+	}
+
+	ctx.Request.Header.Set(header, buf.String())
+}
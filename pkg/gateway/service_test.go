@@ -1,13 +1,24 @@
 package gateway
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/log"
+	"http-benchmark/pkg/middleware/replacepathregex"
+	"http-benchmark/pkg/middleware/stripprefix"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/rs/dnscache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -106,3 +117,552 @@ func TestServeHTTP(t *testing.T) {
 	service.ServeHTTP(ctx, hzCtx)
 	assert.Equal(t, backendResponse, string(hzCtx.Response.Body()))
 }
+
+func TestOriginalURIHeader(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9983"))
+	h.GET("/*path", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, string(ctx.Request.Path())+" "+ctx.Request.Header.Get("X-Original-URI"))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:                "original_uri",
+		Url:               "http://127.0.0.1:9983",
+		OriginalURIHeader: "X-Original-URI",
+	})
+	assert.NoError(t, err)
+
+	strip := stripprefix.NewMiddleware([]string{"/api"})
+	replace, err := replacepathregex.NewMiddleware("^/v1/(.*)$", "/internal/$1")
+	assert.NoError(t, err)
+
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/api/v1/orders?id=1")
+	hzCtx.SetHandlers(app.HandlersChain{strip.ServeHTTP, replace.ServeHTTP, service.ServeHTTP})
+	hzCtx.Next(context.Background())
+
+	assert.Equal(t, "/internal/orders /api/v1/orders?id=1", string(hzCtx.Response.Body()))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9979"))
+	h.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(2 * time.Second)
+		ctx.String(200, "slow")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"slow": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9979"},
+						{Target: "localhost:9979"},
+					},
+				},
+			},
+		},
+	}
+
+	serve := func(service *Service, handlers ...app.HandlerFunc) (*app.RequestContext, time.Duration) {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/slow")
+		hzCtx.SetHandlers(append(handlers, service.ServeHTTP))
+
+		startTime := time.Now()
+		hzCtx.Next(context.Background())
+		return hzCtx, time.Since(startTime)
+	}
+
+	t.Run("service timeout", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:      "timeout",
+			Url:     "http://127.0.0.1:9979",
+			Timeout: config.ServiceTimeoutOptions{RequestTimeout: 200 * time.Millisecond},
+		})
+		assert.NoError(t, err)
+
+		hzCtx, elapsed := serve(service)
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Less(t, elapsed, time.Second)
+
+		duration, err := strconv.ParseFloat(hzCtx.GetString(config.UPSTREAM_DURATION), 64)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, duration, 0.2)
+		assert.Less(t, duration, 0.5)
+	})
+
+	t.Run("route overrides service timeout", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:      "timeout",
+			Url:     "http://127.0.0.1:9979",
+			Timeout: config.ServiceTimeoutOptions{RequestTimeout: 5 * time.Second},
+		})
+		assert.NoError(t, err)
+
+		hzCtx, elapsed := serve(service, func(c context.Context, ctx *app.RequestContext) {
+			ctx.Set(routeRequestTimeoutKey, 100*time.Millisecond)
+			ctx.Next(c)
+		})
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Less(t, elapsed, time.Second)
+	})
+
+	t.Run("remaining time shrinks across retries", func(t *testing.T) {
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:      "timeout",
+			Url:     "http://slow",
+			Timeout: config.ServiceTimeoutOptions{RequestTimeout: 300 * time.Millisecond},
+			Retries: 1,
+		})
+		assert.NoError(t, err)
+
+		hzCtx, elapsed := serve(service)
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Less(t, elapsed, 600*time.Millisecond)
+	})
+}
+
+func TestClientDisconnect(t *testing.T) {
+	// the client asks for server-sent events, the backend sends the headers and part of the body, then stalls
+	backend, err := net.Listen("tcp", "127.0.0.1:9971")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = bufio.NewReader(conn).ReadString('\n')
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial"))
+				time.Sleep(3 * time.Second)
+			}()
+		}
+	}()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:  "disconnect",
+		Url: "http://127.0.0.1:9971",
+	})
+	assert.NoError(t, err)
+
+	type result struct {
+		status    int
+		elapsed   time.Duration
+		ctx       *app.RequestContext
+		targetErr bool
+	}
+	results := make(chan result, 1)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9972"), server.WithSenseClientDisconnection(true))
+	h.GET("/disconnect", func(c context.Context, ctx *app.RequestContext) {
+		startTime := time.Now()
+		service.ServeHTTP(c, ctx)
+		results <- result{
+			status:    ctx.Response.StatusCode(),
+			elapsed:   time.Since(startTime),
+			ctx:       ctx,
+			targetErr: ctx.GetBool("target_error"),
+		}
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9972")
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("GET /disconnect HTTP/1.1\r\nHost: localhost\r\nAccept: text/event-stream\r\n\r\n"))
+	assert.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	_ = conn.Close()
+
+	select {
+	case r := <-results:
+		assert.Equal(t, 499, r.status)
+		assert.Less(t, r.elapsed, time.Second)
+		assert.False(t, r.targetErr)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the proxy kept waiting for the upstream after the client disconnected")
+	}
+}
+
+func TestStatusMap(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9970"))
+	h.GET("/status/:code", func(c context.Context, ctx *app.RequestContext) {
+		code, _ := strconv.Atoi(ctx.Param("code"))
+		ctx.String(code, "upstream body")
+	})
+	h.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(time.Second)
+		ctx.String(200, "slow")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	statusMap := map[int]int{418: 503, 502: 500, 504: 500}
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:        "status_map",
+		Url:       "http://127.0.0.1:9970",
+		StatusMap: statusMap,
+		Timeout:   config.ServiceTimeoutOptions{RequestTimeout: 200 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+
+	serve := func(service *Service, path string) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost" + path)
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/status/418", 503},
+		{"/status/502", 500},
+		{"/status/200", 200},
+		{"/status/404", 404},
+	}
+
+	for _, tt := range tests {
+		hzCtx := serve(service, tt.path)
+		assert.Equal(t, tt.status, hzCtx.Response.StatusCode(), tt.path)
+		assert.Equal(t, "upstream body", string(hzCtx.Response.Body()), tt.path)
+	}
+
+	// $upstream_status keeps the original status
+	hzCtx := serve(service, "/status/418")
+	assert.Equal(t, 418, hzCtx.GetInt(config.UPSTREAM_STATUS))
+
+	// statuses generated by the gateway are not mapped
+	hzCtx = serve(service, "/slow")
+	assert.Equal(t, 504, hzCtx.Response.StatusCode())
+
+	unreachable, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:        "status_map_unreachable",
+		Url:       "http://127.0.0.1:9969",
+		StatusMap: statusMap,
+	})
+	assert.NoError(t, err)
+
+	hzCtx = serve(unreachable, "/status/200")
+	assert.Equal(t, 502, hzCtx.Response.StatusCode())
+}
+
+func TestPreserveHost(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9968"))
+	h.GET("/host", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, string(ctx.Request.Header.Host()))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	preserve := true
+	notPreserve := false
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"host_upstream": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9968"},
+					},
+				},
+				"target_host_upstream": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9968", UpstreamHost: "target.internal"},
+					},
+				},
+			},
+		},
+		resolver: &dnscache.Resolver{},
+	}
+
+	tests := []struct {
+		name string
+		opts config.ServiceOptions
+		host string
+	}{
+		{"direct default", config.ServiceOptions{Url: "http://127.0.0.1:9968"}, "client.example.com"},
+		{"direct preserve host", config.ServiceOptions{Url: "http://127.0.0.1:9968", PreserveHost: &preserve}, "client.example.com"},
+		{"direct target host", config.ServiceOptions{Url: "http://127.0.0.1:9968", PreserveHost: &notPreserve}, "127.0.0.1:9968"},
+		{"direct upstream host", config.ServiceOptions{Url: "http://127.0.0.1:9968", UpstreamHost: "api.internal"}, "api.internal"},
+		{"upstream preserve host", config.ServiceOptions{Url: "http://host_upstream", PreserveHost: &preserve}, "client.example.com"},
+		{"upstream target host", config.ServiceOptions{Url: "http://host_upstream", PreserveHost: &notPreserve}, "127.0.0.1:9968"},
+		{"upstream upstream host", config.ServiceOptions{Url: "http://host_upstream", UpstreamHost: "api.internal"}, "api.internal"},
+		{"target overrides service", config.ServiceOptions{Url: "http://target_host_upstream", PreserveHost: &preserve}, "target.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ID = "host"
+			service, err := newService(bifrost, tt.opts)
+			assert.NoError(t, err)
+
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://client.example.com/host")
+			hzCtx.Request.Header.SetHost("client.example.com")
+			service.ServeHTTP(context.Background(), hzCtx)
+
+			assert.Equal(t, 200, hzCtx.Response.StatusCode())
+			assert.Equal(t, tt.host, string(hzCtx.Response.Body()))
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+
+	h := server.New(server.WithHostPorts(socketPath), server.WithNetwork("unix"))
+	h.GET("/unix", func(c context.Context, ctx *app.RequestContext) {
+		ctx.Response.Header.Set("X-Forwarded-For", string(ctx.Request.Header.Peek("X-Forwarded-For")))
+		ctx.String(200, string(ctx.Request.Header.Host()))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	notPreserve := false
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"unix_upstream": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "unix://" + socketPath},
+					},
+				},
+			},
+		},
+		resolver: &dnscache.Resolver{},
+	}
+
+	tests := []struct {
+		name string
+		opts config.ServiceOptions
+		host string
+	}{
+		{"direct", config.ServiceOptions{Url: "unix://" + socketPath}, "client.example.com"},
+		{"direct synthetic host", config.ServiceOptions{Url: "unix://" + socketPath, PreserveHost: &notPreserve}, "localhost"},
+		{"upstream", config.ServiceOptions{Url: "http://unix_upstream"}, "client.example.com"},
+		{"upstream synthetic host", config.ServiceOptions{Url: "http://unix_upstream", PreserveHost: &notPreserve}, "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ID = "unix"
+			service, err := newService(bifrost, tt.opts)
+			assert.NoError(t, err)
+
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://client.example.com/unix")
+			hzCtx.Request.Header.SetHost("client.example.com")
+			service.ServeHTTP(context.Background(), hzCtx)
+
+			assert.Equal(t, 200, hzCtx.Response.StatusCode())
+			assert.Equal(t, tt.host, string(hzCtx.Response.Body()))
+			assert.Equal(t, "unix:"+socketPath, hzCtx.GetString(config.UPSTREAM_ADDR))
+			assert.Equal(t, "0.0.0.0", string(hzCtx.Response.Header.Peek("X-Forwarded-For")))
+		})
+	}
+}
+
+func TestSlowRequest(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9954"))
+	h.GET("/fast", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, "fast")
+	})
+	h.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(300 * time.Millisecond)
+		ctx.String(201, "slow")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:                   "slow_request",
+		Url:                  "http://127.0.0.1:9954",
+		SlowRequestThreshold: 200 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	c := log.NewContext(context.Background(), slog.New(slog.NewJSONHandler(buf, nil)))
+
+	serve := func(path string) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost" + path)
+		service.ServeHTTP(c, hzCtx)
+		return hzCtx
+	}
+
+	hzCtx := serve("/fast")
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	assert.False(t, hzCtx.GetBool(config.SLOW_REQUEST))
+	assert.Empty(t, buf.String())
+
+	hzCtx = serve("/slow")
+	assert.Equal(t, 201, hzCtx.Response.StatusCode())
+	assert.True(t, hzCtx.GetBool(config.SLOW_REQUEST))
+
+	entry := map[string]any{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "slow request", entry["msg"])
+	assert.Equal(t, "slow_request", entry["service"])
+	assert.Equal(t, "GET http://localhost/slow", entry["request"])
+	assert.Equal(t, "127.0.0.1:9954", entry["upstream_addr"])
+	assert.Equal(t, float64(201), entry["status"])
+	assert.Equal(t, float64(201), entry["upstream_status"])
+	assert.NotEmpty(t, entry["upstream_duration"])
+	assert.GreaterOrEqual(t, entry["duration"], float64(300*time.Millisecond))
+}
+
+func TestMethodOverride(t *testing.T) {
+	h := server.New(server.WithHostPorts("127.0.0.1:9947"))
+	h.Any("/legacy", func(c context.Context, ctx *app.RequestContext) {
+		ctx.Response.Header.Set("Got-Method", string(ctx.Method()))
+		ctx.String(200, string(ctx.Request.Body()))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:             "method_override",
+		Url:            "http://127.0.0.1:9947",
+		MethodOverride: "put",
+	})
+	assert.NoError(t, err)
+
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetMethod("POST")
+	hzCtx.Request.SetRequestURI("http://localhost/legacy")
+	hzCtx.Request.SetBodyString(`{"name":"bifrost"}`)
+	service.ServeHTTP(context.Background(), hzCtx)
+
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	assert.Equal(t, "PUT", string(hzCtx.Response.Header.Peek("Got-Method")))
+	assert.Equal(t, `{"name":"bifrost"}`, string(hzCtx.Response.Body()))
+
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":9955"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"all": {Url: "http://127.0.0.1:9947", MethodOverride: "CONNECT"},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' method_override 'CONNECT' is invalid")
+
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9947", MethodOverride: "FETCH"}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' method_override 'FETCH' is invalid")
+}
+
+func TestDynamicUpstream(t *testing.T) {
+	for _, host := range []string{"127.0.0.1:9911", "127.0.0.1:9912"} {
+		h := server.New(server.WithHostPorts(host))
+		h.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, host)
+		})
+		go h.Spin()
+	}
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"tenant_a": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9911"}},
+				},
+				"default_tenant": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9912"}},
+				},
+			},
+		},
+	}
+
+	serve := func(service *Service, tenant string) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/orders")
+		if len(tenant) > 0 {
+			hzCtx.Set("$tenant", tenant)
+		}
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	withFallback, err := newService(bifrost, config.ServiceOptions{
+		ID:               "orders",
+		Url:              "http://$tenant",
+		FallbackUpstream: "default_tenant",
+	})
+	assert.NoError(t, err)
+
+	withoutFallback, err := newService(bifrost, config.ServiceOptions{
+		ID:  "orders",
+		Url: "http://$tenant",
+	})
+	assert.NoError(t, err)
+
+	t.Run("hit", func(t *testing.T) {
+		for _, service := range []*Service{withFallback, withoutFallback} {
+			hzCtx := serve(service, "tenant_a")
+			assert.Equal(t, "127.0.0.1:9911", string(hzCtx.Response.Body()))
+			assert.Equal(t, "tenant_a", hzCtx.GetString(config.UPSTREAM))
+		}
+	})
+
+	t.Run("miss with fallback", func(t *testing.T) {
+		for _, tenant := range []string{"tenant_b", ""} {
+			hzCtx := serve(withFallback, tenant)
+			assert.Equal(t, "127.0.0.1:9912", string(hzCtx.Response.Body()))
+			assert.Equal(t, "default_tenant", hzCtx.GetString(config.UPSTREAM))
+		}
+	})
+
+	t.Run("miss without fallback", func(t *testing.T) {
+		hzCtx := serve(withoutFallback, "tenant_b")
+		assert.True(t, hzCtx.IsAborted())
+		assert.Empty(t, hzCtx.Response.Body())
+		assert.Empty(t, hzCtx.GetString(config.UPSTREAM))
+	})
+
+	t.Run("fallback upstream must exist", func(t *testing.T) {
+		opts := config.Options{
+			Entries: map[string]config.EntryOptions{
+				"http": {Bind: ":9955"},
+			},
+			Routes: map[string]config.RouteOptions{
+				"all": {Paths: []string{"/"}, ServiceID: "all"},
+			},
+			Services: map[string]config.ServiceOptions{
+				"all": {Url: "http://$tenant", FallbackUpstream: "unknown"},
+			},
+		}
+		err := validateOptions(opts)
+		assert.ErrorContains(t, err, "fallback upstream 'unknown' was not found in service 'all'")
+	})
+}
@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"slices"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+)
+
+type sniService struct {
+	suffix  string
+	service *Service
+}
+
+// sniRouter selects the service by the tls server name of the connection instead of the Host header.
+// A server name can be exact (api.example.com) or wildcard (*.example.com), exact names win and
+// longer wildcard suffixes win over shorter ones. Requests whose server name doesn't match go to the routes of the entry.
+type sniRouter struct {
+	exact         map[string]*Service
+	wildcard      []sniService
+	rejectUnknown bool
+}
+
+func newSNIRouter(opts config.SNIOptions, services map[string]*Service) (*sniRouter, error) {
+	r := &sniRouter{
+		exact:         make(map[string]*Service),
+		rejectUnknown: opts.RejectUnknown,
+	}
+
+	for serverName, serviceID := range opts.Routes {
+		service, found := services[serviceID]
+		if !found {
+			return nil, fmt.Errorf("sni service '%s' was not found", serviceID)
+		}
+
+		serverName = strings.ToLower(strings.TrimSpace(serverName))
+
+		if strings.HasPrefix(serverName, "*.") {
+			r.wildcard = append(r.wildcard, sniService{suffix: serverName[1:], service: service})
+			continue
+		}
+
+		r.exact[serverName] = service
+	}
+
+	slices.SortStableFunc(r.wildcard, func(a, b sniService) int {
+		return len(b.suffix) - len(a.suffix)
+	})
+
+	return r, nil
+}
+
+func (r *sniRouter) match(serverName string) (*Service, bool) {
+	serverName = strings.ToLower(serverName)
+
+	if service, found := r.exact[serverName]; found {
+		return service, true
+	}
+
+	for _, wildcard := range r.wildcard {
+		if strings.HasSuffix(serverName, wildcard.suffix) {
+			return wildcard.service, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r *sniRouter) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	conn, ok := ctx.GetConn().(network.ConnTLSer)
+	if !ok {
+		ctx.Next(c)
+		return
+	}
+
+	service, found := r.match(conn.ConnectionState().ServerName)
+	if !found {
+		ctx.Next(c)
+		return
+	}
+
+	service.ServeHTTP(c, ctx)
+	ctx.Abort()
+}
+
+// setSNIRejection fails the handshake when reject_unknown is enabled and the server name doesn't match any sni route.
+// The router is loaded on every handshake, so reloads take effect for new connections.
+func setSNIRejection(tlsConfig *tls.Config, router func() *sniRouter) {
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		r := router()
+		if r == nil || !r.rejectUnknown {
+			return nil, nil
+		}
+
+		if _, found := r.match(hello.ServerName); !found {
+			return nil, fmt.Errorf("server name '%s' is not allowed", hello.ServerName)
+		}
+
+		return nil, nil
+	}
+}
@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"http-benchmark/pkg/config"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSNIRouter(t *testing.T) {
+	backend := server.New(server.WithHostPorts("127.0.0.1:9961"))
+	backend.GET("/sni", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, string(ctx.Request.Header.Host()))
+	})
+	go backend.Spin()
+
+	services := map[string]*Service{}
+	for _, id := range []string{"orders", "users", "default"} {
+		service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+			ID:           id,
+			Url:          "http://127.0.0.1:9961",
+			UpstreamHost: id + ".internal",
+		})
+		assert.NoError(t, err)
+		services[id] = service
+	}
+
+	newRouter := func(rejectUnknown bool) *sniRouter {
+		router, err := newSNIRouter(config.SNIOptions{
+			Routes: map[string]string{
+				"orders.example.com":   "orders",
+				"*.example.com":        "users",
+				"*.orders.example.com": "orders",
+			},
+			RejectUnknown: rejectUnknown,
+		}, services)
+		assert.NoError(t, err)
+		return router
+	}
+
+	// the router is swapped like a reload
+	var router atomic.Pointer[sniRouter]
+	router.Store(newRouter(true))
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+	setSNIRejection(tlsConfig, router.Load)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9959"), server.WithTLS(tlsConfig))
+	h.Use(func(c context.Context, ctx *app.RequestContext) {
+		router.Load().ServeHTTP(c, ctx)
+	})
+	h.GET("/sni", services["default"].ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	send := func(serverName string, host string) (*protocol.Response, error) {
+		cli, err := client.NewClient(client.WithTLSConfig(&tls.Config{ServerName: serverName, InsecureSkipVerify: true}))
+		assert.NoError(t, err)
+
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI("https://127.0.0.1:9959/sni")
+		req.Header.SetHost(host)
+		err = cli.Do(context.Background(), req, resp)
+		return resp, err
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		host       string
+		expected   string
+	}{
+		{"exact", "orders.example.com", "orders.example.com", "orders.internal"},
+		{"host header disagrees with sni", "orders.example.com", "users.example.com", "orders.internal"},
+		{"wildcard", "users.example.com", "orders.example.com", "users.internal"},
+		{"longest wildcard", "eu.orders.example.com", "eu.orders.example.com", "orders.internal"},
+		{"case insensitive", "ORDERS.example.com", "orders.example.com", "orders.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := send(tt.serverName, tt.host)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode())
+			assert.Equal(t, tt.expected, string(resp.Body()))
+		})
+	}
+
+	t.Run("unknown server name is rejected", func(t *testing.T) {
+		_, err := send("www.example.org", "orders.example.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown server name goes to routes", func(t *testing.T) {
+		router.Store(newRouter(false))
+
+		resp, err := send("www.example.org", "orders.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "default.internal", string(resp.Body()))
+	})
+}
+
+func TestSNIValidation(t *testing.T) {
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"https": {
+				Bind: ":9958",
+				TLS: config.TLSOptions{
+					Enabled: true,
+					SNI: config.SNIOptions{
+						Routes: map[string]string{"orders.example.com": "orders"},
+					},
+				},
+			},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+	}
+
+	err := validateOptions(opts)
+	assert.ErrorContains(t, err, "entry 'https' sni service 'orders' was not found")
+
+	opts.Entries["https"] = config.EntryOptions{
+		Bind: ":9958",
+		TLS:  config.TLSOptions{SNI: config.SNIOptions{RejectUnknown: true}},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "entry 'https' sni requires tls to be enabled")
+}
@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"http-benchmark/pkg/config"
+	"math"
+	"math/rand"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+type splitBucket struct {
+	upstream *Upstream
+	// cutoff is the upper bound of the bucket in [0, 100), buckets are ordered by it
+	cutoff float64
+}
+
+// splitter divides the requests of a service between upstreams by percentage, for example 95% to the stable
+// upstream and 5% to the canary. It is independent of the strategy of the upstreams, the target is picked by the
+// selected upstream as usual.
+type splitter struct {
+	buckets      []splitBucket
+	stickyHeader string
+	stickyCookie string
+}
+
+func newSplitter(serviceID string, opts config.SplitOptions, upstreams map[string]*Upstream) (*splitter, error) {
+	s := &splitter{
+		buckets:      make([]splitBucket, 0, len(opts.Upstreams)),
+		stickyHeader: opts.StickyHeader,
+		stickyCookie: opts.StickyCookie,
+	}
+
+	var cutoff float64
+	for _, bucketOpts := range opts.Upstreams {
+		upstream, found := upstreams[bucketOpts.Upstream]
+		if !found {
+			return nil, fmt.Errorf("split upstream '%s' was not found in service '%s'", bucketOpts.Upstream, serviceID)
+		}
+
+		if bucketOpts.Percentage <= 0 {
+			continue
+		}
+
+		cutoff += bucketOpts.Percentage
+		s.buckets = append(s.buckets, splitBucket{
+			upstream: upstream,
+			cutoff:   cutoff,
+		})
+	}
+
+	if len(s.buckets) == 0 || math.Abs(cutoff-100) > 1e-9 {
+		return nil, fmt.Errorf("service '%s' split percentages must add up to 100", serviceID)
+	}
+
+	return s, nil
+}
+
+// pick returns the upstream of the request. When the sticky header or cookie is present, the same value always
+// lands in the same bucket as long as the percentages are unchanged; otherwise the bucket is random.
+func (s *splitter) pick(ctx *app.RequestContext) *Upstream {
+	point := -1.0
+
+	if len(s.stickyHeader) > 0 {
+		if value := ctx.Request.Header.Peek(s.stickyHeader); len(value) > 0 {
+			point = stickyPoint(value)
+		}
+	}
+
+	if point < 0 && len(s.stickyCookie) > 0 {
+		if value := ctx.Cookie(s.stickyCookie); len(value) > 0 {
+			point = stickyPoint(value)
+		}
+	}
+
+	if point < 0 {
+		point = rand.Float64() * 100
+	}
+
+	for _, bucket := range s.buckets {
+		if point < bucket.cutoff {
+			return bucket.upstream
+		}
+	}
+
+	// rounding of the cutoffs
+	return s.buckets[len(s.buckets)-1].upstream
+}
+
+// stickyPoint maps the value to [0, 100) with a resolution of 0.01%
+func stickyPoint(value []byte) float64 {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(value)
+	return float64(hasher.Sum32()%10000) / 100
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	for name, addr := range map[string]string{"stable": "127.0.0.1:9943", "canary": "127.0.0.1:9942"} {
+		backend := server.New(server.WithHostPorts(addr))
+		backend.Any("/*path", func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(200, name)
+		})
+		go backend.Spin()
+	}
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"stable": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9943"}},
+				},
+				"canary": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9942"}},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{
+		ID:  "split",
+		Url: "http://stable",
+		Split: config.SplitOptions{
+			Upstreams: []config.SplitUpstreamOptions{
+				{Upstream: "stable", Percentage: 80},
+				{Upstream: "canary", Percentage: 20},
+			},
+			StickyHeader: "X-User-ID",
+			StickyCookie: "uid",
+		},
+	})
+	assert.NoError(t, err)
+
+	serve := func(setup func(ctx *app.RequestContext)) *app.RequestContext {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/orders")
+		if setup != nil {
+			setup(hzCtx)
+		}
+		service.ServeHTTP(context.Background(), hzCtx)
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+		return hzCtx
+	}
+
+	t.Run("requests are split by percentage", func(t *testing.T) {
+		canary := 0
+		for i := 0; i < 500; i++ {
+			hzCtx := serve(nil)
+			bucket := hzCtx.GetString(config.UPSTREAM_SPLIT)
+			assert.Equal(t, bucket, string(hzCtx.Response.Body()))
+			if bucket == "canary" {
+				canary++
+			}
+		}
+		assert.Greater(t, canary, 50)
+		assert.Less(t, canary, 150)
+	})
+
+	t.Run("sticky header keeps the bucket", func(t *testing.T) {
+		buckets := map[string]int{}
+		for user := 0; user < 100; user++ {
+			userID := "user-" + strconv.Itoa(user)
+
+			first := serve(func(ctx *app.RequestContext) {
+				ctx.Request.Header.Set("X-User-ID", userID)
+			}).GetString(config.UPSTREAM_SPLIT)
+			buckets[first]++
+
+			for i := 0; i < 5; i++ {
+				hzCtx := serve(func(ctx *app.RequestContext) {
+					ctx.Request.Header.Set("X-User-ID", userID)
+				})
+				assert.Equal(t, first, hzCtx.GetString(config.UPSTREAM_SPLIT))
+			}
+		}
+
+		// users are still split between both buckets
+		assert.Greater(t, buckets["stable"], 0)
+		assert.Greater(t, buckets["canary"], 0)
+	})
+
+	t.Run("sticky cookie keeps the bucket", func(t *testing.T) {
+		first := serve(func(ctx *app.RequestContext) {
+			ctx.Request.Header.SetCookie("uid", "42")
+		}).GetString(config.UPSTREAM_SPLIT)
+
+		for i := 0; i < 10; i++ {
+			hzCtx := serve(func(ctx *app.RequestContext) {
+				ctx.Request.Header.SetCookie("uid", "42")
+			})
+			assert.Equal(t, first, hzCtx.GetString(config.UPSTREAM_SPLIT))
+		}
+	})
+
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":9955"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+		Upstreams: bifrost.opts.Upstreams,
+		Services: map[string]config.ServiceOptions{
+			"all": {
+				Url: "http://stable",
+				Split: config.SplitOptions{
+					Upstreams: []config.SplitUpstreamOptions{
+						{Upstream: "stable", Percentage: 90},
+						{Upstream: "canary", Percentage: 5},
+					},
+				},
+			},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' split percentages must add up to 100")
+
+	opts.Services["all"] = config.ServiceOptions{
+		Url: "http://stable",
+		Split: config.SplitOptions{
+			Upstreams: []config.SplitUpstreamOptions{
+				{Upstream: "stable", Percentage: 95},
+				{Upstream: "beta", Percentage: 5},
+			},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "split upstream 'beta' was not found in service 'all'")
+
+	opts.Services["all"] = config.ServiceOptions{
+		Url: "http://127.0.0.1:9943",
+		Split: config.SplitOptions{
+			Upstreams: []config.SplitUpstreamOptions{
+				{Upstream: "stable", Percentage: 100},
+			},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' split requires the url to be an upstream")
+}
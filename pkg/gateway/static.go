@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"os"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+type staticResponse struct {
+	contentType string
+	body        []byte
+}
+
+// staticResponder answers /robots.txt and /favicon.ico of the entry without going to upstreams,
+// so bots and browsers don't generate 404 or 502 noise when backends are down.
+type staticResponder struct {
+	responses map[string]staticResponse
+}
+
+func newStaticResponder(entryOpts config.EntryOptions) (*staticResponder, error) {
+	responder := &staticResponder{
+		responses: make(map[string]staticResponse),
+	}
+
+	if entryOpts.RobotsTxt.Enabled {
+		body, err := loadStaticContent(entryOpts.RobotsTxt)
+		if err != nil {
+			return nil, fmt.Errorf("robots_txt is invalid in entry '%s': %w", entryOpts.ID, err)
+		}
+
+		if body == nil {
+			body = []byte(defaultRobotsTxt)
+		}
+
+		responder.responses["/robots.txt"] = staticResponse{
+			contentType: "text/plain; charset=utf-8",
+			body:        body,
+		}
+	}
+
+	if entryOpts.Favicon.Enabled {
+		body, err := loadStaticContent(entryOpts.Favicon)
+		if err != nil {
+			return nil, fmt.Errorf("favicon is invalid in entry '%s': %w", entryOpts.ID, err)
+		}
+
+		responder.responses["/favicon.ico"] = staticResponse{
+			contentType: "image/x-icon",
+			body:        body,
+		}
+	}
+
+	if len(responder.responses) == 0 {
+		return nil, nil
+	}
+
+	return responder, nil
+}
+
+func loadStaticContent(opts config.StaticFileOptions) ([]byte, error) {
+	if len(opts.Path) > 0 {
+		return os.ReadFile(opts.Path)
+	}
+
+	if len(opts.Content) > 0 {
+		return []byte(opts.Content), nil
+	}
+
+	return nil, nil
+}
+
+func (s *staticResponder) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	method := string(ctx.Request.Method())
+	if method != "GET" && method != "HEAD" {
+		ctx.Next(c)
+		return
+	}
+
+	resp, found := s.responses[string(ctx.Request.Path())]
+	if !found {
+		ctx.Next(c)
+		return
+	}
+
+	// favicon without content responds 204, browsers stop asking for it
+	if len(resp.body) == 0 {
+		ctx.Response.SetStatusCode(204)
+		ctx.Abort()
+		return
+	}
+
+	ctx.Data(200, resp.contentType, resp.body)
+	ctx.Abort()
+}
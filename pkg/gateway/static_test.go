@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticResponder(t *testing.T) {
+	responder, err := newStaticResponder(config.EntryOptions{
+		ID: "test",
+		RobotsTxt: config.StaticFileOptions{
+			Enabled: true,
+			Content: "User-agent: *\nAllow: /\n",
+		},
+		Favicon: config.StaticFileOptions{
+			Enabled: true,
+		},
+	})
+	assert.NoError(t, err)
+
+	serve := func(method, uri string) *app.RequestContext {
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.SetMethod(method)
+		ctx.SetHandlers([]app.HandlerFunc{responder.ServeHTTP, func(c context.Context, ctx *app.RequestContext) {
+			ctx.String(502, "upstream")
+		}})
+		ctx.Next(context.Background())
+		return ctx
+	}
+
+	ctx := serve("GET", "http://localhost/robots.txt")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "User-agent: *\nAllow: /\n", string(ctx.Response.Body()))
+	assert.Equal(t, "text/plain; charset=utf-8", string(ctx.Response.Header.ContentType()))
+
+	ctx = serve("GET", "http://localhost/favicon.ico")
+	assert.Equal(t, 204, ctx.Response.StatusCode())
+
+	// other requests go to upstreams
+	ctx = serve("POST", "http://localhost/robots.txt")
+	assert.Equal(t, 502, ctx.Response.StatusCode())
+
+	ctx = serve("GET", "http://localhost/orders")
+	assert.Equal(t, 502, ctx.Response.StatusCode())
+}
+
+func TestStaticResponderDisabled(t *testing.T) {
+	responder, err := newStaticResponder(config.EntryOptions{ID: "test"})
+	assert.NoError(t, err)
+	assert.Nil(t, responder)
+
+	responder, err = newStaticResponder(config.EntryOptions{
+		ID: "test",
+		RobotsTxt: config.StaticFileOptions{
+			Enabled: true,
+		},
+	})
+	assert.NoError(t, err)
+
+	ctx := app.NewContext(0)
+	ctx.Request.SetRequestURI("http://localhost/robots.txt")
+	ctx.SetHandlers([]app.HandlerFunc{responder.ServeHTTP})
+	ctx.Next(context.Background())
+	assert.Equal(t, defaultRobotsTxt, string(ctx.Response.Body()))
+
+	// favicon is disabled
+	ctx = app.NewContext(0)
+	ctx.Request.SetRequestURI("http://localhost/favicon.ico")
+	ctx.SetHandlers([]app.HandlerFunc{responder.ServeHTTP, func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(404, "not found")
+	}})
+	ctx.Next(context.Background())
+	assert.Equal(t, 404, ctx.Response.StatusCode())
+}
@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"bytes"
+	"http-benchmark/pkg/config"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/hertz-contrib/http2"
+)
+
+// maxResponseBodySizeKey is the max size of the response body of the service, see streamingBody
+const maxResponseBodySizeKey = "max_response_body_size"
+
+var eventStreamContentType = []byte("text/event-stream")
+
+// isStreaming reports whether the upstream response body of the service is read as a stream
+func isStreaming(opts config.ServiceOptions) bool {
+	return opts.Streaming || opts.ResponseBuffering == config.ResponseBufferingOff
+}
+
+// isEventStreamResponse reports whether the upstream responds with server-sent events
+func isEventStreamResponse(resp *protocol.Response) bool {
+	return bytes.HasPrefix(resp.Header.ContentType(), eventStreamContentType)
+}
+
+// streamResponse pipes the upstream body to the client as it is read instead of buffering it.
+// Server-sent events are flushed as soon as they are read, the http2 server buffers the body until the handler is
+// done otherwise.
+// ErrResponseTooLarge is returned when the Content-Length of the upstream exceeds maxBodySize, a chunked body which
+// crosses it is cut off while it is sent to the client.
+// abandonUpstream makes the upstream connection closed rather than drained when the body is closed before the end,
+// for example when the client went away.
+func streamResponse(ctx *app.RequestContext, maxBodySize int, abandonUpstream func()) error {
+	if !ctx.Response.IsBodyStream() {
+		if maxBodySize > 0 && len(ctx.Response.Body()) > maxBodySize {
+			return ErrResponseTooLarge
+		}
+		return nil
+	}
+
+	if maxBodySize > 0 && ctx.Response.Header.ContentLength() > maxBodySize {
+		return ErrResponseTooLarge
+	}
+
+	body := &streamingBody{
+		reader:          ctx.Response.BodyStream(),
+		maxBodySize:     maxBodySize,
+		abandonUpstream: abandonUpstream,
+	}
+
+	writer, err := http2.NewResponseWriter(ctx.GetConn())
+	if isEventStreamResponse(&ctx.Response) {
+		if err == nil {
+			body.writer = writer
+		} else {
+			body.writer = ctx.GetWriter()
+		}
+	}
+
+	// the http/1 server ends a chunked body with the last chunk whatever the error of the reader is, the connection
+	// is closed so the client doesn't take the body for a complete one. The http2 connection is shared by other
+	// streams and can't be closed.
+	if err != nil {
+		if conn := ctx.GetConn(); conn != nil {
+			body.abort = func() {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	ctx.Response.SetBodyStreamNoReset(body, ctx.Response.Header.ContentLength())
+	return nil
+}
+
+// streamingBody flushes what the server has written before waiting for the next read of the upstream body
+// when writer is set. onDone is called once the upstream body is read to the end or the client goes away.
+type streamingBody struct {
+	reader          io.Reader
+	writer          interface{ Flush() error }
+	written         bool
+	read            int
+	eof             bool
+	maxBodySize     int
+	abort           func()
+	abandonUpstream func()
+	onDone          func()
+	once            sync.Once
+	closeOnce       sync.Once
+}
+
+func (b *streamingBody) Read(p []byte) (int, error) {
+	if b.writer != nil && b.written {
+		_ = b.writer.Flush()
+	}
+
+	n, err := b.reader.Read(p)
+	if n > 0 {
+		b.written = true
+		b.read += n
+	}
+
+	if b.maxBodySize > 0 && b.read > b.maxBodySize {
+		slog.Error("upstream response body is too large", "max_response_body_size", b.maxBodySize)
+		_ = b.Close()
+		if b.abort != nil {
+			b.abort()
+		}
+		return 0, ErrResponseTooLarge
+	}
+
+	if err != nil {
+		b.eof = err == io.EOF
+		b.done()
+	}
+
+	return n, err
+}
+
+func (b *streamingBody) Close() error {
+	b.done()
+
+	var err error
+	b.closeOnce.Do(func() {
+		// the client reads the rest of the body before the connection is put back to the pool, which never ends
+		// for an endless stream. The connection is abandoned instead, so the client closes it when the body is
+		// closed below and the upstream stops sending it.
+		if !b.eof && b.abandonUpstream != nil {
+			b.abandonUpstream()
+		}
+
+		if closer, ok := b.reader.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+func (b *streamingBody) done() {
+	b.once.Do(func() {
+		if b.onDone != nil {
+			b.onDone()
+		}
+	})
+}
@@ -0,0 +1,422 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type upstreamDurationTracer struct {
+	durations chan string
+}
+
+func (t *upstreamDurationTracer) Start(c context.Context, ctx *app.RequestContext) context.Context {
+	return c
+}
+
+func (t *upstreamDurationTracer) Finish(c context.Context, ctx *app.RequestContext) {
+	t.durations <- ctx.GetString(config.UPSTREAM_DURATION)
+}
+
+func TestStreaming(t *testing.T) {
+	next := make(chan bool)
+	download := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	backend := server.New(server.WithHostPorts("127.0.0.1:9949"))
+	backend.GET("/events", func(c context.Context, ctx *app.RequestContext) {
+		r, w := io.Pipe()
+		ctx.SetContentType("text/event-stream")
+		ctx.SetBodyStream(r, -1)
+
+		go func() {
+			_, _ = w.Write([]byte("data: first\n\n"))
+			<-next
+			_, _ = w.Write([]byte("data: second\n\n"))
+			_ = w.Close()
+		}()
+	})
+	backend.GET("/download", func(c context.Context, ctx *app.RequestContext) {
+		ctx.SetBodyStream(bytes.NewReader(download), len(download))
+	})
+	go backend.Spin()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:        "streaming",
+		Url:       "http://127.0.0.1:9949",
+		Streaming: true,
+	})
+	assert.NoError(t, err)
+	assert.True(t, service.proxy.streaming)
+
+	tracer := &upstreamDurationTracer{durations: make(chan string, 1)}
+	h := server.New(server.WithHostPorts("127.0.0.1:9948"), server.WithTracer(tracer))
+	h.GET("/*path", service.ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	t.Run("server-sent events", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9948/events")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		reader := bufio.NewReader(resp.Body)
+		readEvent := func() string {
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			_, _ = reader.ReadString('\n')
+			return line
+		}
+
+		// the backend sends the second event only after the first one reached the client
+		assert.Equal(t, "data: first\n", readEvent())
+		time.Sleep(300 * time.Millisecond)
+		next <- true
+		assert.Equal(t, "data: second\n", readEvent())
+
+		_, err = reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		// the upstream duration is recorded when the stream is done
+		select {
+		case upstreamDuration := <-tracer.durations:
+			duration, err := strconv.ParseFloat(upstreamDuration, 64)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, duration, 0.3)
+		case <-time.After(time.Second):
+			assert.Fail(t, "access log isn't finished")
+		}
+	})
+
+	t.Run("large download", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9948/download")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, download, body)
+		<-tracer.durations
+	})
+}
+
+func TestMaxResponseBodySize(t *testing.T) {
+	oversized := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	backend := server.New(server.WithHostPorts("127.0.0.1:9946"))
+	backend.GET("/small", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(http.StatusOK, "small")
+	})
+	backend.GET("/content-length", func(c context.Context, ctx *app.RequestContext) {
+		ctx.SetBodyStream(bytes.NewReader(oversized), len(oversized))
+	})
+	backend.GET("/chunked", func(c context.Context, ctx *app.RequestContext) {
+		ctx.SetBodyStream(bytes.NewReader(oversized), -1)
+	})
+	backend.POST("/echo", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(http.StatusOK, string(ctx.Request.Body()))
+	})
+	go backend.Spin()
+
+	buffered, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:                  "buffered",
+		Url:                 "http://127.0.0.1:9946",
+		MaxResponseBodySize: 64 * 1024,
+	})
+	assert.NoError(t, err)
+	assert.False(t, buffered.proxy.streaming)
+
+	unbuffered, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:                  "unbuffered",
+		Url:                 "http://127.0.0.1:9946",
+		MaxResponseBodySize: 64 * 1024,
+		ResponseBuffering:   config.ResponseBufferingOff,
+	})
+	assert.NoError(t, err)
+	assert.True(t, unbuffered.proxy.streaming)
+
+	bufferedServer := server.New(server.WithHostPorts("127.0.0.1:9945"))
+	bufferedServer.GET("/*path", buffered.ServeHTTP)
+	go bufferedServer.Spin()
+
+	unbufferedServer := server.New(server.WithHostPorts("127.0.0.1:9944"))
+	unbufferedServer.GET("/*path", unbuffered.ServeHTTP)
+	unbufferedServer.POST("/*path", unbuffered.ServeHTTP)
+	go unbufferedServer.Spin()
+	time.Sleep(time.Second)
+
+	for _, addr := range []string{"127.0.0.1:9945", "127.0.0.1:9944"} {
+		t.Run(addr+" small response", func(t *testing.T) {
+			resp, err := http.Get("http://" + addr + "/small")
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "small", string(body))
+		})
+
+		t.Run(addr+" content-length exceeds the limit", func(t *testing.T) {
+			resp, err := http.Get("http://" + addr + "/content-length")
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			assert.Less(t, len(body), 64*1024)
+		})
+	}
+
+	t.Run("buffered chunked body exceeds the limit", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9945/chunked")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("streamed chunked body is cut off at the limit", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9944/chunked")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		// the status is already sent, the client sees a truncated body instead of a complete one
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		assert.LessOrEqual(t, len(body), 64*1024)
+	})
+
+	t.Run("streamed connection to the upstream is reusable", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:9944/small")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("abandoned connection to the upstream isn't reused", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get("http://127.0.0.1:9944/chunked")
+			assert.NoError(t, err)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			// a request which can't be retried on another connection
+			resp, err = http.Post("http://127.0.0.1:9944/echo", "text/plain", strings.NewReader("order"))
+			assert.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "order", string(body))
+		}
+	})
+
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":9955"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+		Services: map[string]config.ServiceOptions{
+			"all": {Url: "http://127.0.0.1:9946", MaxResponseBodySize: -1},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' max_response_body_size can't be negative")
+
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9946", ResponseBuffering: "auto"}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' response_buffering 'auto' is invalid")
+
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9946", ResponseBuffering: config.ResponseBufferingOn, Streaming: true}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "service 'all' response_buffering on can't be used with streaming")
+
+	opts.Services["all"] = config.ServiceOptions{Url: "http://127.0.0.1:9946", ResponseBuffering: config.ResponseBufferingOff}
+	err = validateOptions(opts)
+	assert.NoError(t, err)
+}
+
+func TestStreamingClientDisconnect(t *testing.T) {
+	upstreamDone := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo" {
+			_, _ = io.Copy(w, r.Body)
+			return
+		}
+
+		defer func() { upstreamDone <- true }()
+
+		// an endless body, it is only stopped when the gateway closes the connection
+		chunk := bytes.Repeat([]byte("a"), 1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer backend.Close()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:        "streaming",
+		Url:       backend.URL,
+		Streaming: true,
+	})
+	assert.NoError(t, err)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9898"))
+	h.GET("/*path", service.ServeHTTP)
+	h.POST("/*path", service.ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9898")
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("GET /download HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	assert.NoError(t, err)
+
+	// the client goes away in the middle of the body
+	_, err = io.ReadAtLeast(conn, make([]byte, 4096), 4096)
+	assert.NoError(t, err)
+	_ = conn.Close()
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "the upstream connection is still read after the client went away")
+	}
+
+	// the abandoned connection isn't put back to the pool, a request which can't be retried is sent on a new one
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post("http://127.0.0.1:9898/echo", "text/plain", strings.NewReader("order"))
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "order", string(body))
+	}
+}
+
+func TestEventStreamPassThrough(t *testing.T) {
+	var acceptEncoding atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "id: %d\ndata: tick\n\n", i)
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	// the responses of the service are buffered and identical requests are coalesced
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:       "events",
+		Url:      backend.URL,
+		Coalesce: config.CoalesceOptions{Enabled: true},
+	})
+	assert.NoError(t, err)
+	assert.False(t, service.proxy.streaming)
+
+	h := server.New(server.WithHostPorts("127.0.0.1:9897"))
+	h.GET("/*path", service.ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	readEvents := func(t *testing.T, accept string) []time.Duration {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:9897/events", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		start := time.Now()
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		var arrivals []time.Duration
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				assert.ErrorIs(t, err, io.EOF)
+				return arrivals
+			}
+			if strings.HasPrefix(line, "id: ") {
+				arrivals = append(arrivals, time.Since(start))
+			}
+		}
+	}
+
+	t.Run("events are flushed as they are sent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+
+			// the streams aren't coalesced, each client gets its own
+			go func() {
+				defer wg.Done()
+
+				arrivals := readEvents(t, "text/event-stream")
+				if assert.Len(t, arrivals, 3) {
+					assert.Less(t, arrivals[0], 200*time.Millisecond)
+					assert.GreaterOrEqual(t, arrivals[2]-arrivals[0], 300*time.Millisecond)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// the upstream isn't asked to compress the stream
+		assert.Empty(t, acceptEncoding.Load())
+	})
+
+	t.Run("events are streamed whatever the request accepts", func(t *testing.T) {
+		arrivals := readEvents(t, "*/*")
+		if assert.Len(t, arrivals, 3) {
+			assert.Less(t, arrivals[0], 200*time.Millisecond)
+			assert.GreaterOrEqual(t, arrivals[2]-arrivals[0], 300*time.Millisecond)
+		}
+		assert.Equal(t, "gzip", acceptEncoding.Load())
+	})
+}
@@ -0,0 +1,355 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultTCPDialTimeout = 10 * time.Second
+
+// TCPServer accepts connections on the bind address of the entry and proxies bytes
+// bidirectionally to a target selected from the upstream of the entry.
+type TCPServer struct {
+	bifrost   *Bifrost
+	entryOpts *config.EntryOptions
+	upstream  atomic.Pointer[Upstream]
+	listener  net.Listener
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	shutdown atomic.Bool
+}
+
+func newTCPServer(bifrost *Bifrost, entryOpts config.EntryOptions) (*TCPServer, error) {
+	upstreamOpts, found := bifrost.opts.Upstreams[entryOpts.UpstreamID]
+	if !found {
+		return nil, fmt.Errorf("upstream '%s' was not found in entry '%s'", entryOpts.UpstreamID, entryOpts.ID)
+	}
+	upstreamOpts.ID = entryOpts.UpstreamID
+
+	upstream, err := newTCPUpstream(upstreamOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TCPServer{
+		bifrost:   bifrost,
+		entryOpts: &entryOpts,
+		conns:     make(map[net.Conn]struct{}),
+	}
+	s.upstream.Store(upstream)
+
+	return s, nil
+}
+
+// newTCPUpstream creates an upstream whose targets are plain addresses, the proxies are only used for selection
+func newTCPUpstream(opts config.UpstreamOptions) (*Upstream, error) {
+	if len(opts.Targets) == 0 {
+		return nil, fmt.Errorf("targets can't be empty. upstream id: %s", opts.ID)
+	}
+
+	upstream := &Upstream{
+		opts:    &opts,
+		proxies: make([]*Proxy, 0),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, targetOpts := range opts.Targets {
+		if targetOpts.Weight < 0 {
+			return nil, fmt.Errorf("weight can't be negative. upstream id: %s, target: %s", opts.ID, targetOpts.Target)
+		}
+
+		_, _, err := net.SplitHostPort(targetOpts.Target)
+		if err != nil {
+			return nil, fmt.Errorf("tcp target '%s' must contain a port. upstream id: %s", targetOpts.Target, opts.ID)
+		}
+
+		upstream.totalWeight += targetOpts.Weight
+		proxy := &Proxy{
+			target:        targetOpts.Target,
+			targetHost:    targetOpts.Target,
+			proxyProtocol: proxyProtocolOf(opts, targetOpts),
+		}
+		proxy.weight.Store(int64(targetOpts.Weight))
+		upstream.proxies = append(upstream.proxies, proxy)
+	}
+
+	if opts.Strategy == config.WeightedStrategy && upstream.totalWeight == 0 {
+		return nil, fmt.Errorf("weight of all targets can't be 0. upstream id: %s", opts.ID)
+	}
+
+	return upstream, nil
+}
+
+// pickTCP selects a target for the client connection, the hashing strategy hashes on the client ip
+func (u *Upstream) pickTCP(clientIP string) *Proxy {
+	switch u.opts.Strategy {
+	case config.RandomStrategy:
+		return u.random()
+	case config.HashingStrategy:
+		return u.hasing(clientIP)
+	case config.WeightedStrategy:
+		return u.weighted()
+	default:
+		return u.roundRobin()
+	}
+}
+
+func (s *TCPServer) Run() {
+	slog.Info("starting tcp entry", "id", s.entryOpts.ID, "bind", s.entryOpts.Bind)
+
+	listenConfig := net.ListenConfig{}
+	if s.entryOpts.ReusePort {
+		listenConfig.Control = reusePortControl
+	}
+
+	ln, err := listenConfig.Listen(context.Background(), "tcp", s.entryOpts.Bind)
+	if err != nil {
+		slog.Error("fail to start tcp entry", "id", s.entryOpts.ID, "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.shutdown.Load() {
+		s.mu.Unlock()
+		_ = ln.Close()
+		return
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shutdown.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("tcp entry fail to accept connection", "id", s.entryOpts.ID, "error", err)
+			continue
+		}
+
+		if !s.track(conn) {
+			_ = conn.Close()
+			continue
+		}
+
+		go func() {
+			defer s.untrack(conn)
+			s.serve(conn)
+		}()
+	}
+}
+
+func (s *TCPServer) serve(conn net.Conn) {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	upstream := s.upstream.Load()
+	proxy := upstream.pickTCP(clientIP)
+	if proxy == nil {
+		slog.Error("no proxy found", "entry", s.entryOpts.ID, "upstream", upstream.opts.ID, "client_ip", clientIP)
+		upstreamEvents.emit(UpstreamEvent{
+			Type:       NoLiveUpstream,
+			UpstreamID: upstream.opts.ID,
+			Reason:     "no target was selected",
+		})
+		return
+	}
+
+	upstreamConn, err := s.dialUpstream(proxy, conn)
+	if err != nil {
+		slog.Error("tcp entry fail to dial upstream", "entry", s.entryOpts.ID, "target", proxy.targetHost, "error", err)
+		return
+	}
+
+	if !s.track(upstreamConn) {
+		_ = upstreamConn.Close()
+		return
+	}
+	defer s.untrack(upstreamConn)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.copy(upstreamConn, conn) }()
+	go func() { errCh <- s.copy(conn, upstreamConn) }()
+
+	// a half close keeps the other direction open, any other error closes both sides
+	for i := 0; i < 2; i++ {
+		err = <-errCh
+		if err != nil {
+			_ = conn.Close()
+			_ = upstreamConn.Close()
+
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("tcp entry connection is closed", "entry", s.entryOpts.ID, "target", proxy.targetHost, "error", err)
+			}
+		}
+	}
+}
+
+// dialUpstream dials the target of the client connection, the PROXY header is sent first when the target enables
+// proxy_protocol, so the target sees the original client instead of the gateway
+func (s *TCPServer) dialUpstream(proxy *Proxy, conn net.Conn) (net.Conn, error) {
+	upstreamConn, err := s.dial(proxy.targetHost)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeProxyHeader(upstreamConn, proxy.proxyProtocol, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+		_ = upstreamConn.Close()
+		return nil, fmt.Errorf("fail to send proxy protocol header: %w", err)
+	}
+
+	return upstreamConn, nil
+}
+
+func (s *TCPServer) dial(address string) (net.Conn, error) {
+	timeout := s.entryOpts.Timeout.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultTCPDialTimeout
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if allowDNS(host) && s.bifrost.resolver != nil {
+		ips, err := s.bifrost.resolver.LookupHost(context.Background(), host)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no ip found for '%s'", host)
+		}
+		address = net.JoinHostPort(ips[rand.Intn(len(ips))], port)
+	}
+
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// copy moves bytes from src to dst, the idle timeout is extended every time data is read
+func (s *TCPServer) copy(dst, src net.Conn) error {
+	idleTimeout := s.entryOpts.Timeout.IdleTimeout
+	buf := make([]byte, 32*1024)
+
+	for {
+		if idleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// half close, let the peer finish its response
+				if tcpConn, ok := dst.(*net.TCPConn); ok {
+					_ = tcpConn.CloseWrite()
+					return nil
+				}
+			}
+			return err
+		}
+	}
+}
+
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown.Load() {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	_ = conn.Close()
+	s.wg.Done()
+}
+
+// activeConns returns the number of the open client and upstream connections
+func (s *TCPServer) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// SetUpstream swaps the upstream used for new connections, existing connections are not affected
+func (s *TCPServer) SetUpstream(upstream *Upstream) {
+	s.upstream.Store(upstream)
+}
+
+// Shutdown stops accepting new connections and waits for active connections to finish.
+// Connections which are still active when ctx is done are closed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown.Store(true)
+	ln := s.listener
+	s.mu.Unlock()
+
+	if ln != nil {
+		_ = ln.Close()
+	}
+
+	if s.entryOpts.Timeout.GracefulTimeOut > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.entryOpts.Timeout.GracefulTimeOut)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/dnscache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPServer(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	opts := config.Options{
+		Upstreams: map[string]config.UpstreamOptions{
+			"echo": {
+				Strategy: config.RoundRobinStrategy,
+				Targets: []config.TargetOptions{
+					{Target: backend.Addr().String()},
+				},
+			},
+		},
+	}
+
+	bifrost := &Bifrost{
+		opts:     &opts,
+		resolver: &dnscache.Resolver{},
+	}
+
+	server, err := newTCPServer(bifrost, config.EntryOptions{
+		ID:         "tcp",
+		Bind:       "127.0.0.1:9984",
+		Protocol:   config.ProtocolTCP,
+		UpstreamID: "echo",
+	})
+	assert.NoError(t, err)
+
+	go server.Run()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", "127.0.0.1:9984")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("PING\n"))
+	assert.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "PING\n", line)
+
+	// active connections are closed when the graceful timeout is reached
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	conn.Close()
+
+	_, err = net.DialTimeout("tcp", "127.0.0.1:9984", 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestTCPUpstreamTargetPort(t *testing.T) {
+	_, err := newTCPUpstream(config.UpstreamOptions{
+		ID:       "redis",
+		Strategy: config.RoundRobinStrategy,
+		Targets: []config.TargetOptions{
+			{Target: "127.0.0.1"},
+		},
+	})
+	assert.Error(t, err)
+}
+
+// decodeProxyHeader parses the PROXY header sent by the gateway and returns "version src dst"
+func decodeProxyHeader(r *bufio.Reader) (string, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return "", err
+	}
+
+	if string(sig) != string(proxyProtocolV2Signature) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 6 || fields[0] != "PROXY" {
+			return "", fmt.Errorf("invalid v1 header: %q", line)
+		}
+		return fmt.Sprintf("v1 %s %s", net.JoinHostPort(fields[2], fields[4]), net.JoinHostPort(fields[3], fields[5])), nil
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[12] != 0x21 || header[13] != 0x11 {
+		return "", fmt.Errorf("unexpected v2 command or family: %x", header[12:14])
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return "", err
+	}
+
+	src := net.JoinHostPort(net.IP(addrs[0:4]).String(), fmt.Sprint(binary.BigEndian.Uint16(addrs[8:10])))
+	dst := net.JoinHostPort(net.IP(addrs[4:8]).String(), fmt.Sprint(binary.BigEndian.Uint16(addrs[10:12])))
+	return fmt.Sprintf("v2 %s %s", src, dst), nil
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// the backend echoes the parsed header, then the bytes of the client
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				header, err := decodeProxyHeader(r)
+				if err != nil {
+					header = "error " + err.Error()
+				}
+				_, _ = conn.Write([]byte(header + "\n"))
+				_, _ = io.Copy(conn, r)
+			}()
+		}
+	}()
+
+	opts := config.Options{
+		Upstreams: map[string]config.UpstreamOptions{
+			"v1": {
+				Strategy:      config.RoundRobinStrategy,
+				ProxyProtocol: config.ProxyProtocolV1,
+				Targets:       []config.TargetOptions{{Target: backend.Addr().String()}},
+			},
+			"v2": {
+				Strategy:      config.RoundRobinStrategy,
+				ProxyProtocol: config.ProxyProtocolV1,
+				// the target overrides the upstream
+				Targets: []config.TargetOptions{{Target: backend.Addr().String(), ProxyProtocol: config.ProxyProtocolV2}},
+			},
+		},
+	}
+
+	bifrost := &Bifrost{
+		opts:     &opts,
+		resolver: &dnscache.Resolver{},
+	}
+
+	for _, tc := range []struct{ version, bind string }{
+		{"v1", "127.0.0.1:9919"},
+		{"v2", "127.0.0.1:9920"},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			server, err := newTCPServer(bifrost, config.EntryOptions{
+				ID:         tc.version,
+				Bind:       tc.bind,
+				Protocol:   config.ProtocolTCP,
+				UpstreamID: tc.version,
+			})
+			assert.NoError(t, err)
+
+			go server.Run()
+			defer server.Shutdown(context.Background())
+
+			var conn net.Conn
+			for i := 0; i < 50; i++ {
+				conn, err = net.Dial("tcp", tc.bind)
+				if err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			// the header is sent once per connection, before the bytes of the client
+			_, err = conn.Write([]byte("PING\n"))
+			assert.NoError(t, err)
+
+			r := bufio.NewReader(conn)
+			line, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%s %s %s\n", tc.version, conn.LocalAddr(), tc.bind), line)
+
+			line, err = r.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "PING\n", line)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		err := validateUpstream("redis", config.UpstreamOptions{
+			Strategy:      config.RoundRobinStrategy,
+			ProxyProtocol: "v3",
+		})
+		assert.Error(t, err)
+
+		// the header is sent by the http/1.1 client of the proxy
+		opts := config.Options{
+			Upstreams: map[string]config.UpstreamOptions{"v1": opts.Upstreams["v1"]},
+		}
+		err = validateService(opts, "orders", config.ServiceOptions{Url: "https://v1", Protocol: config.ProtocolHTTP3})
+		assert.ErrorContains(t, err, "proxy_protocol isn't supported by protocol http3")
+	})
+}
@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"http-benchmark/pkg/config"
+)
+
+const defaultTLSSessionCacheSize = 128
+
+func validateTLSSessionCache(opts config.TLSSessionCacheOptions) error {
+	if opts.Size < 0 {
+		return fmt.Errorf("tls_session_cache size can't be negative")
+	}
+	return nil
+}
+
+// newTLSSessionCache is shared by the https targets of an upstream, so a new connection to a target resumes
+// the session of the last one instead of a full handshake. The sessions are keyed by the server name.
+func newTLSSessionCache(opts config.TLSSessionCacheOptions) tls.ClientSessionCache {
+	if opts.Enabled != nil && !*opts.Enabled {
+		// the client of hertz adds a cache when it is nil
+		return noTLSSessionCache{}
+	}
+
+	size := opts.Size
+	if size == 0 {
+		size = defaultTLSSessionCacheSize
+	}
+	return tls.NewLRUClientSessionCache(size)
+}
+
+type noTLSSessionCache struct{}
+
+func (noTLSSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return nil, false
+}
+
+func (noTLSSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSSessionCache(t *testing.T) {
+	var handshakes, resumed atomic.Int32
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS.DidResume {
+			resumed.Add(1)
+		} else {
+			handshakes.Add(1)
+		}
+
+		// every request dials a new connection
+		w.Header().Set("Connection", "close")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	target := strings.TrimPrefix(backend.URL, "https://")
+	disabled := false
+
+	tests := []struct {
+		name       string
+		opts       config.TLSSessionCacheOptions
+		handshakes int32
+		resumed    int32
+	}{
+		{name: "enabled by default", opts: config.TLSSessionCacheOptions{}, handshakes: 1, resumed: 4},
+		{name: "disabled", opts: config.TLSSessionCacheOptions{Enabled: &disabled}, handshakes: 5, resumed: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshakes.Store(0)
+			resumed.Store(0)
+
+			bifrost := &Bifrost{
+				opts: &config.Options{
+					Upstreams: map[string]config.UpstreamOptions{
+						"secure": {
+							Strategy:        config.RoundRobinStrategy,
+							Targets:         []config.TargetOptions{{Target: target}},
+							TLSSessionCache: tt.opts,
+						},
+					},
+				},
+			}
+
+			service, err := newService(bifrost, config.ServiceOptions{
+				ID:  "secure",
+				Url: "https://secure",
+			})
+			assert.NoError(t, err)
+
+			for i := 0; i < 5; i++ {
+				hzCtx := app.NewContext(0)
+				hzCtx.Request.SetRequestURI("http://localhost/")
+				service.ServeHTTP(context.Background(), hzCtx)
+				assert.Equal(t, 200, hzCtx.Response.StatusCode())
+			}
+
+			assert.Equal(t, tt.handshakes, handshakes.Load())
+			assert.Equal(t, tt.resumed, resumed.Load())
+		})
+	}
+
+	t.Run("invalid size", func(t *testing.T) {
+		err := validateTLSSessionCache(config.TLSSessionCacheOptions{Size: -1})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"log/slog"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/hertz-contrib/obs-opentelemetry/provider"
+	hertztracing "github.com/hertz-contrib/obs-opentelemetry/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultTracingServiceName = "bifrost"
+
+// newTracingSampler samples sample_rate of the new traces. A request with a traceparent keeps the decision
+// of the caller, so the gateway and the upstreams agree on the whole call tree.
+func newTracingSampler(opts config.TracingOptions) sdktrace.Sampler {
+	rate := opts.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+
+	return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(rate))
+}
+
+// newTracingProviderOptions returns the options of the opentelemetry provider, the spans are exported with otlp grpc
+func newTracingProviderOptions(opts config.TracingOptions) []provider.Option {
+	serviceName := opts.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = defaultTracingServiceName
+	}
+
+	providerOpts := []provider.Option{
+		provider.WithEnableMetrics(opts.Metrics),
+		provider.WithServiceName(serviceName),
+		provider.WithSampler(newTracingSampler(opts)),
+	}
+
+	grpcOpts := opts.OTLP.GRPC
+	if len(grpcOpts.Endpoint) > 0 {
+		providerOpts = append(providerOpts, provider.WithExportEndpoint(grpcOpts.Endpoint))
+	}
+	if grpcOpts.Insecure {
+		providerOpts = append(providerOpts, provider.WithInsecure())
+	}
+	if len(grpcOpts.Headers) > 0 {
+		providerOpts = append(providerOpts, provider.WithHeaders(grpcOpts.Headers))
+	}
+
+	return providerOpts
+}
+
+// newTracingProvider sets the global tracer provider, it is only created once because the exporters aren't reloaded
+func newTracingProvider(opts config.TracingOptions) provider.OtelProvider {
+	if len(opts.OTLP.HTTP.Endpoint) > 0 && len(opts.OTLP.GRPC.Endpoint) == 0 {
+		slog.Warn("tracing: otlp http exporter is not supported, the spans are exported with otlp grpc", "endpoint", opts.OTLP.HTTP.Endpoint)
+	}
+
+	return provider.NewOpenTelemetryProvider(newTracingProviderOptions(opts)...)
+}
+
+// setUpstreamSpanAttributes adds the selected upstream, the targets, the retries and the upstream status to the
+// server span of the request
+func setUpstreamSpanAttributes(c context.Context, ctx *app.RequestContext) {
+	span := trace.SpanFromContext(c)
+	if !span.IsRecording() {
+		return
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("bifrost.upstream.addr", ctx.GetString(config.UPSTREAM_ADDR)),
+		attribute.Int("bifrost.upstream.retry_count", ctx.GetInt(retryCountKey)),
+	}
+
+	if upstreamID := ctx.GetString(config.UPSTREAM); len(upstreamID) > 0 {
+		attrs = append(attrs, attribute.String("bifrost.upstream.id", upstreamID))
+	}
+
+	if status, ok := ctx.Get(config.UPSTREAM_STATUS); ok {
+		if code, ok := status.(int); ok {
+			attrs = append(attrs, attribute.Int("bifrost.upstream.status", code))
+		}
+	}
+
+	span.SetAttributes(attrs...)
+}
+
+// tracingClientMiddleware creates a client span for the sampled requests. The requests which are not sampled
+// get the traceparent of the gateway with the sampled flag unset, so the upstream doesn't decide again.
+func tracingClientMiddleware() client.Middleware {
+	tracing := hertztracing.ClientMiddleware()
+
+	return func(next client.Endpoint) client.Endpoint {
+		traced := tracing(next)
+
+		return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			spanCtx := trace.SpanContextFromContext(ctx)
+			if spanCtx.IsValid() && !spanCtx.IsSampled() {
+				otel.GetTextMapPropagator().Inject(ctx, (*headerCarrier)(&req.Header))
+				return next(ctx, req, resp)
+			}
+
+			return traced(ctx, req, resp)
+		}
+	}
+}
+
+var _ propagation.TextMapCarrier = &headerCarrier{}
+
+type headerCarrier protocol.RequestHeader
+
+func (h *headerCarrier) Get(key string) string {
+	return (*protocol.RequestHeader)(h).Get(key)
+}
+
+func (h *headerCarrier) Set(key, value string) {
+	(*protocol.RequestHeader)(h).Set(key, value)
+}
+
+func (h *headerCarrier) Keys() []string {
+	keys := make([]string, 0)
+	(*protocol.RequestHeader)(h).VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
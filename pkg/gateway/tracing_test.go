@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingSampledFlag(t *testing.T) {
+	traceparents := make(chan string, 1)
+
+	r := server.New(server.WithHostPorts("127.0.0.1:9907"))
+	r.GET("/*path", func(cc context.Context, ctx *app.RequestContext) {
+		traceparents <- string(ctx.Request.Header.Peek("traceparent"))
+		ctx.String(200, "ok")
+	})
+	go r.Spin()
+	time.Sleep(time.Second)
+
+	oldProvider := otel.GetTracerProvider()
+	oldPropagator := otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	}()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	proxy, err := newProxy("http://127.0.0.1:9907", true, 1, client.WithDialTimeout(time.Second))
+	assert.NoError(t, err)
+
+	serve := func(sampleRate float64, parent trace.SpanContext) (trace.SpanContext, string) {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(newTracingSampler(config.TracingOptions{SampleRate: sampleRate})),
+		))
+
+		c := context.Background()
+		if parent.IsValid() {
+			c = trace.ContextWithRemoteSpanContext(c, parent)
+		}
+		c, span := otel.Tracer("test").Start(c, "server")
+		defer span.End()
+
+		ctx := app.NewContext(0)
+		ctx.Request.SetRequestURI("http://localhost/orders")
+		proxy.ServeHTTP(c, ctx)
+		assert.Equal(t, 200, ctx.Response.StatusCode())
+
+		return span.SpanContext(), <-traceparents
+	}
+
+	parent := func(flags trace.TraceFlags) trace.SpanContext {
+		return trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+			SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+			TraceFlags: flags,
+			Remote:     true,
+		})
+	}
+
+	t.Run("sampled", func(t *testing.T) {
+		spanCtx, traceparent := serve(1, trace.SpanContext{})
+		assert.True(t, spanCtx.IsSampled())
+		assert.Regexp(t, "^00-"+spanCtx.TraceID().String()+"-[0-9a-f]{16}-01$", traceparent)
+	})
+
+	t.Run("not sampled", func(t *testing.T) {
+		spanCtx, traceparent := serve(0.000000001, trace.SpanContext{})
+		assert.False(t, spanCtx.IsSampled())
+		assert.Equal(t, "00-"+spanCtx.TraceID().String()+"-"+spanCtx.SpanID().String()+"-00", traceparent)
+	})
+
+	t.Run("sampled by the caller", func(t *testing.T) {
+		spanCtx, traceparent := serve(0.000000001, parent(trace.FlagsSampled))
+		assert.True(t, spanCtx.IsSampled())
+		assert.Regexp(t, "^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$", traceparent)
+	})
+
+	t.Run("not sampled by the caller", func(t *testing.T) {
+		spanCtx, traceparent := serve(1, parent(0))
+		assert.False(t, spanCtx.IsSampled())
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+spanCtx.SpanID().String()+"-00", traceparent)
+	})
+}
+
+func TestUpstreamSpanAttributes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	c, span := tracerProvider.Tracer("test").Start(context.Background(), "server")
+
+	ctx := app.NewContext(0)
+	ctx.Set(config.UPSTREAM, "orders")
+	ctx.Set(config.UPSTREAM_ADDR, "127.0.0.1:8001, 127.0.0.1:8002")
+	ctx.Set(config.UPSTREAM_STATUS, 503)
+	ctx.Set(retryCountKey, 1)
+
+	setUpstreamSpanAttributes(c, ctx)
+	span.End()
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.ElementsMatch(t, []attribute.KeyValue{
+			attribute.String("bifrost.upstream.id", "orders"),
+			attribute.String("bifrost.upstream.addr", "127.0.0.1:8001, 127.0.0.1:8002"),
+			attribute.Int("bifrost.upstream.retry_count", 1),
+			attribute.Int("bifrost.upstream.status", 503),
+		}, spans[0].Attributes())
+	}
+
+	// the requests without a recording span are skipped
+	assert.NotPanics(t, func() {
+		setUpstreamSpanAttributes(context.Background(), app.NewContext(0))
+	})
+}
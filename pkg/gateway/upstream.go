@@ -1,31 +1,56 @@
 package gateway
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
-	"hash"
 	"hash/fnv"
 	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	hzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/rs/dnscache"
 )
 
+const (
+	unixScheme        = "unix://"
+	unixSyntheticHost = "localhost"
+)
+
 type Upstream struct {
-	opts        *config.UpstreamOptions
-	proxies     []*Proxy
+	opts    *config.UpstreamOptions
+	proxies []*Proxy
+	// current replaces proxies when the targets are changed after the upstream is created, by dns discovery
+	// or by a reload which keeps the unchanged targets
+	current     atomic.Pointer[[]*Proxy]
 	counter     atomic.Uint64
 	totalWeight int
-	hasher      hash.Hash32
 	rng         *rand.Rand
+	outlier     *outlierDetector
+	retryBudget *retryBudget
+
+	// tlsSessionCache is shared by the https targets, see tls_session_cache
+	tlsSessionCache tls.ClientSessionCache
+
+	// doneCh is closed when the engine of the upstream is replaced by a reload or shut down, it stops the
+	// background tasks of the upstream
+	doneCh   chan bool
+	doneOnce sync.Once
 }
 
 func newDefaultClientOptions() []hzconfig.ClientOption {
@@ -41,6 +66,45 @@ func newDefaultClientOptions() []hzconfig.ClientOption {
 	}
 }
 
+// newPoolClientOptions returns the connection reuse settings of the target and the upstream, they are appended
+// after the client options of the service, so they override the settings of the service
+func newPoolClientOptions(serviceOpts config.ServiceOptions, opts config.UpstreamOptions, targetOpts config.TargetOptions) []hzconfig.ClientOption {
+	clientOpts := []hzconfig.ClientOption{}
+
+	if maxIdleConns := cmp.Or(targetOpts.MaxIdleConnsPerHost, opts.MaxIdleConnsPerHost); maxIdleConns != nil {
+		clientOpts = append(clientOpts, client.WithMaxConnsPerHost(*maxIdleConns))
+	}
+
+	if duration := cmp.Or(targetOpts.MaxIdleConnDuration, opts.MaxIdleConnDuration); duration > 0 {
+		clientOpts = append(clientOpts, client.WithMaxIdleConnDuration(duration))
+	}
+
+	clientOpts = append(clientOpts, client.WithKeepAlive(!keepaliveDisabled(serviceOpts, opts, targetOpts)))
+
+	return clientOpts
+}
+
+// keepaliveDisabled resolves disable_keepalive, the setting of the target overrides the one of the upstream, which
+// overrides the one of the service. Keepalive is enabled when none of them sets it.
+func keepaliveDisabled(serviceOpts config.ServiceOptions, opts config.UpstreamOptions, targetOpts config.TargetOptions) bool {
+	if disabled := cmp.Or(targetOpts.DisableKeepalive, opts.DisableKeepalive, serviceOpts.DisableKeepalive); disabled != nil {
+		return *disabled
+	}
+	return false
+}
+
+func validateConnPool(maxIdleConnsPerHost *int, maxIdleConnDuration time.Duration) error {
+	if maxIdleConnsPerHost != nil && *maxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns_per_host can't be negative")
+	}
+
+	if maxIdleConnDuration < 0 {
+		return fmt.Errorf("max_idle_conn_duration can't be negative")
+	}
+
+	return nil
+}
+
 func loadUpstreams(bifrost *Bifrost, serviceOpts config.ServiceOptions) (map[string]*Upstream, error) {
 	upstreams := map[string]*Upstream{}
 
@@ -49,6 +113,9 @@ func loadUpstreams(bifrost *Bifrost, serviceOpts config.ServiceOptions) (map[str
 
 		upstream, err := newUpstream(bifrost, serviceOpts, upstreamOpts)
 		if err != nil {
+			for _, upstream := range upstreams {
+				upstream.stop()
+			}
 			return nil, err
 		}
 
@@ -70,55 +137,82 @@ func newUpstream(bifrost *Bifrost, serviceOpts config.ServiceOptions, opts confi
 	}
 
 	// direct proxy
-	clientOpts := newDefaultClientOptions()
-
-	if serviceOpts.Timeout.DailTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithDialTimeout(serviceOpts.Timeout.DailTimeout))
-	}
+	clientOpts := newServiceClientOptions(serviceOpts)
 
-	if serviceOpts.Timeout.ReadTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithClientReadTimeout(serviceOpts.Timeout.ReadTimeout))
+	// the source address of the upstream overrides the one of the service
+	sourceAddr := serviceOpts.SourceAddr
+	if len(opts.SourceAddr) > 0 {
+		sourceAddr = opts.SourceAddr
 	}
 
-	if serviceOpts.Timeout.WriteTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithWriteTimeout(serviceOpts.Timeout.WriteTimeout))
+	var localDialer network.Dialer
+	if len(sourceAddr) > 0 {
+		var err error
+		localDialer, err = newSourceDialer(sourceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream '%s' %w", opts.ID, err)
+		}
+		clientOpts = append(clientOpts, client.WithDialer(localDialer))
 	}
 
-	if serviceOpts.Timeout.MaxConnWaitTimeout > 0 {
-		clientOpts = append(clientOpts, client.WithMaxConnWaitTimeout(serviceOpts.Timeout.MaxConnWaitTimeout))
+	upstream := &Upstream{
+		opts:            &opts,
+		proxies:         make([]*Proxy, 0),
+		rng:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		tlsSessionCache: newTLSSessionCache(opts.TLSSessionCache),
+		doneCh:          make(chan bool),
 	}
 
-	if serviceOpts.MaxIdleConnsPerHost != nil {
-		clientOpts = append(clientOpts, client.WithMaxConnsPerHost(*serviceOpts.MaxIdleConnsPerHost))
-	}
+	var discovery *dnsDiscovery
+	if opts.DNSDiscovery {
+		addr, err := url.Parse(serviceOpts.Url)
+		if err != nil {
+			return nil, err
+		}
 
-	upstream := &Upstream{
-		opts:    &opts,
-		proxies: make([]*Proxy, 0),
-		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
-		hasher:  fnv.New32a(),
+		discovery = &dnsDiscovery{
+			upstream:       upstream,
+			resolver:       newDiscoveryResolver(bifrost.resolver),
+			scheme:         strings.ToLower(addr.Scheme),
+			path:           addr.Path,
+			tlsVerify:      serviceOpts.TLSVerify,
+			serviceOpts:    serviceOpts,
+			tracingEnabled: bifrost.opts.Tracing.Enabled,
+			clientOpts:     append(slices.Clone(clientOpts), newPoolClientOptions(serviceOpts, opts, config.TargetOptions{})...),
+			sourceDialer:   localDialer,
+		}
 	}
 
 	for _, targetOpts := range opts.Targets {
 
-		if opts.Strategy == config.WeightedStrategy && targetOpts.Weight == 0 {
-			return nil, fmt.Errorf("weight can't be 0. upstream id: %s, target: %s", opts.ID, targetOpts.Target)
+		if targetOpts.Weight < 0 {
+			return nil, fmt.Errorf("weight can't be negative. upstream id: %s, target: %s", opts.ID, targetOpts.Target)
 		}
 
 		upstream.totalWeight += targetOpts.Weight
 
-		targetHost, targetPort, err := net.SplitHostPort(targetOpts.Target)
-		if err != nil {
-			targetHost = targetOpts.Target
-		}
+		// every target has its own options, the dialer of a target must not be inherited by the next target
+		targetClientOpts := append(slices.Clone(clientOpts), newPoolClientOptions(serviceOpts, opts, targetOpts)...)
 
-		var dnsResolver dnscache.DNSResolver
-		if allowDNS(targetHost) {
-			_, err := bifrost.resolver.LookupHost(context.Background(), targetHost)
+		if socketPath, ok := unixSocketPath(targetOpts.Target); ok {
+			addr, err := url.Parse(serviceOpts.Url)
 			if err != nil {
-				return nil, fmt.Errorf("lookup upstream host error: %v", err)
+				return nil, err
 			}
-			dnsResolver = bifrost.resolver
+
+			proxy, err := newUnixProxy(socketPath, addr.Path, bifrost.opts.Tracing.Enabled, targetOpts.Weight, proxyProtocolOf(opts, targetOpts), targetClientOpts)
+			if err != nil {
+				return nil, err
+			}
+			proxy.hostHeader = upstreamHostHeader(serviceOpts, targetOpts, unixSyntheticHost)
+			proxy.SetErrorHandler(newErrorHandler(serviceOpts))
+			upstream.proxies = append(upstream.proxies, proxy)
+			continue
+		}
+
+		targetHost, targetPort, err := net.SplitHostPort(targetOpts.Target)
+		if err != nil {
+			targetHost = targetOpts.Target
 		}
 
 		addr, err := url.Parse(serviceOpts.Url)
@@ -131,17 +225,47 @@ func newUpstream(bifrost *Bifrost, serviceOpts config.ServiceOptions, opts confi
 			port = addr.Port()
 		}
 
+		if discovery != nil && allowDNS(targetHost) {
+			hostPort := targetHost
+			if port != "" {
+				hostPort = net.JoinHostPort(targetHost, port)
+			}
+
+			discovery.targets = append(discovery.targets, discoveryTarget{
+				host:          targetHost,
+				port:          port,
+				weight:        targetOpts.Weight,
+				hostHeader:    upstreamHostHeader(serviceOpts, targetOpts, hostPort),
+				proxyProtocol: proxyProtocolOf(opts, targetOpts),
+			})
+			continue
+		}
+
+		var dnsResolver dnscache.DNSResolver
+		if allowDNS(targetHost) {
+			_, err := bifrost.resolver.LookupHost(context.Background(), targetHost)
+			if err != nil {
+				return nil, fmt.Errorf("lookup upstream host error: %v", err)
+			}
+			dnsResolver = bifrost.resolver
+		}
+
 		switch strings.ToLower(addr.Scheme) {
 		case "http":
 			if dnsResolver != nil {
-				clientOpts = append(clientOpts, client.WithDialer(newHTTPDialer(dnsResolver)))
+				targetClientOpts = append(targetClientOpts, client.WithDialer(newHTTPDialer(dnsResolver, localDialer)))
 			}
 		case "https":
+			targetClientOpts = append(targetClientOpts, client.WithTLSConfig(&tls.Config{
+				InsecureSkipVerify: !serviceOpts.TLSVerify,
+				ClientSessionCache: upstream.tlsSessionCache,
+			}))
+
+			// the tls config option resets the dialer of the client
 			if dnsResolver != nil {
-				clientOpts = append(clientOpts, client.WithTLSConfig(&tls.Config{
-					InsecureSkipVerify: !serviceOpts.TLSVerify,
-				}))
-				clientOpts = append(clientOpts, client.WithDialer(newHTTPSDialer(dnsResolver)))
+				targetClientOpts = append(targetClientOpts, client.WithDialer(newHTTPSDialer(dnsResolver, localDialer)))
+			} else if localDialer != nil {
+				targetClientOpts = append(targetClientOpts, client.WithDialer(localDialer))
 			}
 		}
 
@@ -151,14 +275,51 @@ func newUpstream(bifrost *Bifrost, serviceOpts config.ServiceOptions, opts confi
 			url = fmt.Sprintf("%s://%s:%s%s", addr.Scheme, targetHost, port, addr.Path)
 		}
 
-		proxy, err := newProxy(url, bifrost.opts.Tracing.Enabled, targetOpts.Weight, clientOpts...)
+		proxy, err := newProxy(url, bifrost.opts.Tracing.Enabled, targetOpts.Weight, targetClientOpts...)
 
 		if err != nil {
 			return nil, err
 		}
+		proxy.hostHeader = upstreamHostHeader(serviceOpts, targetOpts, proxy.targetHost)
+		proxy.SetErrorHandler(newErrorHandler(serviceOpts))
+
+		if serviceOpts.Protocol == config.ProtocolHTTP3 {
+			if err := proxy.enableHTTP3(serviceOpts, targetHost, bifrost.opts.Tracing.Enabled, targetClientOpts); err != nil {
+				return nil, err
+			}
+		}
+
+		if serviceOpts.Protocol == config.ProtocolGRPC {
+			if err := proxy.enableGRPC(serviceOpts, targetHost, bifrost.opts.Tracing.Enabled, targetClientOpts); err != nil {
+				return nil, err
+			}
+		}
+
+		proxy.enableProxyProtocol(proxyProtocolOf(opts, targetOpts), bifrost.opts.Tracing.Enabled, targetClientOpts)
 		upstream.proxies = append(upstream.proxies, proxy)
 	}
 
+	if opts.Strategy == config.WeightedStrategy && upstream.totalWeight == 0 {
+		return nil, fmt.Errorf("weight of all targets can't be 0. upstream id: %s", opts.ID)
+	}
+
+	if discovery != nil && len(discovery.targets) > 0 {
+		err := discovery.refresh(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		discovery.watch(opts.DNSRefreshInterval, upstream.doneCh)
+	}
+
+	if opts.OutlierDetection.Enabled {
+		upstream.outlier = newOutlierDetector(upstream, opts.OutlierDetection)
+		upstream.outlier.watch()
+	}
+
+	if opts.RetryBudget.Enabled {
+		upstream.retryBudget = newRetryBudget(opts.RetryBudget)
+	}
+
 	if opts.Strategy == config.RoundRobinStrategy {
 		go func() {
 			t := time.NewTimer(5 * time.Minute)
@@ -166,7 +327,7 @@ func newUpstream(bifrost *Bifrost, serviceOpts config.ServiceOptions, opts confi
 
 			for {
 				select {
-				case <-bifrost.stopCh:
+				case <-upstream.doneCh:
 					return
 				case <-t.C:
 					upstream.counter.Store(0)
@@ -178,52 +339,425 @@ func newUpstream(bifrost *Bifrost, serviceOpts config.ServiceOptions, opts confi
 	return upstream, nil
 }
 
-func (u *Upstream) roundRobin() *Proxy {
-	if len(u.proxies) == 1 {
-		return u.proxies[0]
+// stop stops the background tasks of the upstream, the proxies kept by the upstream of a reload are not affected
+func (u *Upstream) stop() {
+	u.doneOnce.Do(func() {
+		if u.doneCh != nil {
+			close(u.doneCh)
+		}
+	})
+
+	if u.outlier != nil {
+		u.outlier.stop()
+	}
+}
+
+// reuseProxies keeps the proxies of the old upstream for the targets which are not changed by a reload, so their
+// keep-alive connections, drained and ejected states are kept and the order of the targets used by hashing is
+// stable. The weight of a kept target is updated in place. Both upstreams must belong to the same service with
+// the same options, upstreams with dns discovery are not reused. It returns the number of the kept targets.
+func (u *Upstream) reuseProxies(old *Upstream) int {
+	if u.opts.DNSDiscovery || old.opts.DNSDiscovery {
+		return 0
+	}
+
+	if !sameUpstreamOptions(*old.opts, *u.opts) {
+		return 0
+	}
+
+	oldProxies := old.targets()
+	if len(oldProxies) != len(old.opts.Targets) || len(u.proxies) != len(u.opts.Targets) {
+		return 0
+	}
+
+	proxies := slices.Clone(u.proxies)
+	used := make([]bool, len(oldProxies))
+	kept := 0
+
+	for i, targetOpts := range u.opts.Targets {
+		for j, oldTargetOpts := range old.opts.Targets {
+			if used[j] || !sameTargetOptions(oldTargetOpts, targetOpts) {
+				continue
+			}
+
+			used[j] = true
+			oldProxies[j].weight.Store(int64(targetOpts.Weight))
+			proxies[i] = oldProxies[j]
+			kept++
+			break
+		}
+	}
+
+	if kept > 0 {
+		u.current.Store(&proxies)
+
+		if old.outlier != nil {
+			old.outlier.stop()
+		}
+	}
+
+	return kept
+}
+
+// sameUpstreamOptions reports whether the upstreams only differ in their targets
+func sameUpstreamOptions(a, b config.UpstreamOptions) bool {
+	a.Targets = nil
+	b.Targets = nil
+	return reflect.DeepEqual(a, b)
+}
+
+// sameTargetOptions reports whether the targets only differ in their weights
+func sameTargetOptions(a, b config.TargetOptions) bool {
+	a.Weight = 0
+	b.Weight = 0
+	return reflect.DeepEqual(a, b)
+}
+
+// targets returns the proxies in rotation, including proxies created by dns discovery or kept by a reload
+func (u *Upstream) targets() []*Proxy {
+	if proxies := u.current.Load(); proxies != nil {
+		return *proxies
+	}
+	return u.proxies
+}
+
+// selection records how a target was selected, it is only formatted when selection debugging is enabled
+type selection struct {
+	strategy config.UpstreamStrategy
+	index    int
+	skipped  int
+	weight   int
+	total    int
+	hash     uint32
+	key      string
+}
+
+func (s selection) reason(count int) string {
+	var reason string
+
+	switch {
+	case s.index < 0:
+		return fmt.Sprintf("%s: no available target in %d targets", s.strategy, count)
+	case count == 1:
+		reason = fmt.Sprintf("%s: single target", s.strategy)
+	case s.strategy == config.WeightedStrategy:
+		reason = fmt.Sprintf("%s: random weight %d of total weight %d selected index %d", s.strategy, s.weight, s.total, s.index)
+	case s.strategy == config.HashingStrategy:
+		reason = fmt.Sprintf("%s: key '%s' hash %d selected index %d of %d", s.strategy, s.key, s.hash, s.index, count)
+	default:
+		reason = fmt.Sprintf("%s: selected index %d of %d", s.strategy, s.index, count)
+	}
+
+	if s.skipped > 0 {
+		reason = fmt.Sprintf("%s, skipped %d unavailable targets", reason, s.skipped)
 	}
 
-	index := u.counter.Add(1)
-	proxy := u.proxies[(int(index)-1)%len(u.proxies)]
+	return reason
+}
+
+func (u *Upstream) roundRobin() *Proxy {
+	proxy, _ := u.roundRobinSelect()
 	return proxy
 }
 
+func (u *Upstream) roundRobinSelect() (*Proxy, selection) {
+	proxies := u.targets()
+
+	if len(proxies) == 1 {
+		return u.availableProxy(proxies, 0, selection{strategy: config.RoundRobinStrategy})
+	}
+
+	sel := selection{strategy: config.RoundRobinStrategy}
+
+	for i := 0; i < len(proxies); i++ {
+		index := u.counter.Add(1)
+		sel.index = (int(index) - 1) % len(proxies)
+		proxy := proxies[sel.index]
+		if proxy.isAvailable() {
+			return proxy, sel
+		}
+		sel.skipped++
+	}
+
+	sel.index = -1
+	return nil, sel
+}
+
 func (u *Upstream) weighted() *Proxy {
-	if len(u.proxies) == 1 {
-		return u.proxies[0]
+	proxy, _ := u.weightedSelect()
+	return proxy
+}
+
+// weightedSelect selects a target randomly by weight. A target with weight 0 is drained, it is never selected
+// but stays in the upstream, so it can be drained by config without removing it.
+func (u *Upstream) weightedSelect() (*Proxy, selection) {
+	proxies := u.targets()
+
+	if len(proxies) == 1 && proxies[0].weight.Load() > 0 {
+		return u.availableProxy(proxies, 0, selection{strategy: config.WeightedStrategy})
+	}
+
+	sel := selection{strategy: config.WeightedStrategy, index: -1}
+
+	for _, proxy := range proxies {
+		if weight := int(proxy.weight.Load()); proxy.isAvailable() && weight > 0 {
+			sel.total += weight
+		} else {
+			sel.skipped++
+		}
+	}
+
+	if sel.total == 0 {
+		return nil, sel
 	}
 
-	randomWeight := u.rng.Intn(u.totalWeight)
+	sel.weight = u.rng.Intn(sel.total)
+	randomWeight := sel.weight
 
-	for _, proxy := range u.proxies {
-		randomWeight -= proxy.weight
+	// the weights can be changed by a reload between the two loops, the last target is selected when the
+	// random weight is left over
+	var last *Proxy
+	for i, proxy := range proxies {
+		weight := int(proxy.weight.Load())
+		if !proxy.isAvailable() || weight <= 0 {
+			continue
+		}
+
+		last = proxy
+		sel.index = i
+		randomWeight -= weight
 		if randomWeight < 0 {
-			return proxy
+			return proxy, sel
 		}
 	}
 
-	return nil
+	return last, sel
 }
 
 func (u *Upstream) random() *Proxy {
-	if len(u.proxies) == 1 {
-		return u.proxies[0]
+	proxy, _ := u.randomSelect()
+	return proxy
+}
+
+func (u *Upstream) randomSelect() (*Proxy, selection) {
+	proxies := u.targets()
+
+	if len(proxies) == 1 {
+		return u.availableProxy(proxies, 0, selection{strategy: config.RandomStrategy})
 	}
 
-	selectedIndex := u.rng.Intn(len(u.proxies))
-	return u.proxies[selectedIndex]
+	selectedIndex := u.rng.Intn(len(proxies))
+	return u.availableProxy(proxies, selectedIndex, selection{strategy: config.RandomStrategy})
 }
 
 func (u *Upstream) hasing(key string) *Proxy {
-	if len(u.proxies) == 1 {
-		return u.proxies[0]
+	proxy, _ := u.hashingSelect(key)
+	return proxy
+}
+
+func (u *Upstream) hashingSelect(key string) (*Proxy, selection) {
+	proxies := u.targets()
+
+	if len(proxies) == 1 {
+		return u.availableProxy(proxies, 0, selection{strategy: config.HashingStrategy, key: key})
+	}
+
+	// a new hasher per key keeps the target of a key stable, and it is not shared by concurrent requests
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(key))
+	hashValue := hasher.Sum32()
+
+	selectedIndex := int(hashValue) % len(proxies)
+	return u.availableProxy(proxies, selectedIndex, selection{strategy: config.HashingStrategy, key: key, hash: hashValue})
+}
+
+// pick selects a target with the strategy of the upstream
+func (u *Upstream) pick(ctx *app.RequestContext) (*Proxy, selection) {
+	switch u.opts.Strategy {
+	case config.WeightedStrategy:
+		return u.weightedSelect()
+	case config.RandomStrategy:
+		return u.randomSelect()
+	case config.HashingStrategy:
+		return u.hashingSelect(ctx.GetString(u.opts.HashOn))
+	default:
+		return u.roundRobinSelect()
+	}
+}
+
+// logSelection exposes why the target was selected as $upstream_selected_reason and writes a sampled debug log
+func (u *Upstream) logSelection(c context.Context, ctx *app.RequestContext, proxy *Proxy, sel selection) {
+	if !u.opts.Debug.Enabled {
+		return
+	}
+
+	reason := sel.reason(len(u.targets()))
+	ctx.Set(config.UPSTREAM_SELECTED_REASON, reason)
+
+	sampleRate := u.opts.Debug.SampleRate
+	if sampleRate > 0 && rand.Float64() >= sampleRate {
+		return
+	}
+
+	target := ""
+	if proxy != nil {
+		target = proxy.targetHost
 	}
 
-	u.hasher.Write([]byte(key))
-	hashValue := u.hasher.Sum32()
+	logger := log.FromContext(c)
+	logger.DebugContext(c, "upstream target selected",
+		slog.String("upstream", u.opts.ID),
+		slog.String("target", target),
+		slog.String("reason", reason),
+	)
+}
+
+// availableProxy returns the proxy at index, or the next available one when it is drained
+func (u *Upstream) availableProxy(proxies []*Proxy, index int, sel selection) (*Proxy, selection) {
+	for i := 0; i < len(proxies); i++ {
+		sel.index = (index + i) % len(proxies)
+		proxy := proxies[sel.index]
+		if proxy.isAvailable() {
+			return proxy, sel
+		}
+		sel.skipped++
+	}
+
+	sel.index = -1
+	return nil, sel
+}
+
+// DrainTarget stops sending new requests to the target, in-flight requests are allowed to finish.
+func (u *Upstream) DrainTarget(addr string) error {
+	proxy := u.findProxy(addr)
+	if proxy == nil {
+		return fmt.Errorf("target '%s' was not found in upstream '%s'", addr, u.opts.ID)
+	}
+
+	proxy.drained.Store(true)
+
+	if u.isDrained() {
+		slog.Warn("all targets of upstream are drained", "upstream", u.opts.ID, "target", addr)
+	}
+
+	return nil
+}
+
+// EnableTarget puts a drained target back into rotation.
+func (u *Upstream) EnableTarget(addr string) error {
+	proxy := u.findProxy(addr)
+	if proxy == nil {
+		return fmt.Errorf("target '%s' was not found in upstream '%s'", addr, u.opts.ID)
+	}
+
+	proxy.drained.Store(false)
+	return nil
+}
+
+// Simulate runs the selection of strategy for n iterations and returns how many times each target was selected,
+// keyed by target address. No request is sent and the state of the upstream is not changed, the simulation uses
+// its own counter and random source. When strategy is empty, the strategy of the upstream is used.
+// For the hashing strategy, key returns the hash key of the i-th iteration; when key is nil the iteration number is used.
+// Drained targets are skipped like real requests, selections without an available target are not counted.
+func (u *Upstream) Simulate(strategy config.UpstreamStrategy, n int, key func(i int) string) (map[string]int, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("iterations must be greater than 0")
+	}
+
+	if len(strategy) == 0 && u.opts != nil {
+		strategy = u.opts.Strategy
+	}
+
+	sim := &Upstream{
+		opts:    u.opts,
+		proxies: u.targets(),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if key == nil {
+		key = strconv.Itoa
+	}
+
+	var selectFn func(i int) *Proxy
+	switch strategy {
+	case config.RoundRobinStrategy, "":
+		selectFn = func(int) *Proxy { return sim.roundRobin() }
+	case config.WeightedStrategy:
+		selectFn = func(int) *Proxy { return sim.weighted() }
+	case config.RandomStrategy:
+		selectFn = func(int) *Proxy { return sim.random() }
+	case config.HashingStrategy:
+		selectFn = func(i int) *Proxy { return sim.hasing(key(i)) }
+	default:
+		return nil, fmt.Errorf("strategy '%s' is invalid", strategy)
+	}
+
+	histogram := make(map[string]int, len(sim.proxies))
+	for _, proxy := range sim.proxies {
+		histogram[proxy.targetHost] = 0
+	}
+
+	for i := 0; i < n; i++ {
+		proxy := selectFn(i)
+		if proxy == nil {
+			continue
+		}
+		histogram[proxy.targetHost]++
+	}
+
+	return histogram, nil
+}
+
+// isDrained returns true when every target is administratively drained
+func (u *Upstream) isDrained() bool {
+	proxies := u.targets()
+
+	for _, proxy := range proxies {
+		if !proxy.drained.Load() {
+			return false
+		}
+	}
+	return len(proxies) > 0
+}
+
+func (u *Upstream) findProxy(addr string) *Proxy {
+	proxies := u.targets()
+
+	for _, proxy := range proxies {
+		if proxy.targetHost == addr {
+			return proxy
+		}
+
+		host, _, err := net.SplitHostPort(proxy.targetHost)
+		if err == nil && host == addr {
+			return proxy
+		}
+	}
+
+	return nil
+}
+
+// unixSocketPath returns the socket path of targets like unix:///var/run/app.sock
+func unixSocketPath(target string) (string, bool) {
+	if !strings.HasPrefix(target, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(target, unixScheme), true
+}
+
+// newUnixProxy creates a proxy which sends requests over the unix domain socket.
+// The uri of the outgoing request uses localhost as a synthetic host, dns resolution is skipped.
+func newUnixProxy(socketPath string, path string, tracingEnabled bool, weight int, proxyProtocol config.ProxyProtocol, clientOpts []hzconfig.ClientOption) (*Proxy, error) {
+	clientOpts = append(slices.Clone(clientOpts), client.WithDialer(newUnixDialer(socketPath)))
+
+	proxy, err := newProxy("http://"+unixSyntheticHost+path, tracingEnabled, weight, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.targetHost = "unix:" + socketPath
+	proxy.enableProxyProtocol(proxyProtocol, tracingEnabled, clientOpts)
 
-	selectedIndex := int(hashValue) % len(u.proxies)
-	return u.proxies[selectedIndex]
+	return proxy, nil
 }
 
 func allowDNS(address string) bool {
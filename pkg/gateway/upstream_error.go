@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	errs "github.com/cloudwego/hertz/pkg/common/errors"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// the classes of the upstream errors, the class of the last attempt is kept in $upstream_error
+const (
+	upstreamErrorDNS               = "dns_failure"
+	upstreamErrorDialTimeout       = "dial_timeout"
+	upstreamErrorConnectionRefused = "connection_refused"
+	upstreamErrorConnectionReset   = "connection_reset"
+	upstreamErrorTLSHandshake      = "tls_handshake"
+	upstreamErrorReadTimeout       = "read_timeout"
+	upstreamErrorBodyTooLarge      = "body_too_large"
+	upstreamErrorNoFreeConns       = "no_free_conns"
+	upstreamErrorUnknown           = "unknown"
+)
+
+// UpstreamError is an error of the request sent to the upstream, Class tells why the request failed
+// and decides the response status
+type UpstreamError struct {
+	Class string
+	Err   error
+}
+
+func newUpstreamError(err error) *UpstreamError {
+	class := classifyUpstreamError(err)
+	if isUpstreamTimeout(class) {
+		err = fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+
+	return &UpstreamError{Class: class, Err: err}
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the response status of the error, 504 for the timeouts, 503 when the connection pool of the
+// target is exhausted and 502 for the others
+func (e *UpstreamError) Status() int {
+	switch {
+	case isUpstreamTimeout(e.Class):
+		return consts.StatusGatewayTimeout
+	case e.Class == upstreamErrorNoFreeConns:
+		return consts.StatusServiceUnavailable
+	default:
+		return consts.StatusBadGateway
+	}
+}
+
+func isUpstreamTimeout(class string) bool {
+	return class == upstreamErrorDialTimeout || class == upstreamErrorReadTimeout
+}
+
+// upstreamErrorStatus returns the response status of an error passed to the error handler of a proxy
+func upstreamErrorStatus(err error) int {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.Status()
+	}
+
+	if errors.Is(err, ErrUpstreamTimeout) {
+		return consts.StatusGatewayTimeout
+	}
+	return consts.StatusBadGateway
+}
+
+// classifyUpstreamError finds the class of the error returned by the client, the errors are matched by type
+// because the dialers and connections of netpoll and the standard library report them differently
+func classifyUpstreamError(err error) string {
+	var opErr *net.OpError
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, errs.ErrNoFreeConns):
+		return upstreamErrorNoFreeConns
+	case errors.As(err, &dnsErr):
+		return upstreamErrorDNS
+	case isTLSHandshakeError(err):
+		return upstreamErrorTLSHandshake
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return upstreamErrorDialTimeout
+		}
+		return upstreamErrorConnectionRefused
+	case errors.Is(err, errs.ErrTimeout), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return upstreamErrorReadTimeout
+	case errors.Is(err, errs.ErrBodyTooLarge), errors.Is(err, ErrResponseTooLarge):
+		return upstreamErrorBodyTooLarge
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, errs.ErrConnectionClosed), errors.Is(err, errs.ErrBadPoolConn),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return upstreamErrorConnectionReset
+	default:
+		return upstreamErrorUnknown
+	}
+}
+
+// isTLSHandshakeError returns true when the tls or quic handshake with the target fails
+func isTLSHandshakeError(err error) bool {
+	var http3Err *http3HandshakeError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &http3Err) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
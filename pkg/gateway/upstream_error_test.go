@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	errs "github.com/cloudwego/hertz/pkg/common/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamErrors(t *testing.T) {
+	slow := server.New(server.WithHostPorts("127.0.0.1:9930"))
+	slow.GET("/slow", func(c context.Context, ctx *app.RequestContext) {
+		time.Sleep(500 * time.Millisecond)
+		ctx.String(200, "slow")
+	})
+	slow.GET("/large", func(c context.Context, ctx *app.RequestContext) {
+		ctx.String(200, strings.Repeat("a", 1024))
+	})
+	go slow.Spin()
+
+	// the connection is reset in the middle of the response body
+	reset, err := net.Listen("tcp", "127.0.0.1:9931")
+	assert.NoError(t, err)
+	defer reset.Close()
+	go func() {
+		for {
+			conn, err := reset.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Read(make([]byte, 1024))
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\npartial"))
+			time.Sleep(50 * time.Millisecond)
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+		}
+	}()
+
+	// a plaintext server, the tls handshake of the client fails
+	plaintext, err := net.Listen("tcp", "127.0.0.1:9933")
+	assert.NoError(t, err)
+	defer plaintext.Close()
+	go func() {
+		for {
+			conn, err := plaintext.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			_ = conn.Close()
+		}
+	}()
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"plaintext": {
+					Strategy: config.RoundRobinStrategy,
+					Targets:  []config.TargetOptions{{Target: "127.0.0.1:9933"}},
+				},
+			},
+		},
+	}
+
+	serve := func(opts config.ServiceOptions, path string) *app.RequestContext {
+		service, err := newService(bifrost, opts)
+		assert.NoError(t, err)
+
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost" + path)
+		service.ServeHTTP(context.Background(), hzCtx)
+		return hzCtx
+	}
+
+	t.Run("connection refused", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{ID: "orders", Url: "http://127.0.0.1:1"}, "/orders")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorConnectionRefused, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("dial timeout", func(t *testing.T) {
+		// the accept queue of the listener is full, so new connections are never established
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+		assert.NoError(t, err)
+		defer syscall.Close(fd)
+		assert.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Port: 9932, Addr: [4]byte{127, 0, 0, 1}}))
+		assert.NoError(t, syscall.Listen(fd, 0))
+		for i := 0; i < 3; i++ {
+			if conn, err := net.DialTimeout("tcp", "127.0.0.1:9932", 100*time.Millisecond); err == nil {
+				defer conn.Close()
+			}
+		}
+
+		hzCtx := serve(config.ServiceOptions{
+			ID:      "orders",
+			Url:     "http://127.0.0.1:9932",
+			Timeout: config.ServiceTimeoutOptions{DailTimeout: 200 * time.Millisecond},
+		}, "/orders")
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorDialTimeout, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:      "orders",
+			Url:     "http://127.0.0.1:9930",
+			Timeout: config.ServiceTimeoutOptions{ReadTimeout: 100 * time.Millisecond},
+		}, "/slow")
+		assert.Equal(t, 504, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorReadTimeout, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("connection reset", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{ID: "orders", Url: "http://127.0.0.1:9931"}, "/orders")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorConnectionReset, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("tls handshake", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{ID: "orders", Url: "https://plaintext"}, "/orders")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorTLSHandshake, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("dns failure", func(t *testing.T) {
+		for _, resolver := range []*fakeResolver{
+			{err: &net.DNSError{Err: "no such host", Name: "orders.test", IsNotFound: true}},
+			{err: errors.New("server misbehaving")},
+			{},
+		} {
+			proxy, err := newProxy("http://orders.test:9930", false, 1, client.WithDialer(newHTTPDialer(resolver, nil)))
+			assert.NoError(t, err)
+
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/orders")
+			proxy.ServeHTTP(context.Background(), hzCtx)
+			assert.Equal(t, 502, hzCtx.Response.StatusCode())
+			assert.Equal(t, upstreamErrorDNS, hzCtx.GetString(config.UPSTREAM_ERROR))
+		}
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		hzCtx := serve(config.ServiceOptions{
+			ID:                  "orders",
+			Url:                 "http://127.0.0.1:9930",
+			MaxResponseBodySize: 100,
+		}, "/large")
+		assert.Equal(t, 502, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorBodyTooLarge, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+
+	t.Run("no free connections", func(t *testing.T) {
+		maxConns := 1
+		service, err := newService(bifrost, config.ServiceOptions{
+			ID:                  "orders",
+			Url:                 "http://127.0.0.1:9930",
+			MaxIdleConnsPerHost: &maxConns,
+		})
+		assert.NoError(t, err)
+
+		done := make(chan bool)
+		go func() {
+			hzCtx := app.NewContext(0)
+			hzCtx.Request.SetRequestURI("http://localhost/slow")
+			service.ServeHTTP(context.Background(), hzCtx)
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// the only connection is used by the slow request
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/slow")
+		service.ServeHTTP(context.Background(), hzCtx)
+		<-done
+
+		assert.Equal(t, 503, hzCtx.Response.StatusCode())
+		assert.Equal(t, upstreamErrorNoFreeConns, hzCtx.GetString(config.UPSTREAM_ERROR))
+	})
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	cases := map[error]string{
+		errs.ErrNoFreeConns: upstreamErrorNoFreeConns,
+		errs.ErrTimeout:     upstreamErrorReadTimeout,
+		&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "orders", IsNotFound: true}}: upstreamErrorDNS,
+		&net.DNSError{Err: "i/o timeout", Name: "orders", IsTimeout: true}:                                  upstreamErrorDNS,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}:                                                 upstreamErrorConnectionRefused,
+		&dialTimeoutError{err: &net.OpError{Op: "dial", Err: errors.New("i/o timeout")}}:                    upstreamErrorDialTimeout,
+		tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}:                       upstreamErrorTLSHandshake,
+		fmt.Errorf("read: %w", syscall.ECONNRESET):                                                          upstreamErrorConnectionReset,
+		io.ErrUnexpectedEOF:              upstreamErrorConnectionReset,
+		errs.ErrBodyTooLarge:             upstreamErrorBodyTooLarge,
+		errors.New("malformed response"): upstreamErrorUnknown,
+	}
+
+	for err, class := range cases {
+		assert.Equal(t, class, classifyUpstreamError(err), err.Error())
+	}
+
+	assert.Equal(t, 504, newUpstreamError(errs.ErrTimeout).Status())
+	assert.True(t, errors.Is(newUpstreamError(errs.ErrTimeout), ErrUpstreamTimeout))
+	assert.Equal(t, 503, newUpstreamError(errs.ErrNoFreeConns).Status())
+	assert.Equal(t, 502, newUpstreamError(io.ErrUnexpectedEOF).Status())
+}
@@ -1,12 +1,16 @@
 package gateway
 
 import (
-	"hash/fnv"
+	"context"
+	"http-benchmark/pkg/config"
 	"math/rand"
+	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,6 +64,89 @@ func TestWeighted(t *testing.T) {
 	assert.InDelta(t, 3000, hits["http://backend3"], 100)
 }
 
+func TestZeroWeight(t *testing.T) {
+	proxy1, _ := newProxy("http://backend1", false, 0)
+	proxy2, _ := newProxy("http://backend2", false, 1)
+	proxy3, _ := newProxy("http://backend3", false, 3)
+
+	upstream := &Upstream{
+		proxies:     []*Proxy{proxy1, proxy2, proxy3},
+		totalWeight: 4,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	// a target with weight 0 is drained
+	hits := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		proxy := upstream.weighted()
+		assert.NotNil(t, proxy)
+		hits[proxy.target]++
+	}
+	assert.Equal(t, 0, hits["http://backend1"])
+	assert.InDelta(t, 1000, hits["http://backend2"], 100)
+	assert.InDelta(t, 3000, hits["http://backend3"], 100)
+
+	_, sel := upstream.weightedSelect()
+	assert.Regexp(t, `^weighted: random weight \d of total weight 4 selected index [12], skipped 1 unavailable targets$`, sel.reason(3))
+
+	// the remaining targets are drained as well
+	proxy2.drained.Store(true)
+	proxy3.drained.Store(true)
+	proxy, sel := upstream.weightedSelect()
+	assert.Nil(t, proxy)
+	assert.Equal(t, "weighted: no available target in 3 targets", sel.reason(3))
+
+	single := &Upstream{proxies: []*Proxy{proxy1}, rng: rand.New(rand.NewSource(1))}
+	assert.Nil(t, single.weighted())
+
+	// a retry never falls back to a target with weight 0
+	proxy2.drained.Store(false)
+	upstream.opts = &config.UpstreamOptions{Strategy: config.WeightedStrategy}
+	assert.Nil(t, upstream.pickExcluding(&app.RequestContext{}, []*Proxy{proxy2}))
+
+	// weight is only used by the weighted strategy
+	roundRobin := &Upstream{proxies: []*Proxy{proxy1}}
+	assert.Equal(t, proxy1, roundRobin.roundRobin())
+
+	bifrost := &Bifrost{opts: &config.Options{}}
+	_, err := newUpstream(bifrost, config.ServiceOptions{Url: "http://zero"}, config.UpstreamOptions{
+		ID:       "zero",
+		Strategy: config.WeightedStrategy,
+		Targets: []config.TargetOptions{
+			{Target: "127.0.0.1:8001", Weight: 0},
+			{Target: "127.0.0.1:8002", Weight: 1},
+		},
+	})
+	assert.NoError(t, err)
+
+	opts := config.Options{
+		Entries: map[string]config.EntryOptions{
+			"http": {Bind: ":9955"},
+		},
+		Routes: map[string]config.RouteOptions{
+			"all": {Paths: []string{"/"}, ServiceID: "all"},
+		},
+		Upstreams: map[string]config.UpstreamOptions{
+			"zero": {
+				Strategy: config.WeightedStrategy,
+				Targets: []config.TargetOptions{
+					{Target: "127.0.0.1:8001", Weight: 0},
+					{Target: "127.0.0.1:8002", Weight: 0},
+				},
+			},
+		},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "upstream 'zero' weight of all targets can't be 0")
+
+	opts.Upstreams["zero"] = config.UpstreamOptions{
+		Strategy: config.RoundRobinStrategy,
+		Targets:  []config.TargetOptions{{Target: "127.0.0.1:8001", Weight: -1}},
+	}
+	err = validateOptions(opts)
+	assert.ErrorContains(t, err, "upstream 'zero' target '127.0.0.1:8001' weight can't be negative")
+}
+
 func TestRandom(t *testing.T) {
 	proxy1, _ := newProxy("http://backend1", false, 1)
 	proxy2, _ := newProxy("http://backend2", false, 1)
@@ -98,19 +185,302 @@ func TestHashing(t *testing.T) {
 			proxy2,
 			proxy3,
 		},
-		hasher: fnv.New32a(),
 	}
 
 	keys := []string{"key1", "key2", "key3"}
 	expected := map[string]string{
 		"key1": "http://backend3",
-		"key2": "http://backend1",
+		"key2": "http://backend2",
 		"key3": "http://backend1",
 	}
 
-	for _, key := range keys {
-		proxy := upstream.hasing(key)
-		assert.NotNil(t, proxy)
-		assert.Equal(t, expected[key], proxy.target)
+	// a key goes to the same target however many keys were hashed before
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			proxy := upstream.hasing(key)
+			assert.NotNil(t, proxy)
+			assert.Equal(t, expected[key], proxy.target)
+		}
 	}
 }
+
+func TestDrainTarget(t *testing.T) {
+	hits := map[string]*atomic.Int32{
+		"127.0.0.1:9981": {},
+		"127.0.0.1:9982": {},
+	}
+
+	for addr, counter := range hits {
+		counter := counter
+		h := server.New(server.WithHostPorts(addr))
+		h.GET("/drain", func(c context.Context, ctx *app.RequestContext) {
+			counter.Add(1)
+			ctx.String(200, "ok")
+		})
+		h.GET("/drain/slow", func(c context.Context, ctx *app.RequestContext) {
+			time.Sleep(500 * time.Millisecond)
+			ctx.String(200, "slow")
+		})
+		go h.Spin()
+	}
+	time.Sleep(time.Second)
+
+	bifrost := &Bifrost{
+		opts: &config.Options{
+			Upstreams: map[string]config.UpstreamOptions{
+				"drain_upstream": {
+					Strategy: config.RoundRobinStrategy,
+					Targets: []config.TargetOptions{
+						{Target: "127.0.0.1:9981"},
+						{Target: "127.0.0.1:9982"},
+					},
+				},
+			},
+		},
+	}
+
+	service, err := newService(bifrost, config.ServiceOptions{ID: "drain", Url: "http://drain_upstream"})
+	assert.NoError(t, err)
+
+	// the first request goes to the first target and is still in flight when it gets drained
+	slowDone := make(chan *app.RequestContext)
+	go func() {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/drain/slow")
+		service.ServeHTTP(context.Background(), hzCtx)
+		slowDone <- hzCtx
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err = service.upstream.DrainTarget("127.0.0.1:9981")
+	assert.NoError(t, err)
+	assert.Error(t, service.upstream.DrainTarget("127.0.0.1:9999"))
+
+	for i := 0; i < 10; i++ {
+		hzCtx := app.NewContext(0)
+		hzCtx.Request.SetRequestURI("http://localhost/drain")
+		service.ServeHTTP(context.Background(), hzCtx)
+		assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	}
+
+	assert.Equal(t, int32(0), hits["127.0.0.1:9981"].Load())
+	assert.Equal(t, int32(10), hits["127.0.0.1:9982"].Load())
+
+	slowCtx := <-slowDone
+	assert.Equal(t, 200, slowCtx.Response.StatusCode())
+	assert.Equal(t, "slow", string(slowCtx.Response.Body()))
+
+	// all targets are drained
+	err = service.upstream.DrainTarget("127.0.0.1:9982")
+	assert.NoError(t, err)
+
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/drain")
+	service.ServeHTTP(context.Background(), hzCtx)
+	assert.Equal(t, 503, hzCtx.Response.StatusCode())
+
+	err = service.upstream.EnableTarget("127.0.0.1:9981")
+	assert.NoError(t, err)
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/drain")
+	service.ServeHTTP(context.Background(), hzCtx)
+	assert.Equal(t, 200, hzCtx.Response.StatusCode())
+	assert.Equal(t, int32(1), hits["127.0.0.1:9981"].Load())
+}
+
+func TestSelectionReason(t *testing.T) {
+	proxy1, _ := newProxy("http://backend1", false, 1)
+	proxy2, _ := newProxy("http://backend2", false, 2)
+	proxy3, _ := newProxy("http://backend3", false, 3)
+
+	upstream := &Upstream{
+		proxies:     []*Proxy{proxy1, proxy2, proxy3},
+		totalWeight: 6,
+		rng:         rand.New(rand.NewSource(1)),
+	}
+
+	_, sel := upstream.roundRobinSelect()
+	assert.Equal(t, "round_robin: selected index 0 of 3", sel.reason(3))
+
+	proxy2.drained.Store(true)
+	_, sel = upstream.roundRobinSelect()
+	assert.Equal(t, "round_robin: selected index 2 of 3, skipped 1 unavailable targets", sel.reason(3))
+
+	proxy, sel := upstream.weightedSelect()
+	assert.NotEqual(t, proxy2, proxy)
+	assert.Regexp(t, `^weighted: random weight \d of total weight 4 selected index [02], skipped 1 unavailable targets$`, sel.reason(3))
+	proxy2.drained.Store(false)
+
+	_, sel = upstream.randomSelect()
+	assert.Regexp(t, `^random: selected index [012] of 3$`, sel.reason(3))
+
+	_, sel = upstream.hashingSelect("key1")
+	assert.Regexp(t, `^hashing: key 'key1' hash \d+ selected index [012] of 3$`, sel.reason(3))
+
+	proxy1.drained.Store(true)
+	proxy2.drained.Store(true)
+	proxy3.drained.Store(true)
+	proxy, sel = upstream.randomSelect()
+	assert.Nil(t, proxy)
+	assert.Equal(t, "random: no available target in 3 targets", sel.reason(3))
+
+	single := &Upstream{proxies: []*Proxy{proxy1}}
+	proxy1.drained.Store(false)
+	_, sel = single.roundRobinSelect()
+	assert.Equal(t, "round_robin: single target", sel.reason(1))
+}
+
+type fakeResolver struct {
+	ips   []string
+	delay time.Duration
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	time.Sleep(r.delay)
+	return r.ips, r.err
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, nil
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	resolver := &fakeResolver{ips: []string{"10.0.0.1", "10.0.0.2"}}
+
+	upstream := &Upstream{
+		opts: &config.UpstreamOptions{ID: "test"},
+	}
+
+	discovery := &dnsDiscovery{
+		upstream: upstream,
+		resolver: resolver,
+		scheme:   "http",
+		targets: []discoveryTarget{
+			{host: "backend", port: "8080", weight: 1},
+		},
+	}
+
+	err := discovery.refresh(context.Background())
+	assert.NoError(t, err)
+
+	proxies := upstream.targets()
+	assert.Len(t, proxies, 2)
+	assert.Equal(t, "10.0.0.1:8080", proxies[0].targetHost)
+	assert.Equal(t, "10.0.0.2:8080", proxies[1].targetHost)
+
+	kept := proxies[1]
+
+	// ip is added and removed
+	resolver.ips = []string{"10.0.0.2", "10.0.0.3"}
+	err = discovery.refresh(context.Background())
+	assert.NoError(t, err)
+
+	proxies = upstream.targets()
+	assert.Len(t, proxies, 2)
+	assert.Equal(t, "10.0.0.2:8080", proxies[0].targetHost)
+	assert.Equal(t, "10.0.0.3:8080", proxies[1].targetHost)
+	assert.Same(t, kept, proxies[0])
+
+	proxy := upstream.roundRobin()
+	assert.NotNil(t, proxy)
+}
+
+func TestSimulate(t *testing.T) {
+	proxy1, _ := newProxy("http://backend1", false, 1)
+	proxy2, _ := newProxy("http://backend2", false, 2)
+	proxy3, _ := newProxy("http://backend3", false, 3)
+
+	upstream := &Upstream{
+		opts: &config.UpstreamOptions{
+			ID:       "simulate",
+			Strategy: config.WeightedStrategy,
+		},
+		proxies: []*Proxy{
+			proxy1,
+			proxy2,
+			proxy3,
+		},
+		totalWeight: 6,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	// the strategy of the upstream is used
+	histogram, err := upstream.Simulate("", 6000, nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1000, histogram["backend1"], 150)
+	assert.InDelta(t, 2000, histogram["backend2"], 150)
+	assert.InDelta(t, 3000, histogram["backend3"], 150)
+
+	histogram, err = upstream.Simulate(config.RoundRobinStrategy, 9, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"backend1": 3, "backend2": 3, "backend3": 3}, histogram)
+	assert.Equal(t, uint64(0), upstream.counter.Load())
+
+	// the same keys always go to the same targets
+	keys := func(i int) string { return "key" + strconv.Itoa(i%3+1) }
+	first, err := upstream.Simulate(config.HashingStrategy, 300, keys)
+	assert.NoError(t, err)
+	second, err := upstream.Simulate(config.HashingStrategy, 300, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// a repeated key is always simulated to one target
+	histogram, err = upstream.Simulate(config.HashingStrategy, 100, func(int) string { return "user-1" })
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int{0, 0, 100}, []int{histogram["backend1"], histogram["backend2"], histogram["backend3"]})
+
+	// drained targets are never selected
+	assert.NoError(t, upstream.DrainTarget("backend3"))
+	histogram, err = upstream.Simulate(config.RandomStrategy, 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, histogram["backend3"])
+	assert.Equal(t, 1000, histogram["backend1"]+histogram["backend2"])
+
+	_, err = upstream.Simulate(config.WeightedStrategy, 0, nil)
+	assert.Error(t, err)
+
+	_, err = upstream.Simulate("least_conn", 10, nil)
+	assert.Error(t, err)
+}
+
+func TestTargetConnPool(t *testing.T) {
+	two, four := 2, 4
+	disabled, enabled := true, false
+
+	bifrost := &Bifrost{opts: &config.Options{}}
+	upstream, err := newUpstream(bifrost, config.ServiceOptions{
+		Url:                 "http://orders",
+		MaxIdleConnsPerHost: &two,
+		MaxIdleConnDuration: time.Minute,
+		DisableKeepalive:    &disabled,
+	}, config.UpstreamOptions{
+		ID:                  "orders",
+		Strategy:            config.RoundRobinStrategy,
+		MaxIdleConnDuration: 30 * time.Second,
+		DisableKeepalive:    &enabled,
+		Targets: []config.TargetOptions{
+			{Target: "127.0.0.1:8001", MaxIdleConnsPerHost: &four, DisableKeepalive: &disabled},
+			{Target: "127.0.0.1:8002"},
+		},
+	})
+	assert.NoError(t, err)
+
+	first := upstream.proxies[0].client.GetOptions()
+	assert.Equal(t, 4, first.MaxConnsPerHost)
+	assert.Equal(t, 30*time.Second, first.MaxIdleConnDuration)
+	assert.False(t, first.KeepAlive)
+
+	second := upstream.proxies[1].client.GetOptions()
+	assert.Equal(t, 2, second.MaxConnsPerHost)
+	assert.Equal(t, 30*time.Second, second.MaxIdleConnDuration)
+	assert.True(t, second.KeepAlive)
+
+	// the service disables keepalive when neither the upstream nor the target sets it
+	assert.True(t, keepaliveDisabled(config.ServiceOptions{DisableKeepalive: &disabled}, config.UpstreamOptions{}, config.TargetOptions{}))
+	assert.False(t, keepaliveDisabled(config.ServiceOptions{}, config.UpstreamOptions{}, config.TargetOptions{}))
+
+	err = validateConnPool(nil, -time.Second)
+	assert.Error(t, err)
+}
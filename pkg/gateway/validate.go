@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/config"
+
+	"github.com/rs/dnscache"
+)
+
+// ValidateConfig reads the config file like LoadFromConfigWithProfile and checks it without starting the gateway,
+// nothing is listened and no request is sent. All the problems are returned, joined by errors.Join.
+func ValidateConfig(path string, profile string) error {
+	opts, _, err := readConfig(path, profile)
+	if err != nil {
+		return err
+	}
+
+	return ValidateOptions(opts)
+}
+
+// ValidateOptions validates the options, then builds the middlewares, services and upstreams and compiles the
+// routes of each entry the same way Load does. The options are only built when they are valid, because the
+// constructors expect valid options.
+func ValidateOptions(opts config.Options) error {
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+
+	bifrost := &Bifrost{
+		resolver: &dnscache.Resolver{},
+		opts:     &opts,
+		stopCh:   make(chan bool),
+	}
+	// the goroutines of the upstreams are stopped once the options are built
+	defer close(bifrost.stopCh)
+
+	errs := []error{}
+
+	middlewares, err := loadMiddlewares(opts.Middlewares)
+	if err != nil {
+		return err
+	}
+
+	services := map[string]*Service{}
+	for _, id := range sortedKeys(opts.Services) {
+		serviceOpts := opts.Services[id]
+		serviceOpts.ID = id
+
+		for _, middlewareOpts := range serviceOpts.Middlewares {
+			if _, found := middlewares[middlewareOpts.ID]; !found {
+				errs = append(errs, fmt.Errorf("service '%s': middleware '%s' not found", id, middlewareOpts.ID))
+			}
+		}
+
+		service, err := newService(bifrost, serviceOpts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service '%s': %w", id, err))
+			continue
+		}
+		services[id] = service
+	}
+
+	// the routes of the services which can't be built would only repeat their errors
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, id := range sortedKeys(opts.Entries) {
+		entryOpts := opts.Entries[id]
+		entryOpts.ID = id
+
+		if entryOpts.Protocol == config.ProtocolTCP {
+			if _, err := newTCPServer(bifrost, entryOpts); err != nil {
+				errs = append(errs, fmt.Errorf("entry '%s': %w", id, err))
+			}
+			continue
+		}
+
+		if _, err := loadRouter(bifrost, entryOpts, services, middlewares); err != nil {
+			errs = append(errs, fmt.Errorf("entry '%s': %w", id, err))
+		}
+
+		if len(entryOpts.TLS.SNI.Routes) > 0 {
+			if _, err := newSNIRouter(entryOpts.TLS.SNI, services); err != nil {
+				errs = append(errs, fmt.Errorf("entry '%s': %w", id, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
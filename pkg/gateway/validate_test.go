@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validateContent = `
+entries:
+  http:
+    bind: "127.0.0.1:9934"
+
+routes:
+  orders:
+    paths: ["/orders"]
+    service_id: orders
+  payments:
+    paths: ["/payments"]
+    service_id: payments
+
+services:
+  orders:
+    url: http://orders
+  payments:
+    url: http://127.0.0.1:8002
+
+upstreams:
+  orders:
+    strategy: round_robin
+    targets:
+      - target: 127.0.0.1:8001
+`
+
+func TestValidateConfig(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		err := os.WriteFile(path, []byte(content), 0o600)
+		assert.NoError(t, err)
+		return path
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, ValidateConfig(write(validateContent), ""))
+	})
+
+	t.Run("all errors are reported", func(t *testing.T) {
+		content := strings.Replace(validateContent, "strategy: round_robin", "strategy: unknown", 1)
+		content = strings.Replace(content, "url: http://127.0.0.1:8002", "url: http://127.0.0.1:8002\n    retries: -1", 1)
+		content = strings.Replace(content, "services:", "  refunds:\n    entries: [\"grpc\"]\n    paths: [\"/refunds\"]\n    service_id: orders\n\nservices:", 1)
+
+		err := ValidateConfig(write(content), "")
+		assert.ErrorContains(t, err, "service 'payments' retries can't be negative")
+		assert.ErrorContains(t, err, "upstream 'orders' strategy field 'unknown' is invalid")
+		assert.ErrorContains(t, err, "entry 'grpc' is invalid in 'refunds' route section")
+	})
+
+	t.Run("routes are compiled", func(t *testing.T) {
+		content := strings.Replace(validateContent, `paths: ["/payments"]`, `paths: ["~ ^/payments/(\\d+"]`, 1)
+
+		err := ValidateConfig(write(content), "")
+		assert.ErrorContains(t, err, "entry 'http'")
+	})
+
+	t.Run("config file not found", func(t *testing.T) {
+		assert.Error(t, ValidateConfig(filepath.Join(t.TempDir(), "config.yaml"), ""))
+	})
+}
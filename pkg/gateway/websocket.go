@@ -0,0 +1,506 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/valyala/bytebufferpool"
+)
+
+// websocketIdleTimeoutKey is the idle timeout of the websocket tunnels of the service
+const websocketIdleTimeoutKey = "websocket_idle_timeout"
+
+// websocketPingIntervalKey is the interval of the ping frames sent to the clients of the websocket tunnels of the
+// service
+const websocketPingIntervalKey = "websocket_ping_interval"
+
+const websocketBufferSize = 32 * 1024
+
+// websocketPingFrame is an unmasked ping frame without payload, the frames sent to the client aren't masked
+var websocketPingFrame = []byte{0x89, 0x00}
+
+// isWebSocketUpgrade reports whether the client asks to switch the http/1.1 connection to websocket
+func isWebSocketUpgrade(req *protocol.Request) bool {
+	if req.Header.GetProtocol() != consts.HTTP11 || !req.Header.IsGet() {
+		return false
+	}
+
+	if !strings.EqualFold(b2s(req.Header.Peek("Upgrade")), "websocket") {
+		return false
+	}
+
+	for _, value := range strings.Split(b2s(req.Header.Peek("Connection")), ",") {
+		if strings.EqualFold(textproto.TrimString(value), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebSocket sends the upgrade request to the target over a dedicated connection. When the target switches
+// protocols, the connection of the client is hijacked and the frames are copied both ways until either side closes;
+// otherwise the response of the target is sent to the client like any other response.
+func (r *Proxy) serveWebSocket(c context.Context, ctx *app.RequestContext) error {
+	req := &ctx.Request
+	resp := &ctx.Response
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	cli, err := r.clientOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn, err := r.dialWebSocket(cli, req)
+	if err != nil {
+		return err
+	}
+
+	// the handshake is bounded by the request timeout of the service and the client, the tunnel isn't
+	stop := context.AfterFunc(c, func() {
+		_ = conn.Close()
+	})
+
+	reader := bufio.NewReaderSize(conn, websocketBufferSize)
+	upstreamResp, err := sendUpgradeRequest(conn, reader, req)
+
+	// the target refused to switch protocols, the connection isn't reused
+	var body []byte
+	if err == nil && upstreamResp.StatusCode != consts.StatusSwitchingProtocols {
+		body, err = io.ReadAll(upstreamResp.Body)
+		_ = conn.Close()
+	}
+
+	if !stop() && err == nil {
+		err = c.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	resp.SetStatusCode(upstreamResp.StatusCode)
+	for key, values := range upstreamResp.Header {
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+
+	if upstreamResp.StatusCode != consts.StatusSwitchingProtocols {
+		resp.SetBody(body)
+		return nil
+	}
+
+	var tunnels *websocketTunnels
+	if state, ok := c.Value(connStateKey{}).(*connState); ok {
+		tunnels = state.tunnels
+	}
+
+	tunnel := &websocketTunnel{
+		// the hijacked connection can't be closed before the handler returns, the tunnel closes the connection itself
+		client:         ctx.GetConn(),
+		upstream:       conn,
+		upstreamReader: reader,
+		idleTimeout:    ctx.GetDuration(websocketIdleTimeoutKey),
+		pingInterval:   ctx.GetDuration(websocketPingIntervalKey),
+		done:           make(chan struct{}),
+	}
+
+	ctx.Hijack(func(network.Conn) {
+		if tunnels != nil && !tunnels.add(tunnel) {
+			tunnel.close()
+			return
+		}
+		tunnel.run()
+		if tunnels != nil {
+			tunnels.remove(tunnel)
+		}
+	})
+
+	return nil
+}
+
+// dialWebSocket dials the target with the dialer, the dial timeout and the tls config of cli, or of the client of
+// the proxy when cli is nil
+func (r *Proxy) dialWebSocket(cli *client.Client, req *protocol.Request) (network.Conn, error) {
+	var dialer network.Dialer
+	timeout := consts.DefaultDialTimeout
+	var tlsConfig *tls.Config
+
+	if cli == nil {
+		cli = r.client
+	}
+
+	if cli != nil {
+		opts := cli.GetOptions()
+		dialer = opts.Dialer
+		if opts.DialTimeout > 0 {
+			timeout = opts.DialTimeout
+		}
+		tlsConfig = opts.TLSConfig
+	}
+
+	if dialer == nil {
+		dialer = standard.NewDialer()
+	}
+
+	addr := string(req.URI().Host())
+
+	if string(req.URI().Scheme()) == "https" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName = string(req.URI().Host())
+			if host, _, err := net.SplitHostPort(tlsConfig.ServerName); err == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+		// websocket is upgraded from http/1.1, see RFC 8441 for websocket over http2
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	} else {
+		tlsConfig = nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if tlsConfig != nil {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	return dialer.DialConnection("tcp", addr, timeout, tlsConfig)
+}
+
+// sendUpgradeRequest writes the upgrade request to the target and reads the response header, the body of the
+// response or the frames after it are read from reader
+func sendUpgradeRequest(conn network.Conn, reader *bufio.Reader, req *protocol.Request) (*http.Response, error) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	host := req.Header.Host()
+	if len(host) == 0 {
+		host = req.URI().Host()
+	}
+
+	_, _ = buf.Write(req.Method())
+	_, _ = buf.Write(spaceByte)
+	_, _ = buf.Write(req.URI().RequestURI())
+	_, _ = buf.WriteString(" HTTP/1.1\r\nHost: ")
+	_, _ = buf.Write(host)
+	_, _ = buf.WriteString("\r\n")
+
+	req.Header.VisitAll(func(key, value []byte) {
+		if strings.EqualFold(b2s(key), "Host") {
+			return
+		}
+		_, _ = buf.Write(key)
+		_, _ = buf.WriteString(": ")
+		_, _ = buf.Write(value)
+		_, _ = buf.WriteString("\r\n")
+	})
+	_, _ = buf.WriteString("\r\n")
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(reader, nil)
+}
+
+// websocketTunnel copies the bytes between the client and the target. Close frames are copied like any other
+// frame, so the close of one side reaches the other before both connections are closed.
+// When pingInterval is set, a ping frame is sent to the client between the frames of the target. The pong of the
+// client is copied to the target like any other frame, an unsolicited pong is allowed by RFC 6455, and resets the
+// idle timer, so a client which stops answering is closed by the idle timeout.
+type websocketTunnel struct {
+	client         network.Conn
+	upstream       network.Conn
+	upstreamReader io.Reader
+	idleTimeout    time.Duration
+	idleTimer      *time.Timer
+	pingInterval   time.Duration
+	done           chan struct{}
+	closeOnce      sync.Once
+
+	// clientMu guards the writes to the client and clientFrames, the frames of the target which are written to it
+	clientMu     sync.Mutex
+	clientFrames websocketFrames
+}
+
+func (t *websocketTunnel) run() {
+	if t.idleTimeout > 0 {
+		t.idleTimer = time.AfterFunc(t.idleTimeout, t.close)
+		defer t.idleTimer.Stop()
+	}
+
+	if t.pingInterval > 0 {
+		go t.ping()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		t.copy(t.upstream, t.client, nil)
+	}()
+
+	go func() {
+		defer wg.Done()
+		t.copy(t.client, t.upstreamReader, &t.clientMu)
+	}()
+
+	wg.Wait()
+}
+
+// copy returns when either side is closed, the other side is closed as well so the other copy returns too.
+// The writes to the client hold mu, so the pings aren't written in the middle of a frame.
+func (t *websocketTunnel) copy(dst network.Conn, src io.Reader, mu *sync.Mutex) {
+	defer t.close()
+
+	buf := make([]byte, websocketBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if t.idleTimer != nil {
+				t.idleTimer.Reset(t.idleTimeout)
+			}
+
+			var writeErr error
+			if mu != nil {
+				mu.Lock()
+				t.clientFrames.feed(buf[:n])
+				writeErr = writeAndFlush(dst, buf[:n])
+				mu.Unlock()
+			} else {
+				writeErr = writeAndFlush(dst, buf[:n])
+			}
+			if writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ping sends a ping frame to the client every pingInterval until the tunnel is closed. The ping is skipped when
+// a frame of the target is partly written, the client is receiving data then.
+func (t *websocketTunnel) ping() {
+	ticker := time.NewTicker(t.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		t.clientMu.Lock()
+		var err error
+		if t.clientFrames.atBoundary() {
+			err = writeAndFlush(t.client, websocketPingFrame)
+		}
+		t.clientMu.Unlock()
+
+		if err != nil {
+			t.close()
+			return
+		}
+	}
+}
+
+func (t *websocketTunnel) close() {
+	t.closeOnce.Do(func() {
+		if t.done != nil {
+			close(t.done)
+		}
+		_ = t.client.Close()
+		_ = t.upstream.Close()
+	})
+}
+
+func writeAndFlush(dst network.Conn, b []byte) error {
+	if _, err := dst.Write(b); err != nil {
+		return err
+	}
+	return dst.Flush()
+}
+
+// websocketFrames follows the frame boundaries of a websocket stream, see RFC 6455 section 5.2
+type websocketFrames struct {
+	header    [14]byte
+	headerLen int
+	remaining uint64
+}
+
+// feed consumes the next bytes of the stream
+func (f *websocketFrames) feed(b []byte) {
+	for len(b) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(b))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			b = b[n:]
+			continue
+		}
+
+		f.header[f.headerLen] = b[0]
+		f.headerLen++
+		b = b[1:]
+
+		if size := f.headerSize(); size > 0 && f.headerLen == size {
+			f.remaining = f.payloadLen()
+			f.headerLen = 0
+		}
+	}
+}
+
+// atBoundary reports whether the bytes fed so far end with a complete frame
+func (f *websocketFrames) atBoundary() bool {
+	return f.headerLen == 0 && f.remaining == 0
+}
+
+// headerSize returns the size of the header being read, it is 0 until the length byte is read
+func (f *websocketFrames) headerSize() int {
+	if f.headerLen < 2 {
+		return 0
+	}
+
+	size := 2
+	switch f.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (f *websocketFrames) payloadLen() uint64 {
+	switch length := f.header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(f.header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(f.header[2:10])
+	default:
+		return uint64(length)
+	}
+}
+
+// websocketTunnels tracks the websocket tunnels of an entry. The tunnels outlive the requests which opened them,
+// so the entry waits for them when it shuts down and closes the remaining ones after the graceful timeout.
+type websocketTunnels struct {
+	entryID  string
+	mu       sync.Mutex
+	tunnels  map[*websocketTunnel]struct{}
+	wg       sync.WaitGroup
+	shutdown bool
+}
+
+func newWebSocketTunnels(entryID string) *websocketTunnels {
+	return &websocketTunnels{
+		entryID: entryID,
+		tunnels: make(map[*websocketTunnel]struct{}),
+	}
+}
+
+// add returns false when the entry is shutting down
+func (t *websocketTunnels) add(tunnel *websocketTunnel) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shutdown {
+		return false
+	}
+
+	t.tunnels[tunnel] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *websocketTunnels) remove(tunnel *websocketTunnel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tunnels[tunnel]; ok {
+		delete(t.tunnels, tunnel)
+		t.wg.Done()
+	}
+}
+
+// Len returns the number of active tunnels
+func (t *websocketTunnels) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels)
+}
+
+// Shutdown waits for the active tunnels until ctx is done, then closes the remaining tunnels
+func (t *websocketTunnels) Shutdown(ctx context.Context) {
+	t.mu.Lock()
+	t.shutdown = true
+	active := len(t.tunnels)
+	t.mu.Unlock()
+
+	if active == 0 {
+		return
+	}
+
+	slog.Info("waiting for websocket tunnels", "entry", t.entryID, "active", active)
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	remaining := make([]*websocketTunnel, 0, len(t.tunnels))
+	for tunnel := range t.tunnels {
+		remaining = append(remaining, tunnel)
+	}
+	t.mu.Unlock()
+
+	slog.Warn("closing websocket tunnels after graceful timeout", "entry", t.entryID, "active", len(remaining))
+	for _, tunnel := range remaining {
+		tunnel.close()
+	}
+	<-done
+}
@@ -0,0 +1,254 @@
+package gateway
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Backend": []string{"echo"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/echo", echo)
+	mux.HandleFunc("/ping/echo", echo)
+	mux.HandleFunc("/ws/close", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "bye"))
+	})
+	mux.HandleFunc("/ws/refuse", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+
+	backend := &http.Server{Addr: "127.0.0.1:9951", Handler: mux}
+	go func() {
+		_ = backend.ListenAndServe()
+	}()
+	defer backend.Close()
+
+	service, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:  "websocket",
+		Url: "http://127.0.0.1:9951",
+		Timeout: config.ServiceTimeoutOptions{
+			WebSocketIdle: 500 * time.Millisecond,
+		},
+	})
+	assert.NoError(t, err)
+
+	pingService, err := newService(&Bifrost{opts: &config.Options{}}, config.ServiceOptions{
+		ID:  "websocket_ping",
+		Url: "http://127.0.0.1:9951",
+		Timeout: config.ServiceTimeoutOptions{
+			WebSocketIdle: 500 * time.Millisecond,
+			WebSocketPing: 100 * time.Millisecond,
+		},
+	})
+	assert.NoError(t, err)
+
+	tunnels := newWebSocketTunnels("websocket")
+	h := server.New(
+		server.WithHostPorts("127.0.0.1:9950"),
+		server.WithReadTimeout(100*time.Millisecond),
+		server.WithOnConnect(func(ctx context.Context, conn network.Conn) context.Context {
+			return context.WithValue(ctx, connStateKey{}, &connState{tunnels: tunnels})
+		}),
+	)
+	h.GET("/ws/*path", service.ServeHTTP)
+	h.GET("/ping/*path", pingService.ServeHTTP)
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	t.Run("messages flow both ways", func(t *testing.T) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/echo", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "echo", resp.Header.Get("X-Backend"))
+
+		// the tunnel outlives the read timeout of the entry
+		time.Sleep(300 * time.Millisecond)
+
+		for _, message := range []string{"hello", "world"} {
+			assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+
+			messageType, got, err := conn.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, websocket.TextMessage, messageType)
+			assert.Equal(t, message, string(got))
+		}
+
+		assert.Equal(t, 1, tunnels.Len())
+	})
+
+	t.Run("upstream close reaches the client", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/close", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		assert.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, 4000, closeErr.Code)
+		assert.Equal(t, "bye", closeErr.Text)
+	})
+
+	t.Run("idle tunnel is closed", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/echo", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		_ = conn.SetReadDeadline(start.Add(3 * time.Second))
+		_, _, err = conn.ReadMessage()
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second)
+
+		assert.Eventually(t, func() bool {
+			return tunnels.Len() == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("pings keep the tunnel alive", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ping/echo", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		var pings atomic.Int32
+		conn.SetPingHandler(func(data string) error {
+			pings.Add(1)
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+
+		messages := make(chan string)
+		go func() {
+			defer close(messages)
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				messages <- string(message)
+			}
+		}()
+
+		// the pongs of the client reset the idle timeout
+		time.Sleep(time.Second)
+		assert.GreaterOrEqual(t, pings.Load(), int32(5))
+
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+		assert.Equal(t, "hello", <-messages)
+	})
+
+	t.Run("client which doesn't answer the pings is closed", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ping/echo", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		// the pong isn't sent
+		conn.SetPingHandler(func(string) error {
+			return nil
+		})
+
+		start := time.Now()
+		_ = conn.SetReadDeadline(start.Add(3 * time.Second))
+		_, _, err = conn.ReadMessage()
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("upstream refuses to upgrade", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/refuse", nil)
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("shutdown closes remaining tunnels", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/echo", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Eventually(t, func() bool {
+			return tunnels.Len() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		tunnels.Shutdown(ctx)
+		assert.Equal(t, 0, tunnels.Len())
+
+		_, _, err = conn.ReadMessage()
+		assert.Error(t, err)
+
+		// new tunnels aren't accepted after shutdown
+		conn, _, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:9950/ws/echo", nil)
+		if err == nil {
+			defer conn.Close()
+			_, _, err = conn.ReadMessage()
+		}
+		assert.Error(t, err)
+	})
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	frames := websocketFrames{}
+	assert.True(t, frames.atBoundary())
+
+	// a text frame of 5 bytes fed byte by byte
+	for _, b := range []byte{0x81, 0x05, 'h', 'e', 'l', 'l'} {
+		frames.feed([]byte{b})
+		assert.False(t, frames.atBoundary())
+	}
+	frames.feed([]byte{'o'})
+	assert.True(t, frames.atBoundary())
+
+	// a binary frame with a 16 bits length and a masked close frame in one read
+	payload := make([]byte, 300)
+	stream := append([]byte{0x82, 126, 0x01, 0x2c}, payload...)
+	stream = append(stream, 0x88, 0x82, 1, 2, 3, 4, 0x03, 0xe8)
+	frames.feed(stream[:10])
+	assert.False(t, frames.atBoundary())
+	frames.feed(stream[10 : len(stream)-1])
+	assert.False(t, frames.atBoundary())
+	frames.feed(stream[len(stream)-1:])
+	assert.True(t, frames.atBoundary())
+
+	// a frame with a 64 bits length and an empty ping
+	frames.feed([]byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0})
+	assert.False(t, frames.atBoundary())
+	frames.feed(make([]byte, 65536))
+	assert.True(t, frames.atBoundary())
+	frames.feed(websocketPingFrame)
+	assert.True(t, frames.atBoundary())
+}
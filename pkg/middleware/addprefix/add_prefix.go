@@ -3,15 +3,25 @@ package addprefix
 import (
 	"context"
 	"http-benchmark/pkg/config"
+	"strings"
 
 	"github.com/cloudwego/hertz/pkg/app"
 )
 
+// AddPrefixMiddleware prepends the prefix to the path of the request, it is the inverse of strip_prefix.
+// The query string is kept.
 type AddPrefixMiddleware struct {
 	prefix []byte
 }
 
+// NewMiddleware normalizes the prefix to start with a slash and end without one, so /api, /api/ and api join
+// /orders as /api/orders
 func NewMiddleware(prefix string) *AddPrefixMiddleware {
+	prefix = strings.TrimRight(prefix, "/")
+	if len(prefix) > 0 && prefix[0] != '/' {
+		prefix = "/" + prefix
+	}
+
 	return &AddPrefixMiddleware{
 		prefix: []byte(prefix),
 	}
@@ -23,7 +33,18 @@ func (m *AddPrefixMiddleware) ServeHTTP(c context.Context, ctx *app.RequestConte
 		ctx.Set(config.REQUEST_PATH, string(ctx.Request.Path()))
 	}
 
-	newPath := append(m.prefix, ctx.Request.Path()...)
-	ctx.Request.URI().SetPathBytes(newPath)
+	if len(m.prefix) > 0 {
+		path := ctx.Request.Path()
+
+		// the prefix is shared by the requests, so the new path is built in its own buffer
+		newPath := make([]byte, 0, len(m.prefix)+len(path)+1)
+		newPath = append(newPath, m.prefix...)
+		if len(path) == 0 || path[0] != '/' {
+			newPath = append(newPath, '/')
+		}
+		newPath = append(newPath, path...)
+		ctx.Request.URI().SetPathBytes(newPath)
+	}
+
 	ctx.Next(c)
 }
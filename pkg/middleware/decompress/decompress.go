@@ -0,0 +1,163 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/log"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// DefaultMaxSize is the limit of a decompressed body, it protects against zip bombs
+const DefaultMaxSize = 32 * 1024 * 1024
+
+var ErrTooLarge = errors.New("decompressed body is too large")
+
+type Options struct {
+	// MaxSize is the limit of the decompressed body in bytes, the response is 502 when it is exceeded
+	MaxSize int
+}
+
+// DecompressMiddleware decodes gzip, deflate and br responses of the upstream for the clients which don't accept
+// the encoding. Content-Encoding is removed and Content-Length is set to the decoded body.
+type DecompressMiddleware struct {
+	maxSize int
+}
+
+func NewMiddleware(opts Options) *DecompressMiddleware {
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	return &DecompressMiddleware{
+		maxSize: maxSize,
+	}
+}
+
+func (m *DecompressMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	ctx.Next(c)
+
+	resp := &ctx.Response
+	encoding := strings.ToLower(strings.TrimSpace(string(resp.Header.Peek("Content-Encoding"))))
+	if len(encoding) == 0 || encoding == "identity" || !IsSupported(encoding) {
+		return
+	}
+
+	if accepts(string(ctx.Request.Header.Peek("Accept-Encoding")), encoding) {
+		return
+	}
+
+	body := resp.Body()
+	if len(body) == 0 {
+		return
+	}
+
+	decoded, err := Decode(encoding, body, m.maxSize)
+	if err != nil {
+		log.FromContext(c).ErrorContext(c, "fail to decompress upstream response", slog.String("encoding", encoding), slog.String("error", err.Error()))
+		resp.Reset()
+		resp.SetStatusCode(consts.StatusBadGateway)
+		return
+	}
+
+	resp.Header.Del("Content-Encoding")
+	// the etag was computed for the encoded body
+	if etag := resp.Header.Peek("ETag"); len(etag) > 0 && !bytes.HasPrefix(etag, []byte("W/")) {
+		resp.Header.Set("ETag", "W/"+string(etag))
+	}
+	resp.SetBody(decoded)
+	resp.Header.SetContentLength(len(decoded))
+}
+
+// IsSupported reports whether Decode can decode the content encoding
+func IsSupported(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+// accepts reports whether Accept-Encoding allows the encoding, an encoding with q=0 is refused
+func accepts(acceptEncoding string, encoding string) bool {
+	if encoding == "x-gzip" {
+		encoding = "gzip"
+	}
+
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(value, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			key, val, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// Decode decompresses the body, ErrTooLarge is returned when the decoded body exceeds maxSize
+func Decode(encoding string, body []byte, maxSize int) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case "deflate":
+		// deflate is the zlib format, some servers send raw deflate instead
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("content encoding '%s' is not supported", encoding)
+	}
+
+	buf := bytes.Buffer{}
+	n, err := io.Copy(&buf, io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > int64(maxSize) {
+		return nil, ErrTooLarge
+	}
+
+	return buf.Bytes(), nil
+}
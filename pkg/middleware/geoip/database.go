@@ -0,0 +1,141 @@
+package geoip
+
+import (
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay waits for the writes of a new database to settle before it is opened
+const reloadDelay = 500 * time.Millisecond
+
+var (
+	databasesMu sync.Mutex
+	databases   = map[string]*database{}
+)
+
+// Record is what the database knows about an ip, the fields are empty when they are not in the database
+type Record struct {
+	Country string
+	ASN     uint64
+}
+
+// database is a MaxMind DB file which is reopened when the file changes. The databases are shared by path,
+// the middlewares created by each config reload use the same reader and watcher.
+type database struct {
+	path   string
+	reader atomic.Pointer[reader]
+}
+
+// openDatabase returns the database of the path, the file is opened and watched the first time
+func openDatabase(path string) (*database, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+
+	if db, found := databases[path]; found {
+		return db, nil
+	}
+
+	r, err := openReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &database{path: path}
+	db.reader.Store(r)
+
+	if err := db.watch(); err != nil {
+		_ = r.close()
+		return nil, err
+	}
+
+	databases[path] = db
+	return db, nil
+}
+
+// watch reopens the database when the file is written or replaced. The directory is watched, so a file which is
+// replaced by a rename, like geoipupdate does, is still seen.
+func (db *database) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(db.path)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(reloadDelay)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == db.path && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+					timer.Reset(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("geoip: database watcher error", "path", db.path, "error", err)
+			case <-timer.C:
+				db.reload()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reload swaps the reader of the database, the current one is kept when the new file can't be opened
+func (db *database) reload() {
+	r, err := openReader(db.path)
+	if err != nil {
+		slog.Error("geoip: fail to reload database, the current database is kept", "path", db.path, "error", err)
+		return
+	}
+
+	old := db.reader.Swap(r)
+	slog.Info("geoip: database is reloaded", "path", db.path)
+
+	// the lookups which are still reading the old file hold its read lock
+	if err := old.close(); err != nil {
+		slog.Error("geoip: fail to close database", "path", db.path, "error", err)
+	}
+}
+
+// lookup returns the country and the asn of the ip, found is false when the ip isn't in the database
+func (db *database) lookup(ip net.IP) (Record, bool, error) {
+	for {
+		r := db.reader.Load()
+
+		r.mu.RLock()
+		if r.closed {
+			// the reader was swapped by a reload after it was loaded
+			r.mu.RUnlock()
+			continue
+		}
+
+		record, found, err := r.record(ip)
+		r.mu.RUnlock()
+		return record, found, err
+	}
+}
@@ -0,0 +1,199 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+type Options struct {
+	// Database is the path of the MaxMind DB file of the countries, for example GeoLite2-Country.mmdb
+	Database string
+
+	// ASNDatabase is the path of the MaxMind DB file of the asn, for example GeoLite2-ASN.mmdb. The asn is read
+	// from Database when it is empty.
+	ASNDatabase string
+
+	// AllowCountries are the iso codes of the countries which are allowed, the others are denied
+	AllowCountries []string
+
+	// DenyCountries are the iso codes of the countries which are denied, the others are allowed
+	DenyCountries []string
+
+	// UnknownAction is applied to the ips which aren't in the database, for example the private ranges.
+	// The default is allow.
+	UnknownAction string
+
+	// ErrorAction is applied when the ip can't be looked up, for example when the database is corrupted. The
+	// default is deny, so an error doesn't let the requests of the denied countries through.
+	ErrorAction string
+}
+
+// GeoIPMiddleware resolves the client ip to the country and the asn, and sets $geoip_country and $geoip_asn.
+// The requests of the countries which aren't allowed are rejected with 403.
+type GeoIPMiddleware struct {
+	db             *database
+	asnDB          *database
+	allowCountries map[string]struct{}
+	denyCountries  map[string]struct{}
+	denyUnknown    bool
+	allowOnError   bool
+}
+
+func NewMiddleware(opts Options) (*GeoIPMiddleware, error) {
+	if len(opts.Database) == 0 {
+		return nil, fmt.Errorf("database can't be empty")
+	}
+
+	if len(opts.AllowCountries) > 0 && len(opts.DenyCountries) > 0 {
+		return nil, fmt.Errorf("allow_countries and deny_countries can't be both set")
+	}
+
+	m := &GeoIPMiddleware{}
+
+	switch opts.UnknownAction {
+	case "", ActionAllow:
+	case ActionDeny:
+		m.denyUnknown = true
+	default:
+		return nil, fmt.Errorf("unknown_action '%s' must be '%s' or '%s'", opts.UnknownAction, ActionAllow, ActionDeny)
+	}
+
+	switch opts.ErrorAction {
+	case "", ActionDeny:
+	case ActionAllow:
+		m.allowOnError = true
+	default:
+		return nil, fmt.Errorf("error_action '%s' must be '%s' or '%s'", opts.ErrorAction, ActionAllow, ActionDeny)
+	}
+
+	var err error
+	if m.allowCountries, err = countrySet(opts.AllowCountries); err != nil {
+		return nil, err
+	}
+	if m.denyCountries, err = countrySet(opts.DenyCountries); err != nil {
+		return nil, err
+	}
+
+	if m.db, err = openDatabase(opts.Database); err != nil {
+		return nil, fmt.Errorf("fail to open database '%s': %w", opts.Database, err)
+	}
+
+	if len(opts.ASNDatabase) > 0 {
+		if m.asnDB, err = openDatabase(opts.ASNDatabase); err != nil {
+			return nil, fmt.Errorf("fail to open asn_database '%s': %w", opts.ASNDatabase, err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *GeoIPMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	record, found, err := m.lookup(c, clientIP(ctx))
+	if err != nil {
+		if !m.allowOnError {
+			ctx.AbortWithStatus(consts.StatusForbidden)
+			return
+		}
+		ctx.Next(c)
+		return
+	}
+
+	if len(record.Country) > 0 {
+		ctx.Set(config.GEOIP_COUNTRY, record.Country)
+	}
+	if record.ASN > 0 {
+		ctx.Set(config.GEOIP_ASN, strconv.FormatUint(record.ASN, 10))
+	}
+
+	if !m.allow(record, found) {
+		ctx.AbortWithStatus(consts.StatusForbidden)
+		return
+	}
+
+	ctx.Next(c)
+}
+
+// lookup returns the record of the ip, an error of the asn database is only logged because the asn isn't used to
+// allow the request
+func (m *GeoIPMiddleware) lookup(c context.Context, ip net.IP) (Record, bool, error) {
+	if ip == nil {
+		return Record{}, false, nil
+	}
+
+	record, found, err := m.db.lookup(ip)
+	if err != nil {
+		slog.ErrorContext(c, "geoip: fail to lookup ip", "ip", ip.String(), "path", m.db.path, "error", err)
+		return Record{}, false, err
+	}
+
+	if m.asnDB != nil {
+		asnRecord, asnFound, err := m.asnDB.lookup(ip)
+		if err != nil {
+			slog.ErrorContext(c, "geoip: fail to lookup ip", "ip", ip.String(), "path", m.asnDB.path, "error", err)
+		} else if asnFound {
+			record.ASN = asnRecord.ASN
+		}
+	}
+
+	return record, found, nil
+}
+
+// allow applies the country lists to the record, an ip without a country is unknown
+func (m *GeoIPMiddleware) allow(record Record, found bool) bool {
+	if !found || len(record.Country) == 0 {
+		return !m.denyUnknown
+	}
+
+	if len(m.allowCountries) > 0 {
+		_, ok := m.allowCountries[record.Country]
+		return ok
+	}
+
+	_, denied := m.denyCountries[record.Country]
+	return !denied
+}
+
+func clientIP(ctx *app.RequestContext) net.IP {
+	if ip := ctx.GetString(config.CLIENT_IP); len(ip) > 0 {
+		return net.ParseIP(ip)
+	}
+
+	addr := ctx.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func countrySet(countries []string) (map[string]struct{}, error) {
+	if len(countries) == 0 {
+		return nil, nil
+	}
+
+	set := make(map[string]struct{}, len(countries))
+	for _, country := range countries {
+		if len(country) != 2 {
+			return nil, fmt.Errorf("country '%s' must be an iso 3166-1 alpha-2 code", country)
+		}
+		set[strings.ToUpper(country)] = struct{}{}
+	}
+	return set, nil
+}
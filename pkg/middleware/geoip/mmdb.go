@@ -0,0 +1,64 @@
+package geoip
+
+import (
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// reader looks up the records of a MaxMind DB file. The file is memory-mapped by maxminddb, so the records are read
+// from the page cache and the size of the database doesn't matter. The strings of the records are copied, they stay
+// valid after the reader is closed.
+type reader struct {
+	mu     sync.RWMutex
+	closed bool
+	db     *maxminddb.Reader
+}
+
+// mmdbRecord is the part of the record which is decoded, the fields which aren't in it are skipped. The country
+// databases have the country, the asn databases have autonomous_system_number.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint64 `maxminddb:"autonomous_system_number"`
+}
+
+func openReader(path string) (*reader, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{db: db}, nil
+}
+
+// record returns the country and the asn of the ip, found is false when the ip isn't in the database
+func (r *reader) record(ip net.IP) (Record, bool, error) {
+	var result mmdbRecord
+	_, found, err := r.db.LookupNetwork(ip, &result)
+	if err != nil || !found {
+		return Record{}, false, err
+	}
+
+	record := Record{Country: result.Country.ISOCode, ASN: result.ASN}
+	if len(record.Country) == 0 {
+		record.Country = result.RegisteredCountry.ISOCode
+	}
+	return record, true, nil
+}
+
+func (r *reader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.db.Close()
+}
@@ -0,0 +1,100 @@
+package hsts
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// DefaultMaxAge is one year, the minimum max-age accepted by the preload list
+const DefaultMaxAge = 31536000
+
+type Options struct {
+	// MaxAge is the max-age of Strict-Transport-Security in seconds
+	MaxAge            int
+	IncludeSubDomains bool
+	Preload           bool
+
+	// Redirect sends plaintext requests to https instead of serving them
+	Redirect bool
+
+	// RedirectPort is the https port of the redirect, 443 is omitted from the location
+	RedirectPort int
+}
+
+type HSTSMiddleware struct {
+	header       string
+	redirect     bool
+	redirectPort string
+}
+
+func NewMiddleware(opts Options) *HSTSMiddleware {
+	header := "max-age=" + strconv.Itoa(opts.MaxAge)
+	if opts.IncludeSubDomains {
+		header += "; includeSubDomains"
+	}
+	if opts.Preload {
+		header += "; preload"
+	}
+
+	m := &HSTSMiddleware{
+		header:   header,
+		redirect: opts.Redirect,
+	}
+
+	if opts.RedirectPort > 0 && opts.RedirectPort != 443 {
+		m.redirectPort = strconv.Itoa(opts.RedirectPort)
+	}
+
+	return m
+}
+
+func (m *HSTSMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	// browsers ignore the header over plaintext, it is only sent over tls
+	if !isTLS(ctx) {
+		if m.redirect {
+			m.redirectToHTTPS(ctx)
+			return
+		}
+		ctx.Next(c)
+		return
+	}
+
+	ctx.Next(c)
+	ctx.Response.Header.Set("Strict-Transport-Security", m.header)
+}
+
+func (m *HSTSMiddleware) redirectToHTTPS(ctx *app.RequestContext) {
+	host := string(ctx.Request.Host())
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if len(m.redirectPort) > 0 {
+		host = net.JoinHostPort(host, m.redirectPort)
+	}
+
+	location := "https://" + host + string(ctx.Request.URI().RequestURI())
+
+	// 308 keeps the method and the body of the request
+	code := consts.StatusPermanentRedirect
+	if ctx.Request.Header.IsGet() || ctx.Request.Header.IsHead() {
+		code = consts.StatusMovedPermanently
+	}
+
+	ctx.Redirect(code, []byte(location))
+	ctx.Abort()
+}
+
+// isTLS reports whether the client connected over tls, the connection decides it because
+// the proxy marks the request as plaintext for http targets
+func isTLS(ctx *app.RequestContext) bool {
+	if conn := ctx.GetConn(); conn != nil {
+		_, ok := conn.(network.ConnTLSer)
+		return ok
+	}
+	return string(ctx.Request.URI().Scheme()) == "https"
+}
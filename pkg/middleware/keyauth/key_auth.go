@@ -0,0 +1,171 @@
+package keyauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+const (
+	DefaultHeader = "X-API-Key"
+
+	hashPrefix = "sha256:"
+)
+
+// Key is an api key of a consumer, only the hash of the key is kept in the config
+type Key struct {
+	// Hash is the sha256 of the key in the format of HashKey
+	Hash  string
+	Owner string
+
+	// ExpiresAt is the time the key stops working, the key never expires when it is zero
+	ExpiresAt time.Time
+
+	// Paths are the path prefixes the key is allowed to access, every path is allowed when it is empty
+	Paths []string
+}
+
+type Options struct {
+	// Header is the request header of the key
+	Header string
+
+	// Query is the query parameter of the key, it is read when the header is absent. The query isn't read
+	// when it is empty.
+	Query string
+
+	Keys []Key
+}
+
+// KeyAuthMiddleware validates the api key of the request and sets $api_key_owner to the owner of the key.
+// A missing, unknown or expired key is rejected with 401, a key which can't access the path with 403.
+type KeyAuthMiddleware struct {
+	header string
+	query  string
+	keys   map[string]Key
+}
+
+func NewMiddleware(opts Options) (*KeyAuthMiddleware, error) {
+	header := opts.Header
+	if len(header) == 0 {
+		header = DefaultHeader
+	}
+
+	keys := make(map[string]Key, len(opts.Keys))
+	for _, key := range opts.Keys {
+		digest, err := parseHash(key.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("key of owner '%s' %w", key.Owner, err)
+		}
+
+		if len(key.Owner) == 0 {
+			return nil, fmt.Errorf("owner of key '%s' can't be empty", key.Hash)
+		}
+
+		if _, found := keys[digest]; found {
+			return nil, fmt.Errorf("key of owner '%s' is duplicated", key.Owner)
+		}
+		keys[digest] = key
+	}
+
+	return &KeyAuthMiddleware{
+		header: header,
+		query:  opts.Query,
+		keys:   keys,
+	}, nil
+}
+
+func (m *KeyAuthMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	apiKey := string(ctx.Request.Header.Peek(m.header))
+	if len(apiKey) == 0 && len(m.query) > 0 {
+		apiKey = string(ctx.QueryArgs().Peek(m.query))
+	}
+
+	if len(apiKey) == 0 {
+		abort(ctx, consts.StatusUnauthorized, "api key is missing")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(apiKey))
+	key, found := m.keys[hex.EncodeToString(sum[:])]
+	if !found {
+		abort(ctx, consts.StatusUnauthorized, "api key is invalid")
+		return
+	}
+
+	if !key.ExpiresAt.IsZero() && !time.Now().Before(key.ExpiresAt) {
+		abort(ctx, consts.StatusUnauthorized, "api key is expired")
+		return
+	}
+
+	if !allowPath(key.Paths, requestPath(ctx)) {
+		abort(ctx, consts.StatusForbidden, "api key can't access the path")
+		return
+	}
+
+	ctx.Set(config.API_KEY_OWNER, key.Owner)
+	ctx.Next(c)
+}
+
+// HashKey returns the hash of the key which is put in the config, for example sha256:9f86d0...
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// VerifyKey reports whether the key matches the hash created by HashKey
+func VerifyKey(hash string, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(strings.ToLower(hash))) == 1
+}
+
+// parseHash returns the hex digest of the hash created by HashKey
+func parseHash(hash string) (string, error) {
+	digest, found := strings.CutPrefix(strings.ToLower(hash), hashPrefix)
+	if !found {
+		return "", fmt.Errorf("hash '%s' must start with '%s'", hash, hashPrefix)
+	}
+
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("hash '%s' is not a sha256 digest", hash)
+	}
+
+	return digest, nil
+}
+
+// requestPath is the path requested by the client, before it is rewritten by the other middlewares
+func requestPath(ctx *app.RequestContext) string {
+	if path := ctx.GetString(config.REQUEST_PATH); len(path) > 0 {
+		return path
+	}
+	return string(ctx.Request.URI().Path())
+}
+
+// allowPath matches the prefixes by path segments, so /api allows /api and /api/orders but not /api-admin
+func allowPath(prefixes []string, path string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+func abort(ctx *app.RequestContext, status int, reason string) {
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, reason))
+	ctx.AbortWithStatus(status)
+}
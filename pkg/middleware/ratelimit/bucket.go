@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// TokenBucketLimiter is a token bucket limiter of a single instance. The bucket of a key holds at most burst tokens
+// and is refilled by rate tokens per second, so a client can send burst requests at once and rate requests per
+// second after that. A full bucket is the same as a missing one, so it is removed by the cleanup, and the least
+// recently used keys are evicted when maxKeys is exceeded.
+type TokenBucketLimiter struct {
+	rate     float64
+	burst    int
+	interval time.Duration
+	// now is replaced by the tests
+	now    func() time.Time
+	shards shards[*tokenBucket]
+}
+
+// NewTokenBucketLimiter creates a token bucket limiter which tracks at most maxKeys keys, they are unbounded when it
+// is zero
+func NewTokenBucketLimiter(rate float64, burst int, maxKeys int) *TokenBucketLimiter {
+	// the buckets are cleaned up once per the time to refill an empty bucket
+	interval := time.Duration(float64(burst) / rate * float64(time.Second))
+
+	return &TokenBucketLimiter{
+		rate:     rate,
+		burst:    burst,
+		interval: max(interval, time.Second),
+		now:      time.Now,
+		shards:   newShards[*tokenBucket](maxKeys),
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string, cost int) (AllowResult, error) {
+	now := l.now()
+
+	s := l.shards.of(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now, l.interval, func(b *tokenBucket) bool {
+		return l.refill(b, now) >= float64(l.burst)
+	})
+
+	b, found := s.get(key)
+	if !found {
+		b = &tokenBucket{tokens: float64(l.burst), updatedAt: now}
+		s.set(key, b)
+	}
+
+	b.tokens = l.refill(b, now)
+	b.updatedAt = now
+
+	result := AllowResult{
+		Limit: l.burst,
+	}
+
+	if b.tokens < float64(cost) {
+		result.Remaining = int(b.tokens)
+		// the request is allowed when the bucket is refilled to the cost
+		result.ResetAfter = l.duration(float64(cost) - b.tokens)
+		return result, nil
+	}
+
+	b.tokens -= float64(cost)
+
+	result.Allowed = true
+	result.Remaining = int(b.tokens)
+	// the time until the next token is available, the bucket is full when it is zero
+	if b.tokens < float64(l.burst) {
+		result.ResetAfter = l.duration(math.Floor(b.tokens) + 1 - b.tokens)
+	}
+	return result, nil
+}
+
+func (l *TokenBucketLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updatedAt).Seconds()*l.rate
+	return min(tokens, float64(l.burst))
+}
+
+func (l *TokenBucketLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.rate * float64(time.Second)))
+}
+
+// Len returns the number of the tracked keys
+func (l *TokenBucketLimiter) Len() int {
+	return l.shards.len()
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewTokenBucketLimiter(2, 3, 0)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	allow := func(key string, cost int) AllowResult {
+		result, err := limiter.Allow(context.Background(), key, cost)
+		assert.NoError(t, err)
+		return result
+	}
+
+	// a full bucket lets burst requests through at once
+	for _, remaining := range []int{2, 1, 0} {
+		result := allow("client", 1)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, remaining, result.Remaining)
+		assert.Equal(t, 500*time.Millisecond, result.ResetAfter)
+	}
+
+	result := allow("client", 1)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 500*time.Millisecond, result.ResetAfter)
+
+	// the bucket is refilled by rate tokens per second
+	now = now.Add(250 * time.Millisecond)
+	result = allow("client", 1)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 250*time.Millisecond, result.ResetAfter)
+
+	now = now.Add(250 * time.Millisecond)
+	result = allow("client", 1)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	// another key has its own bucket
+	result = allow("another", 1)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+
+	// the bucket never holds more than burst tokens
+	now = now.Add(time.Minute)
+	result = allow("client", 1)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+
+	// a request of cost n waits until n tokens are refilled, nothing is consumed when it isn't allowed
+	result = allow("client", 3)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+	assert.Equal(t, 500*time.Millisecond, result.ResetAfter)
+
+	result = allow("client", 2)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 500*time.Millisecond, result.ResetAfter)
+}
@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type FailoverPolicy string
+
+const (
+	// FailOpen allows the requests without limiting them while the limiter is unavailable
+	FailOpen FailoverPolicy = "fail_open"
+	// FailClosed rejects the requests with 503 while the limiter is unavailable
+	FailClosed FailoverPolicy = "fail_closed"
+	// LocalFallback limits the requests by a local limiter of the instance while the limiter is unavailable, a
+	// client gets the limit from every instance until the limiter recovers
+	LocalFallback FailoverPolicy = "local_fallback"
+)
+
+// LimiterFactory creates a shared limiter, for example one backed by redis, from the options of the middleware
+type LimiterFactory func(opts Options) (Limiter, error)
+
+var (
+	limitersMu sync.RWMutex
+	limiters   = map[string]LimiterFactory{}
+)
+
+// RegisterLimiter makes the limiter available to the rate_limit middleware of the config by name, it must be
+// called before the config is loaded, for example in an init function
+func RegisterLimiter(name string, factory LimiterFactory) error {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	if _, found := limiters[name]; found {
+		return fmt.Errorf("limiter '%s' already exists", name)
+	}
+
+	limiters[name] = factory
+	return nil
+}
+
+// GetLimiter returns the factory registered by RegisterLimiter
+func GetLimiter(name string) (LimiterFactory, bool) {
+	limitersMu.RLock()
+	defer limitersMu.RUnlock()
+
+	factory, found := limiters[name]
+	return factory, found
+}
+
+// failoverLimiter calls the primary limiter within the latency budget, and the local limiter when the primary
+// fails. The degradation and the recovery are logged once rather than per request.
+type failoverLimiter struct {
+	policy        FailoverPolicy
+	primary       Limiter
+	local         Limiter
+	latencyBudget time.Duration
+	degraded      atomic.Bool
+}
+
+func (l *failoverLimiter) Allow(ctx context.Context, key string, cost int) (AllowResult, error) {
+	c := ctx
+	if l.latencyBudget > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(ctx, l.latencyBudget)
+		defer cancel()
+	}
+
+	result, err := l.primary.Allow(c, key, cost)
+	if err == nil {
+		if l.degraded.CompareAndSwap(true, false) {
+			log.FromContext(ctx).InfoContext(ctx, "rate limit: limiter is recovered")
+		}
+		return result, nil
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("limiter exceeds the latency budget %s: %w", l.latencyBudget, err)
+	}
+
+	if l.degraded.CompareAndSwap(false, true) {
+		msg := "rate limit: limiter is unavailable, requests are not limited"
+		switch l.policy {
+		case FailClosed:
+			msg = "rate limit: limiter is unavailable, requests are rejected"
+		case LocalFallback:
+			msg = "rate limit: limiter is unavailable, requests are limited by the local limiter"
+		}
+		log.FromContext(ctx).WarnContext(ctx, msg, slog.String("error", err.Error()))
+	}
+
+	if l.local != nil {
+		return l.local.Allow(ctx, key, cost)
+	}
+	return AllowResult{}, err
+}
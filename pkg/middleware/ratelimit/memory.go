@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+type fixedWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+// MemoryLimiter is a fixed window limiter of a single instance. The keys are spread over shards, expired windows
+// of a shard are removed when the window of the limiter has passed since its last cleanup, and the least recently
+// used keys are evicted when maxKeys is exceeded.
+type MemoryLimiter struct {
+	limit  int
+	window time.Duration
+	shards shards[*fixedWindow]
+}
+
+// NewMemoryLimiter creates a fixed window limiter which tracks at most maxKeys keys, they are unbounded when it is zero
+func NewMemoryLimiter(limit int, window time.Duration, maxKeys int) *MemoryLimiter {
+	return &MemoryLimiter{
+		limit:  limit,
+		window: window,
+		shards: newShards[*fixedWindow](maxKeys),
+	}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, cost int) (AllowResult, error) {
+	now := time.Now()
+
+	s := l.shards.of(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now, l.window, func(w *fixedWindow) bool {
+		return !now.Before(w.resetAt)
+	})
+
+	w, found := s.get(key)
+	if !found || !now.Before(w.resetAt) {
+		w = &fixedWindow{resetAt: now.Add(l.window)}
+		s.set(key, w)
+	}
+
+	result := AllowResult{
+		Limit:      l.limit,
+		ResetAfter: w.resetAt.Sub(now),
+	}
+
+	if w.count+cost > l.limit {
+		result.Remaining = l.limit - w.count
+		return result, nil
+	}
+
+	w.count += cost
+	result.Allowed = true
+	result.Remaining = l.limit - w.count
+	return result, nil
+}
+
+// Len returns the number of the tracked keys
+func (l *MemoryLimiter) Len() int {
+	return l.shards.len()
+}
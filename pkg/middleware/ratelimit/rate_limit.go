@@ -0,0 +1,456 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// Cost is the variable which overrides the cost of the request, it is set by the rate_limit_cost of a route
+const Cost = "$rate_limit_cost"
+
+type Algorithm string
+
+const (
+	// FixedWindow counts the requests of a key in windows which start at the first request, a client can send
+	// twice the limit around the end of a window
+	FixedWindow Algorithm = "fixed_window"
+	// SlidingWindow counts the requests of a key in the trailing window
+	SlidingWindow Algorithm = "sliding_window"
+	// TokenBucket refills the bucket of a key by Rate tokens per second up to Burst tokens, a client can send Burst
+	// requests at once
+	TokenBucket Algorithm = "token_bucket"
+)
+
+// HeaderStyle is the naming of the rate limit headers of the responses
+type HeaderStyle string
+
+const (
+	// HeadersDraft names the headers RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset as the ietf draft
+	HeadersDraft HeaderStyle = "draft"
+	// HeadersLegacy names the headers X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+	HeadersLegacy HeaderStyle = "legacy"
+)
+
+// EmptyKeyPolicy decides what happens to a request when all the variables of the key are empty
+type EmptyKeyPolicy string
+
+const (
+	// EmptyKeyClientIP limits the request by FallbackKey, or by $client_ip when FallbackKey is empty
+	EmptyKeyClientIP EmptyKeyPolicy = "client_ip"
+	// EmptyKeyAllow passes the request without limiting it
+	EmptyKeyAllow EmptyKeyPolicy = "allow"
+	// EmptyKeyDeny rejects the request with 429
+	EmptyKeyDeny EmptyKeyPolicy = "deny"
+)
+
+type Options struct {
+	// Limit is the number of requests allowed per key in a window, it is Burst for TokenBucket
+	Limit  int
+	Window time.Duration
+
+	// Rate is the number of tokens per second added to the bucket of a key, it is only used by TokenBucket
+	Rate float64
+
+	// Burst is the capacity of the bucket of a key, it is only used by TokenBucket
+	Burst int
+
+	// Algorithm is FixedWindow when it is empty
+	Algorithm Algorithm
+
+	// Keys are the expressions which build the key of the limiter, for example $client_ip, $header_X-Api-Key or
+	// "$client_ip:$request_path". Other variables, for example $jwt_sub, are read from the request context.
+	Keys []string
+
+	// EmptyKey is applied when all the variables of Keys are empty, it is EmptyKeyClientIP when it is empty
+	EmptyKey EmptyKeyPolicy
+
+	// FallbackKey is used by EmptyKeyClientIP instead of $client_ip
+	FallbackKey string
+
+	// Cost is the number of requests consumed by a request, it is 1 when it is zero
+	Cost int
+
+	// MaxKeys bounds the memory of the local limiter, the least recently used keys are evicted when it is exceeded.
+	// The keys are unbounded when it is zero.
+	MaxKeys int
+
+	// Limiter is a limiter shared by the instances, for example one backed by redis. The requests are limited by the
+	// local limiter of Algorithm when it is nil.
+	Limiter Limiter
+
+	// Failover is applied while Limiter returns errors, it is FailOpen when it is empty
+	Failover FailoverPolicy
+
+	// Headers is the naming of the rate limit headers, it is HeadersDraft when it is empty
+	Headers HeaderStyle
+
+	// RejectStatus is the status of a rejected request, it is 429 when it is zero
+	RejectStatus int
+
+	// RejectBody is the body of a rejected request, $limit, $remaining and $reset (the seconds until the window of the
+	// key is reset) are replaced. The body is empty when it is empty.
+	RejectBody string
+
+	// RejectContentType is the content type of RejectBody, it is text/plain when it is empty
+	RejectContentType string
+
+	// LatencyBudget is the timeout of a call to Limiter, a slower call is a failure. There is no timeout when it is
+	// zero.
+	LatencyBudget time.Duration
+}
+
+type AllowResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is the time until the window of the key is reset
+	ResetAfter time.Duration
+}
+
+type Limiter interface {
+	// Allow consumes cost requests of the key, nothing is consumed when the request isn't allowed. The context is
+	// canceled when the latency budget is exceeded.
+	Allow(ctx context.Context, key string, cost int) (AllowResult, error)
+}
+
+type RateLimitMiddleware struct {
+	limiter           Limiter
+	failClosed        bool
+	limitHeader       string
+	remainingHeader   string
+	resetHeader       string
+	rejectStatus      int
+	rejectBody        string
+	rejectContentType string
+	limit             int
+	cost              int
+	keys              []keyTemplate
+	emptyKey          EmptyKeyPolicy
+	fallbackKey       string
+}
+
+func NewMiddleware(opts Options) *RateLimitMiddleware {
+	exprs := opts.Keys
+	if len(exprs) == 0 {
+		exprs = []string{config.CLIENT_IP}
+	}
+
+	keys := make([]keyTemplate, 0, len(exprs))
+	for _, expr := range exprs {
+		keys = append(keys, parseKey(expr))
+	}
+
+	emptyKey := opts.EmptyKey
+	if len(emptyKey) == 0 {
+		emptyKey = EmptyKeyClientIP
+	}
+
+	var limiter Limiter
+	switch opts.Algorithm {
+	case SlidingWindow:
+		limiter = NewSlidingWindowLimiter(opts.Limit, opts.Window, opts.MaxKeys)
+	case TokenBucket:
+		opts.Limit = opts.Burst
+		limiter = NewTokenBucketLimiter(opts.Rate, opts.Burst, opts.MaxKeys)
+	default:
+		limiter = NewMemoryLimiter(opts.Limit, opts.Window, opts.MaxKeys)
+	}
+
+	if opts.Limiter != nil {
+		failover := &failoverLimiter{
+			policy:        opts.Failover,
+			primary:       opts.Limiter,
+			latencyBudget: opts.LatencyBudget,
+		}
+		if opts.Failover == LocalFallback {
+			failover.local = limiter
+		}
+		limiter = failover
+	}
+
+	cost := opts.Cost
+	if cost <= 0 {
+		cost = 1
+	}
+
+	prefix := "RateLimit-"
+	if opts.Headers == HeadersLegacy {
+		prefix = "X-RateLimit-"
+	}
+
+	rejectStatus := opts.RejectStatus
+	if rejectStatus == 0 {
+		rejectStatus = consts.StatusTooManyRequests
+	}
+
+	rejectContentType := opts.RejectContentType
+	if len(rejectContentType) == 0 {
+		rejectContentType = "text/plain; charset=utf-8"
+	}
+
+	return &RateLimitMiddleware{
+		limiter:           limiter,
+		failClosed:        opts.Limiter != nil && opts.Failover == FailClosed,
+		limitHeader:       prefix + "Limit",
+		remainingHeader:   prefix + "Remaining",
+		resetHeader:       prefix + "Reset",
+		rejectStatus:      rejectStatus,
+		rejectBody:        opts.RejectBody,
+		rejectContentType: rejectContentType,
+		limit:             opts.Limit,
+		cost:              cost,
+		keys:              keys,
+		emptyKey:          emptyKey,
+		fallbackKey:       opts.FallbackKey,
+	}
+}
+
+func (m *RateLimitMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	cost := m.cost
+	if val, ok := ctx.Get(Cost); ok {
+		if routeCost, ok := val.(int); ok && routeCost > 0 {
+			cost = routeCost
+		}
+	}
+
+	// the request can't be allowed in any window, so there is no Retry-After
+	if cost > m.limit {
+		m.reject(ctx, AllowResult{Limit: m.limit}, false)
+		return
+	}
+
+	// no bucket is consulted when the request is not limited or the limiter fails, the headers have the full limit
+	unlimited := AllowResult{Limit: m.limit, Remaining: m.limit}
+
+	key, found := m.key(ctx)
+	if !found {
+		switch m.emptyKey {
+		case EmptyKeyAllow:
+			ctx.Next(c)
+			m.setHeaders(ctx, unlimited)
+			return
+		case EmptyKeyDeny:
+			// the request has nothing to be limited by, so it is never allowed and there is no Retry-After
+			m.reject(ctx, AllowResult{Limit: m.limit}, false)
+			return
+		}
+
+		key = m.fallbackKey
+		if len(key) == 0 {
+			key = getVariable(ctx, config.CLIENT_IP)
+		}
+	}
+
+	result, err := m.limiter.Allow(c, key, cost)
+	if err != nil {
+		if m.failClosed {
+			m.setHeaders(ctx, unlimited)
+			ctx.AbortWithStatus(consts.StatusServiceUnavailable)
+			return
+		}
+
+		// the limiter is unavailable, the request is not limited
+		ctx.Next(c)
+		m.setHeaders(ctx, unlimited)
+		return
+	}
+
+	if !result.Allowed {
+		m.reject(ctx, result, true)
+		return
+	}
+
+	ctx.Next(c)
+
+	// the response of the upstream replaces the headers, so they are set after it
+	m.setHeaders(ctx, result)
+}
+
+// reject responds the rejection of the request and sets $rate_limited for the access log and the metrics
+func (m *RateLimitMiddleware) reject(ctx *app.RequestContext, result AllowResult, retryAfter bool) {
+	ctx.Set(config.RATE_LIMITED, true)
+
+	m.setHeaders(ctx, result)
+	if retryAfter {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(resetSeconds(result.ResetAfter)))
+	}
+
+	if len(m.rejectBody) > 0 {
+		body := m.rejectBody
+		if strings.Contains(body, "$") {
+			body = strings.NewReplacer(
+				"$limit", strconv.Itoa(result.Limit),
+				"$remaining", strconv.Itoa(result.Remaining),
+				"$reset", strconv.Itoa(resetSeconds(result.ResetAfter)),
+			).Replace(body)
+		}
+		ctx.Response.Header.SetContentType(m.rejectContentType)
+		ctx.Response.SetBodyString(body)
+	}
+
+	ctx.AbortWithStatus(m.rejectStatus)
+}
+
+func (m *RateLimitMiddleware) setHeaders(ctx *app.RequestContext, result AllowResult) {
+	ctx.Response.Header.Set(m.limitHeader, strconv.Itoa(result.Limit))
+	ctx.Response.Header.Set(m.remainingHeader, strconv.Itoa(result.Remaining))
+	ctx.Response.Header.Set(m.resetHeader, strconv.Itoa(resetSeconds(result.ResetAfter)))
+}
+
+// key joins the keys of the request with ':', it reports false when all the variables are empty
+func (m *RateLimitMiddleware) key(ctx *app.RequestContext) (string, bool) {
+	values := make([]string, 0, len(m.keys))
+	found := false
+
+	for _, key := range m.keys {
+		val, ok := key.resolve(ctx)
+		if ok {
+			found = true
+		}
+		values = append(values, val)
+	}
+
+	return strings.Join(values, ":"), found
+}
+
+type keySegment struct {
+	value    string
+	variable bool
+}
+
+// keyTemplate is a key expression split into constants and variables, for example "$client_ip:$request_path"
+type keyTemplate []keySegment
+
+func parseKey(expr string) keyTemplate {
+	template := keyTemplate{}
+	constant := strings.Builder{}
+
+	for i := 0; i < len(expr); {
+		end := i + 1
+		if expr[i] == '$' {
+			for end < len(expr) && isVariableChar(expr[end]) {
+				end++
+			}
+		}
+
+		// a '$' which isn't followed by a name is a constant
+		if end-i < 2 {
+			constant.WriteByte(expr[i])
+			i++
+			continue
+		}
+
+		if constant.Len() > 0 {
+			template = append(template, keySegment{value: constant.String()})
+			constant.Reset()
+		}
+		template = append(template, keySegment{value: expr[i:end], variable: true})
+		i = end
+	}
+
+	if constant.Len() > 0 {
+		template = append(template, keySegment{value: constant.String()})
+	}
+	return template
+}
+
+// resolve replaces the variables of the template, it reports false when all the variables are empty.
+// A template without variables is a constant key which is shared by all the requests.
+func (t keyTemplate) resolve(ctx *app.RequestContext) (string, bool) {
+	b := strings.Builder{}
+	variables, found := false, false
+
+	for _, segment := range t {
+		if !segment.variable {
+			b.WriteString(segment.value)
+			continue
+		}
+
+		variables = true
+		val := getVariable(ctx, segment.value)
+		if len(val) > 0 {
+			found = true
+		}
+		b.WriteString(val)
+	}
+	return b.String(), found || !variables
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// LimitBy converts a limit_by shorthand to a key variable: ip, path, header:<name>, cookie:<name>, or a variable
+// such as $jwt_sub
+func LimitBy(value string) (string, error) {
+	switch {
+	case value == "ip":
+		return config.CLIENT_IP, nil
+	case value == "path":
+		return config.REQUEST_PATH, nil
+	case strings.HasPrefix(value, "header:") && len(value) > len("header:"):
+		return "$header_" + value[len("header:"):], nil
+	case strings.HasPrefix(value, "cookie:") && len(value) > len("cookie:"):
+		return "$cookie_" + value[len("cookie:"):], nil
+	case strings.HasPrefix(value, "$") && len(value) > 1:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("limit_by '%s' must be ip, path, header:<name>, cookie:<name> or a variable", value)
+}
+
+func getVariable(ctx *app.RequestContext, variable string) string {
+	switch {
+	case variable == config.CLIENT_IP:
+		// X-Forwarded-For is only used when the connection is a trusted proxy of the entry
+		if ip := ctx.GetString(config.CLIENT_IP); len(ip) > 0 {
+			return ip
+		}
+		return remoteIP(ctx)
+	case variable == config.REQUEST_PATH:
+		// path rewrite middlewares save the path of the client before rewriting it
+		if path := ctx.GetString(config.REQUEST_PATH); len(path) > 0 {
+			return path
+		}
+		return string(ctx.Request.Path())
+	case strings.HasPrefix(variable, "$header_"):
+		// the underscores of the name are dashes like nginx, $header_x_api_key is the X-Api-Key header
+		return string(ctx.Request.Header.Peek(strings.ReplaceAll(variable[len("$header_"):], "_", "-")))
+	case strings.HasPrefix(variable, "$cookie_"):
+		return string(ctx.Cookie(variable[len("$cookie_"):]))
+	}
+
+	// the variables set by other middlewares, for example $api_key_owner
+	return ctx.GetString(variable)
+}
+
+func remoteIP(ctx *app.RequestContext) string {
+	switch addr := ctx.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+
+	if addr := ctx.RemoteAddr(); addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			return host
+		}
+		return addr.String()
+	}
+	return ""
+}
+
+// resetSeconds rounds up, so a client never retries before the window is reset
+func resetSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultShards is the number of shards of a local limiter, the keys of a shard share a lock
+const defaultShards = 32
+
+type entry[V any] struct {
+	key   string
+	value V
+}
+
+// shard holds the state of the keys ordered by their last request. When it is full, the least recently used key
+// is evicted and the next request of that key starts a new window.
+type shard[V any] struct {
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	lru       *list.List
+	maxKeys   int
+	cleanedAt time.Time
+}
+
+type shards[V any] []*shard[V]
+
+// newShards splits maxKeys between the shards, the keys are unbounded when it is zero
+func newShards[V any](maxKeys int) shards[V] {
+	n, perShard := defaultShards, 0
+	if maxKeys > 0 {
+		// a small maxKeys uses fewer shards, so a shard still holds enough keys for the lru to be useful
+		n = min(defaultShards, max(1, maxKeys/64))
+		perShard = maxKeys / n
+	}
+
+	s := make(shards[V], n)
+	for i := range s {
+		s[i] = &shard[V]{
+			items:   make(map[string]*list.Element),
+			lru:     list.New(),
+			maxKeys: perShard,
+		}
+	}
+	return s
+}
+
+// of returns the shard of the key by the fnv-1a hash of the key
+func (s shards[V]) of(key string) *shard[V] {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s[h%uint32(len(s))]
+}
+
+// get returns the value of the key and marks it as recently used, the lock must be held
+func (s *shard[V]) get(key string) (V, bool) {
+	elem, found := s.items[key]
+	if !found {
+		var zero V
+		return zero, false
+	}
+
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*entry[V]).value, true
+}
+
+// set stores the value of the key and evicts the least recently used key when the shard is full, the lock must
+// be held
+func (s *shard[V]) set(key string, value V) {
+	if elem, found := s.items[key]; found {
+		elem.Value.(*entry[V]).value = value
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(&entry[V]{key: key, value: value})
+
+	if s.maxKeys > 0 && s.lru.Len() > s.maxKeys {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(*entry[V]).key)
+	}
+}
+
+// cleanup removes the expired keys once per interval, the lock must be held
+func (s *shard[V]) cleanup(now time.Time, interval time.Duration, expired func(V) bool) {
+	if now.Sub(s.cleanedAt) < interval {
+		return
+	}
+
+	for key, elem := range s.items {
+		if expired(elem.Value.(*entry[V]).value) {
+			s.lru.Remove(elem)
+			delete(s.items, key)
+		}
+	}
+	s.cleanedAt = now
+}
+
+// len returns the number of the keys of the shards
+func (s shards[V]) len() int {
+	n := 0
+	for _, shard := range s {
+		shard.mu.Lock()
+		n += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return n
+}
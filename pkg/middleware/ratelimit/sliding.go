@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+type requestLog struct {
+	times []time.Time
+}
+
+// SlidingWindowLimiter is a sliding window log limiter of a single instance. It keeps the time of the allowed
+// requests of every key within the trailing window, so a client can't burst twice the limit at the boundary
+// of two fixed windows. A key holds at most limit entries, and the least recently used keys are evicted when
+// maxKeys is exceeded.
+type SlidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+	shards shards[*requestLog]
+}
+
+// NewSlidingWindowLimiter creates a sliding window limiter which tracks at most maxKeys keys, they are unbounded
+// when it is zero
+func NewSlidingWindowLimiter(limit int, window time.Duration, maxKeys int) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		limit:  limit,
+		window: window,
+		shards: newShards[*requestLog](maxKeys),
+	}
+}
+
+func (l *SlidingWindowLimiter) Allow(ctx context.Context, key string, cost int) (AllowResult, error) {
+	now := time.Now()
+	start := now.Add(-l.window)
+
+	s := l.shards.of(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now, l.window, func(log *requestLog) bool {
+		return len(log.times) == 0 || !log.times[len(log.times)-1].After(start)
+	})
+
+	log, found := s.get(key)
+	if !found {
+		log = &requestLog{}
+		s.set(key, log)
+	}
+
+	// evict the requests which are out of the trailing window, the log is sorted by time
+	expired := 0
+	for expired < len(log.times) && !log.times[expired].After(start) {
+		expired++
+	}
+	log.times = log.times[expired:]
+
+	result := AllowResult{
+		Limit: l.limit,
+	}
+
+	if len(log.times)+cost > l.limit {
+		result.Remaining = l.limit - len(log.times)
+		result.ResetAfter = l.window
+
+		// the request is allowed when enough of the oldest requests are out of the window
+		if expiring := cost - result.Remaining; expiring <= len(log.times) {
+			result.ResetAfter = log.times[expiring-1].Add(l.window).Sub(now)
+		}
+		return result, nil
+	}
+
+	// a request of cost n is logged n times
+	for i := 0; i < cost; i++ {
+		log.times = append(log.times, now)
+	}
+
+	result.Allowed = true
+	result.Remaining = l.limit - len(log.times)
+	result.ResetAfter = log.times[0].Add(l.window).Sub(now)
+	return result, nil
+}
+
+// Len returns the number of the tracked keys
+func (l *SlidingWindowLimiter) Len() int {
+	return l.shards.len()
+}
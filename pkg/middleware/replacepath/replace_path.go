@@ -8,6 +8,9 @@ import (
 	"github.com/cloudwego/hertz/pkg/app"
 )
 
+// ReplacePathMiddleware replaces the path. The path of the client is saved in $request_path and sent to the upstream
+// in X-Replaced-Path, it is the path before the first rewrite when the middlewares are chained, like
+// replace_path_regex.
 type ReplacePathMiddleware struct {
 	newPath []byte
 }
@@ -24,13 +27,13 @@ func NewMiddleware(newPath string) *ReplacePathMiddleware {
 }
 
 func (m *ReplacePathMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
-	path := string(ctx.Request.Path())
-	_, found := ctx.Get(config.REQUEST_PATH)
-	if !found {
-		ctx.Set(config.REQUEST_PATH, path)
+	originalPath := ctx.GetString(config.REQUEST_PATH)
+	if len(originalPath) == 0 {
+		originalPath = string(ctx.Request.Path())
+		ctx.Set(config.REQUEST_PATH, originalPath)
 	}
 
-	ctx.Request.Header.Set("X-Replaced-Path", path)
+	ctx.Request.Header.Set("X-Replaced-Path", originalPath)
 	ctx.Request.URI().SetPathBytes(m.newPath)
 
 	ctx.Next(c)
@@ -8,29 +8,40 @@ import (
 	"github.com/cloudwego/hertz/pkg/app"
 )
 
+// ReplacePathRegexMiddleware rewrites the path which matches the regex. The path of the client is saved in
+// $request_path and sent to the upstream in X-Replaced-Path, it is the path before the first rewrite when the
+// middlewares are chained, for example strip_prefix and replace_path_regex.
 type ReplacePathRegexMiddleware struct {
 	regex       *regexp.Regexp
 	replacement []byte
 }
 
-func NewMiddleware(regex, replacement string) *ReplacePathRegexMiddleware {
-
-	re := regexp.MustCompile(regex)
+func NewMiddleware(regex, replacement string) (*ReplacePathRegexMiddleware, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
 
 	return &ReplacePathRegexMiddleware{
 		regex:       re,
 		replacement: []byte(replacement),
-	}
+	}, nil
 }
 
 func (m *ReplacePathRegexMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
-	originalPath := string(ctx.Request.Path())
-	_, found := ctx.Get(config.REQUEST_PATH)
-	if !found {
+	path := ctx.Request.Path()
+	if !m.regex.Match(path) {
+		ctx.Next(c)
+		return
+	}
+
+	originalPath := ctx.GetString(config.REQUEST_PATH)
+	if len(originalPath) == 0 {
+		originalPath = string(path)
 		ctx.Set(config.REQUEST_PATH, originalPath)
 	}
 
-	newPath := m.regex.ReplaceAll(ctx.Request.Path(), m.replacement)
+	newPath := m.regex.ReplaceAll(path, m.replacement)
 
 	ctx.Request.Header.Set("X-Replaced-Path", originalPath)
 
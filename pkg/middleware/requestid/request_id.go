@@ -0,0 +1,87 @@
+package requestid
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/log"
+	"log/slog"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultHeader = "X-Request-ID"
+
+	// maxLength limits the incoming ids, a longer id is replaced with a generated one
+	maxLength = 128
+)
+
+type Options struct {
+	// Header carries the id from the client, to the upstream and back to the client
+	Header string
+
+	// TrustIncoming keeps the id sent by the client, a new id is always generated when it is false
+	TrustIncoming bool
+}
+
+// RequestIDMiddleware sets $request_id to the id sent by the client or to a new uuid v7. The id is sent to the
+// upstream, echoed on the response and added to the logger of the request.
+type RequestIDMiddleware struct {
+	header        string
+	trustIncoming bool
+}
+
+func NewMiddleware(opts Options) *RequestIDMiddleware {
+	header := opts.Header
+	if len(header) == 0 {
+		header = DefaultHeader
+	}
+
+	return &RequestIDMiddleware{
+		header:        header,
+		trustIncoming: opts.TrustIncoming,
+	}
+}
+
+func (m *RequestIDMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	id := ""
+	if m.trustIncoming {
+		id = string(ctx.Request.Header.Peek(m.header))
+	}
+
+	if !isValid(id) {
+		id = newID()
+	}
+
+	ctx.Set(config.REQUEST_ID, id)
+	ctx.Request.Header.Set(m.header, id)
+
+	logger := log.FromContext(c).With(slog.String("request_id", id))
+	ctx.Next(log.NewContext(c, logger))
+
+	ctx.Response.Header.Set(m.header, id)
+}
+
+// isValid reports whether the incoming id can be logged and forwarded as is, only visible ascii is accepted
+func isValid(id string) bool {
+	if len(id) == 0 || len(id) > maxLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
+}
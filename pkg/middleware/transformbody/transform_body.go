@@ -0,0 +1,286 @@
+package transformbody
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"http-benchmark/pkg/log"
+	"http-benchmark/pkg/middleware/decompress"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// DefaultMaxSize is the limit of a body read by the middleware, the encoded, the decoded and the transformed body
+// are held in memory at the same time
+const DefaultMaxSize = 8 * 1024 * 1024
+
+var ErrTooLarge = errors.New("body is too large to transform")
+
+// Func rewrites a body and returns the new one. The body is always decoded, the compression of the client or
+// the upstream is removed before Func is called. It isn't called for an empty body. body must not be kept after
+// Func returns.
+type Func func(c context.Context, ctx *app.RequestContext, body []byte) ([]byte, error)
+
+var (
+	funcsMu sync.RWMutex
+	funcs   = map[string]Func{}
+)
+
+// Register makes the function available to the transform_body middleware of the config by name, it must be called
+// before the config is loaded, for example in an init function
+func Register(name string, fn Func) error {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+
+	if _, found := funcs[name]; found {
+		return fmt.Errorf("body transform '%s' already exists", name)
+	}
+
+	funcs[name] = fn
+	return nil
+}
+
+// Get returns the function registered by Register
+func Get(name string) (Func, bool) {
+	funcsMu.RLock()
+	defer funcsMu.RUnlock()
+
+	fn, found := funcs[name]
+	return fn, found
+}
+
+type Options struct {
+	// Request rewrites the request body before it is sent to the upstream, the request body isn't read when it is nil
+	Request Func
+
+	// Response rewrites the response body before it is sent to the client, the response body isn't read when it is nil
+	Response Func
+
+	// ContentTypes are the media types of the bodies which are transformed, for example application/json.
+	// Every body is transformed when it is empty.
+	ContentTypes []string
+
+	// MaxSize is the limit of the body in bytes, it is DefaultMaxSize when it is zero
+	MaxSize int
+}
+
+// TransformBodyMiddleware buffers the request and the response body and rewrites them with the functions of the
+// options. A streamed or chunked body is read to the end, a compressed body is decoded and sent uncompressed, and
+// Content-Length is set to the new body. It defeats the streaming of the service, so it is only meant for the
+// routes which need it.
+// A request which can't be transformed is rejected with 400, or 413 when it exceeds MaxSize. A response which can't
+// be transformed is replaced with 502, so the untransformed body never reaches the client.
+type TransformBodyMiddleware struct {
+	request      Func
+	response     Func
+	contentTypes []string
+	maxSize      int
+}
+
+func NewMiddleware(opts Options) *TransformBodyMiddleware {
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	contentTypes := make([]string, 0, len(opts.ContentTypes))
+	for _, contentType := range opts.ContentTypes {
+		contentTypes = append(contentTypes, strings.ToLower(strings.TrimSpace(contentType)))
+	}
+
+	return &TransformBodyMiddleware{
+		request:      opts.Request,
+		response:     opts.Response,
+		contentTypes: contentTypes,
+		maxSize:      maxSize,
+	}
+}
+
+func (m *TransformBodyMiddleware) ServeHTTP(c context.Context, ctx *app.RequestContext) {
+	if m.request != nil {
+		if status, err := m.transformRequest(c, ctx); err != nil {
+			log.FromContext(c).ErrorContext(c, "fail to transform request body", slog.String("error", err.Error()))
+			ctx.AbortWithStatus(status)
+			return
+		}
+	}
+
+	ctx.Next(c)
+
+	if m.response != nil {
+		if err := m.transformResponse(c, ctx); err != nil {
+			log.FromContext(c).ErrorContext(c, "fail to transform response body", slog.String("error", err.Error()))
+			ctx.Response.Reset()
+			ctx.Response.SetStatusCode(consts.StatusBadGateway)
+		}
+	}
+}
+
+func (m *TransformBodyMiddleware) transformRequest(c context.Context, ctx *app.RequestContext) (int, error) {
+	req := &ctx.Request
+	if !m.matchContentType(req.Header.ContentType()) {
+		return 0, nil
+	}
+
+	if req.IsBodyStream() {
+		stream := req.BodyStream()
+		buf := req.BodyBuffer()
+		buf.Reset()
+
+		n, err := io.CopyN(buf, stream, int64(m.maxSize)+1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return consts.StatusBadRequest, err
+		}
+		if n > int64(m.maxSize) {
+			return consts.StatusRequestEntityTooLarge, ErrTooLarge
+		}
+
+		// the stream is detached without closing it, it is closed by the server which owns it
+		req.ConstructBodyStream(buf, nil)
+	}
+
+	body := req.BodyBytes()
+	if len(body) == 0 {
+		return 0, nil
+	}
+	if len(body) > m.maxSize {
+		return consts.StatusRequestEntityTooLarge, ErrTooLarge
+	}
+
+	encoding := contentEncoding(req.Header.Peek("Content-Encoding"))
+	if len(encoding) > 0 {
+		if !decompress.IsSupported(encoding) {
+			return consts.StatusUnsupportedMediaType, fmt.Errorf("content encoding '%s' is not supported", encoding)
+		}
+
+		decoded, err := decompress.Decode(encoding, body, m.maxSize)
+		if errors.Is(err, decompress.ErrTooLarge) {
+			return consts.StatusRequestEntityTooLarge, ErrTooLarge
+		}
+		if err != nil {
+			return consts.StatusBadRequest, err
+		}
+		body = decoded
+	}
+
+	transformed, err := m.request(c, ctx, body)
+	if err != nil {
+		return consts.StatusBadRequest, err
+	}
+
+	req.Header.Del("Content-Encoding")
+	req.SetBody(transformed)
+	req.Header.SetContentLength(len(transformed))
+	return 0, nil
+}
+
+func (m *TransformBodyMiddleware) transformResponse(c context.Context, ctx *app.RequestContext) error {
+	resp := &ctx.Response
+	if !m.transformable(ctx) {
+		return nil
+	}
+
+	var body []byte
+	if resp.IsBodyStream() {
+		if resp.Header.ContentLength() > m.maxSize {
+			return ErrTooLarge
+		}
+
+		b, err := io.ReadAll(io.LimitReader(resp.BodyStream(), int64(m.maxSize)+1))
+		// the upstream connection is released, it is closed when the body isn't read to the end
+		_ = resp.CloseBodyStream()
+		if err != nil {
+			return err
+		}
+		body = b
+	} else {
+		body = resp.BodyBytes()
+	}
+
+	if len(body) > m.maxSize {
+		return ErrTooLarge
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	encoding := contentEncoding(resp.Header.Peek("Content-Encoding"))
+	if len(encoding) > 0 {
+		if !decompress.IsSupported(encoding) {
+			return fmt.Errorf("content encoding '%s' is not supported", encoding)
+		}
+
+		decoded, err := decompress.Decode(encoding, body, m.maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	transformed, err := m.response(c, ctx, body)
+	if err != nil {
+		return err
+	}
+
+	if len(encoding) > 0 {
+		resp.Header.Del("Content-Encoding")
+	}
+	// the etag was computed for the original body
+	if etag := resp.Header.Peek("ETag"); len(etag) > 0 && !bytes.HasPrefix(etag, []byte("W/")) {
+		resp.Header.Set("ETag", "W/"+string(etag))
+	}
+	resp.SetBody(transformed)
+	resp.Header.SetContentLength(len(transformed))
+	return nil
+}
+
+// transformable reports whether the response has a complete body to transform, server-sent events never end and
+// a partial body can't be rewritten
+func (m *TransformBodyMiddleware) transformable(ctx *app.RequestContext) bool {
+	resp := &ctx.Response
+
+	if ctx.Request.Header.IsHead() {
+		return false
+	}
+
+	switch status := resp.StatusCode(); {
+	case status < 200, status == consts.StatusNoContent, status == consts.StatusPartialContent, status == consts.StatusNotModified:
+		return false
+	}
+
+	contentType := resp.Header.ContentType()
+	if bytes.HasPrefix(contentType, []byte("text/event-stream")) {
+		return false
+	}
+
+	return m.matchContentType(contentType)
+}
+
+func (m *TransformBodyMiddleware) matchContentType(contentType []byte) bool {
+	if len(m.contentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, _ := strings.Cut(string(contentType), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range m.contentTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func contentEncoding(value []byte) string {
+	encoding := strings.ToLower(strings.TrimSpace(string(value)))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
@@ -2,6 +2,7 @@ package file
 
 import (
 	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/provider"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -10,12 +11,10 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
-type ChangeFunc func() error
+type ChangeFunc = provider.ChangeFunc
+
+type ContentInfo = provider.ContentInfo
 
-type ContentInfo struct {
-	Content string
-	Path    string
-}
 type FileProvider struct {
 	opts      config.FileProviderOptions
 	watcher   *fsnotify.Watcher
@@ -66,6 +65,10 @@ func (p *FileProvider) Open() ([]*ContentInfo, error) {
 	return contents, nil
 }
 
+func (p *FileProvider) SetOnChanged(onChanged ChangeFunc) {
+	p.OnChanged = onChanged
+}
+
 func (p *FileProvider) Watch() error {
 	var err error
 
@@ -0,0 +1,16 @@
+package provider
+
+type ChangeFunc func() error
+
+type ContentInfo struct {
+	Content string
+	Path    string
+}
+
+// Provider is a source of config contents, they are merged over the main config file.
+// A watching provider calls the change func when its contents change.
+type Provider interface {
+	Open() ([]*ContentInfo, error)
+	Watch() error
+	SetOnChanged(onChanged ChangeFunc)
+}
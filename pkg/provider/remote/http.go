@@ -0,0 +1,147 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"http-benchmark/pkg/config"
+	"http-benchmark/pkg/provider"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultInterval = 30 * time.Second
+)
+
+// HTTPProvider fetches the config from an http endpoint. The endpoint is polled when it is watched, a failed fetch
+// is logged and the config which is running is kept.
+type HTTPProvider struct {
+	opts      config.HTTPProviderOptions
+	client    *http.Client
+	mu        sync.Mutex
+	content   string
+	stopOnce  sync.Once
+	stopCh    chan bool
+	OnChanged provider.ChangeFunc
+}
+
+func NewHTTPProvider(opts config.HTTPProviderOptions) *HTTPProvider {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &HTTPProvider{
+		opts:   opts,
+		client: &http.Client{Timeout: timeout},
+		stopCh: make(chan bool),
+	}
+}
+
+func (p *HTTPProvider) Open() ([]*provider.ContentInfo, error) {
+	content, err := p.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.content = content
+	p.mu.Unlock()
+
+	return []*provider.ContentInfo{{Content: content, Path: p.opts.URL}}, nil
+}
+
+func (p *HTTPProvider) SetOnChanged(onChanged provider.ChangeFunc) {
+	p.OnChanged = onChanged
+}
+
+func (p *HTTPProvider) Watch() error {
+	if len(p.opts.URL) == 0 {
+		return nil
+	}
+
+	interval := p.opts.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.poll()
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops polling the endpoint
+func (p *HTTPProvider) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	return nil
+}
+
+func (p *HTTPProvider) poll() {
+	content, err := p.fetch()
+	if err != nil {
+		slog.Error("http provider: fail to fetch config, the current config is kept", "url", p.opts.URL, "error", err)
+		return
+	}
+
+	p.mu.Lock()
+	changed := content != p.content
+	p.content = content
+	p.mu.Unlock()
+
+	if changed && p.OnChanged != nil {
+		err := p.OnChanged()
+		if err != nil {
+			slog.Error("Error in OnChanged:", "error:", err)
+		}
+	}
+}
+
+func (p *HTTPProvider) fetch() (string, error) {
+	if len(p.opts.URL) == 0 {
+		return "", fmt.Errorf("http provider url can't be empty")
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, p.opts.URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range p.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http provider: unexpected status code %d from '%s'", resp.StatusCode, p.opts.URL)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
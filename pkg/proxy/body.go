@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const bodyReplayableKey = "body_replayable"
+
+// BufferRequestBody makes the request body replayable, so retries, mirrors and middlewares can send or read it
+// more than once. A body stream, like the body of an http2 request, is read once into the pooled body buffer of the
+// request, and every copy of the request carries it from then on. It returns false when the body is larger than
+// maxSize; the bytes already read are put back in front of the stream, so the request can still be sent once.
+// The result is kept in the request context, so the body is only read by the first call and its maxSize applies
+// to the later calls.
+func BufferRequestBody(ctx *app.RequestContext, maxSize int) (bool, error) {
+	if val, found := ctx.Get(bodyReplayableKey); found {
+		return val.(bool), nil
+	}
+
+	replayable, err := bufferRequestBody(ctx, maxSize)
+	if err != nil {
+		return false, err
+	}
+
+	ctx.Set(bodyReplayableKey, replayable)
+	return replayable, nil
+}
+
+func bufferRequestBody(ctx *app.RequestContext, maxSize int) (bool, error) {
+	req := &ctx.Request
+
+	// the server has already read the body
+	if !req.IsBodyStream() {
+		return len(req.BodyBytes()) <= maxSize, nil
+	}
+
+	stream := req.BodyStream()
+	body := req.BodyBuffer()
+	body.Reset()
+
+	n, err := io.CopyN(body, stream, int64(maxSize)+1)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	if err != nil || n > int64(maxSize) {
+		rest := io.MultiReader(bytes.NewReader(bytes.Clone(body.B)), stream)
+		body.Reset()
+		req.ConstructBodyStream(body, rest)
+		return false, err
+	}
+
+	// the stream is detached without closing it, it is closed by the server which owns it
+	req.ConstructBodyStream(body, nil)
+	req.Header.SetContentLength(body.Len())
+	return true, nil
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferRequestBody(t *testing.T) {
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetBodyStream(strings.NewReader("hello"), -1)
+
+	replayable, err := BufferRequestBody(hzCtx, 5)
+	assert.NoError(t, err)
+	assert.True(t, replayable)
+	assert.False(t, hzCtx.Request.IsBodyStream())
+	assert.Equal(t, "hello", string(hzCtx.Request.Body()))
+
+	req := protocol.Request{}
+	hzCtx.Request.CopyTo(&req)
+	assert.Equal(t, "hello", string(req.Body()))
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetBodyStream(strings.NewReader("hello world"), -1)
+
+	replayable, err = BufferRequestBody(hzCtx, 5)
+	assert.NoError(t, err)
+	assert.False(t, replayable)
+	assert.True(t, hzCtx.Request.IsBodyStream())
+	assert.Equal(t, "hello world", string(hzCtx.Request.Body()))
+}
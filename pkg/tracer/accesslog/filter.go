@@ -0,0 +1,374 @@
+package accesslog
+
+import (
+	"fmt"
+	"http-benchmark/pkg/config"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// filter is a compiled access log filter expression, for example:
+//
+//	status >= 400 || path !~ "^/healthz"
+//
+// Supported fields are status, upstream_status, method, path, host and user_agent.
+// Expressions are combined with &&, || and ! and can be grouped with parentheses.
+type filter interface {
+	match(c *app.RequestContext) bool
+}
+
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	numberField
+)
+
+type field struct {
+	kind     fieldKind
+	getStr   func(c *app.RequestContext) string
+	getNum   func(c *app.RequestContext) float64
+	validOps []string
+}
+
+var (
+	stringOps = []string{"==", "!=", "=~", "!~"}
+	numberOps = []string{"==", "!=", ">", ">=", "<", "<="}
+)
+
+var filterFields = map[string]field{
+	"status": {
+		kind:     numberField,
+		getNum:   func(c *app.RequestContext) float64 { return float64(c.Response.StatusCode()) },
+		validOps: numberOps,
+	},
+	"upstream_status": {
+		kind:     numberField,
+		getNum:   func(c *app.RequestContext) float64 { return float64(c.GetInt(config.UPSTREAM_STATUS)) },
+		validOps: numberOps,
+	},
+	"method": {
+		kind:     stringField,
+		getStr:   func(c *app.RequestContext) string { return b2s(c.Request.Method()) },
+		validOps: stringOps,
+	},
+	"path": {
+		kind: stringField,
+		getStr: func(c *app.RequestContext) string {
+			if path := c.GetString(config.REQUEST_PATH); len(path) > 0 {
+				return path
+			}
+			return b2s(c.Request.Path())
+		},
+		validOps: stringOps,
+	},
+	"host": {
+		kind:     stringField,
+		getStr:   func(c *app.RequestContext) string { return b2s(c.Request.Host()) },
+		validOps: stringOps,
+	},
+	"user_agent": {
+		kind:     stringField,
+		getStr:   func(c *app.RequestContext) string { return b2s(c.Request.Header.UserAgent()) },
+		validOps: stringOps,
+	},
+}
+
+type andFilter struct {
+	left, right filter
+}
+
+func (f *andFilter) match(c *app.RequestContext) bool {
+	return f.left.match(c) && f.right.match(c)
+}
+
+type orFilter struct {
+	left, right filter
+}
+
+func (f *orFilter) match(c *app.RequestContext) bool {
+	return f.left.match(c) || f.right.match(c)
+}
+
+type notFilter struct {
+	inner filter
+}
+
+func (f *notFilter) match(c *app.RequestContext) bool {
+	return !f.inner.match(c)
+}
+
+type compareFilter struct {
+	field field
+	op    string
+	str   string
+	num   float64
+	regex *regexp.Regexp
+}
+
+func (f *compareFilter) match(c *app.RequestContext) bool {
+	if f.field.kind == numberField {
+		val := f.field.getNum(c)
+		switch f.op {
+		case "==":
+			return val == f.num
+		case "!=":
+			return val != f.num
+		case ">":
+			return val > f.num
+		case ">=":
+			return val >= f.num
+		case "<":
+			return val < f.num
+		case "<=":
+			return val <= f.num
+		}
+		return false
+	}
+
+	val := f.field.getStr(c)
+	switch f.op {
+	case "==":
+		return val == f.str
+	case "!=":
+		return val != f.str
+	case "=~":
+		return f.regex.MatchString(val)
+	case "!~":
+		return !f.regex.MatchString(val)
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenOp
+	tokenEOF
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// parseFilter compiles the expression once so that evaluating it per request is cheap.
+func parseFilter(expr string) (filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("access log filter: unexpected '%s'", p.peek().value)
+	}
+
+	return f, nil
+}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '"':
+			end := i + 1
+			var sb strings.Builder
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				// only \" and \\ are unescaped, other backslashes are kept for the regexp, e.g. "\.css$"
+				if expr[end] == '\\' && end+1 < len(expr) && (expr[end+1] == '"' || expr[end+1] == '\\') {
+					end++
+				}
+				sb.WriteByte(expr[end])
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("access log filter: unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokenString, value: sb.String()})
+			i = end + 1
+		case ch >= '0' && ch <= '9':
+			end := i
+			for end < len(expr) && (expr[end] >= '0' && expr[end] <= '9' || expr[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: expr[i:end]})
+			i = end
+		case ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z'):
+			end := i
+			for end < len(expr) && (expr[end] == '_' || expr[end] == '-' || (expr[end] >= 'a' && expr[end] <= 'z') || (expr[end] >= 'A' && expr[end] <= 'Z') || (expr[end] >= '0' && expr[end] <= '9')) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: expr[i:end]})
+			i = end
+		default:
+			if i+1 < len(expr) {
+				switch op := expr[i : i+2]; op {
+				case "==", "!=", ">=", "<=", "=~", "!~", "&&", "||":
+					tokens = append(tokens, token{kind: tokenOp, value: op})
+					i += 2
+					continue
+				}
+			}
+
+			switch ch {
+			case '>', '<', '!', '(', ')':
+				tokens = append(tokens, token{kind: tokenOp, value: string(ch)})
+				i++
+			default:
+				return nil, fmt.Errorf("access log filter: invalid character '%c'", ch)
+			}
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF})
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOp && p.peek().value == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orFilter{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOp && p.peek().value == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andFilter{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filter, error) {
+	t := p.peek()
+
+	if t.kind == tokenOp && t.value == "!" {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{inner: inner}, nil
+	}
+
+	if t.kind == tokenOp && t.value == "(" {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenOp || t.value != ")" {
+			return nil, fmt.Errorf("access log filter: missing ')'")
+		}
+		return inner, nil
+	}
+
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (filter, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("access log filter: expected field but got '%s'", t.value)
+	}
+
+	name := strings.ReplaceAll(strings.ToLower(t.value), "-", "_")
+	f, found := filterFields[name]
+	if !found {
+		return nil, fmt.Errorf("access log filter: unknown field '%s'", t.value)
+	}
+
+	opToken := p.next()
+	if opToken.kind != tokenOp || !slices.Contains(f.validOps, opToken.value) {
+		return nil, fmt.Errorf("access log filter: operator '%s' is not supported for field '%s'", opToken.value, t.value)
+	}
+
+	result := &compareFilter{
+		field: f,
+		op:    opToken.value,
+	}
+
+	val := p.next()
+
+	switch f.kind {
+	case numberField:
+		if val.kind != tokenNumber {
+			return nil, fmt.Errorf("access log filter: field '%s' must be compared with a number", t.value)
+		}
+		num, err := strconv.ParseFloat(val.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("access log filter: invalid number '%s'", val.value)
+		}
+		result.num = num
+	case stringField:
+		if val.kind != tokenString {
+			return nil, fmt.Errorf("access log filter: field '%s' must be compared with a quoted string", t.value)
+		}
+		result.str = val.value
+
+		if result.op == "=~" || result.op == "!~" {
+			regex, err := regexp.Compile(val.value)
+			if err != nil {
+				return nil, fmt.Errorf("access log filter: invalid regexp '%s': %w", val.value, err)
+			}
+			result.regex = regex
+		}
+	}
+
+	return result, nil
+}
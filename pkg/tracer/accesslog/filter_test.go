@@ -0,0 +1,75 @@
+package accesslog
+
+import (
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := parseFilter(`status >= 400 || path !~ "^/healthz"`)
+	assert.NoError(t, err)
+
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/healthz")
+	hzCtx.Response.SetStatusCode(200)
+	assert.False(t, f.match(hzCtx))
+
+	hzCtx.Response.SetStatusCode(503)
+	assert.True(t, f.match(hzCtx))
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	hzCtx.Response.SetStatusCode(200)
+	assert.True(t, f.match(hzCtx))
+
+	f, err = parseFilter(`!(method == "GET" && user-agent =~ "kube-probe")`)
+	assert.NoError(t, err)
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/orders")
+	hzCtx.Request.Header.SetMethod("GET")
+	hzCtx.Request.Header.SetUserAgentBytes([]byte("kube-probe/1.29"))
+	assert.False(t, f.match(hzCtx))
+
+	hzCtx.Request.Header.SetMethod("POST")
+	assert.True(t, f.match(hzCtx))
+}
+
+func TestFilterEscape(t *testing.T) {
+	f, err := parseFilter(`path =~ "\.css$"`)
+	assert.NoError(t, err)
+
+	hzCtx := app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/static/site.css")
+	assert.True(t, f.match(hzCtx))
+
+	// the dot is escaped, so it doesn't match any character
+	hzCtx.Request.SetRequestURI("http://localhost/static/sitexcss")
+	assert.False(t, f.match(hzCtx))
+
+	f, err = parseFilter(`user-agent == "say \"hi\" \\o/"`)
+	assert.NoError(t, err)
+
+	hzCtx = app.NewContext(0)
+	hzCtx.Request.SetRequestURI("http://localhost/")
+	hzCtx.Request.Header.SetUserAgentBytes([]byte(`say "hi" \o/`))
+	assert.True(t, f.match(hzCtx))
+}
+
+func TestFilterInvalid(t *testing.T) {
+	invalid := []string{
+		`status >= "abc"`,
+		`path > 1`,
+		`unknown == "a"`,
+		`(status == 200`,
+		`path =~ "["`,
+		`status == 200 extra`,
+	}
+
+	for _, expr := range invalid {
+		_, err := parseFilter(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,77 @@
+package accesslog
+
+import (
+	"http-benchmark/pkg/config"
+	"strconv"
+
+	"github.com/bytedance/sonic"
+)
+
+var numberVariables = map[string]bool{
+	config.STATUS:              true,
+	config.UPSTREAM_STATUS:     true,
+	config.DURATION:            true,
+	config.UPSTREAM_DURATION:   true,
+	config.RECEIVED_SIZE:       true,
+	config.SEND_SIZE:           true,
+	config.CONNECTION_REQUESTS: true,
+	config.BYTES_SENT:          true,
+	config.BYTES_RECEIVED:      true,
+}
+
+// parseJSONVariables returns the variables of the template in the order they appear,
+// each variable becomes a field of the json object.
+func parseJSONVariables(content string) []string {
+	variables := reIsVariable.FindAllString(content, -1)
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(variables))
+
+	for _, v := range variables {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+
+	return result
+}
+
+// buildJSON turns the resolved variables into one json object per line.
+// The field name is the variable name without '$'.
+func buildJSON(entry []string) []byte {
+	buf := make([]byte, 0, 512)
+	buf = append(buf, '{')
+
+	for i := 0; i+1 < len(entry); i += 2 {
+		name, val := entry[i], entry[i+1]
+
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		key, _ := sonic.Marshal(name[1:])
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+
+		if numberVariables[name] {
+			if _, err := strconv.ParseFloat(val, 64); err == nil {
+				buf = append(buf, val...)
+			} else {
+				buf = append(buf, "null"...)
+			}
+			continue
+		}
+
+		b, err := sonic.Marshal(val)
+		if err != nil {
+			buf = append(buf, `""`...)
+			continue
+		}
+		buf = append(buf, b...)
+	}
+
+	buf = append(buf, '}', '\n')
+	return buf
+}
@@ -0,0 +1,30 @@
+package accesslog
+
+import (
+	"http-benchmark/pkg/config"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildJSON(t *testing.T) {
+	vars := parseJSONVariables("$request_path $status $request_body $upstream_duration $status")
+	assert.Equal(t, []string{config.REQUEST_PATH, config.STATUS, config.REQUEST_BODY, config.UPSTREAM_DURATION}, vars)
+
+	entry := []string{
+		config.REQUEST_PATH, "/orders",
+		config.STATUS, "200",
+		config.REQUEST_BODY, `{"name":"a\b"}`,
+		config.UPSTREAM_DURATION, "",
+	}
+
+	result := map[string]any{}
+	err := sonic.Unmarshal(buildJSON(entry), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/orders", result["request_path"])
+	assert.Equal(t, float64(200), result["status"])
+	assert.Equal(t, `{"name":"a\b"}`, result["request_body"])
+	assert.Nil(t, result["upstream_duration"])
+}
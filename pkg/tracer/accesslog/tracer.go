@@ -3,6 +3,7 @@ package accesslog
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"http-benchmark/pkg/config"
 	"log/slog"
 	"net"
@@ -14,12 +15,14 @@ import (
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/common/tracer/stats"
+	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/valyala/bytebufferpool"
 )
 
 type Tracer struct {
 	opts      config.AccessLogOptions
 	matchVars []string
+	filter    filter
 	logChan   chan []string
 	logFile   *os.File
 	writer    *bufio.Writer
@@ -36,6 +39,14 @@ func NewTracer(opts config.AccessLogOptions) (*Tracer, error) {
 	var err error
 	var logFile *os.File
 
+	var logFilter filter
+	if len(strings.TrimSpace(opts.Filter)) > 0 {
+		logFilter, err = parseFilter(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch opts.Output {
 	case "stderr", "":
 		logFile = os.Stderr
@@ -56,10 +67,18 @@ func NewTracer(opts config.AccessLogOptions) (*Tracer, error) {
 		opts.Flush = 1 * time.Second
 	}
 
+	matchVars := parseVariables(opts.Template)
+	if opts.Format == config.JSONAccessLogFormat {
+		// values are escaped by the json encoder
+		opts.Escape = config.NoneEscape
+		matchVars = parseJSONVariables(opts.Template)
+	}
+
 	tracer := &Tracer{
 		opts:      opts,
+		filter:    logFilter,
 		logChan:   make(chan []string, 1000000),
-		matchVars: parseVariables(opts.Template),
+		matchVars: matchVars,
 		logFile:   logFile,
 		writer:    writer,
 	}
@@ -79,6 +98,11 @@ func NewTracer(opts config.AccessLogOptions) (*Tracer, error) {
 					return
 				}
 
+				if opts.Format == config.JSONAccessLogFormat {
+					_, _ = writer.Write(buildJSON(entry))
+					continue
+				}
+
 				replacer := strings.NewReplacer(entry...)
 				result := replacer.Replace(opts.Template)
 				_, _ = writer.WriteString(result)
@@ -97,6 +121,15 @@ func (t *Tracer) Start(ctx context.Context, c *app.RequestContext) context.Conte
 }
 
 func (t *Tracer) Finish(ctx context.Context, c *app.RequestContext) {
+	// the probes of the entry set it unless they are logged
+	if c.GetBool(config.HEALTH_PROBE) {
+		return
+	}
+
+	if t.filter != nil && !t.filter.match(c) {
+		return
+	}
+
 	result := t.buildReplacer(c)
 
 	select {
@@ -211,6 +244,8 @@ func (t *Tracer) buildReplacer(c *app.RequestContext) []string {
 			replacements = append(replacements, config.UPSTREAM_STATUS, strconv.Itoa(code))
 		case config.UPSTREAM_DURATION:
 			replacements = append(replacements, config.UPSTREAM_DURATION, c.GetString(config.UPSTREAM_DURATION))
+		case config.UPSTREAM_ERROR:
+			replacements = append(replacements, config.UPSTREAM_ERROR, c.GetString(config.UPSTREAM_ERROR))
 		case config.DURATION:
 			httpStart := c.GetTraceInfo().Stats().GetEvent(stats.HTTPStart)
 			if httpStart == nil {
@@ -234,6 +269,52 @@ func (t *Tracer) buildReplacer(c *app.RequestContext) []string {
 			replacements = append(replacements, config.RECEIVED_SIZE, strconv.Itoa(info.RecvSize()))
 		case config.SEND_SIZE:
 			replacements = append(replacements, config.SEND_SIZE, strconv.Itoa(info.SendSize()))
+		case config.BYTES_SENT:
+			bodySize := len(c.Response.Body())
+			if c.Response.IsBodyStream() {
+				bodySize = max(c.Response.Header.ContentLength(), 0)
+			}
+			replacements = append(replacements, config.BYTES_SENT, strconv.Itoa(c.Response.Header.GetHeaderLength()+bodySize))
+		case config.BYTES_RECEIVED:
+			size := len(c.Request.Header.RawHeaders()) + len(c.Request.Body())
+			replacements = append(replacements, config.BYTES_RECEIVED, strconv.Itoa(size))
+		case config.SLOW_REQUEST:
+			replacements = append(replacements, config.SLOW_REQUEST, strconv.FormatBool(c.GetBool(config.SLOW_REQUEST)))
+		case config.RETRY_BUDGET_EXHAUSTED:
+			replacements = append(replacements, config.RETRY_BUDGET_EXHAUSTED, strconv.FormatBool(c.GetBool(config.RETRY_BUDGET_EXHAUSTED)))
+		case config.NO_LIVE_UPSTREAM:
+			replacements = append(replacements, config.NO_LIVE_UPSTREAM, strconv.FormatBool(c.GetBool(config.NO_LIVE_UPSTREAM)))
+		case config.RATE_LIMITED:
+			replacements = append(replacements, config.RATE_LIMITED, strconv.FormatBool(c.GetBool(config.RATE_LIMITED)))
+		case config.CONNECTION_REQUESTS:
+			replacements = append(replacements, config.CONNECTION_REQUESTS, c.GetString(config.CONNECTION_REQUESTS))
+		case config.SSL_PROTOCOL:
+			state, ok := tlsConnectionState(c)
+			if !ok {
+				replacements = append(replacements, config.SSL_PROTOCOL, "")
+				continue
+			}
+			replacements = append(replacements, config.SSL_PROTOCOL, tlsVersionName(state.Version))
+		case config.SSL_CIPHER:
+			state, ok := tlsConnectionState(c)
+			if !ok {
+				replacements = append(replacements, config.SSL_CIPHER, "")
+				continue
+			}
+			replacements = append(replacements, config.SSL_CIPHER, tls.CipherSuiteName(state.CipherSuite))
+		case config.SSL_SERVER_NAME:
+			state, ok := tlsConnectionState(c)
+			if !ok {
+				replacements = append(replacements, config.SSL_SERVER_NAME, "")
+				continue
+			}
+			replacements = append(replacements, config.SSL_SERVER_NAME, escape(state.ServerName, t.opts.Escape))
+		case config.SSL_CLIENT_S_DN:
+			replacements = append(replacements, config.SSL_CLIENT_S_DN, escape(c.GetString(config.SSL_CLIENT_S_DN), t.opts.Escape))
+		case config.REQUEST_ID:
+			replacements = append(replacements, config.REQUEST_ID, escape(c.GetString(config.REQUEST_ID), t.opts.Escape))
+		case config.SSL_CLIENT_SAN:
+			replacements = append(replacements, config.SSL_CLIENT_SAN, escape(c.GetString(config.SSL_CLIENT_SAN), t.opts.Escape))
 		default:
 
 			if strings.HasPrefix(matchVal, "$upstream_header_") {
@@ -273,6 +354,32 @@ func (t *Tracer) buildReplacer(c *app.RequestContext) []string {
 	return replacements
 }
 
+// tlsConnectionState returns the tls state of the client connection, false is returned for plaintext connections
+func tlsConnectionState(c *app.RequestContext) (tls.ConnectionState, bool) {
+	conn, ok := c.GetConn().(network.ConnTLSer)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	state := conn.ConnectionState()
+	return state, state.HandshakeComplete
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return ""
+	}
+}
+
 func escape(s string, escapeType config.EscapeType) string {
 	if len(s) == 0 {
 		return s
@@ -0,0 +1,97 @@
+package accesslog
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"http-benchmark/pkg/config"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSVariables(t *testing.T) {
+	tracer, err := NewTracer(config.AccessLogOptions{
+		Output:   filepath.Join(t.TempDir(), "access.log"),
+		Template: "protocol=$ssl_protocol cipher=$ssl_cipher",
+	})
+	assert.NoError(t, err)
+
+	// the entry is rendered into the response, so it is checked with the connection of the request
+	render := func(c context.Context, ctx *app.RequestContext) {
+		replacer := strings.NewReplacer(tracer.buildReplacer(ctx)...)
+		ctx.String(200, replacer.Replace(tracer.opts.Template))
+	}
+
+	plain := server.New(server.WithHostPorts("127.0.0.1:9894"), server.WithTracer(tracer))
+	plain.GET("/", render)
+	go plain.Spin()
+
+	secure := server.New(
+		server.WithHostPorts("127.0.0.1:9895"),
+		server.WithTracer(tracer),
+		server.WithTLS(&tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}),
+	)
+	secure.GET("/", render)
+	go secure.Spin()
+	time.Sleep(time.Second)
+
+	send := func(uri string) string {
+		cli, err := client.NewClient(client.WithTLSConfig(&tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}))
+		assert.NoError(t, err)
+
+		req := protocol.AcquireRequest()
+		defer protocol.ReleaseRequest(req)
+		resp := &protocol.Response{}
+
+		req.SetRequestURI(uri)
+		err = cli.Do(context.Background(), req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+		return string(resp.Body())
+	}
+
+	t.Run("https", func(t *testing.T) {
+		assert.Equal(t, "protocol=TLSv1.2 cipher=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256\n", send("https://127.0.0.1:9895/"))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		assert.Equal(t, "protocol= cipher=\n", send("http://127.0.0.1:9894/"))
+	})
+}
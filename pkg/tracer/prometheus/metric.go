@@ -25,3 +25,20 @@ func histogramObserve(histogramVec *prom.HistogramVec, value time.Duration, labe
 	histogram.Observe(float64(value.Seconds()))
 	return nil
 }
+
+// histogramObserveWithExemplar wraps ObserveWithExemplar of prom.ExemplarObserver.
+func histogramObserveWithExemplar(histogramVec *prom.HistogramVec, value time.Duration, labels prom.Labels, exemplar prom.Labels) error {
+	histogram, err := histogramVec.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+
+	observer, ok := histogram.(prom.ExemplarObserver)
+	if !ok {
+		histogram.Observe(float64(value.Seconds()))
+		return nil
+	}
+
+	observer.ObserveWithExemplar(float64(value.Seconds()), exemplar)
+	return nil
+}
@@ -24,6 +24,16 @@ type promConfig struct {
 	registry           *prom.Registry
 	runtimeMetricRules []collectors.GoRuntimeMetricsRule
 	disableServer      bool
+	enableExemplars    bool
+	contextLabels      []contextLabel
+}
+
+// contextLabel is a label whose value is read from a variable of the request context.
+// Values which are not in the allow-list are reported as other to cap the cardinality.
+type contextLabel struct {
+	name     string
+	variable string
+	values   map[string]struct{}
 }
 
 func defaultConfig() *promConfig {
@@ -73,3 +83,26 @@ func WithRegistry(registry *prom.Registry) Option {
 		}
 	})
 }
+
+// WithEnableExemplars attach the trace id as an exemplar to the request duration histogram
+func WithEnableExemplars(enable bool) Option {
+	return option(func(cfg *promConfig) {
+		cfg.enableExemplars = enable
+	})
+}
+
+// WithContextLabel adds a label to the request metrics whose value is the string of the context variable,
+// values which are not in the allow-list are reported as other and a missing value as unknown
+func WithContextLabel(name, variable string, values []string) Option {
+	return option(func(cfg *promConfig) {
+		label := contextLabel{
+			name:     name,
+			variable: variable,
+			values:   make(map[string]struct{}, len(values)),
+		}
+		for _, value := range values {
+			label.values[value] = struct{}{}
+		}
+		cfg.contextLabels = append(cfg.contextLabels, label)
+	})
+}
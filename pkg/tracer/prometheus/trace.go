@@ -22,13 +22,17 @@ const (
 	labelMethod     = "method"
 	labelPath       = "path"
 	labelStatusCode = "statusCode"
+	labelTraceID    = "trace_id"
+	labelUpstream   = "upstream"
+	labelError      = "error"
 
 	unknownLabelValue = "unknown"
+	otherLabelValue   = "other"
 )
 
 // genLabels make labels values.
-func genLabels(ctx *app.RequestContext) prom.Labels {
-	labels := make(prom.Labels)
+func genLabels(ctx *app.RequestContext, contextLabels []contextLabel) prom.Labels {
+	labels := make(prom.Labels, 4+len(contextLabels))
 
 	entryID := ctx.GetString(config.ENTRY_ID)
 	labels[labelEntry] = defaultValIfEmpty(entryID, unknownLabelValue)
@@ -36,6 +40,19 @@ func genLabels(ctx *app.RequestContext) prom.Labels {
 	labels[labelStatusCode] = defaultValIfEmpty(strconv.Itoa(ctx.Response.Header.StatusCode()), unknownLabelValue)
 	labels[labelPath] = defaultValIfEmpty(string(ctx.Request.Path()), unknownLabelValue)
 
+	for _, label := range contextLabels {
+		value := ctx.GetString(label.variable)
+		if len(value) == 0 {
+			labels[label.name] = unknownLabelValue
+			continue
+		}
+
+		if _, found := label.values[value]; !found {
+			value = otherLabelValue
+		}
+		labels[label.name] = value
+	}
+
 	return labels
 }
 
@@ -44,6 +61,13 @@ type serverTracer struct {
 	respoonseSizeTotalCounter *prom.CounterVec
 	requestTotalCounter       *prom.CounterVec
 	requestDurationHistogram  *prom.HistogramVec
+	slowRequestTotalCounter   *prom.CounterVec
+	retryBudgetCounter        *prom.CounterVec
+	upstreamErrorCounter      *prom.CounterVec
+	noLiveUpstreamCounter     *prom.CounterVec
+	rateLimitedCounter        *prom.CounterVec
+	enableExemplars           bool
+	contextLabels             []contextLabel
 }
 
 // Start record the beginning of server handling request from client.
@@ -67,8 +91,16 @@ func (s *serverTracer) Finish(ctx context.Context, c *app.RequestContext) {
 	}
 
 	cost := httpFinish.Time().Sub(httpStart.Time())
-	_ = counterAdd(s.requestTotalCounter, 1, genLabels(c))
-	_ = histogramObserve(s.requestDurationHistogram, cost, genLabels(c))
+	labels := genLabels(c, s.contextLabels)
+	_ = counterAdd(s.requestTotalCounter, 1, labels)
+
+	traceID := c.GetString(config.TRACE_ID)
+	// exemplar labels are limited to 128 runes, trace ids longer than that are never attached
+	if s.enableExemplars && len(traceID) > 0 && len(labelTraceID)+len(traceID) <= prom.ExemplarMaxRunes {
+		_ = histogramObserveWithExemplar(s.requestDurationHistogram, cost, labels, prom.Labels{labelTraceID: traceID})
+	} else {
+		_ = histogramObserve(s.requestDurationHistogram, cost, labels)
+	}
 
 	entryLabel := make(prom.Labels)
 	entryLabel[labelEntry] = entryID
@@ -78,6 +110,26 @@ func (s *serverTracer) Finish(ctx context.Context, c *app.RequestContext) {
 	_ = counterAdd(s.requestSizeTotalCounter, requestSize, entryLabel)
 	_ = counterAdd(s.respoonseSizeTotalCounter, responseSize, entryLabel)
 
+	if c.GetBool(config.SLOW_REQUEST) {
+		_ = counterAdd(s.slowRequestTotalCounter, 1, entryLabel)
+	}
+
+	if c.GetBool(config.RETRY_BUDGET_EXHAUSTED) {
+		_ = counterAdd(s.retryBudgetCounter, 1, prom.Labels{labelEntry: entryID, labelUpstream: c.GetString(config.UPSTREAM)})
+	}
+
+	if upstreamError := c.GetString(config.UPSTREAM_ERROR); len(upstreamError) > 0 {
+		_ = counterAdd(s.upstreamErrorCounter, 1, prom.Labels{labelEntry: entryID, labelUpstream: c.GetString(config.UPSTREAM), labelError: upstreamError})
+	}
+
+	if c.GetBool(config.NO_LIVE_UPSTREAM) {
+		_ = counterAdd(s.noLiveUpstreamCounter, 1, prom.Labels{labelEntry: entryID, labelUpstream: c.GetString(config.UPSTREAM)})
+	}
+
+	if c.GetBool(config.RATE_LIMITED) {
+		_ = counterAdd(s.rateLimitedCounter, 1, entryLabel)
+	}
+
 }
 
 // NewTracer provides tracer for server access, addr and path is the scrape_configs for prometheus server.
@@ -89,7 +141,10 @@ func NewTracer(addr, path string, opts ...Option) tracer.Tracer {
 	}
 
 	if !cfg.disableServer {
-		http.Handle(path, promhttp.HandlerFor(cfg.registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+		http.Handle(path, promhttp.HandlerFor(cfg.registry, promhttp.HandlerOpts{
+			ErrorHandling:     promhttp.ContinueOnError,
+			EnableOpenMetrics: cfg.enableExemplars,
+		}))
 		go func() {
 			slog.Info("starting prometheus server", "addr", addr)
 			if err := http.ListenAndServe(addr, nil); err != nil {
@@ -116,12 +171,17 @@ func NewTracer(addr, path string, opts ...Option) tracer.Tracer {
 	)
 	cfg.registry.MustRegister(responseSizeTotalCounter)
 
+	requestLabels := []string{labelEntry, labelMethod, labelStatusCode, labelPath}
+	for _, label := range cfg.contextLabels {
+		requestLabels = append(requestLabels, label.name)
+	}
+
 	requestTotalCounter := prom.NewCounterVec(
 		prom.CounterOpts{
 			Name: "bifrost_request_total",
 			Help: "Total number of HTTPs completed by the server, regardless of success or failure.",
 		},
-		[]string{labelEntry, labelMethod, labelStatusCode, labelPath},
+		requestLabels,
 	)
 	cfg.registry.MustRegister(requestTotalCounter)
 
@@ -131,10 +191,55 @@ func NewTracer(addr, path string, opts ...Option) tracer.Tracer {
 			Help:    "Latency (seconds) of HTTP that had been application-level handled by the server.",
 			Buckets: cfg.buckets,
 		},
-		[]string{labelEntry, labelMethod, labelStatusCode, labelPath},
+		requestLabels,
 	)
 	cfg.registry.MustRegister(requestDurationHistogram)
 
+	slowRequestTotalCounter := prom.NewCounterVec(
+		prom.CounterOpts{
+			Name: "bifrost_slow_request_total",
+			Help: "Total number of requests which took longer than slow_request_threshold of the service.",
+		},
+		[]string{labelEntry},
+	)
+	cfg.registry.MustRegister(slowRequestTotalCounter)
+
+	retryBudgetCounter := prom.NewCounterVec(
+		prom.CounterOpts{
+			Name: "bifrost_retry_budget_exhausted_total",
+			Help: "Total number of requests which were not retried because the retry budget of the upstream was exhausted.",
+		},
+		[]string{labelEntry, labelUpstream},
+	)
+	cfg.registry.MustRegister(retryBudgetCounter)
+
+	upstreamErrorCounter := prom.NewCounterVec(
+		prom.CounterOpts{
+			Name: "bifrost_upstream_error_total",
+			Help: "Total number of requests which failed to reach the upstream, by the class of the error.",
+		},
+		[]string{labelEntry, labelUpstream, labelError},
+	)
+	cfg.registry.MustRegister(upstreamErrorCounter)
+
+	noLiveUpstreamCounter := prom.NewCounterVec(
+		prom.CounterOpts{
+			Name: "bifrost_no_live_upstream_total",
+			Help: "Total number of requests which were rejected because no target of the upstream was available.",
+		},
+		[]string{labelEntry, labelUpstream},
+	)
+	cfg.registry.MustRegister(noLiveUpstreamCounter)
+
+	rateLimitedCounter := prom.NewCounterVec(
+		prom.CounterOpts{
+			Name: "bifrost_rate_limited_total",
+			Help: "Total number of requests which were rejected by the rate_limit middleware.",
+		},
+		[]string{labelEntry},
+	)
+	cfg.registry.MustRegister(rateLimitedCounter)
+
 	if cfg.enableGoCollector {
 		cfg.registry.MustRegister(collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(cfg.runtimeMetricRules...)))
 	}
@@ -144,6 +249,13 @@ func NewTracer(addr, path string, opts ...Option) tracer.Tracer {
 		respoonseSizeTotalCounter: responseSizeTotalCounter,
 		requestTotalCounter:       requestTotalCounter,
 		requestDurationHistogram:  requestDurationHistogram,
+		slowRequestTotalCounter:   slowRequestTotalCounter,
+		retryBudgetCounter:        retryBudgetCounter,
+		upstreamErrorCounter:      upstreamErrorCounter,
+		noLiveUpstreamCounter:     noLiveUpstreamCounter,
+		rateLimitedCounter:        rateLimitedCounter,
+		enableExemplars:           cfg.enableExemplars,
+		contextLabels:             cfg.contextLabels,
 	}
 }
 
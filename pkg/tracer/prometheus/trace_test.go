@@ -0,0 +1,260 @@
+package prometheus
+
+import (
+	"context"
+	"http-benchmark/pkg/config"
+	"testing"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/tracer/stats"
+	"github.com/cloudwego/hertz/pkg/common/tracer/traceinfo"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestContext(traceID string) *app.RequestContext {
+	ti := traceinfo.NewTraceInfo()
+	ti.Stats().SetLevel(stats.LevelDetailed)
+	ti.Stats().Record(stats.HTTPStart, stats.StatusInfo, "")
+	ti.Stats().Record(stats.HTTPFinish, stats.StatusInfo, "")
+
+	c := app.NewContext(0)
+	c.SetTraceInfo(ti)
+	c.Request.SetRequestURI("http://localhost/orders")
+	c.Set(config.ENTRY_ID, "test")
+	if len(traceID) > 0 {
+		c.Set(config.TRACE_ID, traceID)
+	}
+	return c
+}
+
+func findExemplarTraceID(t *testing.T, registry *prom.Registry) string {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != "bifrost_request_duration" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				if bucket.GetExemplar() == nil {
+					continue
+				}
+				for _, label := range bucket.GetExemplar().GetLabel() {
+					if label.GetName() == labelTraceID {
+						return label.GetValue()
+					}
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+func TestExemplars(t *testing.T) {
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry), WithEnableExemplars(true))
+	tracer.Finish(context.Background(), newTestContext(traceID))
+	assert.Equal(t, traceID, findExemplarTraceID(t, registry))
+
+	// disabled by default
+	registry = prom.NewRegistry()
+	tracer = NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+	tracer.Finish(context.Background(), newTestContext(traceID))
+	assert.Equal(t, "", findExemplarTraceID(t, registry))
+}
+
+func findTotalLabel(t *testing.T, registry *prom.Registry, name string) []string {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	values := []string{}
+	for _, family := range families {
+		if family.GetName() != "bifrost_request_total" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == name {
+					values = append(values, label.GetValue())
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+func TestContextLabel(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry),
+		WithContextLabel("tenant_tier", "$tenant_tier", []string{"free", "pro"}))
+
+	for _, tier := range []string{"free", "pro", "pro", "enterprise", "tenant-12345", ""} {
+		c := newTestContext("")
+		if len(tier) > 0 {
+			c.Set("$tenant_tier", tier)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	// values which are not allowed share the other bucket
+	assert.ElementsMatch(t, []string{"free", "pro", "other", "unknown"}, findTotalLabel(t, registry, "tenant_tier"))
+}
+
+func TestSlowRequestCounter(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+
+	for _, slow := range []bool{true, false, true} {
+		c := newTestContext("")
+		if slow {
+			c.Set(config.SLOW_REQUEST, true)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "bifrost_slow_request_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, float64(2), total)
+}
+
+func TestRetryBudgetCounter(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+
+	for _, exhausted := range []bool{true, false, true} {
+		c := newTestContext("")
+		c.Set(config.UPSTREAM, "orders")
+		if exhausted {
+			c.Set(config.RETRY_BUDGET_EXHAUSTED, true)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "bifrost_retry_budget_exhausted_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "upstream" {
+					assert.Equal(t, "orders", label.GetValue())
+				}
+			}
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, float64(2), total)
+}
+
+func TestUpstreamErrorCounter(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+
+	for _, upstreamError := range []string{"read_timeout", "", "connection_refused", "read_timeout"} {
+		c := newTestContext("")
+		c.Set(config.UPSTREAM, "orders")
+		if len(upstreamError) > 0 {
+			c.Set(config.UPSTREAM_ERROR, upstreamError)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	totals := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "bifrost_upstream_error_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "error" {
+					totals[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"read_timeout": 2, "connection_refused": 1}, totals)
+}
+
+func TestNoLiveUpstreamCounter(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+
+	for _, upstream := range []string{"orders", "", "orders", "payments"} {
+		c := newTestContext("")
+		if len(upstream) > 0 {
+			c.Set(config.UPSTREAM, upstream)
+			c.Set(config.NO_LIVE_UPSTREAM, true)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	totals := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "bifrost_no_live_upstream_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "upstream" {
+					totals[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"orders": 2, "payments": 1}, totals)
+}
+
+func TestRateLimitedCounter(t *testing.T) {
+	registry := prom.NewRegistry()
+	tracer := NewTracer(":0", "/metrics", WithDisableServer(true), WithRegistry(registry))
+
+	for _, limited := range []bool{true, false, true} {
+		c := newTestContext("")
+		if limited {
+			c.Set(config.RATE_LIMITED, true)
+		}
+		tracer.Finish(context.Background(), c)
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != "bifrost_rate_limited_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, 2.0, total)
+}
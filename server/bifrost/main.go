@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"http-benchmark/pkg/gateway"
 	"http-benchmark/pkg/log"
+	"http-benchmark/pkg/middleware/keyauth"
 	"log/slog"
+	"os"
 
 	"github.com/cloudwego/hertz/pkg/app"
 )
@@ -21,6 +25,10 @@ func (f *FindMyHome) ServeHTTP(c context.Context, ctx *app.RequestContext) {
 var bifrost *gateway.Bifrost
 
 func main() {
+	configPath := flag.String("config", "./config.yaml", "path of the config file")
+	profile := flag.String("profile", "", "config profile to apply, BIFROST_PROFILE is used when it is empty")
+	flag.Parse()
+
 	defer func() {
 		if bifrost != nil {
 			bifrost.Shutdown()
@@ -38,7 +46,27 @@ func main() {
 		panic(err)
 	}
 
-	bifrost, err = gateway.LoadFromConfig("./config.yaml")
+	// bifrost validate checks the config without starting the gateway
+	if flag.Arg(0) == "validate" {
+		if err := gateway.ValidateConfig(*configPath, *profile); err != nil {
+			printErrors(err)
+			os.Exit(1)
+		}
+		fmt.Printf("config '%s' is valid\n", *configPath)
+		return
+	}
+
+	// bifrost hash-key prints the hash of an api key for the key_auth middleware
+	if flag.Arg(0) == "hash-key" {
+		if len(flag.Arg(1)) == 0 {
+			fmt.Fprintln(os.Stderr, "usage: bifrost hash-key <key>")
+			os.Exit(1)
+		}
+		fmt.Println(keyauth.HashKey(flag.Arg(1)))
+		return
+	}
+
+	bifrost, err = gateway.LoadFromConfigWithProfile(*configPath, *profile)
 	if err != nil {
 		slog.Error("fail to start bifrost", "error", err)
 		return
@@ -46,3 +74,14 @@ func main() {
 
 	bifrost.Run()
 }
+
+// printErrors prints each of the joined errors on its own line
+func printErrors(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			printErrors(e)
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "error:", err)
+}